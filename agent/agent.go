@@ -1,13 +1,17 @@
 package agent
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/menmos/menmos-agent/agent/operation"
+	"github.com/menmos/menmos-agent/agent/portpool"
 	"github.com/menmos/menmos-agent/agent/xecute"
 	"github.com/pelletier/go-toml/v2"
 	"go.uber.org/zap"
@@ -46,20 +50,20 @@ func tomlWrite(config interface{}, targetPath string) error {
 	return err
 }
 
+// jsonWrite replaces the target file atomically, so concurrent readers never see a partial file.
 func jsonWrite(config interface{}, targetPath string) error {
-	file, err := os.Create(targetPath)
+	configBytes, err := json.Marshal(config)
+
 	if err != nil {
 		return err
 	}
 
-	configBytes, err := json.Marshal(config)
-
-	if err != nil {
+	tmpPath := targetPath + ".tmp"
+	if err := os.WriteFile(tmpPath, configBytes, 0644); err != nil {
 		return err
 	}
 
-	_, err = file.Write(configBytes)
-	return err
+	return os.Rename(tmpPath, targetPath)
 }
 
 // A MenmosAgent manages menmos processes on a given machine.
@@ -68,40 +72,134 @@ type MenmosAgent struct {
 	config Config
 	log    *zap.SugaredLogger
 
-	artifacts *artifact.Repository
+	artifacts  *artifact.Repository
+	executor   xecute.Executor
+	ports      *portpool.Pool
+	operations *operation.Manager
 
 	// State
-	runningNodes map[string]*xecute.Native
+	nodes *nodeRegistry
+
+	reconcileInterval time.Duration
+	stopLoops         chan struct{}
+	shutdownOnce      sync.Once
 }
 
 // New returns a new menmos agent.
 func New(config Config, log *zap.Logger) (*MenmosAgent, error) {
-	// Using a github release fetcher by default.
-
-	agent := &MenmosAgent{
-		config: config,
-		log:    log.Sugar().Named("agent"),
-		artifacts: artifact.NewRepository(
-			artifact.RepositoryParams{
-				ReleaseFetcher: artifact.NewGithubFetcher(config.GithubToken),
-				Log:            log,
-				Path:           path.Join(config.Path, "pkg"),
-			},
-		),
-		runningNodes: make(map[string]*xecute.Native),
+	agent, err := newAgent(config, log)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := agent.initWorkspace(); err != nil {
+	executor, err := newExecutor(config, agent.getBinary)
+	if err != nil {
 		return nil, err
 	}
+	agent.executor = executor
 
-	if err := agent.restartComponents(); err != nil {
+	if err := agent.init(); err != nil {
 		return nil, err
 	}
 
 	return agent, nil
 }
 
+// newAgent returns an agent without an executor, that isn't initialized yet.
+func newAgent(config Config, log *zap.Logger) (*MenmosAgent, error) {
+	artifacts, err := NewArtifactRepository(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MenmosAgent{
+		config:            config,
+		log:               log.Sugar().Named("agent"),
+		artifacts:         artifacts,
+		operations:        operation.NewManager(operation.HISTORY_SIZE),
+		nodes:             newNodeRegistry(),
+		reconcileInterval: RECONCILE_INTERVAL,
+		stopLoops:         make(chan struct{}),
+	}, nil
+}
+
+// NewArtifactRepository opens the artifact repository of an agent workspace. It can be used while the agent runs,
+// versions are locked on disk.
+func NewArtifactRepository(config Config, log *zap.Logger) (*artifact.Repository, error) {
+	publicKeys, err := artifact.ParsePublicKeys(config.ArtifactPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var signingKey ed25519.PrivateKey
+	if config.ArtifactSigningKey != "" {
+		if signingKey, err = artifact.ParsePrivateKey(config.ArtifactSigningKey); err != nil {
+			return nil, err
+		}
+	}
+
+	releaseFetcher, err := newReleaseFetcher(config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return artifact.NewRepository(
+		artifact.RepositoryParams{
+			ReleaseFetcher:  releaseFetcher,
+			Log:             log,
+			Path:            path.Join(config.Path, "pkg"),
+			PublicKeys:      publicKeys,
+			AllowUnverified: config.AllowUnverifiedArtifacts,
+			SigningKey:      signingKey,
+		},
+	), nil
+}
+
+// newReleaseFetcher returns a fetcher trying the configured release sources in order.
+func newReleaseFetcher(config Config, log *zap.Logger) (artifact.MenmosReleaseFetcher, error) {
+	cacheDir := path.Join(config.Path, "pkg", artifact.METADATA_DIR)
+
+	// Using a github release fetcher by default.
+	if len(config.ReleaseSources) == 0 {
+		return artifact.NewGithubFetcher(artifact.GithubFetcherParams{Token: config.GithubToken, CacheDir: cacheDir})
+	}
+
+	fetchers := make([]artifact.MenmosReleaseFetcher, 0, len(config.ReleaseSources))
+	for _, sourceConfig := range config.ReleaseSources {
+		if sourceConfig.Type == artifact.SourceGithub && sourceConfig.Token == "" {
+			sourceConfig.Token = config.GithubToken
+		}
+
+		fetcher, err := artifact.NewSource(sourceConfig, cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		fetchers = append(fetchers, fetcher)
+	}
+
+	return artifact.NewFallbackFetcher(fetchers, log), nil
+}
+
+// init prepares the agent workspace, brings its nodes to their desired state and starts the background loops.
+func (a *MenmosAgent) init() error {
+	if err := a.initWorkspace(); err != nil {
+		return err
+	}
+
+	if err := a.initPortPool(); err != nil {
+		return err
+	}
+
+	a.reconcile()
+	go a.reconcileLoop()
+
+	if a.config.ArtifactGC.Interval > 0 {
+		go a.artifactGCLoop()
+	}
+
+	return nil
+}
+
 func (a *MenmosAgent) pkgDir() string {
 	return path.Join(a.config.Path, "pkg")
 }
@@ -128,25 +226,6 @@ func (a *MenmosAgent) initWorkspace() error {
 	return nil
 }
 
-func (a *MenmosAgent) restartComponents() error {
-	entries, err := os.ReadDir(a.nodeDir())
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			continue
-		}
-
-		if err := a.StartNode(entry.Name()); err != nil {
-			a.log.Errorf("failed to restart component '%s': %v", entry.Name(), err)
-		}
-	}
-
-	return nil
-}
-
 func (a *MenmosAgent) getBinary(version, binary string) (binaryPath string, err error) {
 	if version != "" {
 		return a.artifacts.Get(version, binary)
@@ -158,13 +237,24 @@ func (a *MenmosAgent) getBinary(version, binary string) (binaryPath string, err
 	return
 }
 
+// Shutdown stops the background loops and every node, without changing their desired state
+// so they are brought back when the agent restarts.
 func (a *MenmosAgent) Shutdown() {
+	a.shutdownOnce.Do(func() { close(a.stopLoops) })
+
 	var wg sync.WaitGroup
-	for nodeID := range a.runningNodes {
+	for nodeID := range a.nodes.processes() {
 		wg.Add(1)
 		go func(nodeID string) {
 			defer wg.Done()
-			if err := a.StopNode(nodeID); err != nil {
+
+			entry := a.nodes.lock(nodeID)
+			defer a.nodes.unlock(entry)
+
+			if entry.process == nil {
+				return
+			}
+			if err := entry.process.Stop(); err != nil {
 				a.log.Errorf("failed to shutdown node '%s': %v", nodeID, err)
 			}
 		}(nodeID)
@@ -1,14 +1,17 @@
 package agent
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/menmos/menmos-agent/agent/amphora"
 	"github.com/menmos/menmos-agent/agent/menmosd"
+	"github.com/menmos/menmos-agent/agent/operation"
 	"github.com/menmos/menmos-agent/agent/xecute"
 	"github.com/menmos/menmos-agent/payload"
 	"github.com/mitchellh/mapstructure"
@@ -24,6 +27,7 @@ func (a *MenmosAgent) createMenmosdConfig(nodeDir string, request *payload.Creat
 		},
 		Server: menmosd.ServerSetting{
 			Type: config.ServerMode,
+			Port: config.Port,
 		},
 	}
 
@@ -62,6 +66,7 @@ func (a *MenmosAgent) createAmphoraConfig(nodeDir string, request *payload.Creat
 		},
 		Server: amphora.ServerConfig{
 			CertificateStoragePath: path.Join(nodeDir, "cert"),
+			Port:                   config.ServerPort,
 		},
 		Redirect: amphora.RedirectConfig{
 			Ip:         config.RedirectIp,
@@ -93,173 +98,374 @@ func (a *MenmosAgent) getNodeInfo(nodeID string) (nodeInfo, error) {
 	return info, nil
 }
 
-func (a *MenmosAgent) GetNode(nodeID string) (*payload.NodeResponse, error) {
-	if process, ok := a.runningNodes[nodeID]; ok {
-		info, err := a.getNodeInfo(nodeID)
-		if err != nil {
-			return nil, err
-		}
+// isStopped returns whether a node in the given status has no process or management routine running.
+func isStopped(status xecute.Status) bool {
+	return status == xecute.StatusStopped || status == xecute.StatusError || status == xecute.StatusCrashLoop
+}
 
-		nodeResp := &payload.NodeResponse{
-			ID:      nodeID,
-			Binary:  string(info.Binary),
-			Version: info.Version,
-			Port:    process.Port(),
-			Status:  process.Status(),
-		}
+func newNodeResponse(nodeID string, info nodeInfo, state nodeState, process xecute.Process, parked *xecute.CrashLoop) *payload.NodeResponse {
+	nodeResp := &payload.NodeResponse{
+		ID:            nodeID,
+		Binary:        string(info.Binary),
+		Version:       info.Version,
+		Port:          info.Port,
+		Status:        xecute.StatusStopped,
+		DesiredState:  state.Desired,
+		Drift:         nodeDrift(state.Desired, process),
+		RestartPolicy: restartPolicyToPayload(info.RestartPolicy),
+
+		RequestedVersion: info.RequestedVersion,
+	}
+
+	// Nodes the agent never started since it booted don't have a process.
+	if process == nil {
+		return nodeResp
+	}
+
+	nodeResp.Port = process.Port()
+	nodeResp.Status = process.Status()
+	nodeResp.Restarts = process.Restarts()
+	nodeResp.CrashLoop = crashLoopToPayload(process.CrashLoop())
+
+	if exitCode := process.LastExitCode(); exitCode != -1 {
+		nodeResp.LastExitCode = &exitCode
+	}
+
+	if nextRetry := process.NextRetry(); !nextRetry.IsZero() {
+		nodeResp.NextRetry = &nextRetry
+	}
+
+	// The last process of a node parked by the reconciler only knows it exited.
+	if parked != nil {
+		nodeResp.Status = xecute.StatusCrashLoop
+		nodeResp.CrashLoop = crashLoopToPayload(parked)
+	}
+
+	return nodeResp
+}
+
+func (a *MenmosAgent) getNode(nodeID string) (*payload.NodeResponse, error) {
+	info, err := a.getNodeInfo(nodeID)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		return nodeResp, nil
+	state, err := a.getNodeState(nodeID)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, nil
+	return newNodeResponse(nodeID, info, state, a.nodes.process(nodeID), a.nodes.parked(nodeID)), nil
+}
+
+func (a *MenmosAgent) GetNode(nodeID string) (*payload.NodeResponse, error) {
+	return a.getNode(nodeID)
 }
 
 func (a *MenmosAgent) ListNodes() (*payload.ListNodesResponse, error) {
-	var resp payload.ListNodesResponse
+	nodeIDs, err := a.nodeIDs()
+	if err != nil {
+		return nil, err
+	}
 
-	for nodeID, process := range a.runningNodes {
-		info, err := a.getNodeInfo(nodeID)
+	var resp payload.ListNodesResponse
+	for _, nodeID := range nodeIDs {
+		node, err := a.getNode(nodeID)
 		if err != nil {
 			return nil, err
 		}
 
-		nodeResp := &payload.NodeResponse{
-			ID:      nodeID,
-			Binary:  string(info.Binary),
-			Version: info.Version,
-			Port:    process.Port(),
-			Status:  process.Status(),
+		if node != nil {
+			resp.Nodes = append(resp.Nodes, node)
 		}
-
-		resp.Nodes = append(resp.Nodes, nodeResp)
 	}
 
 	return &resp, nil
 }
 
-func (a *MenmosAgent) CreateNode(request *payload.CreateNodeRequest) (*payload.NodeResponse, error) {
-	binPath, err := a.getBinary(request.Version, string(request.Type))
+func (a *MenmosAgent) createNode(request *payload.CreateNodeRequest, op *operation.Operation) (*payload.NodeResponse, error) {
+	restartPolicyFrom := restartPolicyFromPayload
+	if a.config.AgentType == Kubernetes {
+		restartPolicyFrom = kubernetesRestartPolicyFromPayload
+	}
+	restartPolicy, err := restartPolicyFrom(request.RestartPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nodes created without a version use the default version, or local binaries if there is none.
+	requested := strings.TrimSpace(request.Version)
+	if requested == "" {
+		requested = a.config.DefaultVersion
+	}
+
+	version, err := a.resolveVersion(requested, op)
 	if err != nil {
 		return nil, err
 	}
 
 	nodeID := uuid.New().String()
+	op.SetNodeID(nodeID)
+
+	// The node is locked until it is created, so the reconciler doesn't start it concurrently.
+	entry := a.nodes.lock(nodeID)
+	defer a.nodes.unlock(entry)
+
+	op.Progress(0.1, "writing node config")
 
 	nodeDir := path.Join(a.nodeDir(), nodeID)
 	if err := ensureDirExists(nodeDir); err != nil {
 		return nil, err
 	}
 
+	nodeInfo := nodeInfo{Version: version, Binary: string(request.Type), RestartPolicy: restartPolicy}
+	if requested != version {
+		nodeInfo.RequestedVersion = requested
+	}
+
 	if request.Type == payload.NodeMenmosd {
 		var requestConfig payload.MenmosdConfig
 		if err := mapstructure.Decode(request.Config, &requestConfig); err != nil {
+			a.cleanupNode(nodeID, entry)
 			return nil, err
 		}
+		if nodeInfo.Port, err = a.assignPort(nodeID, requestConfig.Port); err != nil {
+			a.cleanupNode(nodeID, entry)
+			return nil, err
+		}
+		requestConfig.Port = nodeInfo.Port
 		if err = a.createMenmosdConfig(nodeDir, request, &requestConfig); err != nil {
+			a.cleanupNode(nodeID, entry)
 			return nil, err
 		}
 	} else if request.Type == payload.NodeAmphora {
 		var requestConfig payload.AmphoraConfig
 		if err := mapstructure.Decode(request.Config, &requestConfig); err != nil {
+			a.cleanupNode(nodeID, entry)
+			return nil, err
+		}
+		if nodeInfo.Port, err = a.assignPort(nodeID, requestConfig.ServerPort); err != nil {
+			a.cleanupNode(nodeID, entry)
 			return nil, err
 		}
+		requestConfig.ServerPort = nodeInfo.Port
 		if err = a.createAmphoraConfig(nodeDir, request, &requestConfig); err != nil {
+			a.cleanupNode(nodeID, entry)
 			return nil, err
 		}
 	}
 
-	process, err := xecute.NewNativeProcess(nodeDir, binPath, a.log.Named(string(request.Type)).Named(nodeID).Desugar())
-	if err != nil {
+	// The node info is committed along with the node config, it contains the info required to start the process.
+	if err := jsonWrite(nodeInfo, path.Join(nodeDir, AGENT_NODE_INFO_FILE)); err != nil {
+		a.cleanupNode(nodeID, entry)
 		return nil, err
 	}
 
-	if err := process.Start(xecute.LogNormal); err != nil { // TODO: Find a way to customize this loglevel.
+	if err := a.setDesiredState(nodeID, DesiredRunning); err != nil {
+		a.cleanupNode(nodeID, entry)
 		return nil, err
 	}
 
-	a.runningNodes[nodeID] = process
-
-	// If we made it here, we commit a nodeinfo file along with the process.
-	// This file contains the info required to restart the process.
-	nodeInfo := nodeInfo{Version: request.Version, Binary: string(request.Type)}
-	if err := jsonWrite(nodeInfo, path.Join(nodeDir, AGENT_NODE_INFO_FILE)); err != nil {
+	op.Progress(0.5, "starting node")
+	if err := a.reconcileNode(nodeID, entry); err != nil {
+		a.cleanupNode(nodeID, entry)
 		return nil, err
 	}
 
-	return &payload.NodeResponse{
-		ID:      nodeID,
-		Binary:  string(request.Type),
-		Version: request.Version,
-		Port:    process.Port(),
-		Status:  process.Status(),
-	}, nil
+	return a.getNode(nodeID)
 }
 
-func (a *MenmosAgent) DeleteNode(nodeID string) error {
-	if process, ok := a.runningNodes[nodeID]; ok {
-		status := process.Status()
-		if status == xecute.StatusStopped || status == xecute.StatusError {
-			delete(a.runningNodes, nodeID)
-			return os.RemoveAll(path.Join(a.nodeDir(), nodeID))
-		} else {
-			return fmt.Errorf("cannot delete node in '%v' state, node needs to be stopped", status)
-		}
+// resolveVersion returns the release tag a requested version resolves to, so the node keeps running that release
+// even once newer ones match.
+func (a *MenmosAgent) resolveVersion(requested string, op *operation.Operation) (string, error) {
+	if requested == "" {
+		return "", nil
 	}
 
-	return nil
+	op.Progress(0.05, "resolving version")
+	return a.artifacts.Resolve(context.Background(), requested)
 }
 
-func (a *MenmosAgent) StopNode(nodeID string) error {
-	if process, ok := a.runningNodes[nodeID]; ok {
-		if err := process.Stop(); err != nil {
+// cleanupNode removes what was set up for a node that failed to be created. The node must be locked.
+func (a *MenmosAgent) cleanupNode(nodeID string, entry *nodeEntry) {
+	a.nodes.remove(nodeID, entry)
+	a.releasePort(nodeID)
+	os.RemoveAll(path.Join(a.nodeDir(), nodeID))
+}
+
+func (a *MenmosAgent) deleteNode(nodeID string, op *operation.Operation) error {
+	op.Progress(0, "waiting for pending operations on the node")
+	entry := a.nodes.lock(nodeID)
+	defer a.nodes.unlock(entry)
+
+	op.Progress(0.5, "deleting node")
+
+	if _, err := os.Stat(path.Join(a.nodeDir(), nodeID)); os.IsNotExist(err) {
+		a.nodes.remove(nodeID, entry)
+		return nil
+	}
+
+	if entry.process != nil {
+		if status := entry.process.Status(); !isStopped(status) {
+			return fmt.Errorf("cannot delete node in '%v' state, node needs to be stopped", status)
+		}
+	} else {
+		// The node wasn't started since the agent started, its process is only needed to delete it.
+		info, err := a.getNodeInfo(nodeID)
+		if err != nil {
+			return err
+		}
+		process, err := a.newProcess(nodeID, info)
+		if err != nil {
 			return err
 		}
+		a.nodes.setProcess(entry, process)
 	}
 
-	return nil
-}
-
-func (a *MenmosAgent) StartNode(nodeID string) error {
-	if process, ok := a.runningNodes[nodeID]; ok && (process.Status() != xecute.StatusStopped && process.Status() != xecute.StatusError) {
-		return fmt.Errorf("node '%s' is already running", nodeID)
+	if err := entry.process.Delete(); err != nil {
+		return err
+	}
+	if err := entry.process.Close(); err != nil {
+		a.log.Warnf("failed to close the process of node '%s': %v", nodeID, err)
 	}
 
-	nodeDir := path.Join(a.nodeDir(), nodeID)
+	a.nodes.remove(nodeID, entry)
+	a.releasePort(nodeID)
+	return os.RemoveAll(path.Join(a.nodeDir(), nodeID))
+}
 
-	info, err := a.getNodeInfo(nodeID)
-	if err != nil {
+// stopNode records that a node should be stopped, and stops it.
+func (a *MenmosAgent) stopNode(nodeID string, op *operation.Operation) error {
+	op.Progress(0, "waiting for pending operations on the node")
+	entry := a.nodes.lock(nodeID)
+	defer a.nodes.unlock(entry)
+
+	if _, err := a.getNodeInfo(nodeID); os.IsNotExist(err) {
+		a.nodes.remove(nodeID, entry)
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	binPath, err := a.getBinary(info.Version, info.Binary)
-	if err != nil {
+	if err := a.setDesiredState(nodeID, DesiredStopped); err != nil {
 		return err
 	}
 
-	process, err := xecute.NewNativeProcess(nodeDir, binPath, a.log.Named(info.Binary).Named(nodeID).Desugar())
-	if err != nil {
+	op.Progress(0.5, "stopping node")
+	return a.reconcileNode(nodeID, entry)
+}
+
+// startNode records that a node should be running, and starts it.
+// If the start fails, the reconciler keeps trying to start the node until it is stopped.
+func (a *MenmosAgent) startNode(nodeID string, op *operation.Operation) error {
+	op.Progress(0, "waiting for pending operations on the node")
+	entry := a.nodes.lock(nodeID)
+	defer a.nodes.unlock(entry)
+
+	if entry.process != nil && !isStopped(entry.process.Status()) {
+		return fmt.Errorf("node '%s' is already running", nodeID)
+	}
+
+	if _, err := a.getNodeInfo(nodeID); err != nil {
+		if os.IsNotExist(err) {
+			a.nodes.remove(nodeID, entry)
+		}
 		return err
 	}
 
-	if err := process.Start(xecute.LogNormal); err != nil { // TODO: Find a way to customize this loglevel.
+	if err := a.setDesiredState(nodeID, DesiredRunning); err != nil {
 		return err
 	}
-	a.runningNodes[nodeID] = process
 
-	a.log.Infof("node '%s' started", nodeID)
+	// The node exited since it was last converged, a new process is started on request.
+	entry.reconcile.applied = ""
 
-	return nil
+	op.Progress(0.5, "starting node")
+	return a.reconcileNode(nodeID, entry)
 }
 
-func (a *MenmosAgent) GetNodeLogs(nodeID string, nbOfLines uint) (*payload.GetLogsResponse, error) {
-	if process, ok := a.runningNodes[nodeID]; ok {
-		return &payload.GetLogsResponse{
-			Log: process.GetLogs(nbOfLines),
-		}, nil
+// GetNodeLogs returns the lines of the log of a node matching a query. The log is read from the node directory if the
+// node wasn't started since the agent booted.
+func (a *MenmosAgent) GetNodeLogs(nodeID string, query xecute.LogQuery) (*payload.GetLogsResponse, error) {
+	var page xecute.LogPage
+	if process := a.nodes.process(nodeID); process != nil {
+		var err error
+		if page, err = process.QueryLogs(query); err != nil {
+			return nil, err
+		}
+	} else if _, err := a.getNodeInfo(nodeID); err == nil {
+		if page, err = xecute.ReadLogs(path.Join(a.nodeDir(), nodeID), query); err != nil {
+			return nil, err
+		}
 	} else {
 		return nil, fmt.Errorf("node '%s' does not exist", nodeID)
 	}
+
+	resp := &payload.GetLogsResponse{Log: make([]interface{}, len(page.Lines)), HasMore: page.More}
+	for i, line := range page.Lines {
+		resp.Log[i] = line.Entry()
+	}
+
+	// Without lines, the cursors keep the position of the query.
+	if len(page.Lines) > 0 {
+		resp.StartCursor = page.Lines[0].Start().String()
+		resp.Cursor = page.Lines[len(page.Lines)-1].Cursor.String()
+	} else {
+		if query.Before != nil {
+			resp.StartCursor = query.Before.String()
+		}
+		if query.After != nil {
+			resp.Cursor = query.After.String()
+		}
+	}
+
+	return resp, nil
 }
 
-// TODO: Add call to get logs of a node
-//		 (either JSON or text if the process crashed pre-json)
+// FollowNodeLogs subscribes to the log of a node, starting after a cursor. Without a cursor, it starts with the last
+// nbOfLines lines. It returns nil if the node doesn't exist.
+func (a *MenmosAgent) FollowNodeLogs(nodeID, cursor string, nbOfLines uint) (*xecute.LogSubscription, error) {
+	var after xecute.Cursor
+	if cursor != "" {
+		var err error
+		if after, err = xecute.ParseCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	process := a.nodes.process(nodeID)
+	if process == nil {
+		if _, err := a.getNodeInfo(nodeID); err != nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: node '%s' wasn't started since the agent booted", ErrConflict, nodeID)
+	}
+
+	if cursor == "" {
+		// Following starts from the start of the log if nothing is buffered yet.
+		if lines := process.GetLogs(nbOfLines); len(lines) > 0 {
+			after = lines[0].Start()
+		}
+	}
+
+	return process.FollowLogs(after), nil
+}
+
+// GetNodeCrashReport returns the last stderr lines a node wrote before its last abnormal exit. It returns nil if the
+// node doesn't exist or never crashed.
+func (a *MenmosAgent) GetNodeCrashReport(nodeID string) (*payload.CrashReport, error) {
+	if _, err := a.getNodeInfo(nodeID); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	report, err := xecute.ReadCrashReport(path.Join(a.nodeDir(), nodeID))
+	if err != nil {
+		return nil, err
+	}
+	return crashReportToPayload(report), nil
+}
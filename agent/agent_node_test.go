@@ -0,0 +1,517 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+	"go.uber.org/zap"
+)
+
+func newTestAgent(t *testing.T, workspace string, executor xecute.Executor) *MenmosAgent {
+	return newTestAgentWithConfig(t, Config{AgentType: Native, Path: workspace}, executor)
+}
+
+func newTestAgentWithConfig(t *testing.T, config Config, executor xecute.Executor) *MenmosAgent {
+	agent, err := newAgent(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.executor = executor
+
+	if err := agent.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	return agent
+}
+
+func createTestNode(t *testing.T, agent *MenmosAgent) *payload.NodeResponse {
+	return createTestNodeWithPolicy(t, agent, &payload.RestartPolicy{
+		Mode:       payload.RestartOnFailure,
+		MaxRetries: 3,
+	})
+}
+
+func createTestNodeWithPolicy(t *testing.T, agent *MenmosAgent, restartPolicy *payload.RestartPolicy) *payload.NodeResponse {
+	node, err := agent.CreateNode(&payload.CreateNodeRequest{
+		Version:       "v0.2.0",
+		Type:          payload.NodeMenmosd,
+		Config:        map[string]interface{}{"node_admin_password": "hunter2"},
+		RestartPolicy: restartPolicy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+func TestMenmosAgent_CreateNode(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+
+	if node.Status != xecute.StatusHealthy {
+		t.Errorf("expected node to be healthy, got '%s'", node.Status)
+	}
+
+	process := executor.Process(node.ID)
+	if process == nil {
+		t.Fatalf("no process was created for node '%s'", node.ID)
+	}
+
+	if process.Spec.Binary != payload.NodeMenmosd || process.Spec.Version != "v0.2.0" {
+		t.Errorf("unexpected process spec: %+v", process.Spec)
+	}
+
+	if process.Spec.RestartPolicy.Mode != xecute.RestartOnFailure || process.Spec.RestartPolicy.MaxRetries != 3 {
+		t.Errorf("restart policy was not passed to the process: %+v", process.Spec.RestartPolicy)
+	}
+
+	config, err := os.ReadFile(path.Join(process.Spec.Workdir, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "hunter2") {
+		t.Errorf("node config was not written: %s", config)
+	}
+
+	info, err := agent.getNodeInfo(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Binary != payload.NodeMenmosd || info.RestartPolicy.Mode != xecute.RestartOnFailure {
+		t.Errorf("unexpected node info: %+v", info)
+	}
+}
+
+func TestMenmosAgent_CreateNodeFailure(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	executor.StartError = errors.New("boom")
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	if _, err := agent.CreateNode(&payload.CreateNodeRequest{Type: payload.NodeMenmosd}); err == nil {
+		t.Fatalf("expected node creation to fail")
+	}
+
+	entries, err := os.ReadDir(agent.nodeDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected node directory to be cleaned up")
+	}
+
+	nodes, err := agent.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Nodes) != 0 {
+		t.Errorf("expected no nodes, got %d", len(nodes.Nodes))
+	}
+}
+
+func TestMenmosAgent_CreateNodeInvalidRestartPolicy(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	_, err := agent.CreateNode(&payload.CreateNodeRequest{
+		Type:          payload.NodeMenmosd,
+		RestartPolicy: &payload.RestartPolicy{Mode: "sometimes"},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for an invalid restart policy")
+	}
+
+	if executor.ProcessCount() != 0 {
+		t.Errorf("expected no process to be created")
+	}
+}
+
+func TestMenmosAgent_CreateKubernetesNodeRestartPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *payload.RestartPolicy
+		wantErr bool
+	}{
+		{"default", nil, false},
+		{"always", &payload.RestartPolicy{Mode: payload.RestartAlways}, false},
+		{"never", &payload.RestartPolicy{Mode: payload.RestartNever}, true},
+		{"onFailure", &payload.RestartPolicy{Mode: payload.RestartOnFailure}, true},
+		{"maxRetries", &payload.RestartPolicy{Mode: payload.RestartAlways, MaxRetries: 3}, true},
+		{"backoff", &payload.RestartPolicy{Mode: payload.RestartAlways, InitialBackoffMs: 500}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := xecutetest.NewExecutor()
+			agent := newTestAgentWithConfig(t, Config{AgentType: Kubernetes, Path: t.TempDir()}, executor)
+
+			node, err := agent.CreateNode(&payload.CreateNodeRequest{Type: payload.NodeMenmosd, RestartPolicy: tt.policy})
+			if tt.wantErr {
+				if !errors.Is(err, xecute.ErrInvalidRestartPolicy) {
+					t.Errorf("expected the restart policy to be rejected, got %v", err)
+				}
+				if executor.ProcessCount() != 0 {
+					t.Errorf("expected no process to be created")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := executor.Process(node.ID).Spec.RestartPolicy.Mode; mode != xecute.RestartAlways {
+				t.Errorf("expected kubernetes nodes to always restart, got '%s'", mode)
+			}
+		})
+	}
+}
+
+func TestMenmosAgent_NodeLifecycle(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+
+	if err := agent.DeleteNode(node.ID); err == nil {
+		t.Errorf("expected deleting a running node to fail")
+	}
+
+	if err := agent.StartNode(node.ID); err == nil {
+		t.Errorf("expected starting a running node to fail")
+	}
+
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != xecute.StatusStopped {
+		t.Errorf("expected node to be stopped, got '%s'", resp.Status)
+	}
+
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != xecute.StatusHealthy {
+		t.Errorf("expected node to be healthy, got '%s'", resp.Status)
+	}
+
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := agent.DeleteNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !executor.Process(node.ID).Closed() {
+		t.Errorf("expected the log file of the deleted node to be released")
+	}
+	if !executor.Process(node.ID).Deleted() {
+		t.Errorf("expected the resources of the deleted node to be removed")
+	}
+
+	if resp, _ := agent.GetNode(node.ID); resp != nil {
+		t.Errorf("expected node to be deleted")
+	}
+
+	if _, err := os.Stat(path.Join(agent.nodeDir(), node.ID)); !os.IsNotExist(err) {
+		t.Errorf("expected node directory to be deleted")
+	}
+}
+
+func TestMenmosAgent_DeleteNodeAfterRestart(t *testing.T) {
+	workspace := t.TempDir()
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stopped node has no process once the agent restarts.
+	executor := xecutetest.NewExecutor()
+	agent = newTestAgent(t, workspace, executor)
+	if executor.Process(node.ID) != nil {
+		t.Fatalf("expected the stopped node to have no process")
+	}
+
+	if err := agent.DeleteNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !executor.Process(node.ID).Deleted() {
+		t.Errorf("expected the resources of the deleted node to be removed")
+	}
+}
+
+func TestMenmosAgent_CrashedNode(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	executor.Process(node.ID).Log("starting", map[string]interface{}{"level": "ERROR"})
+	executor.Process(node.ID).CrashLoopWith(xecute.CrashLoop{Crashes: 5, LastExitCode: 101})
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Status != xecute.StatusCrashLoop {
+		t.Errorf("expected crash loop status, got '%s'", resp.Status)
+	}
+	if resp.CrashLoop == nil || resp.CrashLoop.LastExitCode != 101 {
+		t.Errorf("expected crash loop info, got %+v", resp.CrashLoop)
+	}
+	if resp.LastExitCode == nil || *resp.LastExitCode != 101 {
+		t.Errorf("expected last exit code to be 101")
+	}
+
+	logs, err := agent.GetNodeLogs(node.ID, xecute.LogQuery{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.Log) != 1 {
+		t.Errorf("expected a single log line, got %v", logs.Log)
+	}
+
+	// A node parked in a crash loop can be started manually.
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMenmosAgent_FollowNodeLogs(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	process := executor.Process(node.ID)
+	process.Log("first", "second", "third")
+
+	logs, err := agent.GetNodeLogs(node.ID, xecute.LogQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Following without a cursor starts with the last lines.
+	tail, err := agent.FollowNodeLogs(node.ID, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+
+	// Following from the cursor of a snapshot returns the lines written next.
+	resumed, err := agent.FollowNodeLogs(node.ID, logs.Cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+
+	process.Log(map[string]interface{}{"level": "INFO"})
+
+	receive := func(subscription *xecute.LogSubscription) interface{} {
+		select {
+		case line := <-subscription.Lines():
+			return line.Entry()
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a line")
+			return nil
+		}
+	}
+
+	for _, want := range []string{"second", "third"} {
+		if got := receive(tail); got != want {
+			t.Errorf("expected '%s', got %v", want, got)
+		}
+	}
+	for _, subscription := range []*xecute.LogSubscription{tail, resumed} {
+		if entry, ok := receive(subscription).(map[string]interface{}); !ok || entry["level"] != "INFO" {
+			t.Errorf("expected the new JSON line, got %v", entry)
+		}
+	}
+
+	if _, err := agent.FollowNodeLogs(node.ID, "not-a-cursor", 2); !errors.Is(err, xecute.ErrInvalidCursor) {
+		t.Errorf("expected an invalid cursor error, got %v", err)
+	}
+	if subscription, err := agent.FollowNodeLogs("missing", "", 2); subscription != nil || err != nil {
+		t.Errorf("expected no subscription for a missing node, got %v, %v", subscription, err)
+	}
+
+	// Restarting the node replaces its process, the subscribers are told to resume from the new one.
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-tail.Lines():
+		if ok || !errors.Is(tail.Err(), xecute.ErrLogClosed) {
+			t.Errorf("expected the subscription to the replaced process to end, got %v", tail.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the subscription to end")
+	}
+}
+
+func TestMenmosAgent_GetNodeLogsAfterRestart(t *testing.T) {
+	workspace := t.TempDir()
+
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	agent.Shutdown()
+
+	nodeDir := path.Join(agent.nodeDir(), node.ID)
+	if err := os.WriteFile(path.Join(nodeDir, "log.0.json"), []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(nodeDir, xecute.LOG_FILE), []byte("c\nd\ne\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stopped node has no process after the restart, its log is read from its directory.
+	restarted := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	defer restarted.Shutdown()
+
+	logs, err := restarted.GetNodeLogs(node.ID, xecute.LogQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(logs.Log) != "[d e]" || !logs.HasMore || logs.Cursor != "1-6" {
+		t.Errorf("expected the last lines, got %+v", logs)
+	}
+
+	// The previous page spans the rotated file.
+	before, err := xecute.ParseCursor(logs.StartCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err = restarted.GetNodeLogs(node.ID, xecute.LogQuery{Before: &before, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(logs.Log) != "[b c]" || !logs.HasMore {
+		t.Errorf("expected the previous page, got %+v", logs)
+	}
+}
+
+func TestMenmosAgent_GetNodeCrashReport(t *testing.T) {
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+	defer agent.Shutdown()
+
+	node := createTestNode(t, agent)
+	if report, err := agent.GetNodeCrashReport(node.ID); report != nil || err != nil {
+		t.Errorf("expected no crash report before a crash, got %+v, %v", report, err)
+	}
+
+	crash := xecute.CrashReport{
+		ExitCode: 101,
+		Lines:    []xecute.CrashReportLine{{Stream: xecute.StreamStderr, Line: "thread 'main' panicked"}},
+	}
+	encoded, err := json.Marshal(crash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(agent.nodeDir(), node.ID, xecute.CRASH_REPORT_FILE), encoded, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := agent.GetNodeCrashReport(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.ExitCode != 101 || len(report.Lines) != 1 || report.Lines[0].Stream != "stderr" {
+		t.Errorf("unexpected crash report: %+v", report)
+	}
+
+	if report, err := agent.GetNodeCrashReport("missing"); report != nil || err != nil {
+		t.Errorf("expected no crash report for a missing node, got %+v, %v", report, err)
+	}
+}
+
+func TestMenmosAgent_RestartComponents(t *testing.T) {
+	workspace := t.TempDir()
+
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, workspace, executor)
+	node := createTestNode(t, agent)
+	agent.Shutdown()
+
+	// A new agent on the same workspace brings the node back.
+	restartedExecutor := xecutetest.NewExecutor()
+	restarted := newTestAgent(t, workspace, restartedExecutor)
+
+	process := restartedExecutor.Process(node.ID)
+	if process == nil || process.Starts() != 1 {
+		t.Fatalf("expected node to be restarted")
+	}
+
+	if process.Spec.RestartPolicy.Mode != xecute.RestartOnFailure {
+		t.Errorf("restart policy was not restored: %+v", process.Spec.RestartPolicy)
+	}
+
+	nodes, err := restarted.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].ID != node.ID {
+		t.Errorf("unexpected nodes: %+v", nodes.Nodes)
+	}
+}
+
+func Test_newExecutor(t *testing.T) {
+	tests := []struct {
+		name      string
+		agentType RunType
+		want      interface{}
+		wantErr   bool
+	}{
+		{"defaultsToNative", "", &xecute.NativeExecutor{}, false},
+		{"native", Native, &xecute.NativeExecutor{}, false},
+		{"docker", Docker, &xecute.DockerExecutor{}, false},
+		{"unknown", "vm", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newExecutor(Config{AgentType: tt.agentType}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newExecutor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			switch tt.want.(type) {
+			case *xecute.NativeExecutor:
+				if _, ok := got.(*xecute.NativeExecutor); !ok {
+					t.Errorf("expected a native executor, got %T", got)
+				}
+			case *xecute.DockerExecutor:
+				if _, ok := got.(*xecute.DockerExecutor); !ok {
+					t.Errorf("expected a docker executor, got %T", got)
+				}
+			}
+		})
+	}
+}
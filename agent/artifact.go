@@ -0,0 +1,240 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+// artifactReferences returns the nodes using each version.
+func (a *MenmosAgent) artifactReferences() (map[string][]string, error) {
+	nodeIDs, err := a.nodeIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	references := make(map[string][]string)
+	for _, nodeID := range nodeIDs {
+		info, err := a.getNodeInfo(nodeID)
+		if err != nil {
+			// Nodes can be deleted, or still being created, while listing.
+			continue
+		}
+
+		if info.Version != "" {
+			references[info.Version] = append(references[info.Version], nodeID)
+		}
+	}
+
+	return references, nil
+}
+
+func artifactToPayload(info *artifact.VersionInfo, nodes []string) *payload.ArtifactVersion {
+	if nodes == nil {
+		nodes = []string{}
+	}
+
+	return &payload.ArtifactVersion{
+		Version:     info.Version,
+		Binaries:    info.Binaries,
+		Size:        info.Size,
+		Complete:    info.Complete,
+		Verified:    info.Verified,
+		InstalledAt: info.InstalledAt,
+		LastUsed:    info.LastUsed,
+		Pinned:      info.Pinned,
+		Nodes:       nodes,
+	}
+}
+
+func downloadToPayload(progress *artifact.InstallProgress) *payload.ArtifactDownload {
+	if progress == nil {
+		return nil
+	}
+
+	download := &payload.ArtifactDownload{
+		State:        string(progress.State),
+		Platform:     progress.Platform,
+		Architecture: progress.Architecture,
+		Assets:       []*payload.ArtifactAssetProgress{},
+		StartedAt:    progress.StartedAt,
+		Error:        progress.Error,
+	}
+
+	if !progress.EndedAt.IsZero() {
+		download.EndedAt = &progress.EndedAt
+	}
+
+	for _, asset := range progress.Assets {
+		download.Assets = append(download.Assets, &payload.ArtifactAssetProgress{
+			Name:       asset.FullName,
+			Bytes:      asset.Bytes,
+			TotalBytes: asset.TotalBytes,
+			Done:       asset.Done,
+			Error:      asset.Error,
+		})
+		download.Bytes += asset.Bytes
+		download.TotalBytes += asset.TotalBytes
+	}
+
+	return download
+}
+
+// artifactError maps artifact errors to agent errors.
+func artifactError(err error) error {
+	if errors.Is(err, artifact.ErrPinned) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+func (a *MenmosAgent) ListArtifacts() (*payload.ListArtifactsResponse, error) {
+	references, err := a.artifactReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := a.artifacts.List()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := payload.ListArtifactsResponse{Versions: []*payload.ArtifactVersion{}}
+	for _, version := range versions {
+		resp.Versions = append(resp.Versions, artifactToPayload(version, references[version.Version]))
+		resp.TotalSize += version.Size
+	}
+
+	return &resp, nil
+}
+
+// GetArtifact returns a version of the artifact cache along with its last download, or nil if the version is
+// neither installed nor being downloaded.
+func (a *MenmosAgent) GetArtifact(version string) (*payload.ArtifactVersion, error) {
+	download := downloadToPayload(a.artifacts.Progress(version))
+
+	info, err := a.artifacts.Info(version)
+	if errors.Is(err, artifact.ErrNotInstalled) {
+		// Versions that were removed after being installed are gone, failed and running downloads are reported.
+		if download == nil || download.State == string(artifact.InstallInstalled) {
+			return nil, nil
+		}
+		info = &artifact.VersionInfo{Version: version, Binaries: []string{}}
+	} else if err != nil {
+		return nil, err
+	}
+
+	references, err := a.artifactReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := artifactToPayload(info, references[version])
+	resp.Download = download
+	return resp, nil
+}
+
+// PrefetchArtifact starts downloading a version in the background, so nodes using it later don't wait for the download.
+// The version can be an alias or a constraint, it is resolved first. It returns whether a download is running.
+func (a *MenmosAgent) PrefetchArtifact(version string) (*payload.ArtifactVersion, bool, error) {
+	resolved, err := a.artifacts.Resolve(context.Background(), version)
+	if err != nil {
+		return nil, false, err
+	}
+
+	started, err := a.artifacts.Prefetch(resolved)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp, err := a.GetArtifact(resolved)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp, started, nil
+}
+
+// ExportArtifact writes a bundle of an installed version, that can be imported by agents without network access.
+func (a *MenmosAgent) ExportArtifact(version string, w io.Writer) error {
+	return a.artifacts.Export(version, w)
+}
+
+// ImportArtifact installs the version held by a bundle, and returns it.
+func (a *MenmosAgent) ImportArtifact(bundle io.Reader) (*payload.ArtifactVersion, error) {
+	version, err := a.artifacts.Import(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.GetArtifact(version)
+}
+
+// RemoveArtifact removes a version from the artifact cache. Versions that are pinned or used by a node can't be removed.
+func (a *MenmosAgent) RemoveArtifact(version string) error {
+	references, err := a.artifactReferences()
+	if err != nil {
+		return err
+	}
+
+	if nodes := references[version]; len(nodes) > 0 {
+		return fmt.Errorf("%w: version '%s' is used by nodes %v", ErrConflict, version, nodes)
+	}
+
+	return artifactError(a.artifacts.Remove(version))
+}
+
+func (a *MenmosAgent) PinArtifact(version string) error {
+	return a.artifacts.Pin(version)
+}
+
+func (a *MenmosAgent) UnpinArtifact(version string) error {
+	return a.artifacts.Unpin(version)
+}
+
+// CollectArtifacts garbage-collects the versions no node uses, according to the configured policy.
+func (a *MenmosAgent) CollectArtifacts(dryRun bool) (*payload.CollectArtifactsResponse, error) {
+	references, err := a.artifactReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make(map[string]bool, len(references))
+	for version := range references {
+		inUse[version] = true
+	}
+
+	result, err := a.artifacts.Collect(a.config.ArtifactGC, inUse, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payload.CollectArtifactsResponse{
+		Removed:    result.Removed,
+		FreedBytes: result.FreedBytes,
+		DryRun:     dryRun,
+	}, nil
+}
+
+func (a *MenmosAgent) artifactGCLoop() {
+	ticker := time.NewTicker(a.config.ArtifactGC.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result, err := a.CollectArtifacts(false)
+			if err != nil {
+				a.log.Errorf("failed to collect artifacts: %v", err)
+			} else if len(result.Removed) > 0 {
+				a.log.Infof("collected versions %v, freeing %d bytes", result.Removed, result.FreedBytes)
+			}
+		case <-a.stopLoops:
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package artifact
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archive formats of release assets, by extension.
+const (
+	ARCHIVE_TAR_GZ = ".tar.gz"
+	ARCHIVE_TGZ    = ".tgz"
+	ARCHIVE_TAR    = ".tar"
+	ARCHIVE_ZIP    = ".zip"
+)
+
+// The maximum size of a file installed from an asset, so a decompression bomb can't fill the disk.
+const MAX_INSTALLED_FILE_SIZE = 1 << 30
+
+var archiveFormats = []string{ARCHIVE_TAR_GZ, ARCHIVE_TGZ, ARCHIVE_TAR, ARCHIVE_ZIP}
+
+// Magic numbers of the executable formats menmos ships: ELF, Mach-O (32 and 64 bits, both endiannesses, universal),
+// PE and scripts.
+var executableMagics = [][]byte{
+	[]byte("\x7fELF"),
+	{0xfe, 0xed, 0xfa, 0xce},
+	{0xfe, 0xed, 0xfa, 0xcf},
+	{0xce, 0xfa, 0xed, 0xfe},
+	{0xcf, 0xfa, 0xed, 0xfe},
+	{0xca, 0xfe, 0xba, 0xbe},
+	[]byte("MZ"),
+	[]byte("#!"),
+}
+
+// isExecutable returns whether a file starting with header is an executable.
+func isExecutable(header []byte) bool {
+	for _, magic := range executableMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSafeName returns whether a file name can be used as is in a version directory.
+func isSafeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// entryName returns the name an archive entry is installed as, rejecting entries pointing outside of the archive.
+func entryName(rawName string) (string, error) {
+	name := strings.ReplaceAll(rawName, `\`, "/")
+	cleaned := path.Clean(name)
+	if path.IsAbs(name) || filepath.VolumeName(name) != "" || strings.Contains(name, ":") || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: unsafe archive entry '%s'", ErrVerification, rawName)
+	}
+
+	// Archives often nest their files in a directory, executables are installed at the root of the version.
+	return path.Base(cleaned), nil
+}
+
+// installFile writes a file to the version directory, through a temporary file in tmpDirectory.
+// The file is only made executable if it is a real executable. If executableOnly is set, other files are skipped
+// and nil is returned.
+func installFile(src io.Reader, tmpDirectory, directory, name string, executableOnly bool) (*ManifestFile, error) {
+	reader := bufio.NewReader(src)
+	header, _ := reader.Peek(4)
+
+	executable := isExecutable(header)
+	if executableOnly && !executable {
+		return nil, nil
+	}
+
+	if !isSafeName(name) {
+		return nil, fmt.Errorf("%w: unsafe file name '%s'", ErrVerification, name)
+	}
+
+	tmpFile, err := os.CreateTemp(tmpDirectory, name+".*.install")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), io.LimitReader(reader, MAX_INSTALLED_FILE_SIZE+1))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > MAX_INSTALLED_FILE_SIZE {
+		return nil, fmt.Errorf("%w: file '%s' is larger than %d bytes", ErrVerification, name, MAX_INSTALLED_FILE_SIZE)
+	}
+
+	var mode os.FileMode = 0644
+	if executable {
+		mode = 0755
+	}
+	if err := os.Chmod(tmpFile.Name(), mode); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpFile.Name(), filepath.Join(directory, name)); err != nil {
+		return nil, err
+	}
+
+	return &ManifestFile{
+		Name:       name,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+		Size:       size,
+		Executable: executable,
+	}, nil
+}
+
+// archiveInstaller installs the executables of an archive, making sure no two entries are installed with the same name.
+type archiveInstaller struct {
+	tmpDirectory string
+	directory    string
+	files        []ManifestFile
+	installed    map[string]string
+}
+
+func (i *archiveInstaller) install(rawName string, open func() (io.ReadCloser, error)) error {
+	name, err := entryName(rawName)
+	if err != nil {
+		return err
+	}
+
+	entry, err := open()
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	file, err := installFile(entry, i.tmpDirectory, i.directory, name, true)
+	if err != nil || file == nil {
+		return err
+	}
+
+	if previous, ok := i.installed[name]; ok {
+		return fmt.Errorf("archive entries '%s' and '%s' are both installed as '%s'", previous, rawName, name)
+	}
+	i.installed[name] = rawName
+	i.files = append(i.files, *file)
+	return nil
+}
+
+func extractTar(reader io.Reader, installer *archiveInstaller) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Even entries that aren't extracted must not point outside of the archive.
+		if _, err := entryName(header.Name); err != nil {
+			return err
+		}
+
+		// Links and directories are never extracted, only the files they would point to.
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err := installer.install(header.Name, func() (io.ReadCloser, error) { return io.NopCloser(tarReader), nil }); err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archivePath string, installer *archiveInstaller) error {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zipReader.Close()
+
+	for _, entry := range zipReader.File {
+		if _, err := entryName(entry.Name); err != nil {
+			return err
+		}
+
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+
+		if err := installer.install(entry.Name, entry.Open); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractArchive installs the executables of an archive to the version directory.
+func extractArchive(format, archivePath, tmpDirectory, directory string) ([]ManifestFile, error) {
+	installer := archiveInstaller{tmpDirectory: tmpDirectory, directory: directory, installed: make(map[string]string)}
+
+	var err error
+	switch format {
+	case ARCHIVE_ZIP:
+		err = extractZip(archivePath, &installer)
+	case ARCHIVE_TAR, ARCHIVE_TAR_GZ, ARCHIVE_TGZ:
+		var file *os.File
+		if file, err = os.Open(archivePath); err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		var reader io.Reader = file
+		if format != ARCHIVE_TAR {
+			gzipReader, gzErr := gzip.NewReader(file)
+			if gzErr != nil {
+				return nil, gzErr
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		}
+
+		err = extractTar(reader, &installer)
+	default:
+		err = fmt.Errorf("unsupported archive format '%s'", format)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(installer.files) == 0 {
+		return nil, fmt.Errorf("archive '%s' contains no executable", filepath.Base(archivePath))
+	}
+
+	return installer.files, nil
+}
@@ -0,0 +1,244 @@
+package artifact
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+var fakeELF = []byte("\x7fELF fake binary")
+
+type testEntry struct {
+	name     string
+	content  []byte
+	linkname string // Makes the entry a symlink.
+}
+
+func buildArchive(t *testing.T, format string, entries []testEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	switch format {
+	case ARCHIVE_ZIP:
+		writer := zip.NewWriter(&buf)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+			content := entry.content
+			if entry.linkname != "" {
+				header.SetMode(os.ModeSymlink | 0777)
+				content = []byte(entry.linkname)
+			}
+			w, err := writer.CreateHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(content)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		var gzipWriter *gzip.Writer
+		var writer *tar.Writer
+		if format == ARCHIVE_TAR {
+			writer = tar.NewWriter(&buf)
+		} else {
+			gzipWriter = gzip.NewWriter(&buf)
+			writer = tar.NewWriter(gzipWriter)
+		}
+
+		for _, entry := range entries {
+			header := &tar.Header{Name: entry.name, Mode: 0755, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+			if entry.linkname != "" {
+				header = &tar.Header{Name: entry.name, Linkname: entry.linkname, Mode: 0777, Typeflag: tar.TypeSymlink}
+			}
+			if err := writer.WriteHeader(header); err != nil {
+				t.Fatal(err)
+			}
+			writer.Write(entry.content)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if gzipWriter != nil {
+			if err := gzipWriter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []testEntry
+		wantFiles []string
+		wantErr   error
+	}{
+		{
+			"nestedExecutable",
+			[]testEntry{{name: "amphora-linux-amd64/amphora", content: fakeELF}, {name: "amphora-linux-amd64/README.md", content: []byte("# amphora")}},
+			[]string{"amphora"},
+			nil,
+		},
+		{
+			"script",
+			[]testEntry{{name: "start.sh", content: []byte("#!/bin/sh\necho hi")}, {name: "menmosd", content: fakeELF}},
+			[]string{"start.sh", "menmosd"},
+			nil,
+		},
+		{
+			"symlinksAreSkipped",
+			[]testEntry{{name: "passwd", linkname: "/etc/passwd"}, {name: "menmosd", content: fakeELF}},
+			[]string{"menmosd"},
+			nil,
+		},
+		{"parentTraversal", []testEntry{{name: "../../evil", content: fakeELF}}, nil, ErrVerification},
+		{"nestedTraversal", []testEntry{{name: "bin/../../evil", content: fakeELF}}, nil, ErrVerification},
+		{"absolutePath", []testEntry{{name: "/usr/bin/evil", content: fakeELF}}, nil, ErrVerification},
+		{"windowsTraversal", []testEntry{{name: `..\evil.exe`, content: []byte("MZ")}}, nil, ErrVerification},
+		{"traversalInSkippedEntry", []testEntry{{name: "menmosd", content: fakeELF}, {name: "../README", content: []byte("hi")}}, nil, ErrVerification},
+		{"duplicateNames", []testEntry{{name: "a/menmosd", content: fakeELF}, {name: "b/menmosd", content: fakeELF}}, nil, errors.New("")},
+		{"noExecutable", []testEntry{{name: "README.md", content: []byte("# menmos")}}, nil, errors.New("")},
+	}
+	for _, format := range archiveFormats {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				dir := t.TempDir()
+				archivePath := filepath.Join(dir, "archive"+format)
+				if err := os.WriteFile(archivePath, buildArchive(t, format, tt.entries), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				versionDir := filepath.Join(dir, "version")
+				if err := os.Mkdir(versionDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+
+				files, err := extractArchive(format, archivePath, dir, versionDir)
+				if (err != nil) != (tt.wantErr != nil) {
+					t.Fatalf("extractArchive() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if errors.Is(tt.wantErr, ErrVerification) && !errors.Is(err, ErrVerification) {
+					t.Errorf("expected a verification error, got %v", err)
+				}
+				if err != nil {
+					if _, statErr := os.Stat(filepath.Join(filepath.Dir(dir), "evil")); statErr == nil {
+						t.Errorf("archive entry escaped the version directory")
+					}
+					return
+				}
+
+				var names []string
+				for _, file := range files {
+					names = append(names, file.Name)
+
+					info, err := os.Stat(filepath.Join(versionDir, file.Name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !file.Executable || info.Mode().Perm() != 0755 {
+						t.Errorf("expected '%s' to be executable, got mode %v", file.Name, info.Mode())
+					}
+				}
+				if !reflect.DeepEqual(names, tt.wantFiles) {
+					t.Errorf("expected files %v, got %v", tt.wantFiles, names)
+				}
+
+				entries, err := os.ReadDir(versionDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != len(tt.wantFiles) {
+					t.Errorf("expected only executables to be extracted, got %d files", len(entries))
+				}
+			})
+		}
+	}
+}
+
+func TestRepository_ArchiveRelease(t *testing.T) {
+	sourceDir := t.TempDir()
+	releaseDir := filepath.Join(sourceDir, "v1.0.0")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	platform := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
+	assets := map[string][]byte{
+		"amphora-" + platform + ARCHIVE_TAR_GZ: buildArchive(t, ARCHIVE_TAR_GZ, []testEntry{
+			{name: "amphora-" + platform + "/amphora", content: fakeELF},
+			{name: "amphora-" + platform + "/LICENSE", content: []byte("MIT")},
+		}),
+		"menmosd-" + platform: []byte("not really a binary"),
+	}
+
+	var sums bytes.Buffer
+	for name, content := range assets {
+		if err := os.WriteFile(filepath.Join(releaseDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	if err := os.WriteFile(filepath.Join(releaseDir, CHECKSUM_FILE), sums.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher, err := NewLocalFetcher(sourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepository(RepositoryParams{ReleaseFetcher: fetcher, Log: zap.NewNop(), Path: t.TempDir()})
+
+	tests := []struct {
+		name     string
+		wantMode os.FileMode
+		wantErr  bool
+	}{
+		{"amphora", 0755, false},
+		{"menmosd", 0644, false},
+		{"LICENSE", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifactPath, err := r.Get("v1.0.0", tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Repository.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			info, err := os.Stat(artifactPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != tt.wantMode {
+				t.Errorf("expected mode %v, got %v", tt.wantMode, info.Mode().Perm())
+			}
+		})
+	}
+
+	binaries, err := r.Binaries("v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(binaries, []string{"amphora"}) {
+		t.Errorf("expected the version to provide amphora, got %v", binaries)
+	}
+}
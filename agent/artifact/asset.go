@@ -2,6 +2,7 @@ package artifact
 
 import (
 	"fmt"
+	"net/http"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -10,14 +11,39 @@ import (
 type Asset struct {
 	FullName    string
 	DownloadURL string
+
+	// The client downloading the asset, for sources needing a special transport. Defaults to http.DefaultClient.
+	client *http.Client
+}
+
+func (a *Asset) httpClient() *http.Client {
+	if a.client == nil {
+		return http.DefaultClient
+	}
+	return a.client
 }
 
 func (a *Asset) stripExtension() string {
 	return strings.TrimSuffix(a.FullName, filepath.Ext(a.FullName))
 }
 
+// archiveFormat returns the archive format of the asset, or an empty string if it isn't an archive.
+func (a *Asset) archiveFormat() string {
+	lower := strings.ToLower(a.FullName)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(lower, format) {
+			return format
+		}
+	}
+	return ""
+}
+
 func (a *Asset) Name() string {
 	stripped := a.stripExtension()
+	if format := a.archiveFormat(); format != "" {
+		// Archive extensions like ".tar.gz" span multiple dots.
+		stripped = a.FullName[:len(a.FullName)-len(format)]
+	}
 	if stripped == "" {
 		return "unknown"
 	}
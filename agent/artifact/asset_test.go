@@ -44,6 +44,9 @@ func Test_asset_Name(t *testing.T) {
 		{"noExtension", fields{FullName: "bing-linux-arm64"}, "bing"},
 		{"extensionOnly", fields{FullName: ".txt"}, "unknown"},
 		{"noDashes", fields{FullName: "test.txt"}, "test"},
+		{"tarball", fields{FullName: "amphora-linux-amd64.tar.gz"}, "amphora"},
+		{"tarballNoDashes", fields{FullName: "amphora.tar.gz"}, "amphora"},
+		{"zip", fields{FullName: "amphora-windows-amd64.ZIP"}, "amphora"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,388 @@
+package artifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// The bundle entry describing the bundled version. It is listed in the bundle checksums, so it is covered by
+	// the bundle signature.
+	BUNDLE_METADATA_FILE = "bundle.json"
+
+	// The extension of bundle files.
+	BUNDLE_EXTENSION = ".bundle.tar.gz"
+)
+
+// ErrInvalidBundle is returned when importing a file that isn't a well-formed bundle.
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// BundleMetadata describes the version held by a bundle.
+type BundleMetadata struct {
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// bundleWriter writes the entries of a bundle, recording their checksums.
+type bundleWriter struct {
+	tar  *tar.Writer
+	sums checksums
+}
+
+func (b *bundleWriter) add(name string, size int64, src io.Reader) error {
+	if _, ok := b.sums[name]; ok {
+		return fmt.Errorf("duplicate bundle entry '%s'", name)
+	}
+
+	header := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(b.tar, hash), src); err != nil {
+		return err
+	}
+
+	b.sums[name] = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+func (b *bundleWriter) addBytes(name string, content []byte) error {
+	return b.add(name, int64(len(content)), bytes.NewReader(content))
+}
+
+func (b *bundleWriter) addFile(name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return b.add(name, info.Size(), file)
+}
+
+// formatChecksums formats checksums in the `sha256sum` format, sorted by name.
+func formatChecksums(sums checksums) []byte {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[name], name)
+	}
+	return buf.Bytes()
+}
+
+// repackAsset writes the installed files of an archive asset to a new tar.gz archive.
+func repackAsset(versionDir string, asset ManifestAsset, archivePath string) (err error) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, installed := range asset.Files {
+		mode := int64(0644)
+		if installed.Executable {
+			mode = 0755
+		}
+
+		header := &tar.Header{Name: installed.Name, Mode: mode, Size: installed.Size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+
+		src, err := os.Open(filepath.Join(versionDir, installed.Name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tarWriter, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// verifyInstalled checks the files of an installed version against its manifest.
+func verifyInstalled(versionDir string, manifest *Manifest) error {
+	for _, asset := range manifest.Assets {
+		for _, installed := range asset.Files {
+			sum, size, err := hashFile(filepath.Join(versionDir, installed.Name))
+			if err != nil {
+				return err
+			}
+			if sum != installed.SHA256 || size != installed.Size {
+				return fmt.Errorf("%w: installed file '%s' of version '%s' doesn't match its manifest", ErrVerification, installed.Name, manifest.Version)
+			}
+		}
+	}
+	return nil
+}
+
+// Export writes a bundle of an installed version. A bundle is a gzipped tar file laid out like a release: the assets
+// of the version, their checksum file, and the signature of the checksum file if the repository has a signing key.
+// Assets that were archives are repacked as tar.gz archives of their installed files.
+// Only verified versions can be exported, and their files are checked against their manifest first.
+func (r *Repository) Export(version string, w io.Writer) error {
+	if !isSafeName(version) {
+		return fmt.Errorf("%w: '%s'", ErrNotInstalled, version)
+	}
+
+	// The version can't be repaired or replaced while it is exported.
+	lock, err := acquireFileLock(filepath.Join(r.path, LOCKS_DIR, version))
+	if err != nil {
+		return fmt.Errorf("failed to lock version '%s': %w", version, err)
+	}
+	defer lock.release()
+
+	versionDir := filepath.Join(r.path, version)
+	if !isComplete(versionDir) {
+		return fmt.Errorf("%w: '%s'", ErrNotInstalled, version)
+	}
+
+	manifest, err := readManifest(versionDir)
+	if err != nil {
+		return err
+	}
+	if !manifest.Verified {
+		return fmt.Errorf("%w: version '%s' was installed without verification, it can't be exported", ErrVerification, version)
+	}
+	if err := verifyInstalled(versionDir, manifest); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.path, STAGING_DIR), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Join(r.path, STAGING_DIR), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	gzipWriter := gzip.NewWriter(w)
+	bundle := bundleWriter{tar: tar.NewWriter(gzipWriter), sums: make(checksums)}
+
+	metadata, err := json.Marshal(BundleMetadata{Version: version, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := bundle.addBytes(BUNDLE_METADATA_FILE, metadata); err != nil {
+		return err
+	}
+
+	for _, asset := range manifest.Assets {
+		format := (&Asset{FullName: asset.FullName}).archiveFormat()
+		if format == "" && len(asset.Files) == 1 {
+			// Assets that aren't archives are installed as is.
+			if err := bundle.addFile(asset.FullName, filepath.Join(versionDir, asset.Files[0].Name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := asset.FullName[:len(asset.FullName)-len(format)] + ARCHIVE_TAR_GZ
+		archivePath := filepath.Join(tmpDir, name)
+		if err := repackAsset(versionDir, asset, archivePath); err != nil {
+			return fmt.Errorf("failed to repack asset '%s': %w", asset.FullName, err)
+		}
+		if err := bundle.addFile(name, archivePath); err != nil {
+			return err
+		}
+	}
+
+	sums := formatChecksums(bundle.sums)
+	if err := bundle.addBytes(CHECKSUM_FILE, sums); err != nil {
+		return err
+	}
+
+	if r.signingKey != nil {
+		if err := bundle.addBytes(SIGNATURE_FILE, ed25519.Sign(r.signingKey, sums)); err != nil {
+			return err
+		}
+	} else {
+		r.log.Warnf("no signing key configured, the bundle of version '%s' isn't signed", version)
+	}
+
+	if err := bundle.tar.Close(); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+
+	r.log.Infof("exported version '%s'", version)
+	return nil
+}
+
+// extractBundle extracts the entries of a bundle to a directory, and returns the metadata of the bundle.
+func extractBundle(src io.Reader, directory string) (*BundleMetadata, error) {
+	gzipReader, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer gzipReader.Close()
+
+	seen := make(map[string]bool)
+	reader := tar.NewReader(gzipReader)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+
+		// Bundles are flat, every entry is a file at the root.
+		if header.Typeflag != tar.TypeReg || !isSafeName(header.Name) {
+			return nil, fmt.Errorf("%w: unexpected entry '%s'", ErrInvalidBundle, header.Name)
+		}
+		if seen[header.Name] {
+			return nil, fmt.Errorf("%w: duplicate entry '%s'", ErrInvalidBundle, header.Name)
+		}
+		seen[header.Name] = true
+
+		if header.Size > MAX_INSTALLED_FILE_SIZE {
+			return nil, fmt.Errorf("%w: entry '%s' exceeds %d bytes", ErrInvalidBundle, header.Name, MAX_INSTALLED_FILE_SIZE)
+		}
+
+		file, err := os.Create(filepath.Join(directory, header.Name))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(file, io.LimitReader(reader, MAX_INSTALLED_FILE_SIZE))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+		}
+	}
+
+	raw, err := os.ReadFile(filepath.Join(directory, BUNDLE_METADATA_FILE))
+	if err != nil {
+		return nil, fmt.Errorf("%w: no %s entry", ErrInvalidBundle, BUNDLE_METADATA_FILE)
+	}
+
+	var metadata BundleMetadata
+	if err := json.Unmarshal(raw, &metadata); err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %v", ErrInvalidBundle, BUNDLE_METADATA_FILE, err)
+	}
+	if !isSafeName(metadata.Version) {
+		return nil, fmt.Errorf("%w: invalid version '%s'", ErrInvalidBundle, metadata.Version)
+	}
+
+	// The metadata is only trusted if the checksums cover it, the checksums themselves are verified on install.
+	if raw, err := os.ReadFile(filepath.Join(directory, CHECKSUM_FILE)); err == nil {
+		sums, err := parseChecksums(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		sum, _, err := hashFile(filepath.Join(directory, BUNDLE_METADATA_FILE))
+		if err != nil {
+			return nil, err
+		}
+		if sums[BUNDLE_METADATA_FILE] != sum {
+			return nil, fmt.Errorf("%w: checksum mismatch for %s", ErrVerification, BUNDLE_METADATA_FILE)
+		}
+	}
+
+	return &metadata, nil
+}
+
+// Import installs the version held by a bundle. Bundles are installed like releases fetched from a source:
+// their checksums and signature are verified against the keys trusted by the repository, and a manifest is written.
+// Importing a version that is already installed does nothing. It returns the imported version.
+func (r *Repository) Import(src io.Reader) (string, error) {
+	if err := os.MkdirAll(filepath.Join(r.path, STAGING_DIR), 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Join(r.path, STAGING_DIR), ".import-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Entries are extracted to a hidden directory first, since the version is only known once the metadata is read.
+	entriesDir := filepath.Join(tmpDir, ".entries")
+	if err := os.Mkdir(entriesDir, 0755); err != nil {
+		return "", err
+	}
+
+	metadata, err := extractBundle(src, entriesDir)
+	if err != nil {
+		return "", err
+	}
+	version := metadata.Version
+
+	// The extracted bundle is served like a local release source.
+	if err := os.Rename(entriesDir, filepath.Join(tmpDir, version)); err != nil {
+		return "", err
+	}
+	fetcher, err := NewLocalFetcher(tmpDir)
+	if err != nil {
+		return "", err
+	}
+
+	lock, err := acquireFileLock(filepath.Join(r.path, LOCKS_DIR, version))
+	if err != nil {
+		return "", fmt.Errorf("failed to lock version '%s': %w", version, err)
+	}
+	defer lock.release()
+
+	versionDir := filepath.Join(r.path, version)
+	if isComplete(versionDir) {
+		r.log.Infof("version '%s' is already installed, skipping its import", version)
+		return version, nil
+	}
+
+	// Downloads left behind by a failed network install don't belong to the bundle, they must not be resumed.
+	if err := os.RemoveAll(filepath.Join(r.path, STAGING_DIR, version)); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(versionDir); err != nil {
+		return "", err
+	}
+
+	if err := r.downloadRelease(version, fetcher, newInstallTracker(version)); err != nil {
+		return "", err
+	}
+
+	r.log.Infof("imported version '%s'", version)
+	return version, nil
+}
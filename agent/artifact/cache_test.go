@@ -0,0 +1,171 @@
+package artifact
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestCache returns a repository with the given versions installed, from a local source.
+func newTestCache(t *testing.T, versions ...string) *Repository {
+	t.Helper()
+
+	sourceDir := t.TempDir()
+	for _, version := range versions {
+		writeRelease(t, sourceDir, version)
+	}
+
+	fetcher, err := NewLocalFetcher(sourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRepository(RepositoryParams{ReleaseFetcher: fetcher, Log: zap.NewNop(), Path: t.TempDir()})
+	for _, version := range versions {
+		if _, err := r.Get(version, "myapp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return r
+}
+
+func setLastUsed(t *testing.T, r *Repository, version string, lastUsed time.Time) {
+	t.Helper()
+
+	err := r.updateState(func(state *cacheState) {
+		state.LastUsed[version] = lastUsed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The installation time is the floor of the last use time.
+	manifest, err := readManifest(filepath.Join(r.path, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.CompletedAt = lastUsed
+	if err := writeManifest(filepath.Join(r.path, version), manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepository_Inventory(t *testing.T) {
+	r := newTestCache(t, "v1.0.0", "v2.0.0")
+
+	versions, err := r.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != "v1.0.0" || versions[1].Version != "v2.0.0" {
+		t.Fatalf("unexpected inventory: %+v", versions)
+	}
+	for _, version := range versions {
+		if !reflect.DeepEqual(version.Binaries, []string{"myapp"}) || version.Size == 0 || !version.Complete || !version.Verified {
+			t.Errorf("unexpected version: %+v", version)
+		}
+		if version.LastUsed.IsZero() || version.Pinned {
+			t.Errorf("unexpected version state: %+v", version)
+		}
+	}
+
+	if err := r.Pin("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := r.Info("v1.0.0"); err != nil || !info.Pinned {
+		t.Errorf("expected version to be pinned: %+v, %v", info, err)
+	}
+	if err := r.Remove("v1.0.0"); !errors.Is(err, ErrPinned) {
+		t.Errorf("expected pinned version not to be removed, got %v", err)
+	}
+
+	if err := r.Unpin("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Info("v1.0.0"); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("expected removed version not to be installed, got %v", err)
+	}
+
+	for _, version := range []string{"v1.0.0", "v3.0.0", "../v2.0.0"} {
+		if err := r.Pin(version); !errors.Is(err, ErrNotInstalled) {
+			t.Errorf("expected pinning version '%s' to fail, got %v", version, err)
+		}
+	}
+
+	// Removed versions are downloaded again when used.
+	if _, err := r.Get("v1.0.0", "myapp"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepository_Collect(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      GCPolicy
+		pinned      []string
+		inUse       map[string]bool
+		dryRun      bool
+		wantRemoved []string
+	}{
+		{"noPolicy", GCPolicy{}, nil, nil, false, []string{}},
+		{"maxAge", GCPolicy{MaxAge: 150 * time.Minute}, nil, nil, false, []string{"v1.0.0", "v2.0.0"}},
+		{"maxVersions", GCPolicy{MaxVersions: 2}, nil, nil, false, []string{"v1.0.0", "v2.0.0"}},
+		{"maxSize", GCPolicy{MaxSize: 1}, nil, nil, false, []string{"v1.0.0", "v2.0.0", "v3.0.0"}},
+		{"pinned", GCPolicy{MaxVersions: 2}, []string{"v1.0.0"}, nil, false, []string{"v2.0.0", "v3.0.0"}},
+		{"inUse", GCPolicy{MaxAge: 150 * time.Minute}, nil, map[string]bool{"v1.0.0": true}, false, []string{"v2.0.0"}},
+		{"dryRun", GCPolicy{MaxVersions: 3}, nil, nil, true, []string{"v1.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// v4.0.0 was just used, and is protected by the grace period.
+			r := newTestCache(t, "v1.0.0", "v2.0.0", "v3.0.0", "v4.0.0")
+			setLastUsed(t, r, "v1.0.0", time.Now().Add(-4*time.Hour))
+			setLastUsed(t, r, "v2.0.0", time.Now().Add(-3*time.Hour))
+			setLastUsed(t, r, "v3.0.0", time.Now().Add(-2*time.Hour))
+
+			for _, version := range tt.pinned {
+				if err := r.Pin(version); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := r.Collect(tt.policy, tt.inUse, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Removed, tt.wantRemoved) {
+				t.Errorf("expected %v to be removed, got %v", tt.wantRemoved, result.Removed)
+			}
+			if len(tt.wantRemoved) > 0 && result.FreedBytes == 0 {
+				t.Errorf("expected freed bytes to be reported")
+			}
+
+			for _, version := range []string{"v1.0.0", "v2.0.0", "v3.0.0", "v4.0.0"} {
+				_, err := os.Stat(filepath.Join(r.path, version))
+				removed := os.IsNotExist(err)
+				wantRemoved := !tt.dryRun && contains(tt.wantRemoved, version)
+				if removed != wantRemoved {
+					t.Errorf("version '%s': removed = %v, want %v", version, removed, wantRemoved)
+				}
+			}
+		})
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The directory of the repository where releases are downloaded before being moved in place.
+	STAGING_DIR = ".staging"
+
+	// The directory of a staged release where assets are downloaded before being installed.
+	DOWNLOADS_DIR = ".downloads"
+
+	// The prefix of version directories moved to the staging directory while they are downloaded again. Versions
+	// can't start with a dot, so they don't collide with staged releases.
+	PREVIOUS_PREFIX = ".previous-"
+
+	// The suffix of assets that are still being downloaded.
+	PARTIAL_SUFFIX = ".part"
+
+	// How many times an interrupted transfer is resumed before giving up.
+	MAX_DOWNLOAD_ATTEMPTS = 3
+)
+
+// errUnexpectedStatus is returned when a server refuses a transfer. Such transfers aren't retried.
+var errUnexpectedStatus = errors.New("unexpected status")
+
+// rangeTotal returns the size of the whole asset announced by a Content-Range header, or -1 if unknown.
+func rangeTotal(contentRange string) int64 {
+	if i := strings.LastIndexByte(contentRange, '/'); i >= 0 {
+		if total, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+			return total
+		}
+	}
+	return -1
+}
+
+// contentTotal returns the size of the whole asset announced by a response, or zero if unknown.
+func contentTotal(resp *http.Response, offset int64) int64 {
+	if resp.StatusCode == http.StatusPartialContent {
+		if total := rangeTotal(resp.Header.Get("Content-Range")); total >= 0 {
+			return total
+		}
+	}
+
+	if resp.ContentLength < 0 {
+		return 0
+	}
+	return offset + resp.ContentLength
+}
+
+// remoteSize returns the size of an asset announced by the server, or -1 if unknown.
+func remoteSize(asset *Asset) int64 {
+	resp, err := asset.httpClient().Head(asset.DownloadURL)
+	if err != nil {
+		return -1
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1
+	}
+	return resp.ContentLength
+}
+
+// fetchPartial downloads an asset to partPath, resuming from the bytes already present with a range request.
+func fetchPartial(asset *Asset, partPath string, counter *assetCounter) (err error) {
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, asset.DownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := asset.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			// Start over rather than stitching mismatched ranges together.
+			file.Truncate(0)
+			return fmt.Errorf("unexpected content range '%s' resuming at byte %d", resp.Header.Get("Content-Range"), offset)
+		}
+	case http.StatusOK:
+		// The server ignored the range, the whole file is sent again.
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The previous transfer may have got the whole file before being interrupted. Releases don't always publish
+		// checksums, so the size of the file is checked before assuming it.
+		total := rangeTotal(resp.Header.Get("Content-Range"))
+		if total < 0 {
+			total = remoteSize(asset)
+		}
+		if total == offset {
+			return nil
+		}
+
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		return fmt.Errorf("partial asset has %d bytes but '%s' has %d, restarting its download", offset, asset.DownloadURL, total)
+	default:
+		return fmt.Errorf("%w fetching '%s': %s", errUnexpectedStatus, asset.DownloadURL, resp.Status)
+	}
+
+	counter.start(offset, contentTotal(resp, offset))
+	if _, err := io.Copy(io.MultiWriter(file, counter), resp.Body); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// fetchAsset downloads an asset to downloadPath and verifies it against its expected checksum.
+// Interrupted transfers leave a partial file behind, that the next download resumes.
+func (r *Repository) fetchAsset(tgtAsset *Asset, version, downloadPath, expectedSum string, hasSum bool, counter *assetCounter) (string, int64, error) {
+	partPath := downloadPath + PARTIAL_SUFFIX
+
+	var err error
+	for attempt := 1; attempt <= MAX_DOWNLOAD_ATTEMPTS; attempt++ {
+		r.log.Debugf("downloading asset '%s' (attempt %d/%d)", tgtAsset.FullName, attempt, MAX_DOWNLOAD_ATTEMPTS)
+		if err = fetchPartial(tgtAsset, partPath, counter); err == nil || errors.Is(err, errUnexpectedStatus) {
+			break
+		}
+		r.log.Warnf("download of asset '%s' interrupted: %v", tgtAsset.FullName, err)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	sum, size, err := hashFile(partPath)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if hasSum && sum != expectedSum {
+		err := fmt.Errorf("%w: checksum mismatch for asset '%s', expected %s, got %s", ErrVerification, tgtAsset.FullName, expectedSum, sum)
+		r.quarantine(partPath, version, tgtAsset, err)
+		return "", 0, err
+	}
+
+	if err := os.Rename(partPath, downloadPath); err != nil {
+		return "", 0, err
+	}
+
+	r.log.Infof("downloaded asset '%v'", tgtAsset.FullName)
+	return sum, size, nil
+}
+
+// installAsset installs a downloaded asset to the staging directory. Archives have their executables extracted,
+// other assets are installed as is.
+func (r *Repository) installAsset(tgtAsset *Asset, version, downloadPath, stagingDirectory string) ([]ManifestFile, error) {
+	downloadsDirectory := filepath.Dir(downloadPath)
+
+	if format := tgtAsset.archiveFormat(); format != "" {
+		files, err := extractArchive(format, downloadPath, downloadsDirectory, stagingDirectory)
+		if errors.Is(err, ErrVerification) {
+			r.quarantine(downloadPath, version, tgtAsset, err)
+		}
+		return files, err
+	}
+
+	file, err := os.Open(downloadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	installed, err := installFile(file, downloadsDirectory, stagingDirectory, tgtAsset.Name(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ManifestFile{*installed}, nil
+}
+
+// downloadAsset downloads an asset, verifies it against the release checksums and installs it to the staging directory.
+func (r *Repository) downloadAsset(tgtAsset *Asset, version, stagingDirectory string, sums checksums, counter *assetCounter) (manifestAsset *ManifestAsset, err error) {
+	defer func() {
+		if manifestAsset != nil {
+			counter.finish(manifestAsset.Size, nil)
+		} else {
+			counter.finish(0, err)
+		}
+	}()
+
+	if tgtAsset.DownloadURL == "" || tgtAsset.FullName == "" {
+		r.log.Debugf("skipped asset, missingfilename or url")
+		return nil, nil
+	}
+
+	if !isSafeName(tgtAsset.FullName) {
+		return nil, fmt.Errorf("%w: unsafe asset name '%s'", ErrVerification, tgtAsset.FullName)
+	}
+
+	expectedSum, hasSum := sums[tgtAsset.FullName]
+	if sums != nil && !hasSum {
+		return nil, fmt.Errorf("%w: no checksum published for asset '%s'", ErrVerification, tgtAsset.FullName)
+	}
+
+	downloadsDirectory := filepath.Join(stagingDirectory, DOWNLOADS_DIR)
+	if err := os.MkdirAll(downloadsDirectory, 0755); err != nil {
+		return nil, err
+	}
+	downloadPath := filepath.Join(downloadsDirectory, tgtAsset.FullName)
+
+	// The asset may have been downloaded by a previous attempt that failed before installing it.
+	sum, size, err := hashFile(downloadPath)
+	if err != nil || (hasSum && sum != expectedSum) {
+		os.Remove(downloadPath)
+		if sum, size, err = r.fetchAsset(tgtAsset, version, downloadPath, expectedSum, hasSum, counter); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := r.installAsset(tgtAsset, version, downloadPath, stagingDirectory)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(downloadPath)
+
+	return &ManifestAsset{
+		FullName: tgtAsset.FullName,
+		SHA256:   sum,
+		Size:     size,
+		Files:    files,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package artifact
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A LocalReleaseFetcher fetches releases from a local directory, holding a subdirectory per release.
+type LocalReleaseFetcher struct {
+	root   string
+	client *http.Client
+}
+
+func NewLocalFetcher(root string) (*LocalReleaseFetcher, error) {
+	if root == "" {
+		return nil, fmt.Errorf("local release source has no path")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Assets are served through a file transport, so they are downloaded and resumed like remote ones.
+	transport := &http.Transport{}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir(root)))
+
+	return &LocalReleaseFetcher{
+		root:   root,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (l *LocalReleaseFetcher) String() string {
+	return fmt.Sprintf("local directory '%s'", l.root)
+}
+
+func (l *LocalReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
+	if versionTag == "" || strings.ContainsAny(versionTag, `/\`) || versionTag == "." || versionTag == ".." {
+		return nil, fmt.Errorf("invalid release '%s'", versionTag)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(l.root, versionTag))
+	if err != nil {
+		return nil, fmt.Errorf("release '%s' not found: %w", versionTag, err)
+	}
+
+	var assets []*Asset
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		downloadURL := url.URL{Scheme: "file", Path: "/" + versionTag + "/" + entry.Name()}
+		assets = append(assets, &Asset{FullName: entry.Name(), DownloadURL: downloadURL.String(), client: l.client})
+	}
+
+	return assets, nil
+}
+
+func (l *LocalReleaseFetcher) ListReleases(ctx context.Context) ([]Release, error) {
+	entries, err := os.ReadDir(l.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			releases = append(releases, Release{Version: entry.Name(), Prerelease: isPrerelease(entry.Name())})
+		}
+	}
+
+	return releases, nil
+}
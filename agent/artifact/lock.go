@@ -0,0 +1,43 @@
+package artifact
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// The directory holding the lock files of versions, relative to the repository.
+const LOCKS_DIR = ".locks"
+
+// A fileLock is an exclusive lock on a file, held across processes sharing a repository.
+// Lock files are never removed, removing a lock file while another process waits on it would let a third one
+// take a second lock on a new file.
+type fileLock struct {
+	file *os.File
+}
+
+// acquireFileLock blocks until it holds the lock on a file, creating the file if needed.
+func acquireFileLock(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+func (l *fileLock) release() error {
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,119 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The file marking a version directory as complete. Version directories without one are repaired on use.
+const MANIFEST_FILE = ".manifest.json"
+
+// A ManifestFile is a file installed in a version directory.
+type ManifestFile struct {
+	Name       string `json:"name"`
+	SHA256     string `json:"sha256"`
+	Size       int64  `json:"size"`
+	Executable bool   `json:"executable"`
+}
+
+// A ManifestAsset is a downloaded release asset, along with the files installed from it.
+type ManifestAsset struct {
+	FullName string         `json:"full_name"`
+	SHA256   string         `json:"sha256"`
+	Size     int64          `json:"size"`
+	Files    []ManifestFile `json:"files"`
+}
+
+// A Manifest describes a completely downloaded version.
+type Manifest struct {
+	Version     string          `json:"version"`
+	CompletedAt time.Time       `json:"completed_at"`
+	Verified    bool            `json:"verified"`
+	Assets      []ManifestAsset `json:"assets"`
+}
+
+// Binaries returns the names of the executables provided by a version, sorted.
+func (m *Manifest) Binaries() []string {
+	binaries := []string{}
+	for _, asset := range m.Assets {
+		for _, file := range asset.Files {
+			if file.Executable {
+				binaries = append(binaries, file.Name)
+			}
+		}
+	}
+	sort.Strings(binaries)
+	return binaries
+}
+
+// hashFile returns the hex-encoded SHA-256 checksum and the size of a file.
+func hashFile(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func readManifest(versionDirectory string) (*Manifest, error) {
+	raw, err := os.ReadFile(filepath.Join(versionDirectory, MANIFEST_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// writeManifest replaces the manifest of a version directory atomically.
+func writeManifest(versionDirectory string, manifest *Manifest) error {
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(versionDirectory, MANIFEST_FILE)
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, manifestPath)
+}
+
+// isComplete returns whether a version directory holds a manifest and all the files it lists.
+func isComplete(versionDirectory string) bool {
+	manifest, err := readManifest(versionDirectory)
+	if err != nil {
+		return false
+	}
+
+	for _, asset := range manifest.Assets {
+		for _, file := range asset.Files {
+			info, err := os.Stat(filepath.Join(versionDirectory, file.Name))
+			if err != nil || info.Size() != file.Size {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,83 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The directory of the repository where release sources cache release metadata.
+const METADATA_DIR = ".metadata"
+
+// A metadataEntry is a cached API response, revalidated with its ETag.
+type metadataEntry struct {
+	URL       string          `json:"url"`
+	ETag      string          `json:"etag,omitempty"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	NextPage  int             `json:"next_page,omitempty"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// A metadataCache stores API responses on disk, keyed by URL. A cache without a directory stores nothing.
+type metadataCache struct {
+	dir string
+}
+
+func (c *metadataCache) entryPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// get returns the cached response of a URL, or nil if there is none.
+func (c *metadataCache) get(url string) *metadataEntry {
+	if c.dir == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.entryPath(url))
+	if err != nil {
+		return nil
+	}
+
+	var entry metadataEntry
+	if err := json.Unmarshal(raw, &entry); err != nil || entry.URL != url {
+		// Corrupted entries are overwritten by the next response.
+		return nil
+	}
+	return &entry
+}
+
+// put stores a response, replacing the previous one atomically.
+func (c *metadataCache) put(entry *metadataEntry) error {
+	if c.dir == "" {
+		return nil
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(c.dir, ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(raw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), c.entryPath(entry.URL))
+}
@@ -0,0 +1,112 @@
+package artifact
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The file listing the releases of a mirror, at the root of the mirror.
+const MIRROR_INDEX_FILE = "index.json"
+
+// A MirrorRelease is a release listed in the index of a mirror.
+type MirrorRelease struct {
+	Version string `json:"version"`
+
+	// The file names of the release assets. Assets are served at "<mirror>/<version>/<asset>".
+	Assets []string `json:"assets"`
+
+	// Marks releases that aren't semver prereleases as prereleases.
+	Prerelease bool `json:"prerelease,omitempty"`
+}
+
+// A MirrorIndex lists the releases of a mirror.
+type MirrorIndex struct {
+	Releases []MirrorRelease `json:"releases"`
+}
+
+// A MirrorReleaseFetcher fetches releases from a plain HTTP server publishing an index of its releases.
+type MirrorReleaseFetcher struct {
+	baseURL string
+}
+
+func NewMirrorFetcher(baseURL string) (*MirrorReleaseFetcher, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror url '%s': %v", baseURL, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid mirror url '%s': expected an http or https url", baseURL)
+	}
+
+	return &MirrorReleaseFetcher{baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (m *MirrorReleaseFetcher) String() string {
+	return fmt.Sprintf("mirror '%s'", m.baseURL)
+}
+
+func (m *MirrorReleaseFetcher) getIndex(ctx context.Context) (*MirrorIndex, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.baseURL+"/"+MIRROR_INDEX_FILE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w fetching mirror index: %s", errUnexpectedStatus, resp.Status)
+	}
+
+	var index MirrorIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid mirror index: %v", err)
+	}
+
+	return &index, nil
+}
+
+func (m *MirrorReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
+	index, err := m.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, release := range index.Releases {
+		if release.Version != versionTag {
+			continue
+		}
+
+		assets := make([]*Asset, len(release.Assets))
+		for i, name := range release.Assets {
+			assets[i] = &Asset{
+				FullName:    name,
+				DownloadURL: m.baseURL + "/" + url.PathEscape(versionTag) + "/" + url.PathEscape(name),
+			}
+		}
+		return assets, nil
+	}
+
+	return nil, fmt.Errorf("release '%s' not found", versionTag)
+}
+
+func (m *MirrorReleaseFetcher) ListReleases(ctx context.Context) ([]Release, error) {
+	index, err := m.getIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]Release, len(index.Releases))
+	for i, release := range index.Releases {
+		releases[i] = Release{Version: release.Version, Prerelease: release.Prerelease || isPrerelease(release.Version)}
+	}
+
+	return releases, nil
+}
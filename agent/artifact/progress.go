@@ -0,0 +1,135 @@
+package artifact
+
+import (
+	"sync"
+	"time"
+)
+
+// The state of the install of a version.
+type InstallState string
+
+const (
+	InstallDownloading InstallState = "downloading"
+	InstallInstalled   InstallState = "installed"
+	InstallFailed      InstallState = "failed"
+)
+
+// AssetProgress is the download progress of a release asset.
+type AssetProgress struct {
+	FullName string
+	Bytes    int64
+
+	// The size of the asset, zero until the server announces it.
+	TotalBytes int64
+	Done       bool
+	Error      string
+}
+
+// InstallProgress is the progress of the install of a version.
+type InstallProgress struct {
+	Version string
+	State   InstallState
+
+	// The platform and architecture the assets were selected for. The architecture is empty until the release is
+	// fetched, or if the release has no asset for the platform.
+	Platform     string
+	Architecture string
+	Assets       []AssetProgress
+
+	StartedAt time.Time
+	EndedAt   time.Time
+	Error     string
+}
+
+// An installTracker records the progress of an install while it runs.
+type installTracker struct {
+	mutex    sync.Mutex
+	progress InstallProgress
+}
+
+func newInstallTracker(version string) *installTracker {
+	return &installTracker{progress: InstallProgress{
+		Version:   version,
+		State:     InstallDownloading,
+		Assets:    []AssetProgress{},
+		StartedAt: time.Now().UTC(),
+	}}
+}
+
+// selectAssets records the assets selected for the platform, and returns a counter for each of them.
+func (t *installTracker) selectAssets(platform, architecture string, assets []*Asset) []*assetCounter {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.progress.Platform = platform
+	t.progress.Architecture = architecture
+	t.progress.Assets = make([]AssetProgress, len(assets))
+
+	counters := make([]*assetCounter, len(assets))
+	for i, asset := range assets {
+		t.progress.Assets[i].FullName = asset.FullName
+		counters[i] = &assetCounter{tracker: t, index: i}
+	}
+	return counters
+}
+
+func (t *installTracker) finish(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.progress.EndedAt = time.Now().UTC()
+	if err != nil {
+		t.progress.State = InstallFailed
+		t.progress.Error = err.Error()
+	} else {
+		t.progress.State = InstallInstalled
+	}
+}
+
+func (t *installTracker) snapshot() *InstallProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	snapshot := t.progress
+	snapshot.Assets = append([]AssetProgress{}, t.progress.Assets...)
+	return &snapshot
+}
+
+// An assetCounter records the progress of an asset download. Bytes written to it count as downloaded.
+type assetCounter struct {
+	tracker *installTracker
+	index   int
+}
+
+func (c *assetCounter) update(f func(progress *AssetProgress)) {
+	c.tracker.mutex.Lock()
+	defer c.tracker.mutex.Unlock()
+	f(&c.tracker.progress.Assets[c.index])
+}
+
+// start records a transfer resuming at offset, out of total bytes.
+func (c *assetCounter) start(offset, total int64) {
+	c.update(func(progress *AssetProgress) {
+		progress.Bytes = offset
+		if total > 0 {
+			progress.TotalBytes = total
+		}
+	})
+}
+
+func (c *assetCounter) Write(p []byte) (int, error) {
+	c.update(func(progress *AssetProgress) { progress.Bytes += int64(len(p)) })
+	return len(p), nil
+}
+
+func (c *assetCounter) finish(size int64, err error) {
+	c.update(func(progress *AssetProgress) {
+		if err != nil {
+			progress.Error = err.Error()
+			return
+		}
+		progress.Bytes = size
+		progress.TotalBytes = size
+		progress.Done = true
+	})
+}
@@ -0,0 +1,95 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/go-github/v43/github"
+)
+
+// How many times a GitHub request failing with a transient error is sent before giving up.
+const GITHUB_MAX_ATTEMPTS = 4
+
+// The delay before retrying a failed GitHub request, doubled after every attempt.
+var githubRetryDelay = 500 * time.Millisecond
+
+// ErrRateLimited is returned when a release source refuses requests until its rate limit resets.
+var ErrRateLimited = errors.New("rate limited")
+
+// A RateLimitError is returned when GitHub refuses requests because the rate limit of the agent is exceeded.
+// It matches ErrRateLimited.
+type RateLimitError struct {
+	// The number of requests allowed per hour, zero if unknown.
+	Limit int
+
+	// When requests are allowed again, zero if unknown.
+	Reset time.Time
+
+	// Whether requests were authenticated with a token. Unauthenticated requests have a much lower limit.
+	Authenticated bool
+}
+
+func (e *RateLimitError) Error() string {
+	msg := "github rate limit exceeded"
+	if e.Limit > 0 {
+		msg += fmt.Sprintf(" (%d requests per hour)", e.Limit)
+	}
+	if !e.Reset.IsZero() {
+		msg += fmt.Sprintf(", requests are allowed again at %s", e.Reset.UTC().Format(time.RFC3339))
+	}
+	if !e.Authenticated {
+		msg += ", configure a github token to raise the limit"
+	}
+	return msg
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// RetryAfter returns how long to wait before sending requests again, zero if unknown.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	if e.Reset.IsZero() {
+		return 0
+	}
+	return time.Until(e.Reset)
+}
+
+// githubError turns the rate limit errors of the GitHub client into a RateLimitError.
+func githubError(err error, authenticated bool) error {
+	var rateErr *github.RateLimitError
+	if errors.As(err, &rateErr) {
+		return &RateLimitError{Limit: rateErr.Rate.Limit, Reset: rateErr.Rate.Reset.Time, Authenticated: authenticated}
+	}
+
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		limitErr := &RateLimitError{Authenticated: authenticated}
+		if abuseErr.RetryAfter != nil {
+			limitErr.Reset = time.Now().Add(*abuseErr.RetryAfter)
+		}
+		return limitErr
+	}
+
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) && respErr.Response != nil && respErr.Response.StatusCode == http.StatusTooManyRequests {
+		return &RateLimitError{Authenticated: authenticated}
+	}
+
+	return err
+}
+
+// isTransient returns whether a failed GitHub request is worth sending again.
+func isTransient(err error) bool {
+	var respErr *github.ErrorResponse
+	if errors.As(err, &respErr) {
+		return respErr.Response != nil && respErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -1,7 +1,15 @@
 package artifact
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/google/go-github/v43/github"
 )
@@ -9,21 +17,120 @@ import (
 // A MenmosReleaseFetcher fetches a given release from the menmos repository.
 type MenmosReleaseFetcher interface {
 	GetRelease(context context.Context, versionTag string) ([]*Asset, error)
+
+	// ListReleases returns the releases available from the fetcher, in no particular order.
+	ListReleases(context context.Context) ([]Release, error)
+}
+
+type GithubFetcherParams struct {
+	// Requests are anonymous if no token is set, with a much lower rate limit.
+	Token string
+
+	// The URL of the GitHub API, e.g. "https://github.example.com/api/v3/". Defaults to api.github.com.
+	BaseURL string
+
+	// The directory where release metadata is cached. Metadata isn't cached if empty.
+	CacheDir string
 }
 
+// A GithubReleaseFetcher fetches releases of the menmos repository on GitHub.
+// Responses are cached on disk and revalidated with their ETag, unchanged responses don't count against the rate limit.
+// Cached responses are used while the rate limit is exceeded.
 type GithubReleaseFetcher struct {
-	client *github.Client
+	client        *github.Client
+	authenticated bool
+	cache         *metadataCache
 }
 
-func NewGithubFetcher(token string) *GithubReleaseFetcher {
+func NewGithubFetcher(params GithubFetcherParams) (*GithubReleaseFetcher, error) {
+	client := getGithubClient(params.Token)
+	if params.BaseURL != "" {
+		baseURL, err := url.Parse(params.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid github url '%s': %v", params.BaseURL, err)
+		}
+		if !strings.HasSuffix(baseURL.Path, "/") {
+			baseURL.Path += "/"
+		}
+		client.BaseURL = baseURL
+	}
+
 	return &GithubReleaseFetcher{
-		client: getGithubClient(token),
+		client:        client,
+		authenticated: params.Token != "",
+		cache:         &metadataCache{dir: params.CacheDir},
+	}, nil
+}
+
+func (g *GithubReleaseFetcher) String() string {
+	return "github"
+}
+
+// do sends a request, retrying transient failures with an exponential backoff.
+func (g *GithubReleaseFetcher) do(ctx context.Context, req *http.Request) (*github.Response, []byte, error) {
+	delay := githubRetryDelay
+	for attempt := 1; ; attempt++ {
+		var body bytes.Buffer
+		resp, err := g.client.Do(ctx, req, &body)
+		if err == nil {
+			return resp, body.Bytes(), nil
+		}
+
+		err = githubError(err, g.authenticated)
+		if attempt == GITHUB_MAX_ATTEMPTS || !isTransient(err) {
+			return resp, nil, err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		delay *= 2
 	}
 }
 
-func (g *GithubReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
-	release, _, err := g.client.Repositories.GetReleaseByTag(ctx, "menmos", "menmos", versionTag)
+// get fetches an API path into v, and returns the next page of the response.
+func (g *GithubReleaseFetcher) get(ctx context.Context, urlStr string, v interface{}) (int, error) {
+	req, err := g.client.NewRequest(http.MethodGet, urlStr, nil)
 	if err != nil {
+		return 0, err
+	}
+
+	key := req.URL.String()
+	entry := g.cache.get(key)
+	if entry != nil && entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+
+	resp, body, err := g.do(ctx, req)
+	switch {
+	case err == nil:
+		entry = &metadataEntry{
+			URL:       key,
+			ETag:      resp.Header.Get("ETag"),
+			FetchedAt: time.Now().UTC(),
+			NextPage:  resp.NextPage,
+			Body:      body,
+		}
+		// The cache only saves requests, responses are used even if they can't be cached.
+		g.cache.put(entry)
+	case entry != nil && resp != nil && resp.StatusCode == http.StatusNotModified:
+	case entry != nil && errors.Is(err, ErrRateLimited):
+		// Releases rarely change, a stale response is better than no response.
+	default:
+		return 0, err
+	}
+
+	if err := json.Unmarshal(entry.Body, v); err != nil {
+		return 0, fmt.Errorf("invalid github response for '%s': %v", urlStr, err)
+	}
+	return entry.NextPage, nil
+}
+
+func (g *GithubReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
+	var release github.RepositoryRelease
+	if _, err := g.get(ctx, "repos/menmos/menmos/releases/tags/"+url.PathEscape(versionTag), &release); err != nil {
 		return nil, err
 	}
 
@@ -34,3 +141,28 @@ func (g *GithubReleaseFetcher) GetRelease(ctx context.Context, versionTag string
 
 	return assets, nil
 }
+
+func (g *GithubReleaseFetcher) ListReleases(ctx context.Context) ([]Release, error) {
+	var releases []Release
+
+	page := 1
+	for {
+		var pageReleases []*github.RepositoryRelease
+		nextPage, err := g.get(ctx, fmt.Sprintf("repos/menmos/menmos/releases?per_page=100&page=%d", page), &pageReleases)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, release := range pageReleases {
+			if release.GetDraft() {
+				continue
+			}
+			releases = append(releases, Release{Version: release.GetTagName(), Prerelease: release.GetPrerelease()})
+		}
+
+		if nextPage == 0 {
+			return releases, nil
+		}
+		page = nextPage
+	}
+}
@@ -0,0 +1,230 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A githubStandIn serves the releases of the menmos repository like the GitHub API.
+type githubStandIn struct {
+	mutex       sync.Mutex
+	requests    map[string]int
+	notModified int
+
+	// Each request fails with this status while set.
+	failures   int
+	failStatus int
+
+	rateLimited bool
+	reset       time.Time
+}
+
+func (g *githubStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.requests[r.URL.Path]++
+
+	if g.rateLimited {
+		w.Header().Set("X-RateLimit-Limit", "60")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(g.reset.Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+		return
+	}
+
+	if g.failures > 0 {
+		g.failures--
+		w.WriteHeader(g.failStatus)
+		return
+	}
+
+	var body string
+	switch r.URL.Path {
+	case "/repos/menmos/menmos/releases/tags/v0.2.0":
+		body = `{"tag_name": "v0.2.0", "assets": [{"name": "menmosd-linux-amd64", "browser_download_url": "https://example.com/menmosd"}]}`
+	case "/repos/menmos/menmos/releases":
+		if r.URL.Query().Get("page") == "2" {
+			body = `[{"tag_name": "v0.1.0"}, {"tag_name": "v0.3.0", "draft": true}]`
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s/repos/menmos/menmos/releases?per_page=100&page=2>; rel="next"`, r.Host))
+			body = `[{"tag_name": "v0.2.0"}, {"tag_name": "v0.3.0-rc.1", "prerelease": true}]`
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, len(body))
+	if r.Header.Get("If-None-Match") == etag {
+		g.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, body)
+}
+
+func (g *githubStandIn) Requests(path string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.requests[path]
+}
+
+func newGithubStandIn(t *testing.T) (*githubStandIn, *httptest.Server) {
+	t.Helper()
+
+	standIn := &githubStandIn{requests: make(map[string]int)}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	delay := githubRetryDelay
+	githubRetryDelay = time.Millisecond
+	t.Cleanup(func() { githubRetryDelay = delay })
+
+	return standIn, server
+}
+
+func newTestGithubFetcher(t *testing.T, server *httptest.Server, cacheDir string) *GithubReleaseFetcher {
+	t.Helper()
+
+	fetcher, err := NewGithubFetcher(GithubFetcherParams{BaseURL: server.URL, CacheDir: cacheDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetcher
+}
+
+func TestGithubReleaseFetcher(t *testing.T) {
+	_, server := newGithubStandIn(t)
+	fetcher := newTestGithubFetcher(t, server, t.TempDir())
+
+	assets, err := fetcher.GetRelease(context.Background(), "v0.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].FullName != "menmosd-linux-amd64" || assets[0].DownloadURL != "https://example.com/menmosd" {
+		t.Errorf("unexpected assets: %+v", assets)
+	}
+
+	assertSourceLists(t, fetcher,
+		Release{Version: "v0.1.0"},
+		Release{Version: "v0.2.0"},
+		Release{Version: "v0.3.0-rc.1", Prerelease: true},
+	)
+
+	if _, err := fetcher.GetRelease(context.Background(), "v9.9.9"); err == nil {
+		t.Error("expected an error getting a missing release")
+	}
+}
+
+func TestGithubReleaseFetcher_Cache(t *testing.T) {
+	standIn, server := newGithubStandIn(t)
+	cacheDir := t.TempDir()
+
+	for i := 0; i < 3; i++ {
+		// Responses are cached on disk, so they are revalidated by later agents too.
+		fetcher := newTestGithubFetcher(t, server, cacheDir)
+		if _, err := fetcher.GetRelease(context.Background(), "v0.2.0"); err != nil {
+			t.Fatal(err)
+		}
+		assertSourceLists(t, fetcher,
+			Release{Version: "v0.1.0"},
+			Release{Version: "v0.2.0"},
+			Release{Version: "v0.3.0-rc.1", Prerelease: true},
+		)
+	}
+
+	// The release and both pages of the listing are fetched once, and revalidated twice.
+	if standIn.notModified != 6 {
+		t.Errorf("expected 6 responses to be revalidated, got %d", standIn.notModified)
+	}
+}
+
+func TestGithubReleaseFetcher_RateLimit(t *testing.T) {
+	standIn, server := newGithubStandIn(t)
+	fetcher := newTestGithubFetcher(t, server, t.TempDir())
+
+	if _, err := fetcher.GetRelease(context.Background(), "v0.2.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	standIn.mutex.Lock()
+	standIn.rateLimited = true
+	standIn.reset = time.Now().Add(time.Hour)
+	standIn.mutex.Unlock()
+
+	// Cached releases are still served.
+	assets, err := fetcher.GetRelease(context.Background(), "v0.2.0")
+	if err != nil {
+		t.Fatalf("expected the cached release to be served: %v", err)
+	}
+	if len(assets) != 1 {
+		t.Errorf("unexpected assets: %+v", assets)
+	}
+
+	_, err = fetcher.GetRelease(context.Background(), "v0.1.0")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) {
+		t.Fatalf("expected a RateLimitError, got %T", err)
+	}
+	if rateErr.Limit != 60 || rateErr.Authenticated || rateErr.Reset.Unix() != standIn.reset.Unix() {
+		t.Errorf("unexpected rate limit error: %+v", rateErr)
+	}
+	if rateErr.RetryAfter() <= 0 {
+		t.Errorf("expected a positive retry delay, got %v", rateErr.RetryAfter())
+	}
+
+	// Requests aren't sent again before the rate limit resets.
+	requests := standIn.Requests("/repos/menmos/menmos/releases/tags/v0.1.0")
+	if _, err := fetcher.GetRelease(context.Background(), "v0.1.0"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected a rate limit error, got %v", err)
+	}
+	if got := standIn.Requests("/repos/menmos/menmos/releases/tags/v0.1.0"); got != requests {
+		t.Errorf("expected no request to be sent while rate limited, got %d more", got-requests)
+	}
+}
+
+func TestGithubReleaseFetcher_Retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		failStatus   int
+		wantErr      bool
+		wantRequests int
+	}{
+		{"transientFailures", 2, http.StatusBadGateway, false, 3},
+		{"persistentFailures", GITHUB_MAX_ATTEMPTS, http.StatusServiceUnavailable, true, GITHUB_MAX_ATTEMPTS},
+		{"permanentFailure", 1, http.StatusUnauthorized, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standIn, server := newGithubStandIn(t)
+			standIn.failures = tt.failures
+			standIn.failStatus = tt.failStatus
+
+			fetcher := newTestGithubFetcher(t, server, "")
+			if _, err := fetcher.GetRelease(context.Background(), "v0.2.0"); (err != nil) != tt.wantErr {
+				t.Errorf("GetRelease() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := standIn.Requests("/repos/menmos/menmos/releases/tags/v0.2.0"); got != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, got)
+			}
+		})
+	}
+}
@@ -2,13 +2,14 @@ package artifact
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -17,19 +18,58 @@ type RepositoryParams struct {
 	ReleaseFetcher MenmosReleaseFetcher
 	Log            *zap.Logger
 	Path           string
+
+	// If set, the checksum file of a release must be signed by one of these keys.
+	PublicKeys []ed25519.PublicKey
+
+	// Allows using releases that publish no checksum file. Their assets are used unverified.
+	AllowUnverified bool
+
+	// If set, exported bundles are signed with this key.
+	SigningKey ed25519.PrivateKey
 }
 
 type Repository struct {
-	releaseFetcher MenmosReleaseFetcher
-	log            *zap.SugaredLogger
-	path           string
+	releaseFetcher  MenmosReleaseFetcher
+	log             *zap.SugaredLogger
+	path            string
+	publicKeys      []ed25519.PublicKey
+	allowUnverified bool
+	signingKey      ed25519.PrivateKey
+
+	// Guards the cache state file.
+	stateMutex sync.Mutex
+
+	// The last install of each version. Concurrent requests of a version share the install in progress.
+	installsMutex sync.Mutex
+	installs      map[string]*install
+}
+
+// An install of a version, shared by every caller requesting the version while it runs.
+type install struct {
+	done     chan struct{}
+	err      error
+	progress *installTracker
+}
+
+func (i *install) finished() bool {
+	select {
+	case <-i.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func NewRepository(params RepositoryParams) *Repository {
 	return &Repository{
-		releaseFetcher: params.ReleaseFetcher,
-		log:            params.Log.Sugar().Named("artifacts"),
-		path:           params.Path,
+		releaseFetcher:  params.ReleaseFetcher,
+		log:             params.Log.Sugar().Named("artifacts"),
+		path:            params.Path,
+		publicKeys:      params.PublicKeys,
+		allowUnverified: params.AllowUnverified,
+		signingKey:      params.SigningKey,
+		installs:        make(map[string]*install),
 	}
 }
 
@@ -63,37 +103,8 @@ func (r *Repository) doesArtifactExist(path string) (bool, error) {
 	return true, nil
 }
 
-func (r *Repository) downloadAsset(tgtAsset *Asset, versionDirectory string) error {
-
-	if tgtAsset.DownloadURL == "" || tgtAsset.FullName == "" {
-		r.log.Debugf("skipped asset, missingfilename or url")
-		return nil
-	}
-
-	r.log.Debugf("downloading asset '%s'", tgtAsset.FullName)
-
-	assetPath := filepath.Join(versionDirectory, tgtAsset.Name())
-	assetFile, err := os.OpenFile(assetPath, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.Get(tgtAsset.DownloadURL)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(assetFile, resp.Body)
-	if err != nil {
-		return err
-	}
-
-	r.log.Infof("downloaded asset '%v'", tgtAsset.FullName)
-	return nil
-}
-
-func (r *Repository) getPlatformAssets(assets []*Asset) []*Asset {
+// getPlatformAssets returns the assets of the host platform, along with the architecture they were selected for.
+func (r *Repository) getPlatformAssets(assets []*Asset) ([]*Asset, string) {
 	validArchitectures := []string{runtime.GOARCH}
 	if runtime.GOOS == "darwin" {
 		// Hack to support M1 macs, they _can_ use amd64 via rosetta
@@ -112,51 +123,331 @@ func (r *Repository) getPlatformAssets(assets []*Asset) []*Asset {
 
 		if len(archAssets) > 0 {
 			r.log.Debugf("got %d platform assets", len(archAssets))
-			return archAssets
+			return archAssets, arch
 		}
 	}
 
-	return []*Asset{}
+	return []*Asset{}, ""
 }
 
-func (r *Repository) downloadRelease(version string) error {
-	assets, err := r.releaseFetcher.GetRelease(context.Background(), version)
+// downloadRelease downloads the platform assets of a release to a staging directory, and moves the directory
+// in place once all assets are downloaded and verified.
+func (r *Repository) downloadRelease(version string, fetcher MenmosReleaseFetcher, progress *installTracker) error {
+	assets, err := fetcher.GetRelease(context.Background(), version)
 	if err != nil {
 		return err
 
 	}
-	r.log.Debugf("got github release for '%s'", version)
+	r.log.Debugf("got release for '%s'", version)
 
-	versionDirectory := filepath.Join(r.path, version)
-	if err := os.MkdirAll(versionDirectory, 0755); err != nil {
+	sums, err := r.fetchChecksums(version, assets)
+	if err != nil {
 		return err
 	}
 
+	stagingDirectory := filepath.Join(r.path, STAGING_DIR, version)
+	if err := os.MkdirAll(stagingDirectory, 0755); err != nil {
+		return err
+	}
+
+	platformAssets, architecture := r.getPlatformAssets(assets)
+	counters := progress.selectAssets(runtime.GOOS, architecture, platformAssets)
+
 	var wg sync.WaitGroup
-	for _, currentAsset := range r.getPlatformAssets(assets) {
+	var mutex sync.Mutex
+	var downloadErr, verificationErr error
+	manifestAssets := make([]*ManifestAsset, len(platformAssets))
+	for i, currentAsset := range platformAssets {
 		wg.Add(1)
-		go func(currentAsset *Asset) {
-			if err := r.downloadAsset(currentAsset, versionDirectory); err != nil {
+		go func(i int, currentAsset *Asset) {
+			defer wg.Done()
+			manifestAsset, err := r.downloadAsset(currentAsset, version, stagingDirectory, sums, counters[i])
+			if err != nil {
 				r.log.Errorf("failed to download asset '%s': %v", currentAsset.Name(), err.Error())
+
+				mutex.Lock()
+				if errors.Is(err, ErrVerification) {
+					verificationErr = err
+				} else {
+					downloadErr = err
+				}
+				mutex.Unlock()
+				return
 			}
-			wg.Done()
-		}(currentAsset)
+			manifestAssets[i] = manifestAsset
+		}(i, currentAsset)
 	}
 
 	wg.Wait()
 
-	return nil
+	if verificationErr != nil {
+		// A release with a single bad asset can't be trusted, none of its assets are kept.
+		os.RemoveAll(stagingDirectory)
+		return verificationErr
+	}
+
+	if downloadErr != nil {
+		// The staging directory is kept, so the next download resumes where this one stopped.
+		return fmt.Errorf("failed to download release '%s': %w", version, downloadErr)
+	}
+
+	manifest := Manifest{
+		Version:     version,
+		CompletedAt: time.Now().UTC(),
+		Verified:    sums != nil,
+		Assets:      []ManifestAsset{},
+	}
+	installedBy := make(map[string]string)
+	for _, manifestAsset := range manifestAssets {
+		if manifestAsset == nil {
+			continue
+		}
+
+		for _, file := range manifestAsset.Files {
+			if other, ok := installedBy[file.Name]; ok {
+				return fmt.Errorf("assets '%s' and '%s' of release '%s' both provide '%s'", other, manifestAsset.FullName, version, file.Name)
+			}
+			installedBy[file.Name] = manifestAsset.FullName
+		}
+		manifest.Assets = append(manifest.Assets, *manifestAsset)
+	}
+
+	if err := os.RemoveAll(filepath.Join(stagingDirectory, DOWNLOADS_DIR)); err != nil {
+		return err
+	}
+	if err := writeManifest(stagingDirectory, &manifest); err != nil {
+		return err
+	}
+
+	r.log.Infof("installed release '%s', providing %v", version, manifest.Binaries())
+	return os.Rename(stagingDirectory, filepath.Join(r.path, version))
+}
+
+// Binaries returns the executables provided by an installed version.
+func (r *Repository) Binaries(version string) ([]string, error) {
+	manifest, err := readManifest(filepath.Join(r.path, version))
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Binaries(), nil
+}
+
+// installVersion downloads a version unless it is already installed, repairing incomplete versions.
+// It holds the lock of the version, so agents sharing the repository don't download the same version at once.
+func (r *Repository) installVersion(version string, progress *installTracker) error {
+	lock, err := acquireFileLock(filepath.Join(r.path, LOCKS_DIR, version))
+	if err != nil {
+		return fmt.Errorf("failed to lock version '%s': %w", version, err)
+	}
+	defer lock.release()
+
+	// Another agent may have installed the version while we waited for the lock.
+	versionDir := filepath.Join(r.path, version)
+	previousDir := filepath.Join(r.path, STAGING_DIR, PREVIOUS_PREFIX+version)
+	if err := r.restorePrevious(versionDir, previousDir); err != nil {
+		return err
+	}
+
+	exists, err := r.doesDirectoryExist(versionDir)
+	if err != nil {
+		return err
+	}
+
+	if exists && isComplete(versionDir) {
+		return nil
+	}
+
+	if exists {
+		if _, err := os.Stat(filepath.Join(versionDir, MANIFEST_FILE)); os.IsNotExist(err) {
+			// Installed by a version of the agent predating manifests.
+			adopted, err := r.adoptLegacyVersion(version, versionDir)
+			if err != nil {
+				r.log.Warnf("failed to adopt version directory '%s': %v", versionDir, err)
+			}
+			if adopted {
+				return nil
+			}
+		}
+
+		// The directory is only removed once the version is downloaded again, it may be the only copy of the version
+		// an offline agent has.
+		r.log.Warnf("version directory '%s' is incomplete, repairing it", versionDir)
+		if err := os.MkdirAll(filepath.Dir(previousDir), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(versionDir, previousDir); err != nil {
+			return err
+		}
+	}
+
+	if err := r.downloadRelease(version, r.releaseFetcher, progress); err != nil {
+		if restoreErr := r.restorePrevious(versionDir, previousDir); restoreErr != nil {
+			r.log.Errorf("failed to restore version directory '%s': %v", versionDir, restoreErr)
+		}
+		return err
+	}
+
+	return os.RemoveAll(previousDir)
+}
+
+// restorePrevious moves back a version directory that was moved aside to be repaired, unless the version was
+// installed since.
+func (r *Repository) restorePrevious(versionDir, previousDir string) error {
+	if exists, err := r.doesDirectoryExist(previousDir); err != nil || !exists {
+		return err
+	}
+
+	if exists, err := r.doesDirectoryExist(versionDir); err != nil {
+		return err
+	} else if exists {
+		return os.RemoveAll(previousDir)
+	}
+
+	return os.Rename(previousDir, versionDir)
+}
+
+// adoptLegacyVersion writes the manifest of a version directory installed before manifests existed, once its
+// assets are found complete. The assets are verified against the release checksums when it publishes some.
+// It returns whether the directory was adopted.
+func (r *Repository) adoptLegacyVersion(version, versionDir string) (bool, error) {
+	assets, err := r.releaseFetcher.GetRelease(context.Background(), version)
+	if err != nil {
+		return false, err
+	}
+
+	sums, err := r.fetchChecksums(version, assets)
+	if err != nil {
+		return false, err
+	}
+
+	manifest := Manifest{
+		Version:     version,
+		CompletedAt: time.Now().UTC(),
+		Verified:    sums != nil,
+		Assets:      []ManifestAsset{},
+	}
+
+	platformAssets, _ := r.getPlatformAssets(assets)
+	for _, currentAsset := range platformAssets {
+		if currentAsset.DownloadURL == "" || currentAsset.FullName == "" {
+			continue
+		}
+
+		// Older agents stored every asset as is, archives included.
+		if currentAsset.archiveFormat() != "" {
+			return false, fmt.Errorf("asset '%s' wasn't extracted", currentAsset.FullName)
+		}
+
+		sum, size, err := hashFile(filepath.Join(versionDir, currentAsset.Name()))
+		if err != nil {
+			return false, err
+		}
+
+		if sums != nil {
+			expectedSum, hasSum := sums[currentAsset.FullName]
+			if !hasSum {
+				return false, fmt.Errorf("%w: no checksum published for asset '%s'", ErrVerification, currentAsset.FullName)
+			}
+			if sum != expectedSum {
+				return false, fmt.Errorf("%w: checksum mismatch for asset '%s'", ErrVerification, currentAsset.FullName)
+			}
+		}
+
+		manifest.Assets = append(manifest.Assets, ManifestAsset{
+			FullName: currentAsset.FullName,
+			SHA256:   sum,
+			Size:     size,
+			Files:    []ManifestFile{{Name: currentAsset.Name(), SHA256: sum, Size: size, Executable: true}},
+		})
+	}
+
+	if len(manifest.Assets) == 0 {
+		return false, fmt.Errorf("release '%s' has no asset for this platform", version)
+	}
+
+	if err := writeManifest(versionDir, &manifest); err != nil {
+		return false, err
+	}
+
+	r.log.Infof("adopted version directory '%s', providing %v", versionDir, manifest.Binaries())
+	return true, nil
+}
+
+// startInstall returns the install of a version in progress, starting one in the background if there is none.
+func (r *Repository) startInstall(version string) *install {
+	r.installsMutex.Lock()
+	defer r.installsMutex.Unlock()
+
+	if current, ok := r.installs[version]; ok && !current.finished() {
+		r.log.Debugf("joining the install of version '%s' in progress", version)
+		return current
+	}
+
+	current := &install{done: make(chan struct{}), progress: newInstallTracker(version)}
+	r.installs[version] = current
+
+	go func() {
+		current.err = r.installVersion(version, current.progress)
+		current.progress.finish(current.err)
+		close(current.done)
+	}()
+
+	return current
+}
+
+// ensureInstalled installs a version, or waits for the install already in progress and shares its result.
+func (r *Repository) ensureInstalled(version string) error {
+	current := r.startInstall(version)
+	<-current.done
+	return current.err
+}
+
+// Prefetch starts installing a version in the background, unless it is already installed.
+// It returns whether an install is running.
+func (r *Repository) Prefetch(version string) (bool, error) {
+	if !isSafeName(version) {
+		return false, fmt.Errorf("invalid version '%s'", version)
+	}
+
+	versionDir := filepath.Join(r.path, version)
+	exists, err := r.doesDirectoryExist(versionDir)
+	if err != nil {
+		return false, err
+	}
+	if exists && isComplete(versionDir) {
+		return false, nil
+	}
+
+	r.startInstall(version)
+	return true, nil
+}
+
+// Progress returns the progress of the last install of a version, or nil if the version wasn't installed
+// since the repository was opened.
+func (r *Repository) Progress(version string) *InstallProgress {
+	r.installsMutex.Lock()
+	current, ok := r.installs[version]
+	r.installsMutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return current.progress.snapshot()
 }
 
 func (r *Repository) Get(version, name string) (string, error) {
+	if !isSafeName(version) {
+		return "", fmt.Errorf("invalid version '%s'", version)
+	}
+
 	versionDir := filepath.Join(r.path, version)
 	exists, err := r.doesDirectoryExist(versionDir)
 	if err != nil {
 		return "", err
 	}
 
-	if !exists {
-		if err := r.downloadRelease(version); err != nil {
+	if !exists || !isComplete(versionDir) {
+		if err := r.ensureInstalled(version); err != nil {
 			return "", err
 		}
 	}
@@ -170,8 +461,10 @@ func (r *Repository) Get(version, name string) (string, error) {
 	}
 
 	if exists {
+		r.touch(version)
 		return artifactPath, nil
 	} else {
-		return "", fmt.Errorf("artifact '%s' does not exist for version '%s'", name, version)
+		binaries, _ := r.Binaries(version)
+		return "", fmt.Errorf("artifact '%s' does not exist for version '%s', it provides %v", name, version, binaries)
 	}
 }
@@ -1,15 +1,27 @@
 package artifact_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/menmos/menmos-agent/agent/artifact"
 	"go.uber.org/zap"
@@ -18,36 +30,160 @@ import (
 type mockReleaseFetcher struct {
 	Releases map[string][]*artifact.Asset
 	ts       *httptest.Server
+
+	mutex      sync.Mutex
+	checksums  map[string][]byte
+	signatures map[string][]byte
+	tampered   map[string]bool
+	missing    map[string]bool
+
+	// Number of upcoming requests of an asset that are cut short, by URL path.
+	interrupted map[string]int
+
+	// Range headers of the requests of each asset, by URL path.
+	ranges map[string][]string
+
+	// Number of release listings.
+	listings int
+
+	// Delay before serving each request, in nanoseconds.
+	latency int64
 }
 
 func newMockFetcher(versions ...string) *mockReleaseFetcher {
 	fetcher := mockReleaseFetcher{
-		Releases: make(map[string][]*artifact.Asset),
+		Releases:   make(map[string][]*artifact.Asset),
+		checksums:  make(map[string][]byte),
+		signatures: make(map[string][]byte),
+		tampered:   make(map[string]bool),
+		missing:    make(map[string]bool),
+
+		interrupted: make(map[string]int),
+		ranges:      make(map[string][]string),
 	}
 
 	fetcher.ts = httptest.NewServer(http.HandlerFunc(fetcher.serveAsset))
 
 	for _, version := range versions {
 		var assets []*artifact.Asset
+		var sums bytes.Buffer
 		for _, plat := range []string{"linux", "darwin", "windows"} {
 			for _, arch := range []string{"amd64", "arm", "arm64"} {
 				fullName := fmt.Sprintf("myapp-%s-%s", plat, arch)
-				assets = append(assets, &artifact.Asset{FullName: fullName, DownloadURL: fetcher.ts.URL + fmt.Sprintf("/%s/%s", version, fullName)})
+				assets = append(assets, &artifact.Asset{FullName: fullName, DownloadURL: fetcher.assetURL(version, fullName)})
+
+				// Assets contain their URL path, the checksum file lists the matching sums.
+				sum := sha256.Sum256([]byte(fmt.Sprintf("/%s/%s", version, fullName)))
+				fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(sum[:]), fullName)
 			}
 
 		}
 
+		assets = append(assets, &artifact.Asset{FullName: artifact.CHECKSUM_FILE, DownloadURL: fetcher.assetURL(version, artifact.CHECKSUM_FILE)})
+		fetcher.checksums[version] = sums.Bytes()
 		fetcher.Releases[version] = assets
 	}
 
 	return &fetcher
 }
 
+func (f *mockReleaseFetcher) assetURL(version, fullName string) string {
+	return f.ts.URL + fmt.Sprintf("/%s/%s", version, fullName)
+}
+
 func (f *mockReleaseFetcher) serveAsset(w http.ResponseWriter, r *http.Request) {
-	// We write the URL path directly in the response. This allows the test
-	// to see what artifact was requested.
-	w.Write([]byte(r.URL.Path))
-	w.WriteHeader(http.StatusOK)
+	time.Sleep(time.Duration(atomic.LoadInt64(&f.latency)))
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	version, name := path.Split(r.URL.Path)
+	version = strings.Trim(version, "/")
+
+	if f.missing[r.URL.Path] {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch name {
+	case artifact.CHECKSUM_FILE:
+		w.Write(f.checksums[version])
+	case artifact.SIGNATURE_FILE:
+		w.Write(f.signatures[version])
+	default:
+		// We write the URL path directly in the response. This allows the test
+		// to see what artifact was requested.
+		content := []byte(r.URL.Path)
+		if f.tampered[r.URL.Path] {
+			content = append([]byte("tampered"), content...)
+		}
+
+		f.ranges[r.URL.Path] = append(f.ranges[r.URL.Path], r.Header.Get("Range"))
+
+		if f.interrupted[r.URL.Path] > 0 {
+			// Announce the whole asset but only send half of it.
+			f.interrupted[r.URL.Path] -= 1
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:len(content)/2])
+			return
+		}
+
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// SetLatency delays the transfers of every asset.
+func (f *mockReleaseFetcher) SetLatency(latency time.Duration) {
+	atomic.StoreInt64(&f.latency, int64(latency))
+}
+
+// Interrupt cuts the next transfers of an asset short.
+func (f *mockReleaseFetcher) Interrupt(version, fullName string, times int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.interrupted[fmt.Sprintf("/%s/%s", version, fullName)] = times
+}
+
+// Ranges returns the range headers of the requests of an asset.
+func (f *mockReleaseFetcher) Ranges(version, fullName string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.ranges[fmt.Sprintf("/%s/%s", version, fullName)]...)
+}
+
+// Tamper makes the server return altered contents for an asset.
+func (f *mockReleaseFetcher) Tamper(version, fullName string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tampered[fmt.Sprintf("/%s/%s", version, fullName)] = true
+}
+
+// Remove makes the server answer 404 for an asset that is still listed in the release.
+func (f *mockReleaseFetcher) Remove(version, fullName string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.missing[fmt.Sprintf("/%s/%s", version, fullName)] = true
+}
+
+// RemoveChecksums removes the checksum file from a release.
+func (f *mockReleaseFetcher) RemoveChecksums(version string) {
+	var assets []*artifact.Asset
+	for _, asset := range f.Releases[version] {
+		if asset.FullName != artifact.CHECKSUM_FILE {
+			assets = append(assets, asset)
+		}
+	}
+	f.Releases[version] = assets
+}
+
+// Sign publishes a signature of the checksum file of a release.
+func (f *mockReleaseFetcher) Sign(version string, key ed25519.PrivateKey) {
+	f.mutex.Lock()
+	f.signatures[version] = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, f.checksums[version])))
+	f.mutex.Unlock()
+
+	f.Releases[version] = append(f.Releases[version], &artifact.Asset{FullName: artifact.SIGNATURE_FILE, DownloadURL: f.assetURL(version, artifact.SIGNATURE_FILE)})
 }
 
 func (f *mockReleaseFetcher) GetRelease(ctx context.Context, version string) ([]*artifact.Asset, error) {
@@ -58,10 +194,41 @@ func (f *mockReleaseFetcher) GetRelease(ctx context.Context, version string) ([]
 	}
 }
 
+func (f *mockReleaseFetcher) ListReleases(ctx context.Context) ([]artifact.Release, error) {
+	f.mutex.Lock()
+	f.listings += 1
+	f.mutex.Unlock()
+
+	var releases []artifact.Release
+	for version := range f.Releases {
+		releases = append(releases, artifact.Release{Version: version, Prerelease: strings.Contains(version, "-")})
+	}
+	return releases, nil
+}
+
+func (f *mockReleaseFetcher) Listings() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.listings
+}
+
 func (f *mockReleaseFetcher) Close() {
 	f.ts.Close()
 }
 
+func newTestRepository(t *testing.T, fetcher *mockReleaseFetcher, dir string, keys ...ed25519.PublicKey) *artifact.Repository {
+	return artifact.NewRepository(artifact.RepositoryParams{
+		ReleaseFetcher: fetcher,
+		Log:            zap.NewNop(),
+		Path:           dir,
+		PublicKeys:     keys,
+	})
+}
+
+func platformAssetName(name string) string {
+	return fmt.Sprintf("%s-%s-%s", name, runtime.GOOS, runtime.GOARCH)
+}
+
 func TestRepository_Get(t *testing.T) {
 
 	fetcher := newMockFetcher("v1.0.0", "v2.0.0")
@@ -122,3 +289,523 @@ func TestRepository_Get(t *testing.T) {
 		})
 	}
 }
+
+func TestRepository_TamperedAsset(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+	fetcher.Tamper("v1.0.0", platformAssetName("myapp"))
+
+	dir := t.TempDir()
+	r := newTestRepository(t, fetcher, dir)
+
+	if _, err := r.Get("v1.0.0", "myapp"); !errors.Is(err, artifact.ErrVerification) {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "v1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("expected the version directory to be removed")
+	}
+
+	quarantined, err := filepath.Glob(filepath.Join(dir, artifact.QUARANTINE_DIR, "v1.0.0", platformAssetName("myapp")+".*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 {
+		t.Fatalf("expected the asset and its reason to be quarantined, got %v", quarantined)
+	}
+
+	for _, file := range quarantined {
+		if !strings.HasSuffix(file, ".reason") {
+			continue
+		}
+		reason, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(reason), "checksum mismatch") {
+			t.Errorf("unexpected quarantine reason: %s", reason)
+		}
+	}
+}
+
+func TestRepository_MissingAsset(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+	fetcher.Remove("v1.0.0", platformAssetName("myapp"))
+
+	dir := t.TempDir()
+	r := newTestRepository(t, fetcher, dir)
+
+	if _, err := r.Get("v1.0.0", "myapp"); err == nil {
+		t.Fatalf("expected an error for a missing asset")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "v1.0.0", "myapp")); !os.IsNotExist(err) {
+		t.Errorf("expected the 404 page not to be written as an artifact")
+	}
+}
+
+func TestRepository_Checksums(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowUnverified bool
+		wantErr         bool
+	}{
+		{"unverifiableRejected", false, true},
+		{"unverifiableAllowed", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v1.0.0")
+			defer fetcher.Close()
+			fetcher.RemoveChecksums("v1.0.0")
+
+			r := artifact.NewRepository(artifact.RepositoryParams{
+				ReleaseFetcher:  fetcher,
+				Log:             zap.NewNop(),
+				Path:            t.TempDir(),
+				AllowUnverified: tt.allowUnverified,
+			})
+
+			_, err := r.Get("v1.0.0", "myapp")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Repository.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, artifact.ErrVerification) {
+				t.Errorf("expected a verification error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRepository_Signature(t *testing.T) {
+	trustedKey, trustedPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, untrustedPrivateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		signer  ed25519.PrivateKey
+		wantErr bool
+	}{
+		{"signedByTrustedKey", trustedPrivateKey, false},
+		{"signedByUntrustedKey", untrustedPrivateKey, true},
+		{"unsigned", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v1.0.0")
+			defer fetcher.Close()
+			if tt.signer != nil {
+				fetcher.Sign("v1.0.0", tt.signer)
+			}
+
+			r := newTestRepository(t, fetcher, t.TempDir(), trustedKey)
+
+			_, err := r.Get("v1.0.0", "myapp")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Repository.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, artifact.ErrVerification) {
+				t.Errorf("expected a verification error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := artifact.ParsePublicKeys([]string{base64.StdEncoding.EncodeToString(key)}); err != nil || len(keys) != 1 {
+		t.Errorf("failed to parse a valid key: %v", err)
+	}
+
+	for _, invalid := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := artifact.ParsePublicKeys([]string{invalid}); err == nil {
+			t.Errorf("expected an error for key '%s'", invalid)
+		}
+	}
+}
+
+func assertArtifact(t *testing.T, r *artifact.Repository, version, name string) {
+	t.Helper()
+
+	got, err := r.Get(version, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "/" + version + "/" + platformAssetName(name); string(contents) != expected {
+		t.Errorf("artifact contents expected = '%v', actual = '%v'", expected, string(contents))
+	}
+}
+
+func TestRepository_AtomicDownload(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+
+	dir := t.TempDir()
+	r := newTestRepository(t, fetcher, dir)
+
+	// Downloads that keep failing leave no version directory behind.
+	fetcher.Interrupt("v1.0.0", platformAssetName("myapp"), artifact.MAX_DOWNLOAD_ATTEMPTS)
+	if _, err := r.Get("v1.0.0", "myapp"); err == nil {
+		t.Fatalf("expected the download to fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "v1.0.0")); !os.IsNotExist(err) {
+		t.Fatalf("expected no version directory after a failed download")
+	}
+
+	assertArtifact(t, r, "v1.0.0", "myapp")
+
+	if _, err := os.Stat(filepath.Join(dir, "v1.0.0", artifact.MANIFEST_FILE)); err != nil {
+		t.Errorf("expected a manifest in the version directory: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, artifact.STAGING_DIR, "v1.0.0")); !os.IsNotExist(err) {
+		t.Errorf("expected the staging directory to be moved in place")
+	}
+}
+
+func TestRepository_ResumeDownload(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+
+	fullName := platformAssetName("myapp")
+	fetcher.Interrupt("v1.0.0", fullName, 1)
+
+	r := newTestRepository(t, fetcher, t.TempDir())
+	assertArtifact(t, r, "v1.0.0", "myapp")
+
+	half := len("/v1.0.0/"+fullName) / 2
+	ranges := fetcher.Ranges("v1.0.0", fullName)
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != fmt.Sprintf("bytes=%d-", half) {
+		t.Errorf("expected the interrupted transfer to be resumed, got requests with ranges %q", ranges)
+	}
+}
+
+func TestRepository_ConcurrentGet(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+	fetcher.SetLatency(50 * time.Millisecond)
+
+	// Two repositories sharing a directory stand for two agents sharing a workspace.
+	dir := t.TempDir()
+	repositories := []*artifact.Repository{newTestRepository(t, fetcher, dir), newTestRepository(t, fetcher, dir)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(r *artifact.Repository) {
+			defer wg.Done()
+			_, err := r.Get("v1.0.0", "myapp")
+			errs <- err
+		}(repositories[i%len(repositories)])
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if ranges := fetcher.Ranges("v1.0.0", platformAssetName("myapp")); len(ranges) != 1 {
+		t.Errorf("expected the asset to be downloaded once, got %d requests", len(ranges))
+	}
+
+	for _, r := range repositories {
+		assertArtifact(t, r, "v1.0.0", "myapp")
+	}
+}
+
+func TestRepository_ConcurrentGetError(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0")
+	defer fetcher.Close()
+	fetcher.SetLatency(50 * time.Millisecond)
+	fetcher.Tamper("v1.0.0", platformAssetName("myapp"))
+
+	r := newTestRepository(t, fetcher, t.TempDir())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Get("v1.0.0", "myapp")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Callers waiting on the install get its error.
+	for err := range errs {
+		if !errors.Is(err, artifact.ErrVerification) {
+			t.Errorf("expected a verification error, got %v", err)
+		}
+	}
+}
+
+// waitInstalled waits for the install of a version to end, and returns its progress.
+func waitInstalled(t *testing.T, r *artifact.Repository, version string) *artifact.InstallProgress {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress := r.Progress(version)
+		if progress == nil {
+			t.Fatalf("no install of version '%s'", version)
+		}
+		if progress.State != artifact.InstallDownloading {
+			return progress
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the install of version '%s'", version)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRepository_Prefetch(t *testing.T) {
+	fetcher := newMockFetcher("v1.0.0", "v2.0.0")
+	defer fetcher.Close()
+	fetcher.SetLatency(50 * time.Millisecond)
+
+	fullName := platformAssetName("myapp")
+	fetcher.Tamper("v2.0.0", fullName)
+
+	r := newTestRepository(t, fetcher, t.TempDir())
+
+	if progress := r.Progress("v1.0.0"); progress != nil {
+		t.Errorf("expected no progress before the version is fetched, got %+v", progress)
+	}
+
+	started, err := r.Prefetch("v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started {
+		t.Fatalf("expected the prefetch to start a download")
+	}
+	if progress := r.Progress("v1.0.0"); progress == nil || progress.State != artifact.InstallDownloading {
+		t.Errorf("expected the version to be downloading, got %+v", progress)
+	}
+
+	progress := waitInstalled(t, r, "v1.0.0")
+	if progress.State != artifact.InstallInstalled || progress.Platform != runtime.GOOS || progress.Architecture != runtime.GOARCH || progress.EndedAt.IsZero() {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	size := int64(len("/v1.0.0/" + fullName))
+	if len(progress.Assets) != 1 {
+		t.Fatalf("expected the progress of the platform asset, got %+v", progress.Assets)
+	}
+	if asset := progress.Assets[0]; asset.FullName != fullName || !asset.Done || asset.Bytes != size || asset.TotalBytes != size {
+		t.Errorf("unexpected asset progress %+v", asset)
+	}
+
+	// Installed versions aren't fetched again.
+	if started, err := r.Prefetch("v1.0.0"); err != nil || started {
+		t.Errorf("expected no download of an installed version, got %v, %v", started, err)
+	}
+	assertArtifact(t, r, "v1.0.0", "myapp")
+
+	if _, err := r.Prefetch("v2.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	progress = waitInstalled(t, r, "v2.0.0")
+	if progress.State != artifact.InstallFailed || !strings.Contains(progress.Error, "checksum mismatch") {
+		t.Errorf("expected the download to fail verification, got %+v", progress)
+	}
+	if len(progress.Assets) != 1 || progress.Assets[0].Done || progress.Assets[0].Error == "" {
+		t.Errorf("expected the asset to report its failure, got %+v", progress.Assets)
+	}
+
+	if _, err := r.Prefetch("../v1.0.0"); err == nil {
+		t.Errorf("expected an invalid version to be rejected")
+	}
+}
+
+func TestRepository_Repair(t *testing.T) {
+	fullName := platformAssetName("myapp")
+	content := "/v1.0.0/" + fullName
+
+	tests := []struct {
+		name string
+
+		// Breaks the repository, after it installed the version once.
+		breakRepository func(t *testing.T, dir string)
+
+		// The range of the request of the asset while repairing, if it is downloaded again.
+		wantRange string
+	}{
+		{
+			"missingManifest",
+			func(t *testing.T, dir string) {
+				os.Remove(filepath.Join(dir, "v1.0.0", artifact.MANIFEST_FILE))
+				os.WriteFile(filepath.Join(dir, "v1.0.0", "myapp"), []byte("garbage"), 0755)
+			},
+			"",
+		},
+		{
+			"missingAsset",
+			func(t *testing.T, dir string) {
+				os.Remove(filepath.Join(dir, "v1.0.0", "myapp"))
+			},
+			"",
+		},
+		{
+			"leftoverPartialAsset",
+			func(t *testing.T, dir string) {
+				os.RemoveAll(filepath.Join(dir, "v1.0.0"))
+
+				downloadsDir := filepath.Join(dir, artifact.STAGING_DIR, "v1.0.0", artifact.DOWNLOADS_DIR)
+				if err := os.MkdirAll(downloadsDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				os.WriteFile(filepath.Join(downloadsDir, fullName+artifact.PARTIAL_SUFFIX), []byte(content[:4]), 0644)
+			},
+			"bytes=4-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v1.0.0")
+			defer fetcher.Close()
+
+			dir := t.TempDir()
+			r := newTestRepository(t, fetcher, dir)
+			assertArtifact(t, r, "v1.0.0", "myapp")
+
+			tt.breakRepository(t, dir)
+			assertArtifact(t, r, "v1.0.0", "myapp")
+
+			ranges := fetcher.Ranges("v1.0.0", fullName)
+			if len(ranges) != 2 || ranges[1] != tt.wantRange {
+				t.Errorf("expected the asset to be downloaded again with range '%s', got requests with ranges %q", tt.wantRange, ranges)
+			}
+		})
+	}
+}
+
+func TestRepository_AdoptLegacyVersion(t *testing.T) {
+	fullName := platformAssetName("myapp")
+
+	tests := []struct {
+		name    string
+		content string
+
+		// Whether the release can be fetched.
+		online bool
+
+		wantErr      bool
+		wantDownload bool
+	}{
+		{"complete", "/v1.0.0/" + fullName, true, false, false},
+		{"corrupt", "garbage", true, false, true},
+		{"offline", "/v1.0.0/" + fullName, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v1.0.0")
+			defer fetcher.Close()
+
+			release := fetcher.Releases["v1.0.0"]
+			if !tt.online {
+				delete(fetcher.Releases, "v1.0.0")
+			}
+
+			// Older agents stored the assets as is, without a manifest.
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "v1.0.0"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "v1.0.0", "myapp"), []byte(tt.content), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			r := newTestRepository(t, fetcher, dir)
+			_, err := r.Get("v1.0.0", "myapp")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if downloaded := len(fetcher.Ranges("v1.0.0", fullName)) > 0; downloaded != tt.wantDownload {
+				t.Errorf("expected the asset to be downloaded: %v", tt.wantDownload)
+			}
+			if _, err := os.Stat(filepath.Join(dir, artifact.STAGING_DIR, artifact.PREVIOUS_PREFIX+"v1.0.0")); !os.IsNotExist(err) {
+				t.Errorf("expected no version directory to be left aside")
+			}
+
+			if tt.wantErr {
+				// The directory is kept until the version can be downloaded again.
+				if contents, err := os.ReadFile(filepath.Join(dir, "v1.0.0", "myapp")); err != nil || string(contents) != tt.content {
+					t.Fatalf("expected the version directory to be kept, got '%s': %v", contents, err)
+				}
+				fetcher.Releases["v1.0.0"] = release
+			}
+
+			assertArtifact(t, r, "v1.0.0", "myapp")
+		})
+	}
+}
+
+func TestRepository_ResumeUnverifiedDownload(t *testing.T) {
+	fullName := platformAssetName("myapp")
+	content := "/v1.0.0/" + fullName
+
+	tests := []struct {
+		name    string
+		partial string
+
+		// The ranges of the requests of the asset.
+		wantRanges []string
+	}{
+		{"complete", content, []string{fmt.Sprintf("bytes=%d-", len(content))}},
+		{"stale", content + "stale", []string{fmt.Sprintf("bytes=%d-", len(content)+5), ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v1.0.0")
+			defer fetcher.Close()
+			fetcher.RemoveChecksums("v1.0.0")
+
+			dir := t.TempDir()
+			downloadsDir := filepath.Join(dir, artifact.STAGING_DIR, "v1.0.0", artifact.DOWNLOADS_DIR)
+			if err := os.MkdirAll(downloadsDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(downloadsDir, fullName+artifact.PARTIAL_SUFFIX), []byte(tt.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			r := artifact.NewRepository(artifact.RepositoryParams{
+				ReleaseFetcher:  fetcher,
+				Log:             zap.NewNop(),
+				Path:            dir,
+				AllowUnverified: true,
+			})
+			assertArtifact(t, r, "v1.0.0", "myapp")
+
+			if ranges := fetcher.Ranges("v1.0.0", fullName); fmt.Sprint(ranges) != fmt.Sprint(tt.wantRanges) {
+				t.Errorf("expected requests with ranges %q, got %q", tt.wantRanges, ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package artifact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version aliases resolved against the release listing.
+const (
+	// The newest release, prereleases included.
+	ALIAS_LATEST = "latest"
+
+	// The newest release that isn't a prerelease.
+	ALIAS_LATEST_STABLE = "latest-stable"
+)
+
+// ErrNoMatchingVersion is returned when no release satisfies a requested version.
+var ErrNoMatchingVersion = errors.New("no matching release")
+
+// A Release is a release listed by a fetcher.
+type Release struct {
+	Version    string
+	Prerelease bool
+}
+
+// isPrerelease returns whether a version is a semver prerelease, e.g. "v0.3.0-rc.1".
+func isPrerelease(version string) bool {
+	parsed, ok := parseSemver(version)
+	return ok && len(parsed.prerelease) > 0
+}
+
+// needsResolution returns whether a requested version is an alias or a constraint, as opposed to an exact tag.
+func needsResolution(requested string) bool {
+	if requested == ALIAS_LATEST || requested == ALIAS_LATEST_STABLE {
+		return true
+	}
+
+	if strings.ContainsAny(requested, "<>=!~^*|, ") {
+		return true
+	}
+
+	// Partial versions like "0.2" or "v1.x" are ranges.
+	version, err := parsePartialVersion(requested)
+	return err == nil && version.parts < 3
+}
+
+// Resolve returns the release tag matching a requested version. The requested version can be an exact tag,
+// an alias ("latest", "latest-stable") or a semver constraint (e.g. "~0.2", ">=0.3,<0.4").
+// Exact tags are returned as is, without listing releases.
+func (r *Repository) Resolve(ctx context.Context, requested string) (string, error) {
+	requested = strings.TrimSpace(requested)
+	if !needsResolution(requested) {
+		return requested, nil
+	}
+
+	var versionConstraint *constraint
+	if requested != ALIAS_LATEST && requested != ALIAS_LATEST_STABLE {
+		var err error
+		if versionConstraint, err = parseConstraint(requested); err != nil {
+			return "", err
+		}
+	}
+
+	releases, err := r.releaseFetcher.ListReleases(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list releases: %w", err)
+	}
+
+	var best string
+	var bestVersion semver
+	for _, release := range releases {
+		version, ok := parseSemver(release.Version)
+		if !ok {
+			// Tags that aren't semantic versions can only be requested exactly.
+			continue
+		}
+
+		prerelease := release.Prerelease || len(version.prerelease) > 0
+		switch {
+		case requested == ALIAS_LATEST:
+		case requested == ALIAS_LATEST_STABLE:
+			if prerelease {
+				continue
+			}
+		default:
+			if !versionConstraint.matches(version) || (release.Prerelease && !versionConstraint.allowPrerelease) {
+				continue
+			}
+		}
+
+		if best == "" || version.compare(bestVersion) > 0 {
+			best, bestVersion = release.Version, version
+		}
+	}
+
+	if best == "" {
+		return "", fmt.Errorf("%w for version '%s'", ErrNoMatchingVersion, requested)
+	}
+
+	r.log.Infof("resolved version '%s' to '%s'", requested, best)
+	return best, nil
+}
@@ -0,0 +1,58 @@
+package artifact_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/menmos/menmos-agent/agent/artifact"
+)
+
+func TestRepository_Resolve(t *testing.T) {
+	type testCase struct {
+		name      string
+		requested string
+		want      string
+		wantErr   error
+		listed    bool
+	}
+
+	cases := []testCase{
+		{"exactTag", "v0.2.1", "v0.2.1", nil, false},
+		{"unknownExactTag", "nightly", "nightly", nil, false},
+		{"latest", artifact.ALIAS_LATEST, "v0.4.0-rc.1", nil, true},
+		{"latestStable", artifact.ALIAS_LATEST_STABLE, "v0.3.2", nil, true},
+		{"tilde", "~0.2", "v0.2.10", nil, true},
+		{"range", ">=0.3,<0.4", "v0.3.2", nil, true},
+		{"partial", "0.2", "v0.2.10", nil, true},
+		{"prereleaseConstraint", ">=0.4.0-rc.0", "v0.4.0-rc.1", nil, true},
+		{"noMatch", "~1.0", "", artifact.ErrNoMatchingVersion, true},
+		{"invalidConstraint", ">=0.3,<", "", artifact.ErrInvalidConstraint, false},
+	}
+
+	for _, tCase := range cases {
+		t.Run(tCase.name, func(t *testing.T) {
+			fetcher := newMockFetcher("v0.2.1", "v0.2.10", "v0.3.0", "v0.3.2", "v0.4.0-rc.1", "nightly")
+			defer fetcher.Close()
+
+			repo := newTestRepository(t, fetcher, t.TempDir())
+
+			resolved, err := repo.Resolve(context.Background(), tCase.requested)
+			if tCase.wantErr != nil {
+				if !errors.Is(err, tCase.wantErr) {
+					t.Fatalf("expected error '%v', got '%v'", tCase.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if resolved != tCase.want {
+				t.Errorf("resolved '%s' to '%s', expected '%s'", tCase.requested, resolved, tCase.want)
+			}
+
+			if listed := fetcher.Listings() > 0; listed != tCase.listed {
+				t.Errorf("expected releases listed: %v, got %v", tCase.listed, listed)
+			}
+		})
+	}
+}
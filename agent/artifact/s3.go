@@ -0,0 +1,307 @@
+package artifact
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hash of an empty payload, sent with every S3 request since the agent only reads from buckets.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type S3FetcherParams struct {
+	// The S3 endpoint, e.g. "http://localhost:9000". Defaults to the AWS endpoint of the region.
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	// The prefix of release directories in the bucket. Assets are stored at "<prefix><version>/<asset>".
+	Prefix string
+
+	// Requests are anonymous if no access key is set.
+	AccessKey string
+	SecretKey string
+}
+
+// An S3ReleaseFetcher fetches releases from an S3-compatible bucket, using path-style requests.
+type S3ReleaseFetcher struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	client   *http.Client
+}
+
+func NewS3Fetcher(params S3FetcherParams) (*S3ReleaseFetcher, error) {
+	if params.Bucket == "" {
+		return nil, fmt.Errorf("s3 release source has no bucket")
+	}
+
+	region := params.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	rawEndpoint := params.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(rawEndpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s': %v", rawEndpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s': expected an http or https url", rawEndpoint)
+	}
+
+	client := http.DefaultClient
+	if params.AccessKey != "" {
+		client = &http.Client{Transport: &sigV4Transport{
+			accessKey: params.AccessKey,
+			secretKey: params.SecretKey,
+			region:    region,
+			base:      http.DefaultTransport,
+		}}
+	}
+
+	return &S3ReleaseFetcher{
+		endpoint: endpoint,
+		bucket:   params.Bucket,
+		prefix:   params.Prefix,
+		client:   client,
+	}, nil
+}
+
+func (s *S3ReleaseFetcher) String() string {
+	return fmt.Sprintf("s3 bucket '%s' at '%s'", s.bucket, s.endpoint)
+}
+
+// objectURL returns the URL of a key of the bucket, encoded the way S3 signatures expect it.
+func (s *S3ReleaseFetcher) objectURL(key string, query url.Values) *url.URL {
+	objectPath := path.Join(s.endpoint.Path, "/", s.bucket, key)
+	if strings.HasSuffix(key, "/") {
+		objectPath += "/"
+	}
+
+	u := *s.endpoint
+	u.Path = objectPath
+	u.RawPath = awsURIEncode(objectPath, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects returns the keys under a prefix. If a delimiter is set, keys containing it after the prefix are
+// grouped and returned as common prefixes instead.
+func (s *S3ReleaseFetcher) listObjects(ctx context.Context, prefix, delimiter string) ([]string, []string, error) {
+	var keys, commonPrefixes []string
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL("", query).String(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result listBucketResult
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("%w listing bucket '%s': %s", errUnexpectedStatus, s.bucket, resp.Status)
+		} else if decodeErr := xml.NewDecoder(resp.Body).Decode(&result); decodeErr != nil {
+			err = fmt.Errorf("invalid bucket listing: %v", decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			commonPrefixes = append(commonPrefixes, commonPrefix.Prefix)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, commonPrefixes, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *S3ReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
+	releasePrefix := s.prefix + versionTag + "/"
+	keys, _, err := s.listObjects(ctx, releasePrefix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var assets []*Asset
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, releasePrefix)
+		if name == "" || strings.Contains(name, "/") {
+			// Skip directory markers and nested objects.
+			continue
+		}
+
+		assets = append(assets, &Asset{FullName: name, DownloadURL: s.objectURL(key, nil).String(), client: s.client})
+	}
+
+	if len(assets) == 0 {
+		return nil, fmt.Errorf("release '%s' not found", versionTag)
+	}
+
+	return assets, nil
+}
+
+func (s *S3ReleaseFetcher) ListReleases(ctx context.Context) ([]Release, error) {
+	_, prefixes, err := s.listObjects(ctx, s.prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	for _, prefix := range prefixes {
+		version := strings.TrimSuffix(strings.TrimPrefix(prefix, s.prefix), "/")
+		if version != "" {
+			releases = append(releases, Release{Version: version, Prerelease: isPrerelease(version)})
+		}
+	}
+
+	return releases, nil
+}
+
+// awsURIEncode encodes a string the way AWS signatures expect it, escaping everything but unreserved characters.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signV4 signs a bodyless S3 request with AWS Signature Version 4.
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// Sign the host, the range of resumed downloads and the amz headers.
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalURI := req.URL.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// sigV4Transport signs every request going through it.
+type sigV4Transport struct {
+	accessKey string
+	secretKey string
+	region    string
+	base      http.RoundTripper
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	signV4(signed, t.accessKey, t.secretKey, t.region, time.Now())
+	return t.base.RoundTrip(signed)
+}
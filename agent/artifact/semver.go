@@ -0,0 +1,303 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidConstraint is returned when a version constraint can't be parsed.
+var ErrInvalidConstraint = errors.New("invalid version constraint")
+
+// A semver is a semantic version, e.g. "v0.2.1-rc.1".
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// partialVersion is a version whose minor or patch may be missing, e.g. "0.2" or "0.2.x".
+type partialVersion struct {
+	semver
+	parts int
+}
+
+func parsePartialVersion(raw string) (partialVersion, error) {
+	raw = strings.TrimPrefix(strings.TrimSpace(raw), "v")
+	if raw == "" || raw == "*" || raw == "x" || raw == "X" {
+		return partialVersion{}, nil
+	}
+
+	// Build metadata doesn't affect precedence.
+	if i := strings.IndexByte(raw, '+'); i >= 0 {
+		raw = raw[:i]
+	}
+
+	var version partialVersion
+	if i := strings.IndexByte(raw, '-'); i >= 0 {
+		if raw[i+1:] == "" {
+			return partialVersion{}, fmt.Errorf("empty prerelease in '%s'", raw)
+		}
+		version.prerelease = strings.Split(raw[i+1:], ".")
+		raw = raw[:i]
+	}
+
+	fields := strings.Split(raw, ".")
+	if len(fields) > 3 {
+		return partialVersion{}, fmt.Errorf("too many components in '%s'", raw)
+	}
+
+	numbers := []*uint64{&version.major, &version.minor, &version.patch}
+	for i, field := range fields {
+		if field == "x" || field == "X" || field == "*" {
+			break
+		}
+
+		n, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return partialVersion{}, fmt.Errorf("invalid version component '%s'", field)
+		}
+		*numbers[i] = n
+		version.parts = i + 1
+	}
+
+	if version.prerelease != nil && version.parts != 3 {
+		return partialVersion{}, fmt.Errorf("prerelease on a partial version '%s'", raw)
+	}
+
+	return version, nil
+}
+
+// parseSemver parses a complete semantic version, with or without a "v" prefix.
+func parseSemver(raw string) (semver, bool) {
+	version, err := parsePartialVersion(raw)
+	if err != nil || version.parts != 3 {
+		return semver{}, false
+	}
+	return version.semver, true
+}
+
+func compareUint(a, b uint64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func comparePrereleaseIdentifier(a, b string) int {
+	aNum, aErr := strconv.ParseUint(a, 10, 64)
+	bNum, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(aNum, bNum)
+	case aErr == nil:
+		// Numeric identifiers have lower precedence than alphanumeric ones.
+		return -1
+	case bErr == nil:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// compare returns -1, 0 or 1 if v is lower than, equal to or greater than other, following semver precedence.
+func (v semver) compare(other semver) int {
+	if c := compareUint(v.major, other.major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.minor, other.minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.patch, other.patch); c != 0 {
+		return c
+	}
+
+	// A version without prerelease has higher precedence than its prereleases.
+	switch {
+	case len(v.prerelease) == 0 && len(other.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(other.prerelease); i++ {
+		if c := comparePrereleaseIdentifier(v.prerelease[i], other.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.prerelease)), uint64(len(other.prerelease)))
+}
+
+// A comparator is a single bound of a constraint, e.g. ">=0.3.0".
+type comparator struct {
+	op      string
+	version semver
+}
+
+func (c comparator) matches(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// A constraint is a union of comparator sets, e.g. ">=0.3,<0.4 || ~0.2".
+type constraint struct {
+	sets [][]comparator
+
+	// Prereleases only match constraints mentioning a prerelease.
+	allowPrerelease bool
+}
+
+func (c *constraint) matches(v semver) bool {
+	if len(v.prerelease) > 0 && !c.allowPrerelease {
+		return false
+	}
+
+	for _, set := range c.sets {
+		matches := true
+		for _, comp := range set {
+			if !comp.matches(v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// upperBound returns the exclusive upper bound of a partial version, e.g. "<0.3.0" for "0.2".
+func upperBound(v partialVersion) semver {
+	switch v.parts {
+	case 1:
+		return semver{major: v.major + 1}
+	case 2:
+		return semver{major: v.major, minor: v.minor + 1}
+	default:
+		return semver{major: v.major, minor: v.minor, patch: v.patch + 1}
+	}
+}
+
+// expandComparator turns a single comparator, possibly using a partial version, into bounds on complete versions.
+func expandComparator(raw string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(raw, candidate) {
+			op = candidate
+			break
+		}
+	}
+
+	version, err := parsePartialVersion(raw[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	lower := version.semver
+
+	if version.parts == 0 {
+		// Wildcards match everything.
+		if op != "" && op != "=" {
+			return nil, fmt.Errorf("wildcard used with operator '%s'", op)
+		}
+		return []comparator{{">=", semver{}}}, nil
+	}
+
+	switch op {
+	case "", "=":
+		if version.parts == 3 {
+			return []comparator{{"=", lower}}, nil
+		}
+		return []comparator{{">=", lower}, {"<", upperBound(version)}}, nil
+	case "~":
+		// Patch updates, or minor updates if no minor is given.
+		bound := version
+		if bound.parts == 3 {
+			bound.parts = 2
+		}
+		return []comparator{{">=", lower}, {"<", upperBound(bound)}}, nil
+	case "^":
+		// Updates that don't change the leftmost non-zero component.
+		bound := version
+		switch {
+		case version.major > 0 || version.parts == 1:
+			bound.parts = 1
+		case version.minor > 0 || version.parts == 2:
+			bound.parts = 2
+		default:
+			bound.parts = 3
+		}
+		return []comparator{{">=", lower}, {"<", upperBound(bound)}}, nil
+	case ">":
+		if version.parts < 3 {
+			return []comparator{{">=", upperBound(version)}}, nil
+		}
+		return []comparator{{">", lower}}, nil
+	case "<=":
+		if version.parts < 3 {
+			return []comparator{{"<", upperBound(version)}}, nil
+		}
+		return []comparator{{"<=", lower}}, nil
+	case "!=":
+		if version.parts < 3 {
+			return nil, fmt.Errorf("'!=' requires a complete version")
+		}
+		return []comparator{{"!=", lower}}, nil
+	default:
+		// ">=" and "<" on partial versions use the first version of the range.
+		return []comparator{{op, lower}}, nil
+	}
+}
+
+// parseConstraint parses a version constraint. Comparators are separated by commas or spaces, and "||" separates
+// alternatives, e.g. ">=0.3,<0.4 || ~0.2".
+func parseConstraint(raw string) (*constraint, error) {
+	var c constraint
+	for _, alternative := range strings.Split(raw, "||") {
+		// Allow spaces between operators and versions, e.g. ">= 0.3".
+		normalized := strings.NewReplacer(",", " ").Replace(alternative)
+		for _, op := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+			normalized = strings.ReplaceAll(normalized, op+" ", op)
+		}
+
+		var set []comparator
+		for _, field := range strings.Fields(normalized) {
+			comparators, err := expandComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("%w '%s': %v", ErrInvalidConstraint, raw, err)
+			}
+			for _, comp := range comparators {
+				if len(comp.version.prerelease) > 0 {
+					c.allowPrerelease = true
+				}
+			}
+			set = append(set, comparators...)
+		}
+
+		if len(set) == 0 {
+			return nil, fmt.Errorf("%w '%s': empty constraint", ErrInvalidConstraint, raw)
+		}
+		c.sets = append(c.sets, set)
+	}
+
+	return &c, nil
+}
@@ -0,0 +1,110 @@
+package artifact
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSemver_Compare(t *testing.T) {
+	type testCase struct {
+		name string
+		a    string
+		b    string
+		want int
+	}
+
+	cases := []testCase{
+		{"equal", "0.2.1", "v0.2.1", 0},
+		{"major", "1.0.0", "0.9.9", 1},
+		{"minor", "0.2.0", "0.10.0", -1},
+		{"patch", "0.2.2", "0.2.1", 1},
+		{"releaseAfterPrerelease", "0.3.0", "0.3.0-rc.1", 1},
+		{"numericPrerelease", "0.3.0-rc.2", "0.3.0-rc.10", -1},
+		{"numericBeforeAlphanumeric", "0.3.0-1", "0.3.0-alpha", -1},
+		{"longerPrerelease", "0.3.0-alpha.1", "0.3.0-alpha", 1},
+		{"buildMetadataIgnored", "0.3.0+build.1", "0.3.0", 0},
+	}
+
+	for _, tCase := range cases {
+		t.Run(tCase.name, func(t *testing.T) {
+			a, ok := parseSemver(tCase.a)
+			if !ok {
+				t.Fatalf("failed to parse '%s'", tCase.a)
+			}
+			b, ok := parseSemver(tCase.b)
+			if !ok {
+				t.Fatalf("failed to parse '%s'", tCase.b)
+			}
+
+			if got := a.compare(b); got != tCase.want {
+				t.Errorf("compare('%s', '%s') = %d, expected %d", tCase.a, tCase.b, got, tCase.want)
+			}
+		})
+	}
+}
+
+func TestSemver_Parse(t *testing.T) {
+	for _, raw := range []string{"", "0.2", "nightly", "0.2.1.4", "0.2.x", "0.2.1-", "v"} {
+		if _, ok := parseSemver(raw); ok {
+			t.Errorf("'%s' parsed as a complete version", raw)
+		}
+	}
+}
+
+func TestConstraint_Matches(t *testing.T) {
+	type testCase struct {
+		name       string
+		constraint string
+		matching   []string
+		rejected   []string
+	}
+
+	cases := []testCase{
+		{"tildeMinor", "~0.2", []string{"0.2.0", "v0.2.9"}, []string{"0.1.9", "0.3.0"}},
+		{"tildePatch", "~0.2.3", []string{"0.2.3", "0.2.8"}, []string{"0.2.2", "0.3.0"}},
+		{"tildeMajor", "~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"range", ">=0.3,<0.4", []string{"0.3.0", "0.3.12"}, []string{"0.2.9", "0.4.0"}},
+		{"rangeWithSpaces", ">= 0.3, < 0.4", []string{"0.3.1"}, []string{"0.4.0"}},
+		{"rangeSpaceSeparated", ">0.2.1 <=0.3", []string{"0.2.2", "0.3.5"}, []string{"0.2.1", "0.4.0"}},
+		{"caretMajor", "^1.2", []string{"1.2.0", "1.9.9"}, []string{"1.1.0", "2.0.0"}},
+		{"caretZeroMinor", "^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"caretZeroPatch", "^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"partial", "0.2", []string{"0.2.0", "0.2.5"}, []string{"0.3.0"}},
+		{"wildcard", "0.2.x", []string{"0.2.5"}, []string{"0.3.0"}},
+		{"exact", "=0.2.1", []string{"0.2.1"}, []string{"0.2.2"}},
+		{"notEqual", ">=0.2,!=0.2.1", []string{"0.2.0", "0.2.2"}, []string{"0.2.1"}},
+		{"alternatives", "~0.1 || >=0.3", []string{"0.1.4", "0.3.0", "1.0.0"}, []string{"0.2.0"}},
+		{"prereleaseExcluded", ">=0.3,<0.4", nil, []string{"0.3.1-rc.1"}},
+		{"prereleaseAllowed", ">=0.3.0-rc.1", []string{"0.3.0-rc.2", "0.3.0"}, []string{"0.3.0-beta"}},
+	}
+
+	for _, tCase := range cases {
+		t.Run(tCase.name, func(t *testing.T) {
+			c, err := parseConstraint(tCase.constraint)
+			if err != nil {
+				t.Fatalf("failed to parse '%s': %v", tCase.constraint, err)
+			}
+
+			for _, raw := range tCase.matching {
+				v, _ := parseSemver(raw)
+				if !c.matches(v) {
+					t.Errorf("'%s' should match '%s'", tCase.constraint, raw)
+				}
+			}
+			for _, raw := range tCase.rejected {
+				v, _ := parseSemver(raw)
+				if c.matches(v) {
+					t.Errorf("'%s' should not match '%s'", tCase.constraint, raw)
+				}
+			}
+		})
+	}
+}
+
+func TestConstraint_Invalid(t *testing.T) {
+	for _, raw := range []string{">=", "~nightly", ">=0.3,,<", "!=0.2", ">*", "0.2 ||", "0.2-rc.1"} {
+		if _, err := parseConstraint(raw); !errors.Is(err, ErrInvalidConstraint) {
+			t.Errorf("parseConstraint('%s') = %v, expected an invalid constraint", raw, err)
+		}
+	}
+}
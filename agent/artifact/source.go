@@ -0,0 +1,147 @@
+package artifact
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The kind of place releases are fetched from.
+type SourceType string
+
+const (
+	// Releases of the menmos repository on GitHub.
+	SourceGithub SourceType = "github"
+
+	// A local directory holding a subdirectory per release.
+	SourceLocal SourceType = "local"
+
+	// An HTTP server publishing an index of its releases.
+	SourceMirror SourceType = "mirror"
+
+	// An S3-compatible bucket holding a prefix per release.
+	SourceS3 SourceType = "s3"
+)
+
+// SourceConfig describes a place releases are fetched from.
+type SourceConfig struct {
+	Type SourceType `json:"type" mapstructure:"TYPE" toml:"type"`
+
+	// GitHub sources only.
+	Token string `json:"token" mapstructure:"TOKEN" toml:"token"`
+
+	// Local sources only.
+	Path string `json:"path" mapstructure:"PATH" toml:"path"`
+
+	// The base URL of mirror sources, the endpoint of S3 sources, or the API URL of GitHub sources.
+	// Defaults to AWS for S3 sources, and to api.github.com for GitHub sources.
+	URL string `json:"url" mapstructure:"URL" toml:"url"`
+
+	// S3 sources only. Requests are anonymous if no access key is set.
+	Bucket    string `json:"bucket" mapstructure:"BUCKET" toml:"bucket"`
+	Region    string `json:"region" mapstructure:"REGION" toml:"region"`
+	Prefix    string `json:"prefix" mapstructure:"PREFIX" toml:"prefix"`
+	AccessKey string `json:"access_key" mapstructure:"ACCESS_KEY" toml:"access_key"`
+	SecretKey string `json:"secret_key" mapstructure:"SECRET_KEY" toml:"secret_key"`
+}
+
+// NewSource returns a release fetcher for a source. Sources caching release metadata cache it in cacheDir.
+func NewSource(config SourceConfig, cacheDir string) (MenmosReleaseFetcher, error) {
+	switch config.Type {
+	case SourceGithub:
+		return NewGithubFetcher(GithubFetcherParams{Token: config.Token, BaseURL: config.URL, CacheDir: cacheDir})
+	case SourceLocal:
+		return NewLocalFetcher(config.Path)
+	case SourceMirror:
+		return NewMirrorFetcher(config.URL)
+	case SourceS3:
+		return NewS3Fetcher(S3FetcherParams{
+			Endpoint:  config.URL,
+			Bucket:    config.Bucket,
+			Region:    config.Region,
+			Prefix:    config.Prefix,
+			AccessKey: config.AccessKey,
+			SecretKey: config.SecretKey,
+		})
+	default:
+		return nil, fmt.Errorf("unknown release source type '%s'", config.Type)
+	}
+}
+
+func describeFetcher(fetcher MenmosReleaseFetcher) string {
+	if stringer, ok := fetcher.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", fetcher)
+}
+
+// A FallbackReleaseFetcher tries a list of fetchers in order, until one of them has the release.
+type FallbackReleaseFetcher struct {
+	fetchers []MenmosReleaseFetcher
+	log      *zap.SugaredLogger
+}
+
+func NewFallbackFetcher(fetchers []MenmosReleaseFetcher, log *zap.Logger) *FallbackReleaseFetcher {
+	return &FallbackReleaseFetcher{
+		fetchers: fetchers,
+		log:      log.Sugar().Named("sources"),
+	}
+}
+
+func (f *FallbackReleaseFetcher) GetRelease(ctx context.Context, versionTag string) ([]*Asset, error) {
+	var lastErr error
+	var failures []string
+	for _, fetcher := range f.fetchers {
+		assets, err := fetcher.GetRelease(ctx, versionTag)
+		if err == nil {
+			f.log.Debugf("got release '%s' from %s", versionTag, describeFetcher(fetcher))
+			return assets, nil
+		}
+
+		f.log.Warnf("failed to get release '%s' from %s: %v", versionTag, describeFetcher(fetcher), err)
+		failures = append(failures, fmt.Sprintf("%s: %v", describeFetcher(fetcher), err))
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return nil, fmt.Errorf("no release source configured")
+	}
+
+	return nil, fmt.Errorf("failed to get release '%s' from any source (%s): %w", versionTag, strings.Join(failures, "; "), lastErr)
+}
+
+// ListReleases returns the releases of every fetcher that could list them.
+func (f *FallbackReleaseFetcher) ListReleases(ctx context.Context) ([]Release, error) {
+	var lastErr error
+	listed := false
+	seen := make(map[string]bool)
+
+	var releases []Release
+	for _, fetcher := range f.fetchers {
+		fetcherReleases, err := fetcher.ListReleases(ctx)
+		if err != nil {
+			f.log.Warnf("failed to list releases from %s: %v", describeFetcher(fetcher), err)
+			lastErr = err
+			continue
+		}
+
+		listed = true
+		for _, release := range fetcherReleases {
+			if !seen[release.Version] {
+				seen[release.Version] = true
+				releases = append(releases, release)
+			}
+		}
+	}
+
+	if !listed {
+		if lastErr == nil {
+			return nil, fmt.Errorf("no release source configured")
+		}
+		return nil, fmt.Errorf("failed to list releases from any source: %w", lastErr)
+	}
+
+	return releases, nil
+}
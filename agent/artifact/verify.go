@@ -0,0 +1,207 @@
+package artifact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The release asset listing the SHA-256 checksums of the other assets, in the `sha256sum` format.
+	CHECKSUM_FILE = "SHA256SUMS"
+
+	// The release asset holding the ed25519 signature of the checksum file.
+	SIGNATURE_FILE = CHECKSUM_FILE + ".sig"
+
+	// The directory of the repository where rejected assets are moved.
+	QUARANTINE_DIR = ".quarantine"
+)
+
+// ErrVerification is returned when an asset is corrupt, or can't be verified.
+var ErrVerification = errors.New("artifact verification failed")
+
+// checksums maps the name of a release asset to its hex-encoded SHA-256 checksum.
+type checksums map[string]string
+
+func parseChecksums(raw []byte) (checksums, error) {
+	sums := make(checksums)
+
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: malformed checksum line '%s'", ErrVerification, line)
+		}
+
+		sum, name := strings.ToLower(fields[0]), strings.TrimPrefix(fields[1], "*")
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%w: invalid checksum for '%s'", ErrVerification, name)
+		}
+
+		sums[name] = sum
+	}
+
+	return sums, scanner.Err()
+}
+
+// ParsePublicKeys decodes base64-encoded ed25519 public keys.
+func ParsePublicKeys(encoded []string) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(encoded))
+	for _, raw := range encoded {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key '%s': %v", raw, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key '%s': expected %d bytes, got %d", raw, ed25519.PublicKeySize, len(key))
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+// ParsePrivateKey decodes a base64-encoded ed25519 private key, or its 32 bytes seed.
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("invalid private key: expected %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+	}
+}
+
+// decodeSignature accepts both raw and base64-encoded signatures.
+func decodeSignature(raw []byte) []byte {
+	if len(raw) == ed25519.SignatureSize {
+		return raw
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return raw
+	}
+	return decoded
+}
+
+func findAsset(assets []*Asset, fullName string) *Asset {
+	for _, asset := range assets {
+		if asset.FullName == fullName {
+			return asset
+		}
+	}
+	return nil
+}
+
+// httpGet fetches an asset, failing on any status other than 200.
+func httpGet(asset *Asset) (*http.Response, error) {
+	resp, err := asset.httpClient().Get(asset.DownloadURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w fetching '%s': %s", errUnexpectedStatus, asset.DownloadURL, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func fetchAll(asset *Asset) ([]byte, error) {
+	resp, err := httpGet(asset)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// fetchChecksums returns the checksums published with a release.
+// It returns nil checksums if the release publishes none and unverified artifacts are allowed.
+func (r *Repository) fetchChecksums(version string, assets []*Asset) (checksums, error) {
+	sumsAsset := findAsset(assets, CHECKSUM_FILE)
+	if sumsAsset == nil {
+		if r.allowUnverified {
+			r.log.Warnf("release '%s' publishes no checksums, its assets won't be verified", version)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: release '%s' has no %s file", ErrVerification, version, CHECKSUM_FILE)
+	}
+
+	raw, err := fetchAll(sumsAsset)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.publicKeys) > 0 {
+		if err := r.verifySignature(version, assets, raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseChecksums(raw)
+}
+
+func (r *Repository) verifySignature(version string, assets []*Asset, message []byte) error {
+	sigAsset := findAsset(assets, SIGNATURE_FILE)
+	if sigAsset == nil {
+		return fmt.Errorf("%w: release '%s' has no %s file", ErrVerification, version, SIGNATURE_FILE)
+	}
+
+	raw, err := fetchAll(sigAsset)
+	if err != nil {
+		return err
+	}
+
+	signature := decodeSignature(raw)
+	for _, key := range r.publicKeys {
+		if ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: checksums of release '%s' are not signed by a trusted key", ErrVerification, version)
+}
+
+// quarantine moves a rejected asset out of the way, along with the reason it was rejected.
+func (r *Repository) quarantine(filePath, version string, asset *Asset, reason error) {
+	quarantineDir := filepath.Join(r.path, QUARANTINE_DIR, version)
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		r.log.Errorf("failed to create quarantine directory: %v", err)
+		os.Remove(filePath)
+		return
+	}
+
+	target := filepath.Join(quarantineDir, fmt.Sprintf("%s.%d", asset.FullName, time.Now().UnixNano()))
+	if err := os.Rename(filePath, target); err != nil {
+		r.log.Errorf("failed to quarantine asset '%s': %v", asset.FullName, err)
+		os.Remove(filePath)
+		return
+	}
+
+	os.WriteFile(target+".reason", []byte(reason.Error()+"\n"), 0644)
+	r.log.Warnf("quarantined asset '%s' to '%s': %v", asset.FullName, target, reason)
+}
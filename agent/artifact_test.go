@@ -0,0 +1,256 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+// writeTestRelease writes a release providing a menmosd binary to a local release source.
+func writeTestRelease(t *testing.T, sourceDir, version string) {
+	t.Helper()
+
+	releaseDir := path.Join(sourceDir, version)
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assetName := fmt.Sprintf("menmosd-%s-%s", runtime.GOOS, runtime.GOARCH)
+	content := []byte("#!/bin/sh\necho menmosd " + version)
+	if err := os.WriteFile(path.Join(releaseDir, assetName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(content)
+	sums := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum[:]), assetName)
+	if err := os.WriteFile(path.Join(releaseDir, artifact.CHECKSUM_FILE), []byte(sums), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newArtifactTestAgent returns an agent fetching releases from a local source holding the given versions.
+func newArtifactTestAgent(t *testing.T, versions ...string) *MenmosAgent {
+	sourceDir := t.TempDir()
+	for _, version := range versions {
+		writeTestRelease(t, sourceDir, version)
+	}
+
+	return newTestAgentWithConfig(t, Config{
+		AgentType:      Native,
+		Path:           t.TempDir(),
+		ReleaseSources: []artifact.SourceConfig{{Type: artifact.SourceLocal, Path: sourceDir}},
+	}, xecutetest.NewExecutor())
+}
+
+func TestMenmosAgent_Artifacts(t *testing.T) {
+	agent := newArtifactTestAgent(t, "v0.2.0", "v0.3.0")
+	defer agent.Shutdown()
+
+	node := createTestNode(t, agent)
+	for _, version := range []string{"v0.2.0", "v0.3.0"} {
+		if _, err := agent.getBinary(version, "menmosd"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	artifacts, err := agent.ListArtifacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts.Versions) != 2 || artifacts.TotalSize == 0 {
+		t.Fatalf("unexpected artifacts: %+v", artifacts)
+	}
+
+	inUse := artifacts.Versions[0]
+	if inUse.Version != "v0.2.0" || len(inUse.Nodes) != 1 || inUse.Nodes[0] != node.ID || len(inUse.Binaries) != 1 || inUse.Binaries[0] != "menmosd" {
+		t.Errorf("unexpected artifact: %+v", inUse)
+	}
+
+	if err := agent.RemoveArtifact("v0.2.0"); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a version in use not to be removed, got %v", err)
+	}
+
+	if err := agent.PinArtifact("v0.3.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.RemoveArtifact("v0.3.0"); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a pinned version not to be removed, got %v", err)
+	}
+
+	if err := agent.UnpinArtifact("v0.3.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.RemoveArtifact("v0.3.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := agent.GetArtifact("v0.3.0"); err != nil || removed != nil {
+		t.Errorf("expected removed version to be missing, got %+v, %v", removed, err)
+	}
+	if err := agent.PinArtifact("v0.3.0"); !errors.Is(err, artifact.ErrNotInstalled) {
+		t.Errorf("expected pinning a missing version to fail, got %v", err)
+	}
+
+	// Versions used recently are never collected.
+	collected, err := agent.CollectArtifacts(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collected.Removed) != 0 {
+		t.Errorf("expected no version to be collected, got %v", collected.Removed)
+	}
+}
+
+func TestMenmosAgent_ResolveVersion(t *testing.T) {
+	sourceDir := t.TempDir()
+	for _, version := range []string{"v0.2.0", "v0.2.3", "v0.3.0", "v0.4.0-rc.1"} {
+		writeTestRelease(t, sourceDir, version)
+	}
+
+	agent := newTestAgentWithConfig(t, Config{
+		AgentType:      Native,
+		Path:           t.TempDir(),
+		ReleaseSources: []artifact.SourceConfig{{Type: artifact.SourceLocal, Path: sourceDir}},
+		DefaultVersion: artifact.ALIAS_LATEST_STABLE,
+	}, xecutetest.NewExecutor())
+	defer agent.Shutdown()
+
+	type testCase struct {
+		requested     string
+		wantVersion   string
+		wantRequested string
+	}
+
+	cases := []testCase{
+		{"~0.2", "v0.2.3", "~0.2"},
+		{">=0.2,<0.3", "v0.2.3", ">=0.2,<0.3"},
+		{artifact.ALIAS_LATEST, "v0.4.0-rc.1", artifact.ALIAS_LATEST},
+		{"", "v0.3.0", artifact.ALIAS_LATEST_STABLE},
+		{"v0.2.0", "v0.2.0", ""},
+	}
+
+	for _, tCase := range cases {
+		t.Run(tCase.requested, func(t *testing.T) {
+			node, err := agent.CreateNode(&payload.CreateNodeRequest{
+				Version: tCase.requested,
+				Type:    payload.NodeMenmosd,
+				Config:  map[string]interface{}{"node_admin_password": "hunter2"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if node.Version != tCase.wantVersion || node.RequestedVersion != tCase.wantRequested {
+				t.Errorf("expected version '%s' requested as '%s', got '%s' requested as '%s'", tCase.wantVersion, tCase.wantRequested, node.Version, node.RequestedVersion)
+			}
+
+			// The resolved version is what the node restarts with.
+			info, err := agent.getNodeInfo(node.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Version != tCase.wantVersion {
+				t.Errorf("expected node info to record version '%s', got '%s'", tCase.wantVersion, info.Version)
+			}
+		})
+	}
+
+	// A newer matching release doesn't change the version of existing nodes.
+	node, err := agent.CreateNode(&payload.CreateNodeRequest{Version: "~0.2", Type: payload.NodeMenmosd, Config: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestRelease(t, sourceDir, "v0.2.4")
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if restarted, err := agent.GetNode(node.ID); err != nil || restarted.Version != "v0.2.3" {
+		t.Errorf("expected restarted node to keep version 'v0.2.3', got %+v, %v", restarted, err)
+	}
+
+	if _, err := agent.CreateNode(&payload.CreateNodeRequest{Version: ">=0.2,<", Type: payload.NodeMenmosd}); !errors.Is(err, artifact.ErrInvalidConstraint) {
+		t.Errorf("expected an invalid constraint error, got %v", err)
+	}
+	if _, err := agent.CreateNode(&payload.CreateNodeRequest{Version: "~1.0", Type: payload.NodeMenmosd}); !errors.Is(err, artifact.ErrNoMatchingVersion) {
+		t.Errorf("expected no matching version, got %v", err)
+	}
+}
+
+func TestMenmosAgent_PrefetchArtifact(t *testing.T) {
+	agent := newArtifactTestAgent(t, "v0.2.0", "v0.2.1", "v0.3.0")
+	defer agent.Shutdown()
+
+	if artifact, err := agent.GetArtifact("v0.2.1"); err != nil || artifact != nil {
+		t.Fatalf("expected no artifact before the prefetch, got %+v, %v", artifact, err)
+	}
+
+	prefetched, started, err := agent.PrefetchArtifact("~0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started || prefetched.Version != "v0.2.1" || prefetched.Download == nil {
+		t.Fatalf("expected a download of version 'v0.2.1' to start, got %+v", prefetched)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for prefetched.Download.State == string(artifact.InstallDownloading) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the download")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		if prefetched, err = agent.GetArtifact("v0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	download := prefetched.Download
+	if !prefetched.Complete || download.State != string(artifact.InstallInstalled) || download.Platform != runtime.GOOS || download.Architecture != runtime.GOARCH {
+		t.Errorf("unexpected artifact after the download %+v, %+v", prefetched, download)
+	}
+	if len(download.Assets) != 1 || !download.Assets[0].Done || download.Bytes == 0 || download.Bytes != download.TotalBytes {
+		t.Errorf("unexpected download progress %+v", download)
+	}
+
+	if _, started, err := agent.PrefetchArtifact("v0.2.1"); err != nil || started {
+		t.Errorf("expected no download of an installed version, got %v, %v", started, err)
+	}
+
+	// Failed downloads are reported even though the version isn't installed.
+	if _, _, err := agent.PrefetchArtifact("v9.9.9"); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		failed, err := agent.GetArtifact("v9.9.9")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed == nil || failed.Download == nil {
+			t.Fatalf("expected the failed download to be reported, got %+v", failed)
+		}
+		if failed.Download.State == string(artifact.InstallFailed) {
+			if failed.Complete || failed.Download.Error == "" {
+				t.Errorf("unexpected failed artifact %+v", failed)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the download to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
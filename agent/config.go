@@ -1,5 +1,11 @@
 package agent
 
+import (
+	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/menmos/menmos-agent/agent/portpool"
+	"github.com/menmos/menmos-agent/agent/xecute"
+)
+
 type RunType string
 
 const (
@@ -23,6 +29,43 @@ type Config struct {
 	GithubToken string `json:"github_token" mapstructure:"GH_TOKEN" toml:"github_token"`
 	Path        string `json:"path" mapstructure:"PATH" toml:"path"`
 
+	// Where releases are fetched from, tried in order. Releases are fetched from GitHub when empty.
+	ReleaseSources []artifact.SourceConfig `json:"release_sources" mapstructure:"RELEASE_SOURCES" toml:"release_sources"`
+
+	// The version of nodes created without one, e.g. "latest-stable" or "~0.2". Nodes created without a version use
+	// local binaries when empty.
+	DefaultVersion string `json:"default_version" mapstructure:"DEFAULT_VERSION" toml:"default_version"`
+
+	// Which unused versions are removed from the artifact cache.
+	ArtifactGC artifact.GCPolicy `json:"artifact_gc" mapstructure:"ARTIFACT_GC" toml:"artifact_gc"`
+
+	// Base64-encoded ed25519 keys trusted to sign release checksums. Signatures aren't checked when empty.
+	ArtifactPublicKeys []string `json:"artifact_public_keys" mapstructure:"ARTIFACT_PUBLIC_KEYS" toml:"artifact_public_keys"`
+
+	// Base64-encoded ed25519 private key, or its seed, signing exported bundles. Bundles aren't signed when empty.
+	ArtifactSigningKey string `json:"artifact_signing_key" mapstructure:"ARTIFACT_SIGNING_KEY" toml:"artifact_signing_key"`
+
+	// Whether to install releases that publish no checksums. Their assets are used without verification.
+	AllowUnverifiedArtifacts bool `json:"allow_unverified_artifacts" mapstructure:"ALLOW_UNVERIFIED_ARTIFACTS" toml:"allow_unverified_artifacts"`
+
+	// When node log files are rotated, and how many rotated files are kept. Logs grow without limit when empty.
+	LogRotation xecute.LogRotation `json:"log_rotation" mapstructure:"LOG_ROTATION" toml:"log_rotation"`
+
+	// The ports handed out to nodes. Not used by kubernetes agents, where every pod has its own network namespace.
+	Ports portpool.Config `json:"ports" mapstructure:"PORTS" toml:"ports"`
+
 	// Native agent settings only.
 	LocalBinaryPath string `json:"local_binary_path" mapstructure:"BIN_PATH" toml:"local_binary_path"`
+
+	// Docker & Kubernetes agent settings only.
+	// The image used for menmos containers. "{binary}" and "{version}" are replaced by the node binary and version.
+	ContainerImage string `json:"container_image" mapstructure:"CONTAINER_IMAGE" toml:"container_image"`
+
+	// Docker agent settings only.
+	DockerHost string `json:"docker_host" mapstructure:"DOCKER_HOST" toml:"docker_host"`
+
+	// Kubernetes agent settings only.
+	KubernetesNamespace   string `json:"k8s_namespace" mapstructure:"K8S_NAMESPACE" toml:"k8s_namespace"`
+	KubernetesStorageSize string `json:"k8s_storage_size" mapstructure:"K8S_STORAGE_SIZE" toml:"k8s_storage_size"`
+	KubeconfigPath        string `json:"kubeconfig_path" mapstructure:"KUBECONFIG_PATH" toml:"kubeconfig_path"` // Empty when running in-cluster.
 }
@@ -0,0 +1,6 @@
+package agent
+
+import "errors"
+
+// ErrConflict is returned when a request conflicts with the current state of the agent.
+var ErrConflict = errors.New("conflict")
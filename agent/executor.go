@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+)
+
+// newExecutor returns the executor matching the agent type of the config.
+func newExecutor(config Config, resolveBinary xecute.BinaryResolver) (xecute.Executor, error) {
+	switch config.AgentType {
+	case Native, "":
+		return &xecute.NativeExecutor{ResolveBinary: resolveBinary, LogRotation: config.LogRotation}, nil
+	case Docker:
+		return &xecute.DockerExecutor{
+			Host:          config.DockerHost,
+			ImageTemplate: config.ContainerImage,
+			LogRotation:   config.LogRotation,
+		}, nil
+	case Kubernetes:
+		kubeClient, err := xecute.NewKubernetesClient(config.KubeconfigPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &xecute.KubernetesExecutor{
+			Client:        kubeClient,
+			Namespace:     config.KubernetesNamespace,
+			ImageTemplate: config.ContainerImage,
+			StorageSize:   config.KubernetesStorageSize,
+			LogRotation:   config.LogRotation,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported agent type '%s'", config.AgentType)
+	}
+}
+
+// newProcess returns a process for the given node, using the executor of the agent.
+func (a *MenmosAgent) newProcess(nodeID string, info nodeInfo) (xecute.Process, error) {
+	spec := xecute.ProcessSpec{
+		NodeID:        nodeID,
+		Binary:        info.Binary,
+		Version:       info.Version,
+		Workdir:       path.Join(a.nodeDir(), nodeID),
+		RestartPolicy: info.RestartPolicy,
+		Port:          info.Port,
+	}
+
+	return a.executor.NewProcess(spec, a.log.Named(info.Binary).Named(nodeID).Desugar())
+}
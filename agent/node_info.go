@@ -1,6 +1,112 @@
 package agent
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/payload"
+)
+
 type nodeInfo struct {
-	Binary  string `json:"binary,omitempty"`
-	Version string `json:"version,omitempty"`
+	Binary        string               `json:"binary,omitempty"`
+	Version       string               `json:"version,omitempty"`
+	RestartPolicy xecute.RestartPolicy `json:"restart_policy"`
+
+	// The port assigned to the node, reused every time it starts.
+	Port uint16 `json:"port,omitempty"`
+
+	// The alias or constraint the version was resolved from. Nodes keep the resolved version so restarts are reproducible.
+	RequestedVersion string `json:"requested_version,omitempty"`
+}
+
+func restartPolicyFromPayload(policy *payload.RestartPolicy) (xecute.RestartPolicy, error) {
+	if policy == nil {
+		return xecute.RestartPolicy{Mode: xecute.RestartNever}, nil
+	}
+
+	restartPolicy := xecute.RestartPolicy{
+		Mode:           string(policy.Mode),
+		MaxRetries:     policy.MaxRetries,
+		InitialBackoff: time.Duration(policy.InitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(policy.MaxBackoffMs) * time.Millisecond,
+
+		CrashLoopThreshold: policy.CrashLoopThreshold,
+		CrashLoopWindow:    time.Duration(policy.CrashLoopWindowMs) * time.Millisecond,
+	}
+
+	if err := restartPolicy.Validate(); err != nil {
+		return xecute.RestartPolicy{}, err
+	}
+
+	return restartPolicy, nil
+}
+
+// kubernetesRestartPolicyFromPayload returns the restart policy of a node running on kubernetes. The pods of a
+// StatefulSet are always restarted by kubernetes, with its own backoff, so only the "always" mode is supported.
+func kubernetesRestartPolicyFromPayload(policy *payload.RestartPolicy) (xecute.RestartPolicy, error) {
+	if policy == nil {
+		return xecute.RestartPolicy{Mode: xecute.RestartAlways}, nil
+	}
+
+	restartPolicy, err := restartPolicyFromPayload(policy)
+	if err != nil {
+		return xecute.RestartPolicy{}, err
+	}
+	if restartPolicy.Mode == "" {
+		restartPolicy.Mode = xecute.RestartAlways
+	}
+
+	if restartPolicy != (xecute.RestartPolicy{Mode: xecute.RestartAlways}) {
+		return xecute.RestartPolicy{}, fmt.Errorf("%w: kubernetes nodes are always restarted, without retry limit, backoff or crash loop settings", xecute.ErrInvalidRestartPolicy)
+	}
+	return restartPolicy, nil
+}
+
+func restartPolicyToPayload(policy xecute.RestartPolicy) *payload.RestartPolicy {
+	mode := policy.Mode
+	if mode == "" {
+		mode = xecute.RestartNever
+	}
+
+	return &payload.RestartPolicy{
+		Mode:             payload.RestartMode(mode),
+		MaxRetries:       policy.MaxRetries,
+		InitialBackoffMs: uint64(policy.InitialBackoff / time.Millisecond),
+		MaxBackoffMs:     uint64(policy.MaxBackoff / time.Millisecond),
+
+		CrashLoopThreshold: policy.CrashLoopThreshold,
+		CrashLoopWindowMs:  uint64(policy.CrashLoopWindow / time.Millisecond),
+	}
+}
+
+func crashLoopToPayload(crashLoop *xecute.CrashLoop) *payload.CrashLoop {
+	if crashLoop == nil {
+		return nil
+	}
+
+	return &payload.CrashLoop{
+		Since:        crashLoop.Since,
+		Crashes:      crashLoop.Crashes,
+		WindowMs:     uint64(crashLoop.Window / time.Millisecond),
+		LastExitCode: crashLoop.LastExitCode,
+		LogTail:      crashLoop.LogTail,
+	}
+}
+
+func crashReportToPayload(report *xecute.CrashReport) *payload.CrashReport {
+	if report == nil {
+		return nil
+	}
+
+	resp := &payload.CrashReport{
+		StartedAt: report.StartedAt,
+		ExitedAt:  report.ExitedAt,
+		ExitCode:  report.ExitCode,
+		Lines:     make([]payload.CrashReportLine, len(report.Lines)),
+	}
+	for i, line := range report.Lines {
+		resp.Lines[i] = payload.CrashReportLine{CapturedAt: line.CapturedAt, Stream: line.Stream, Line: line.Line}
+	}
+	return resp
 }
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/operation"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+func operationToPayload(op *operation.Operation) *payload.Operation {
+	snapshot := op.Snapshot()
+
+	resp := &payload.Operation{
+		ID:        snapshot.ID,
+		Kind:      payload.OperationKind(snapshot.Kind),
+		NodeID:    snapshot.NodeID,
+		State:     snapshot.State,
+		Progress:  snapshot.Progress,
+		Message:   snapshot.Message,
+		StartedAt: snapshot.StartedAt,
+		Result:    snapshot.Result,
+	}
+
+	if !snapshot.EndedAt.IsZero() {
+		resp.EndedAt = &snapshot.EndedAt
+	}
+
+	if snapshot.Err != nil {
+		resp.Error = snapshot.Err.Error()
+		resp.Result = nil
+	}
+
+	return resp
+}
+
+func (a *MenmosAgent) createNodeOperation(request *payload.CreateNodeRequest) *operation.Operation {
+	return a.operations.Start(payload.OperationCreateNode, "", func(op *operation.Operation) (interface{}, error) {
+		return a.createNode(request, op)
+	})
+}
+
+func (a *MenmosAgent) nodeOperation(kind, nodeID string, f func(nodeID string, op *operation.Operation) error) *operation.Operation {
+	return a.operations.Start(kind, nodeID, func(op *operation.Operation) (interface{}, error) {
+		return nil, f(nodeID, op)
+	})
+}
+
+func (a *MenmosAgent) CreateNode(request *payload.CreateNodeRequest) (*payload.NodeResponse, error) {
+	op := a.createNodeOperation(request)
+	<-op.Done()
+
+	result, err := op.Result()
+	if err != nil {
+		return nil, err
+	}
+	return result.(*payload.NodeResponse), nil
+}
+
+func (a *MenmosAgent) DeleteNode(nodeID string) error {
+	op := a.nodeOperation(payload.OperationDeleteNode, nodeID, a.deleteNode)
+	<-op.Done()
+	_, err := op.Result()
+	return err
+}
+
+func (a *MenmosAgent) StopNode(nodeID string) error {
+	op := a.nodeOperation(payload.OperationStopNode, nodeID, a.stopNode)
+	<-op.Done()
+	_, err := op.Result()
+	return err
+}
+
+func (a *MenmosAgent) StartNode(nodeID string) error {
+	op := a.nodeOperation(payload.OperationStartNode, nodeID, a.startNode)
+	<-op.Done()
+	_, err := op.Result()
+	return err
+}
+
+// CreateNodeAsync starts creating a node in the background.
+func (a *MenmosAgent) CreateNodeAsync(request *payload.CreateNodeRequest) *payload.Operation {
+	return operationToPayload(a.createNodeOperation(request))
+}
+
+// DeleteNodeAsync starts deleting a node in the background.
+func (a *MenmosAgent) DeleteNodeAsync(nodeID string) *payload.Operation {
+	return operationToPayload(a.nodeOperation(payload.OperationDeleteNode, nodeID, a.deleteNode))
+}
+
+// StopNodeAsync starts stopping a node in the background.
+func (a *MenmosAgent) StopNodeAsync(nodeID string) *payload.Operation {
+	return operationToPayload(a.nodeOperation(payload.OperationStopNode, nodeID, a.stopNode))
+}
+
+// StartNodeAsync starts starting a node in the background.
+func (a *MenmosAgent) StartNodeAsync(nodeID string) *payload.Operation {
+	return operationToPayload(a.nodeOperation(payload.OperationStartNode, nodeID, a.startNode))
+}
+
+// GetOperation returns an operation from the history, or nil if it isn't known.
+// If wait is positive, it blocks until the operation completes, the wait expires or the context is done.
+func (a *MenmosAgent) GetOperation(ctx context.Context, id string, wait time.Duration) *payload.Operation {
+	op := a.operations.Get(id)
+	if op == nil {
+		return nil
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-op.Done():
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	return operationToPayload(op)
+}
+
+// ListOperations returns the operation history of the agent, oldest first.
+func (a *MenmosAgent) ListOperations() *payload.ListOperationsResponse {
+	var resp payload.ListOperationsResponse
+	for _, op := range a.operations.List() {
+		resp.Operations = append(resp.Operations, operationToPayload(op))
+	}
+	return &resp
+}
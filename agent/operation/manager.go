@@ -0,0 +1,77 @@
+package operation
+
+import "sync"
+
+// The number of operations kept in the history by default.
+const HISTORY_SIZE = 256
+
+// A Manager runs operations and keeps a bounded history of them.
+type Manager struct {
+	mutex       sync.Mutex
+	historySize int
+	operations  map[string]*Operation
+
+	// Operations in the order they were started.
+	history []*Operation
+}
+
+// NewManager returns a manager keeping at least the last historySize operations.
+// Running operations are never evicted from the history.
+func NewManager(historySize int) *Manager {
+	return &Manager{
+		historySize: historySize,
+		operations:  make(map[string]*Operation),
+	}
+}
+
+// Start runs an operation in the background.
+func (m *Manager) Start(kind, nodeID string, f Func) *Operation {
+	op := newOperation(kind, nodeID)
+
+	m.mutex.Lock()
+	m.operations[op.id] = op
+	m.history = append(m.history, op)
+	m.evict()
+	m.mutex.Unlock()
+
+	go op.run(f)
+
+	return op
+}
+
+func (m *Manager) evict() {
+	excess := len(m.history) - m.historySize
+	if excess <= 0 {
+		return
+	}
+
+	kept := m.history[:0]
+	for _, op := range m.history {
+		if excess > 0 && op.isDone() {
+			delete(m.operations, op.id)
+			excess -= 1
+			continue
+		}
+		kept = append(kept, op)
+	}
+
+	// Clear the tail so evicted operations can be collected.
+	for i := len(kept); i < len(m.history); i++ {
+		m.history[i] = nil
+	}
+	m.history = kept
+}
+
+// Get returns an operation by ID, or nil if it isn't in the history.
+func (m *Manager) Get(id string) *Operation {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.operations[id]
+}
+
+// List returns the operations in the history, oldest first.
+func (m *Manager) List() []*Operation {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*Operation{}, m.history...)
+}
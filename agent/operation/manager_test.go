@@ -0,0 +1,115 @@
+package operation
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, op *Operation) Snapshot {
+	select {
+	case <-op.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("operation '%s' didn't complete", op.ID())
+	}
+	return op.Snapshot()
+}
+
+func TestManager_Start(t *testing.T) {
+	tests := []struct {
+		name      string
+		f         Func
+		wantState State
+		wantErr   bool
+	}{
+		{"succeeds", func(op *Operation) (interface{}, error) { return "ok", nil }, StateSucceeded, false},
+		{"fails", func(op *Operation) (interface{}, error) { return nil, errors.New("boom") }, StateFailed, true},
+		{"panics", func(op *Operation) (interface{}, error) { panic("boom") }, StateFailed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := NewManager(HISTORY_SIZE)
+
+			snapshot := waitDone(t, manager.Start("test", "node", tt.f))
+
+			if snapshot.State != tt.wantState {
+				t.Errorf("expected state '%s', got '%s'", tt.wantState, snapshot.State)
+			}
+			if (snapshot.Err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", snapshot.Err)
+			}
+			if snapshot.EndedAt.Before(snapshot.StartedAt) {
+				t.Errorf("operation ended before it started")
+			}
+			if snapshot.Kind != "test" || snapshot.NodeID != "node" {
+				t.Errorf("unexpected operation: %+v", snapshot)
+			}
+		})
+	}
+}
+
+func TestOperation_Progress(t *testing.T) {
+	manager := NewManager(HISTORY_SIZE)
+
+	proceed := make(chan struct{})
+	op := manager.Start("test", "", func(op *Operation) (interface{}, error) {
+		op.SetNodeID("node")
+		op.Progress(0.5, "halfway there")
+		<-proceed
+		return nil, nil
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for op.Snapshot().Progress != 0.5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("progress was not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	snapshot := op.Snapshot()
+	if snapshot.State != StateRunning || snapshot.Message != "halfway there" || snapshot.NodeID != "node" {
+		t.Errorf("unexpected running operation: %+v", snapshot)
+	}
+	if !snapshot.EndedAt.IsZero() {
+		t.Errorf("running operation has an end time")
+	}
+
+	close(proceed)
+	if snapshot := waitDone(t, op); snapshot.Progress != 1 {
+		t.Errorf("expected completed operation to be at 100%%, got %v", snapshot.Progress)
+	}
+}
+
+func TestManager_History(t *testing.T) {
+	manager := NewManager(2)
+
+	block := make(chan struct{})
+	defer close(block)
+	running := manager.Start("running", "", func(op *Operation) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+
+	var done []*Operation
+	for i := 0; i < 3; i++ {
+		op := manager.Start("done", "", func(op *Operation) (interface{}, error) { return nil, nil })
+		waitDone(t, op)
+		done = append(done, op)
+	}
+
+	if manager.Get(running.ID()) == nil {
+		t.Errorf("running operation was evicted from the history")
+	}
+	if manager.Get(done[0].ID()) != nil {
+		t.Errorf("expected the oldest completed operation to be evicted")
+	}
+	if manager.Get(done[2].ID()) == nil {
+		t.Errorf("expected the latest operation to be kept")
+	}
+
+	history := manager.List()
+	if len(history) != 2 || history[0] != running || history[1] != done[2] {
+		t.Errorf("unexpected history: %v", history)
+	}
+}
@@ -0,0 +1,159 @@
+package operation
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The state of an operation.
+type State = string
+
+const (
+	// The operation was created but didn't start running yet.
+	StatePending = "pending"
+
+	// The operation is running.
+	StateRunning = "running"
+
+	// The operation completed successfully.
+	StateSucceeded = "succeeded"
+
+	// The operation failed, its error explains why.
+	StateFailed = "failed"
+)
+
+// A Func is the work done by an operation. Its result is kept along with the operation.
+type Func func(op *Operation) (interface{}, error)
+
+// An Operation tracks a long-running action of the agent.
+type Operation struct {
+	id   string
+	kind string
+	done chan struct{}
+
+	mutex     sync.Mutex
+	nodeID    string
+	state     State
+	progress  float64
+	message   string
+	startedAt time.Time
+	endedAt   time.Time
+	result    interface{}
+	err       error
+}
+
+// A Snapshot is the state of an operation at a given time.
+type Snapshot struct {
+	ID        string
+	Kind      string
+	NodeID    string
+	State     State
+	Progress  float64
+	Message   string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Result    interface{}
+	Err       error
+}
+
+func newOperation(kind, nodeID string) *Operation {
+	return &Operation{
+		id:        uuid.New().String(),
+		kind:      kind,
+		done:      make(chan struct{}),
+		nodeID:    nodeID,
+		state:     StatePending,
+		startedAt: time.Now(),
+	}
+}
+
+func (o *Operation) run(f Func) {
+	defer close(o.done)
+
+	o.mutex.Lock()
+	o.state = StateRunning
+	o.mutex.Unlock()
+
+	result, err := func() (result interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("operation panicked: %v", r)
+			}
+		}()
+		return f(o)
+	}()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.endedAt = time.Now()
+	o.result = result
+	o.err = err
+	if err != nil {
+		o.state = StateFailed
+	} else {
+		o.state = StateSucceeded
+		o.progress = 1
+	}
+}
+
+func (o *Operation) ID() string {
+	return o.id
+}
+
+// SetNodeID records the node an operation acts on, once it is known.
+func (o *Operation) SetNodeID(nodeID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.nodeID = nodeID
+}
+
+// Progress reports how far along the operation is, as a fraction between 0 and 1.
+func (o *Operation) Progress(fraction float64, message string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.progress = fraction
+	o.message = message
+}
+
+// Done returns a channel closed once the operation completed.
+func (o *Operation) Done() <-chan struct{} {
+	return o.done
+}
+
+// Result returns the result of a completed operation.
+func (o *Operation) Result() (interface{}, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.result, o.err
+}
+
+func (o *Operation) Snapshot() Snapshot {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return Snapshot{
+		ID:        o.id,
+		Kind:      o.kind,
+		NodeID:    o.nodeID,
+		State:     o.state,
+		Progress:  o.progress,
+		Message:   o.message,
+		StartedAt: o.startedAt,
+		EndedAt:   o.endedAt,
+		Result:    o.result,
+		Err:       o.err,
+	}
+}
+
+func (o *Operation) isDone() bool {
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
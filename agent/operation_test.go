@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/operation"
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+func TestMenmosAgent_CreateNodeAsync(t *testing.T) {
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+
+	op := agent.CreateNodeAsync(&payload.CreateNodeRequest{Type: payload.NodeMenmosd})
+	if op.Kind != payload.OperationCreateNode {
+		t.Errorf("unexpected operation kind '%s'", op.Kind)
+	}
+
+	op = agent.GetOperation(context.Background(), op.ID, 5*time.Second)
+	if op.State != operation.StateSucceeded || op.EndedAt == nil {
+		t.Fatalf("expected the operation to succeed, got %+v", op)
+	}
+
+	node, ok := op.Result.(*payload.NodeResponse)
+	if !ok || node.ID != op.NodeID || node.Status != xecute.StatusHealthy {
+		t.Errorf("unexpected operation result: %+v", op.Result)
+	}
+}
+
+func TestMenmosAgent_FailedOperation(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	executor.SetStartError(errors.New("boom"))
+
+	op := agent.StartNodeAsync(node.ID)
+	op = agent.GetOperation(context.Background(), op.ID, 5*time.Second)
+	if op.State != operation.StateFailed || op.Error != "boom" || op.NodeID != node.ID {
+		t.Errorf("expected the operation to fail, got %+v", op)
+	}
+}
+
+func TestMenmosAgent_OperationWaitTimeout(t *testing.T) {
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+
+	// An operation waiting on a locked node keeps running.
+	entry := agent.nodes.lock(node.ID)
+
+	op := agent.StopNodeAsync(node.ID)
+	if op := agent.GetOperation(context.Background(), op.ID, 10*time.Millisecond); op.State == operation.StateSucceeded {
+		t.Errorf("expected the operation to be in progress, got %+v", op)
+	}
+
+	agent.nodes.unlock(entry)
+
+	if op := agent.GetOperation(context.Background(), op.ID, 5*time.Second); op.State != operation.StateSucceeded {
+		t.Errorf("expected the operation to succeed, got %+v", op)
+	}
+}
+
+func TestMenmosAgent_OperationHistory(t *testing.T) {
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.DeleteNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if op := agent.GetOperation(context.Background(), "unknown", 0); op != nil {
+		t.Errorf("expected unknown operation to be nil")
+	}
+
+	history := agent.ListOperations().Operations
+	want := []payload.OperationKind{payload.OperationCreateNode, payload.OperationStopNode, payload.OperationDeleteNode}
+	if len(history) != len(want) {
+		t.Fatalf("expected %d operations, got %+v", len(want), history)
+	}
+	for i, op := range history {
+		if op.Kind != want[i] || op.NodeID != node.ID || op.State != operation.StateSucceeded {
+			t.Errorf("unexpected operation %d: %+v", i, op)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/menmos/menmos-agent/agent/portpool"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+func (a *MenmosAgent) initPortPool() error {
+	pool, err := portpool.New(portpool.PoolParams{
+		Config:    a.config.Ports,
+		Path:      a.config.Path,
+		CheckHost: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.ports = pool
+	return nil
+}
+
+func portError(err error) error {
+	if errors.Is(err, portpool.ErrUnavailable) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
+
+// assignPort reserves the port a node should listen on.
+// A requested port is used as-is if no other node holds it and it is free on the host,
+// otherwise a port is picked from the agent port pool.
+func (a *MenmosAgent) assignPort(nodeID string, requested uint16) (uint16, error) {
+	if a.config.AgentType == Kubernetes {
+		// Every pod has its own network namespace, ports can't conflict.
+		return requested, nil
+	}
+
+	port, err := a.ports.Reserve(nodeID, requested)
+	return port, portError(err)
+}
+
+// adoptPort reserves the port a node was assigned previously, even if it is outside of the pool ranges.
+func (a *MenmosAgent) adoptPort(nodeID string, port uint16) error {
+	if a.config.AgentType == Kubernetes {
+		return nil
+	}
+
+	return portError(a.ports.Adopt(nodeID, port))
+}
+
+func (a *MenmosAgent) releasePort(nodeID string) {
+	if err := a.ports.Release(nodeID); err != nil {
+		a.log.Errorf("failed to release port of node '%s': %v", nodeID, err)
+	}
+}
+
+// ListPorts returns the ports currently reserved by nodes.
+func (a *MenmosAgent) ListPorts() *payload.ListPortsResponse {
+	resp := &payload.ListPortsResponse{
+		Ranges:  a.ports.Ranges(),
+		Exclude: a.config.Ports.Exclude,
+	}
+
+	for _, reservation := range a.ports.List() {
+		resp.Ports = append(resp.Ports, payload.PortReservation{
+			Port:       reservation.Port,
+			NodeID:     reservation.NodeID,
+			ReservedAt: reservation.ReservedAt,
+		})
+	}
+
+	return resp
+}
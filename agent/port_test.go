@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/menmos/menmos-agent/agent/portpool"
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+func TestMenmosAgent_RequestedPort(t *testing.T) {
+	port, err := xecute.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node, err := agent.CreateNode(&payload.CreateNodeRequest{
+		Type:   payload.NodeAmphora,
+		Config: map[string]interface{}{"server_port": port, "blob_storage_type": payload.BlobStorageDisk},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.Port != port {
+		t.Errorf("expected node to use port %d, got %d", port, node.Port)
+	}
+
+	info, err := agent.getNodeInfo(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Port != port {
+		t.Errorf("expected port %d to be persisted, got %d", port, info.Port)
+	}
+
+	config, err := os.ReadFile(path.Join(agent.nodeDir(), node.ID, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "port =") {
+		t.Errorf("expected port to be written in the node config: %s", config)
+	}
+
+	// Another node can't claim the same port.
+	_, err = agent.CreateNode(&payload.CreateNodeRequest{
+		Type:   payload.NodeMenmosd,
+		Config: map[string]interface{}{"port": port},
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+}
+
+func TestMenmosAgent_RequestedPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+
+	_, err = agent.CreateNode(&payload.CreateNodeRequest{
+		Type:   payload.NodeMenmosd,
+		Config: map[string]interface{}{"port": uint16(listener.Addr().(*net.TCPAddr).Port)},
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+}
+
+func TestMenmosAgent_PortIsStable(t *testing.T) {
+	workspace := t.TempDir()
+
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	if node.Port == 0 {
+		t.Fatalf("expected a port to be assigned")
+	}
+
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Port != node.Port {
+		t.Errorf("expected port %d after restart, got %d", node.Port, resp.Port)
+	}
+
+	agent.Shutdown()
+
+	restartedExecutor := xecutetest.NewExecutor()
+	newTestAgent(t, workspace, restartedExecutor)
+
+	if port := restartedExecutor.Process(node.ID).Port(); port != node.Port {
+		t.Errorf("expected port %d after agent restart, got %d", node.Port, port)
+	}
+}
+
+func TestMenmosAgent_LegacyNodeGetsPort(t *testing.T) {
+	workspace := t.TempDir()
+
+	nodeDir := path.Join(workspace, "node", "legacy")
+	if err := os.MkdirAll(nodeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonWrite(nodeInfo{Binary: payload.NodeMenmosd}, path.Join(nodeDir, AGENT_NODE_INFO_FILE)); err != nil {
+		t.Fatal(err)
+	}
+
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, workspace, executor)
+
+	info, err := agent.getNodeInfo("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Port == 0 {
+		t.Fatalf("expected a port to be assigned to the legacy node")
+	}
+
+	if port := executor.Process("legacy").Port(); port != info.Port {
+		t.Errorf("expected process to use the persisted port %d, got %d", info.Port, port)
+	}
+}
+
+func TestMenmosAgent_PortPool(t *testing.T) {
+	port, err := xecute.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent := newTestAgentWithConfig(t, Config{
+		AgentType: Native,
+		Path:      t.TempDir(),
+		Ports:     portpool.Config{Ranges: []string{fmt.Sprint(port)}},
+	}, xecutetest.NewExecutor())
+
+	node := createTestNode(t, agent)
+	if node.Port != port {
+		t.Fatalf("expected node to get port %d from the pool, got %d", port, node.Port)
+	}
+
+	// The pool is exhausted.
+	if _, err := agent.CreateNode(&payload.CreateNodeRequest{Type: payload.NodeMenmosd}); err == nil {
+		t.Errorf("expected node creation to fail")
+	}
+
+	ports := agent.ListPorts()
+	if len(ports.Ports) != 1 || ports.Ports[0].NodeID != node.ID || ports.Ports[0].Port != port {
+		t.Errorf("unexpected port allocations: %+v", ports)
+	}
+	if len(ports.Ranges) != 1 || ports.Ranges[0] != fmt.Sprint(port) {
+		t.Errorf("unexpected port ranges: %v", ports.Ranges)
+	}
+
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.DeleteNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if ports := agent.ListPorts(); len(ports.Ports) != 0 {
+		t.Errorf("expected the port to be released, got %+v", ports.Ports)
+	}
+
+	// The released port can be handed out again.
+	if node := createTestNode(t, agent); node.Port != port {
+		t.Errorf("expected released port %d to be reused, got %d", port, node.Port)
+	}
+}
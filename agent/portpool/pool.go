@@ -0,0 +1,319 @@
+package portpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+)
+
+const RESERVATIONS_FILE = "ports.json"
+
+// ErrUnavailable is returned when a requested port can't be reserved.
+var ErrUnavailable = errors.New("port unavailable")
+
+// ErrExhausted is returned when every port of the pool is reserved.
+var ErrExhausted = errors.New("port pool exhausted")
+
+// Config describes which ports the agent may hand out to nodes.
+type Config struct {
+	// Port ranges, e.g. "7000-7999" or "8080". Ephemeral ports are used if empty.
+	Ranges []string `json:"ranges" mapstructure:"RANGES" toml:"ranges"`
+
+	// Ports never handed out, even if they are part of a range.
+	Exclude []uint16 `json:"exclude" mapstructure:"EXCLUDE" toml:"exclude"`
+}
+
+type portRange struct {
+	start uint16
+	end   uint16
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.start && port <= r.end
+}
+
+func (r portRange) String() string {
+	if r.start == r.end {
+		return fmt.Sprint(r.start)
+	}
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+func parseRange(raw string) (portRange, error) {
+	bounds := strings.SplitN(strings.TrimSpace(raw), "-", 2)
+
+	start, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range '%s': %v", raw, err)
+	}
+
+	end := start
+	if len(bounds) == 2 {
+		if end, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil {
+			return portRange{}, fmt.Errorf("invalid port range '%s': %v", raw, err)
+		}
+	}
+
+	if start == 0 || end < start {
+		return portRange{}, fmt.Errorf("invalid port range '%s'", raw)
+	}
+
+	return portRange{start: uint16(start), end: uint16(end)}, nil
+}
+
+// A Reservation records the port assigned to a node.
+type Reservation struct {
+	Port       uint16    `json:"port"`
+	NodeID     string    `json:"node_id"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+type PoolParams struct {
+	Config Config
+
+	// The directory where reservations are persisted.
+	Path string
+
+	// Whether ports must also be free on the host to be handed out.
+	CheckHost bool
+}
+
+// A Pool hands out ports to nodes and keeps track of the reservations.
+type Pool struct {
+	mutex        sync.Mutex
+	ranges       []portRange
+	excluded     map[uint16]bool
+	path         string
+	checkHost    bool
+	reservations map[uint16]Reservation
+}
+
+func New(params PoolParams) (*Pool, error) {
+	pool := &Pool{
+		excluded:     make(map[uint16]bool),
+		path:         filepath.Join(params.Path, RESERVATIONS_FILE),
+		checkHost:    params.CheckHost,
+		reservations: make(map[uint16]Reservation),
+	}
+
+	for _, raw := range params.Config.Ranges {
+		r, err := parseRange(raw)
+		if err != nil {
+			return nil, err
+		}
+		pool.ranges = append(pool.ranges, r)
+	}
+
+	for _, port := range params.Config.Exclude {
+		pool.excluded[port] = true
+	}
+
+	if err := pool.load(); err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+func (p *Pool) load() error {
+	raw, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var reservations []Reservation
+	if err := json.Unmarshal(raw, &reservations); err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		p.reservations[reservation.Port] = reservation
+	}
+
+	return nil
+}
+
+func (p *Pool) save() error {
+	raw, err := json.Marshal(p.listLocked())
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave a truncated file behind.
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, p.path)
+}
+
+func (p *Pool) inRanges(port uint16) bool {
+	if len(p.ranges) == 0 {
+		return true
+	}
+
+	for _, r := range p.ranges {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pool) isFree(port uint16) bool {
+	if _, ok := p.reservations[port]; ok {
+		return false
+	}
+	if p.excluded[port] {
+		return false
+	}
+	return !p.checkHost || xecute.IsPortAvailable(port)
+}
+
+func (p *Pool) nodePort(nodeID string) (uint16, bool) {
+	for port, reservation := range p.reservations {
+		if reservation.NodeID == nodeID {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+func (p *Pool) pick() (uint16, error) {
+	if len(p.ranges) == 0 {
+		for i := 0; i < 100; i++ {
+			port, err := xecute.GetFreePort()
+			if err != nil {
+				return 0, err
+			}
+			if p.isFree(port) {
+				return port, nil
+			}
+		}
+		return 0, ErrExhausted
+	}
+
+	for _, r := range p.ranges {
+		for port := uint32(r.start); port <= uint32(r.end); port++ {
+			if p.isFree(uint16(port)) {
+				return uint16(port), nil
+			}
+		}
+	}
+
+	return 0, ErrExhausted
+}
+
+func (p *Pool) reserveLocked(nodeID string, port uint16) error {
+	// A node holds a single port, so any previous reservation is replaced.
+	if previous, ok := p.nodePort(nodeID); ok && previous != port {
+		delete(p.reservations, previous)
+	}
+
+	p.reservations[port] = Reservation{Port: port, NodeID: nodeID, ReservedAt: time.Now()}
+	return p.save()
+}
+
+// Reserve reserves a port for a node. If requested is zero, a port is picked
+// from the pool ranges, otherwise the requested port must be available.
+func (p *Pool) Reserve(nodeID string, requested uint16) (uint16, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if requested == 0 {
+		port, err := p.pick()
+		if err != nil {
+			return 0, err
+		}
+		return port, p.reserveLocked(nodeID, port)
+	}
+
+	if reservation, ok := p.reservations[requested]; ok {
+		if reservation.NodeID == nodeID {
+			return requested, nil
+		}
+		return 0, fmt.Errorf("%w: port %d is already reserved by node '%s'", ErrUnavailable, requested, reservation.NodeID)
+	}
+
+	if !p.inRanges(requested) || p.excluded[requested] {
+		return 0, fmt.Errorf("%w: port %d is outside of the agent port ranges", ErrUnavailable, requested)
+	}
+
+	if p.checkHost && !xecute.IsPortAvailable(requested) {
+		return 0, fmt.Errorf("%w: port %d is already in use", ErrUnavailable, requested)
+	}
+
+	return requested, p.reserveLocked(nodeID, requested)
+}
+
+// Adopt records a port a node already uses, without checking it against the pool ranges.
+// It is used for nodes that were assigned a port before the pool configuration changed.
+func (p *Pool) Adopt(nodeID string, port uint16) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if reservation, ok := p.reservations[port]; ok {
+		if reservation.NodeID == nodeID {
+			return nil
+		}
+		return fmt.Errorf("%w: port %d is already reserved by node '%s'", ErrUnavailable, port, reservation.NodeID)
+	}
+
+	return p.reserveLocked(nodeID, port)
+}
+
+// Release frees the port reserved by a node, if any.
+func (p *Pool) Release(nodeID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	port, ok := p.nodePort(nodeID)
+	if !ok {
+		return nil
+	}
+
+	delete(p.reservations, port)
+	return p.save()
+}
+
+func (p *Pool) listLocked() []Reservation {
+	reservations := make([]Reservation, 0, len(p.reservations))
+	for _, reservation := range p.reservations {
+		reservations = append(reservations, reservation)
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Port < reservations[j].Port
+	})
+
+	return reservations
+}
+
+// List returns the current reservations, ordered by port.
+func (p *Pool) List() []Reservation {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.listLocked()
+}
+
+// Ranges returns the configured port ranges.
+func (p *Pool) Ranges() []string {
+	ranges := make([]string, len(p.ranges))
+	for i, r := range p.ranges {
+		ranges[i] = r.String()
+	}
+	return ranges
+}
@@ -0,0 +1,179 @@
+package portpool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestPool(t *testing.T, path string, config Config) *Pool {
+	pool, err := New(PoolParams{Config: config, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func Test_parseRange(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    portRange
+		wantErr bool
+	}{
+		{"7000-7010", portRange{7000, 7010}, false},
+		{" 7000 - 7010 ", portRange{7000, 7010}, false},
+		{"8080", portRange{8080, 8080}, false},
+		{"7010-7000", portRange{}, true},
+		{"0-10", portRange{}, true},
+		{"70000", portRange{}, true},
+		{"abc", portRange{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseRange(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPool_ReserveFromRanges(t *testing.T) {
+	pool := newTestPool(t, t.TempDir(), Config{Ranges: []string{"7000-7002", "7100"}, Exclude: []uint16{7001}})
+
+	var got []uint16
+	for i := 0; i < 3; i++ {
+		port, err := pool.Reserve(fmt.Sprintf("node-%d", i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, port)
+	}
+
+	want := []uint16{7000, 7002, 7100}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected ports %v, got %v", want, got)
+		}
+	}
+
+	if _, err := pool.Reserve("node-3", 0); !errors.Is(err, ErrExhausted) {
+		t.Errorf("expected the pool to be exhausted, got %v", err)
+	}
+
+	if err := pool.Release("node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := pool.Reserve("node-3", 0); err != nil || port != 7002 {
+		t.Errorf("expected released port 7002 to be reused, got %d (%v)", port, err)
+	}
+}
+
+func TestPool_ReserveRequested(t *testing.T) {
+	pool := newTestPool(t, t.TempDir(), Config{Ranges: []string{"7000-7010"}, Exclude: []uint16{7005}})
+
+	if port, err := pool.Reserve("a", 7003); err != nil || port != 7003 {
+		t.Fatalf("expected port 7003, got %d (%v)", port, err)
+	}
+
+	// Reserving the same port again for the same node is a no-op.
+	if _, err := pool.Reserve("a", 7003); err != nil {
+		t.Errorf("expected reservation to be idempotent, got %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		requested uint16
+	}{
+		{"reservedByAnotherNode", 7003},
+		{"excluded", 7005},
+		{"outsideOfRanges", 8000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := pool.Reserve("b", tt.requested); !errors.Is(err, ErrUnavailable) {
+				t.Errorf("expected port %d to be unavailable, got %v", tt.requested, err)
+			}
+		})
+	}
+
+	// A node holds a single port.
+	if _, err := pool.Reserve("a", 7004); err != nil {
+		t.Fatal(err)
+	}
+	if reservations := pool.List(); len(reservations) != 1 || reservations[0].Port != 7004 {
+		t.Errorf("expected the previous reservation to be replaced, got %+v", reservations)
+	}
+}
+
+func TestPool_Adopt(t *testing.T) {
+	pool := newTestPool(t, t.TempDir(), Config{Ranges: []string{"7000-7010"}})
+
+	if err := pool.Adopt("legacy", 9000); err != nil {
+		t.Fatalf("expected a port outside of the ranges to be adopted, got %v", err)
+	}
+
+	if err := pool.Adopt("other", 9000); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected an adopted port to be unavailable to other nodes, got %v", err)
+	}
+}
+
+func TestPool_Persistence(t *testing.T) {
+	workspace := t.TempDir()
+
+	pool := newTestPool(t, workspace, Config{Ranges: []string{"7000-7010"}})
+	if _, err := pool.Reserve("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Reserve("b", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestPool(t, workspace, Config{Ranges: []string{"7000-7010"}})
+	reservations := reloaded.List()
+	if len(reservations) != 1 || reservations[0].NodeID != "b" || reservations[0].Port != 7001 {
+		t.Errorf("unexpected reservations after reload: %+v", reservations)
+	}
+}
+
+func TestPool_ConcurrentReservations(t *testing.T) {
+	pool := newTestPool(t, t.TempDir(), Config{})
+
+	const nodes = 50
+
+	var wg sync.WaitGroup
+	ports := make([]uint16, nodes)
+	errs := make([]error, nodes)
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ports[i], errs[i] = pool.Reserve(fmt.Sprintf("node-%d", i), 0)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint16]bool)
+	for i, port := range ports {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if seen[port] {
+			t.Fatalf("port %d was handed out twice", port)
+		}
+		seen[port] = true
+	}
+}
+
+func TestNew_InvalidRange(t *testing.T) {
+	if _, err := New(PoolParams{Config: Config{Ranges: []string{"nope"}}, Path: t.TempDir()}); err == nil {
+		t.Errorf("expected an error for an invalid range")
+	}
+}
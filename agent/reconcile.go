@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+)
+
+const (
+	AGENT_NODE_STATE_FILE = ".agent_node_state.json"
+	RECONCILE_INTERVAL    = 10 * time.Second
+)
+
+// The state an operator wants a node to be in.
+type DesiredState = string
+
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// nodeState is persisted next to the node info, and updated every time the node is started or stopped through the agent.
+type nodeState struct {
+	Desired   DesiredState `json:"desired"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// reconcileStatus is what the reconciler remembers of a node between two passes.
+type reconcileStatus struct {
+	// The desired state the current process of the node was converged to.
+	applied DesiredState
+
+	// The drift reported during the last pass, logged once when it appears.
+	drift string
+
+	// The restarts of the node since it was last seen healthy, when its restart policy allows them and its runtime
+	// didn't restart it. They are spaced by the backoff of the policy, and the node is parked once it crash loops.
+	restarts    uint
+	nextRestart time.Time
+	crashes     *xecute.CrashLoopDetector
+	parked      bool
+
+	// The restarts of the current process by its runtime when the node was last seen healthy.
+	healthyRestarts uint
+}
+
+func (a *MenmosAgent) getNodeState(nodeID string) (nodeState, error) {
+	stateBytes, err := os.ReadFile(path.Join(a.nodeDir(), nodeID, AGENT_NODE_STATE_FILE))
+	if os.IsNotExist(err) {
+		// Nodes created before desired states were persisted were always restarted.
+		return nodeState{Desired: DesiredRunning}, nil
+	}
+	if err != nil {
+		return nodeState{}, err
+	}
+
+	var state nodeState
+	if err := json.Unmarshal(stateBytes, &state); err != nil {
+		return nodeState{}, err
+	}
+
+	return state, nil
+}
+
+func (a *MenmosAgent) setDesiredState(nodeID string, desired DesiredState) error {
+	state := nodeState{Desired: desired, UpdatedAt: time.Now()}
+	return jsonWrite(state, path.Join(a.nodeDir(), nodeID, AGENT_NODE_STATE_FILE))
+}
+
+// nodeIDs returns the IDs of every node in the agent workspace.
+func (a *MenmosAgent) nodeIDs() ([]string, error) {
+	entries, err := os.ReadDir(a.nodeDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var nodeIDs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			nodeIDs = append(nodeIDs, entry.Name())
+		}
+	}
+
+	return nodeIDs, nil
+}
+
+// nodeDrift describes how the actual status of a node differs from its desired state.
+// It returns an empty string if the node converged.
+func nodeDrift(desired DesiredState, process xecute.Process) string {
+	status := xecute.StatusStopped
+	if process != nil {
+		status = process.Status()
+	}
+
+	if desired == DesiredRunning && isStopped(status) {
+		return fmt.Sprintf("node should be running but is %s", status)
+	}
+	if desired == DesiredStopped && !isStopped(status) {
+		return fmt.Sprintf("node should be stopped but is %s", status)
+	}
+
+	return ""
+}
+
+// startProcess starts a new process for a node. It is only called by the reconciler, with the node locked.
+func (a *MenmosAgent) startProcess(nodeID string, entry *nodeEntry, info nodeInfo) error {
+	persistedPort := info.Port
+
+	if info.Port == 0 {
+		// Nodes created before ports were persisted get one assigned once.
+		var err error
+		if info.Port, err = a.assignPort(nodeID, 0); err != nil {
+			return err
+		}
+	} else if err := a.adoptPort(nodeID, info.Port); err != nil {
+		return err
+	} else if a.config.AgentType != Kubernetes && !xecute.IsPortAvailable(info.Port) {
+		return fmt.Errorf("%w: port %d of node '%s' is already in use", ErrConflict, info.Port, nodeID)
+	}
+
+	// Processes replacing a restarted process only get the retries the node has left.
+	spec := info
+	spec.RestartPolicy = info.RestartPolicy.Remaining(entry.reconcile.restarts)
+
+	process, err := a.newProcess(nodeID, spec)
+	if err != nil {
+		return err
+	}
+
+	if err := process.Start(xecute.LogNormal); err != nil { // TODO: Find a way to customize this loglevel.
+		process.Close()
+		return err
+	}
+
+	// The previous process stopped, its log file is released.
+	if previous := entry.process; previous != nil {
+		if err := previous.Close(); err != nil {
+			a.log.Warnf("failed to close the previous process of node '%s': %v", nodeID, err)
+		}
+	}
+	a.nodes.setProcess(entry, process)
+
+	// The port is persisted so the node keeps it. Executors may also pick one if none was assigned.
+	if port := process.Port(); port != persistedPort {
+		info.Port = port
+		if err := jsonWrite(info, path.Join(a.nodeDir(), nodeID, AGENT_NODE_INFO_FILE)); err != nil {
+			return err
+		}
+	}
+
+	a.log.Infof("node '%s' started", nodeID)
+
+	return nil
+}
+
+// reconcileNode converges the status of a node toward its desired state. The node must be locked.
+// A node that should be running is started again whenever its process exited, unless it crash loops.
+func (a *MenmosAgent) reconcileNode(nodeID string, entry *nodeEntry) error {
+	info, err := a.getNodeInfo(nodeID)
+	if err != nil {
+		return err
+	}
+
+	state, err := a.getNodeState(nodeID)
+	if err != nil {
+		return err
+	}
+
+	status := &entry.reconcile
+	process := entry.process
+
+	if status.applied != state.Desired {
+		// Restarts are counted anew once the node converges to a new desired state.
+		*status = reconcileStatus{drift: status.drift}
+		a.nodes.park(entry, nil)
+
+		switch state.Desired {
+		case DesiredRunning:
+			if process == nil || isStopped(process.Status()) {
+				if err := a.startProcess(nodeID, entry, info); err != nil {
+					return err
+				}
+				process = entry.process
+			}
+		case DesiredStopped:
+			if process != nil && !isStopped(process.Status()) {
+				if err := process.Stop(); err != nil {
+					return err
+				}
+				a.log.Infof("node '%s' stopped", nodeID)
+			}
+		default:
+			return fmt.Errorf("unknown desired state '%s' for node '%s'", state.Desired, nodeID)
+		}
+
+		status.applied = state.Desired
+	} else if state.Desired == DesiredRunning && process != nil {
+		if err := a.recoverNode(nodeID, entry, info); err != nil {
+			return err
+		}
+		process = entry.process
+	}
+
+	drift := nodeDrift(state.Desired, process)
+	if drift != "" && drift != status.drift {
+		a.log.Warnf("node '%s' drifted from its desired state: %s", nodeID, drift)
+	}
+	status.drift = drift
+
+	return nil
+}
+
+// logTail returns the last lines of a node, parsed as JSON when possible like the lines of the crash loops reported by
+// the runtimes.
+func logTail(lines []xecute.LogLine) []interface{} {
+	tail := make([]interface{}, len(lines))
+	for i, line := range lines {
+		tail[i] = line.Entry()
+	}
+	return tail
+}
+
+// recoverNode starts a new process for a node that should be running, once its process exited and its runtime didn't
+// restart it. The node must be locked. Like the runtimes, it only restarts nodes whose restart policy allows it, and
+// the restarts of the runtimes count toward the retries of the policy. Restarts wait for the backoff of the policy,
+// and a node crashing repeatedly is parked until it is started again through the agent.
+func (a *MenmosAgent) recoverNode(nodeID string, entry *nodeEntry, info nodeInfo) error {
+	status := &entry.reconcile
+	process := entry.process
+	processStatus := process.Status()
+
+	if processStatus == xecute.StatusHealthy {
+		// The process came up properly, so failures are counted anew.
+		status.restarts = 0
+		status.nextRestart = time.Time{}
+		status.healthyRestarts = process.Restarts()
+		return nil
+	}
+
+	// Processes still managed by their runtime, including the ones waiting to be restarted by their restart policy,
+	// are left alone. So are parked nodes.
+	if !isStopped(processStatus) || processStatus == xecute.StatusCrashLoop || status.parked {
+		return nil
+	}
+
+	attempt := status.restarts + process.Restarts() - status.healthyRestarts
+	cleanExit := processStatus == xecute.StatusStopped
+	if !info.RestartPolicy.ShouldRestart(cleanExit, attempt) || time.Now().Before(status.nextRestart) {
+		return nil
+	}
+
+	if !cleanExit {
+		if status.crashes == nil {
+			status.crashes = xecute.NewCrashLoopDetector(info.RestartPolicy)
+		}
+		if status.crashes.Record(time.Now()) {
+			status.parked = true
+			a.nodes.park(entry, &xecute.CrashLoop{
+				Since:        time.Now(),
+				Crashes:      status.crashes.Count(),
+				Window:       status.crashes.Window(),
+				LastExitCode: process.LastExitCode(),
+				LogTail:      logTail(process.GetLogs(xecute.CRASH_LOOP_LOG_LINES)),
+			})
+			a.log.Errorf("node '%s' crashed %d times, not restarting it until it is started", nodeID, status.crashes.Count())
+			return nil
+		}
+	}
+
+	// The backoff also applies when the process fails to start.
+	status.nextRestart = time.Now().Add(info.RestartPolicy.Backoff(attempt))
+	status.restarts = attempt + 1
+	status.healthyRestarts = 0
+
+	a.log.Warnf("node '%s' exited with status '%s', restarting it", nodeID, processStatus)
+	return a.startProcess(nodeID, entry, info)
+}
+
+// reconcile converges every node of the agent toward its desired state.
+func (a *MenmosAgent) reconcile() {
+	nodeIDs, err := a.nodeIDs()
+	if err != nil {
+		a.log.Errorf("failed to list nodes: %v", err)
+		return
+	}
+
+	for _, nodeID := range nodeIDs {
+		entry := a.nodes.lock(nodeID)
+		err := a.reconcileNode(nodeID, entry)
+		if errors.Is(err, os.ErrNotExist) {
+			// Don't keep an entry around for a node that was deleted.
+			a.nodes.remove(nodeID, entry)
+		}
+		a.nodes.unlock(entry)
+
+		// Nodes can be deleted, or still being created, while the pass runs.
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			a.log.Errorf("failed to reconcile node '%s': %v", nodeID, err)
+		}
+	}
+}
+
+func (a *MenmosAgent) reconcileLoop() {
+	ticker := time.NewTicker(a.reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.reconcile()
+		case <-a.stopLoops:
+			return
+		}
+	}
+}
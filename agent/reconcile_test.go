@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+	"go.uber.org/zap"
+)
+
+func TestMenmosAgent_StoppedNodeStaysStopped(t *testing.T) {
+	workspace := t.TempDir()
+
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	agent.Shutdown()
+
+	restartedExecutor := xecutetest.NewExecutor()
+	restarted := newTestAgent(t, workspace, restartedExecutor)
+
+	if restartedExecutor.ProcessCount() != 0 {
+		t.Errorf("expected a stopped node not to be restarted")
+	}
+
+	nodes, err := restarted.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Nodes) != 1 {
+		t.Fatalf("expected the stopped node to be listed, got %+v", nodes.Nodes)
+	}
+
+	resp := nodes.Nodes[0]
+	if resp.Status != xecute.StatusStopped || resp.DesiredState != DesiredStopped || resp.Drift != "" {
+		t.Errorf("unexpected node: %+v", resp)
+	}
+	if resp.Port != node.Port {
+		t.Errorf("expected port %d, got %d", node.Port, resp.Port)
+	}
+
+	if err := restarted.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if restartedExecutor.Process(node.ID).Starts() != 1 {
+		t.Errorf("expected the node to be started")
+	}
+}
+
+func TestMenmosAgent_ReconcileRetriesFailedStart(t *testing.T) {
+	workspace := t.TempDir()
+
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	agent.Shutdown()
+
+	executor := xecutetest.NewExecutor()
+	executor.StartError = errors.New("boom")
+	restarted := newTestAgent(t, workspace, executor)
+
+	resp, err := restarted.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DesiredState != DesiredRunning || resp.Drift == "" {
+		t.Errorf("expected the node to drift from its desired state, got %+v", resp)
+	}
+
+	executor.SetStartError(nil)
+	restarted.reconcile()
+
+	resp, err = restarted.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != xecute.StatusHealthy || resp.Drift != "" {
+		t.Errorf("expected the node to converge, got %+v", resp)
+	}
+}
+
+func TestMenmosAgent_ReconcileLeavesExitedNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *payload.RestartPolicy
+		exit   func(process *xecutetest.Process)
+	}{
+		{"never", &payload.RestartPolicy{Mode: payload.RestartNever}, func(p *xecutetest.Process) { p.Crash(1) }},
+		{"defaultPolicy", nil, func(p *xecutetest.Process) { p.Crash(1) }},
+		{"onFailureCleanExit", &payload.RestartPolicy{Mode: payload.RestartOnFailure}, func(p *xecutetest.Process) { p.SetStatus(xecute.StatusStopped) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executor := xecutetest.NewExecutor()
+			agent := newTestAgent(t, t.TempDir(), executor)
+
+			node := createTestNodeWithPolicy(t, agent, tt.policy)
+			exited := executor.Process(node.ID)
+			tt.exit(exited)
+
+			agent.reconcile()
+
+			if executor.Process(node.ID) != exited || exited.Starts() != 1 {
+				t.Errorf("expected the restart policy to handle the exit")
+			}
+
+			resp, err := agent.GetNode(node.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Drift == "" {
+				t.Errorf("expected the exited node to be reported as drifting, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestMenmosAgent_ReconcileRestartsExitedNode(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	crashed := executor.Process(node.ID)
+	crashed.Crash(1)
+
+	agent.reconcile()
+
+	restarted := executor.Process(node.ID)
+	if restarted == crashed || restarted.Starts() != 1 {
+		t.Fatalf("expected the reconciler to start a new process")
+	}
+	if !crashed.Closed() || restarted.Closed() {
+		t.Errorf("expected the log file of the crashed process to be released")
+	}
+	if retries := restarted.Spec.RestartPolicy.MaxRetries; retries != 2 {
+		t.Errorf("expected the new process to get the retries left, got %d", retries)
+	}
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != xecute.StatusHealthy || resp.Drift != "" {
+		t.Errorf("expected the node to converge again, got %+v", resp)
+	}
+}
+
+// crashAndReconcile crashes the process of a node, and runs a reconciliation pass without waiting for the backoff.
+func crashAndReconcile(agent *MenmosAgent, executor *xecutetest.Executor, nodeID string) {
+	executor.Process(nodeID).Crash(1)
+
+	entry := agent.nodes.lock(nodeID)
+	entry.reconcile.nextRestart = time.Time{}
+	agent.nodes.unlock(entry)
+
+	agent.reconcile()
+}
+
+func TestMenmosAgent_ReconcileUsesUpRetries(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	// The node allows 3 restarts, the processes crash before becoming healthy.
+	node := createTestNode(t, agent)
+	for i := 0; i < 3; i++ {
+		crashAndReconcile(agent, executor, node.ID)
+	}
+	last := executor.Process(node.ID)
+	if last.Spec.RestartPolicy.Mode != xecute.RestartNever {
+		t.Errorf("expected the last process not to be restarted by its runtime, got %+v", last.Spec.RestartPolicy)
+	}
+
+	crashAndReconcile(agent, executor, node.ID)
+	if executor.Process(node.ID) != last {
+		t.Errorf("expected the node not to be restarted once its retries are used up")
+	}
+}
+
+func TestMenmosAgent_ReconcileBacksOffRestarts(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	executor.Process(node.ID).Crash(1)
+	agent.reconcile()
+
+	// The restarted process exits before becoming healthy, the next restart waits for the backoff.
+	restarted := executor.Process(node.ID)
+	restarted.Crash(1)
+	agent.reconcile()
+
+	if executor.Process(node.ID) != restarted {
+		t.Errorf("expected the node not to be restarted before the backoff elapsed")
+	}
+}
+
+func TestMenmosAgent_ReconcileParksCrashLoopingNode(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+	node := createTestNodeWithPolicy(t, agent, &payload.RestartPolicy{Mode: payload.RestartOnFailure})
+
+	// Crash loops parked by the runtime are left alone.
+	parked := executor.Process(node.ID)
+	parked.CrashLoopWith(xecute.CrashLoop{Crashes: 5, LastExitCode: 101})
+	agent.reconcile()
+	if executor.Process(node.ID) != parked {
+		t.Fatalf("expected a crash looping node not to be restarted")
+	}
+
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Processes crashing right after being restarted by the reconciler are parked as well.
+	for i := 0; i < xecute.DefaultCrashLoopThreshold; i++ {
+		crashAndReconcile(agent, executor, node.ID)
+	}
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != xecute.StatusCrashLoop || resp.Drift == "" {
+		t.Errorf("expected the node to be parked, got %+v", resp)
+	}
+	if resp.CrashLoop == nil || resp.CrashLoop.Crashes != xecute.DefaultCrashLoopThreshold ||
+		resp.CrashLoop.WindowMs != uint64(xecute.DefaultCrashLoopWindow/time.Millisecond) || resp.CrashLoop.LastExitCode != 1 {
+		t.Errorf("expected the crash loop the node was parked in, got %+v", resp.CrashLoop)
+	}
+
+	// Starting the node through the agent clears the crashes.
+	if err := agent.StartNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := agent.GetNode(node.ID); err != nil || resp.Status != xecute.StatusHealthy || resp.CrashLoop != nil {
+		t.Errorf("expected the node to be started, got %+v, %v", resp, err)
+	}
+}
+
+func TestMenmosAgent_ReconcileStopsNode(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	if err := agent.setDesiredState(node.ID, DesiredStopped); err != nil {
+		t.Fatal(err)
+	}
+
+	agent.reconcile()
+
+	if status := executor.Process(node.ID).Status(); status != xecute.StatusStopped {
+		t.Errorf("expected the node to be stopped, got '%s'", status)
+	}
+}
+
+func TestMenmosAgent_ReconcileLoop(t *testing.T) {
+	workspace := t.TempDir()
+
+	agent := newTestAgent(t, workspace, xecutetest.NewExecutor())
+	node := createTestNode(t, agent)
+	agent.Shutdown()
+
+	executor := xecutetest.NewExecutor()
+	executor.StartError = errors.New("boom")
+
+	restarted, err := newAgent(Config{AgentType: Native, Path: workspace}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.executor = executor
+	restarted.reconcileInterval = 10 * time.Millisecond
+	if err := restarted.init(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Shutdown()
+
+	executor.SetStartError(nil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := restarted.GetNode(node.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == xecute.StatusHealthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the reconciler didn't start the node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
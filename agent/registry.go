@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+)
+
+// A nodeEntry holds the runtime state of a node.
+type nodeEntry struct {
+	// Serialises the operations on the node (create, start, stop, delete and reconciliation).
+	mutex sync.Mutex
+
+	// Guarded by the registry mutex, so the node can be read while an operation is in progress.
+	process xecute.Process
+	removed bool
+
+	// The crash loop the reconciler parked the node in, nil if it isn't parked.
+	crashLoop *xecute.CrashLoop
+
+	// Guarded by the entry mutex.
+	reconcile reconcileStatus
+}
+
+// A nodeRegistry keeps track of the nodes managed by the agent.
+type nodeRegistry struct {
+	mutex sync.Mutex
+	nodes map[string]*nodeEntry
+}
+
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{nodes: make(map[string]*nodeEntry)}
+}
+
+// lock returns the entry of a node, locked for an operation. The entry is created if needed.
+func (r *nodeRegistry) lock(nodeID string) *nodeEntry {
+	for {
+		r.mutex.Lock()
+		entry, ok := r.nodes[nodeID]
+		if !ok {
+			entry = &nodeEntry{}
+			r.nodes[nodeID] = entry
+		}
+		r.mutex.Unlock()
+
+		entry.mutex.Lock()
+
+		r.mutex.Lock()
+		removed := entry.removed
+		r.mutex.Unlock()
+
+		if !removed {
+			return entry
+		}
+
+		// The node was removed while we were waiting for it, the next operation starts from a fresh entry.
+		entry.mutex.Unlock()
+	}
+}
+
+func (r *nodeRegistry) unlock(entry *nodeEntry) {
+	entry.mutex.Unlock()
+}
+
+// remove forgets a node. The entry must be locked.
+func (r *nodeRegistry) remove(nodeID string, entry *nodeEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry.removed = true
+	entry.process = nil
+	if r.nodes[nodeID] == entry {
+		delete(r.nodes, nodeID)
+	}
+}
+
+// process returns the current process of a node, or nil if it has none.
+func (r *nodeRegistry) process(nodeID string) xecute.Process {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry, ok := r.nodes[nodeID]; ok {
+		return entry.process
+	}
+	return nil
+}
+
+// parked returns the crash loop the reconciler parked a node in, or nil if it isn't parked.
+func (r *nodeRegistry) parked(nodeID string) *xecute.CrashLoop {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if entry, ok := r.nodes[nodeID]; ok {
+		return entry.crashLoop
+	}
+	return nil
+}
+
+// park records the crash loop the reconciler parked a node in, nil once it is started again. The entry must be locked.
+func (r *nodeRegistry) park(entry *nodeEntry, crashLoop *xecute.CrashLoop) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry.crashLoop = crashLoop
+}
+
+// setProcess replaces the process of a node. The entry must be locked.
+func (r *nodeRegistry) setProcess(entry *nodeEntry, process xecute.Process) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry.process = process
+}
+
+// processes returns the current process of every node that has one.
+func (r *nodeRegistry) processes() map[string]xecute.Process {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	processes := make(map[string]xecute.Process)
+	for nodeID, entry := range r.nodes {
+		if entry.process != nil {
+			processes[nodeID] = entry.process
+		}
+	}
+	return processes
+}
@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/agent/xecute/xecutetest"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+func TestNodeRegistry_LockAfterRemove(t *testing.T) {
+	registry := newNodeRegistry()
+
+	entry := registry.lock("a")
+	process, err := xecutetest.NewExecutor().NewProcess(xecute.ProcessSpec{NodeID: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.setProcess(entry, process)
+
+	locked := make(chan *nodeEntry)
+	go func() {
+		locked <- registry.lock("a")
+	}()
+
+	registry.remove("a", entry)
+	registry.unlock(entry)
+
+	next := <-locked
+	defer registry.unlock(next)
+
+	if next == entry {
+		t.Errorf("expected a fresh entry after the node was removed")
+	}
+	if registry.process("a") != nil {
+		t.Errorf("expected the removed node to have no process")
+	}
+}
+
+func TestMenmosAgent_ConcurrentStart(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	stopped := executor.Process(node.ID)
+
+	const callers = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- agent.StartNode(node.ID)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	var started int
+	for err := range errs {
+		if err == nil {
+			started += 1
+		}
+	}
+
+	if started != 1 {
+		t.Errorf("expected a single start to succeed, got %d", started)
+	}
+
+	process := executor.Process(node.ID)
+	if process == stopped || process.Starts() != 1 {
+		t.Errorf("expected a single new process to be started")
+	}
+}
+
+func TestMenmosAgent_ConcurrentCreate(t *testing.T) {
+	agent := newTestAgent(t, t.TempDir(), xecutetest.NewExecutor())
+
+	const nodes = 20
+
+	var wg sync.WaitGroup
+	responses := make(chan *payload.NodeResponse, nodes)
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node, err := agent.CreateNode(&payload.CreateNodeRequest{Type: payload.NodeMenmosd})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			responses <- node
+		}()
+	}
+	wg.Wait()
+	close(responses)
+
+	ports := make(map[uint16]string)
+	for node := range responses {
+		if owner, ok := ports[node.Port]; ok {
+			t.Errorf("nodes '%s' and '%s' got the same port %d", owner, node.ID, node.Port)
+		}
+		ports[node.Port] = node.ID
+	}
+
+	list, err := agent.ListNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Nodes) != nodes {
+		t.Errorf("expected %d nodes, got %d", nodes, len(list.Nodes))
+	}
+}
+
+func TestMenmosAgent_ConcurrentOperations(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	var nodeIDs []string
+	for i := 0; i < 4; i++ {
+		nodeIDs = append(nodeIDs, createTestNode(t, agent).ID)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, nodeID := range nodeIDs {
+			wg.Add(1)
+			go func(i int, nodeID string) {
+				defer wg.Done()
+
+				// Errors are expected, operations conflict with each other on purpose.
+				switch i % 5 {
+				case 0:
+					agent.StartNode(nodeID)
+				case 1:
+					agent.StopNode(nodeID)
+				case 2:
+					agent.GetNode(nodeID)
+					agent.GetNodeLogs(nodeID, xecute.LogQuery{Limit: 10})
+				case 3:
+					agent.ListNodes()
+					agent.ListPorts()
+				case 4:
+					agent.reconcile()
+				}
+			}(i, nodeID)
+		}
+	}
+	wg.Wait()
+
+	// Nodes converge to their desired state once the dust settles.
+	agent.reconcile()
+	for _, nodeID := range nodeIDs {
+		node, err := agent.GetNode(nodeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Drift != "" {
+			t.Errorf("node '%s' didn't converge: %s", nodeID, node.Drift)
+		}
+	}
+
+	agent.Shutdown()
+}
+
+func TestMenmosAgent_ConcurrentDelete(t *testing.T) {
+	executor := xecutetest.NewExecutor()
+	agent := newTestAgent(t, t.TempDir(), executor)
+
+	node := createTestNode(t, agent)
+	if err := agent.StopNode(node.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				agent.DeleteNode(node.ID)
+			} else {
+				agent.StartNode(node.ID)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := agent.GetNode(node.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp == nil {
+		// The node was deleted, it must not have a running process left behind.
+		if process := agent.nodes.process(node.ID); process != nil {
+			t.Errorf("deleted node still has a process")
+		}
+		if status := executor.Process(node.ID).Status(); status != xecute.StatusStopped {
+			t.Errorf("deleted node process is '%s'", status)
+		}
+	} else if resp.Status != xecute.StatusHealthy {
+		t.Errorf("expected the node to be running, got '%s'", resp.Status)
+	}
+}
@@ -0,0 +1,69 @@
+package xecute
+
+import "time"
+
+const (
+	DefaultCrashLoopThreshold = 5
+	DefaultCrashLoopWindow    = 10 * time.Minute
+
+	// Number of log lines kept when a process is parked in a crash loop.
+	CRASH_LOOP_LOG_LINES = 50
+)
+
+// CrashLoop explains why a process was parked in the crash loop status.
+type CrashLoop struct {
+	Since        time.Time
+	Crashes      uint
+	Window       time.Duration
+	LastExitCode int
+	LogTail      []interface{}
+}
+
+// A CrashLoopDetector keeps the history of process crashes in a sliding window.
+type CrashLoopDetector struct {
+	threshold uint
+	window    time.Duration
+	crashes   []time.Time
+}
+
+func NewCrashLoopDetector(policy RestartPolicy) *CrashLoopDetector {
+	threshold := policy.CrashLoopThreshold
+	if threshold == 0 {
+		threshold = DefaultCrashLoopThreshold
+	}
+
+	window := policy.CrashLoopWindow
+	if window <= 0 {
+		window = DefaultCrashLoopWindow
+	}
+
+	return &CrashLoopDetector{
+		threshold: threshold,
+		window:    window,
+	}
+}
+
+// Record adds a crash to the history and returns whether the process is crash looping.
+func (d *CrashLoopDetector) Record(at time.Time) bool {
+	d.crashes = append(d.crashes, at)
+
+	// Drop the crashes that fell out of the window.
+	cutoff := at.Add(-d.window)
+	firstInWindow := 0
+	for firstInWindow < len(d.crashes) && d.crashes[firstInWindow].Before(cutoff) {
+		firstInWindow++
+	}
+	d.crashes = d.crashes[firstInWindow:]
+
+	return uint(len(d.crashes)) >= d.threshold
+}
+
+// Count returns the number of crashes currently in the window.
+func (d *CrashLoopDetector) Count() uint {
+	return uint(len(d.crashes))
+}
+
+// Window returns how long crashes are remembered.
+func (d *CrashLoopDetector) Window() time.Duration {
+	return d.window
+}
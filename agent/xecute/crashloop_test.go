@@ -0,0 +1,48 @@
+package xecute
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCrashLoopDetector_Record(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		offsets []time.Duration
+		want    bool
+	}{
+		{"singleCrash", []time.Duration{0}, false},
+		{"belowThreshold", []time.Duration{0, time.Second}, false},
+		{"thresholdReached", []time.Duration{0, time.Second, 2 * time.Second}, true},
+		{"crashesOutsideWindow", []time.Duration{0, time.Minute, 2 * time.Minute}, false},
+		{"slidingWindow", []time.Duration{0, 2 * time.Minute, 2*time.Minute + time.Second, 2*time.Minute + 2*time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewCrashLoopDetector(RestartPolicy{CrashLoopThreshold: 3, CrashLoopWindow: 30 * time.Second})
+
+			var got bool
+			for _, offset := range tt.offsets {
+				got = d.Record(start.Add(offset))
+			}
+
+			if got != tt.want {
+				t.Errorf("CrashLoopDetector.Record() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrashLoopDetector_defaults(t *testing.T) {
+	d := NewCrashLoopDetector(RestartPolicy{})
+
+	if d.threshold != DefaultCrashLoopThreshold {
+		t.Errorf("expected threshold %d got %d", DefaultCrashLoopThreshold, d.threshold)
+	}
+
+	if d.window != DefaultCrashLoopWindow {
+		t.Errorf("expected window %v got %v", DefaultCrashLoopWindow, d.window)
+	}
+}
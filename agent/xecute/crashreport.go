@@ -0,0 +1,65 @@
+package xecute
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// The crash report of a node, in the node directory.
+	CRASH_REPORT_FILE = "crash.json"
+
+	// Number of stderr lines kept in a crash report.
+	CRASH_REPORT_LINES = 50
+)
+
+// A CrashReport holds the last lines a process wrote to stderr before exiting abnormally. Processes running on a
+// runtime that doesn't separate stdout from stderr report their combined output.
+type CrashReport struct {
+	// When the process started and when it exited.
+	StartedAt time.Time `json:"started_at"`
+	ExitedAt  time.Time `json:"exited_at"`
+
+	ExitCode int               `json:"exit_code"`
+	Lines    []CrashReportLine `json:"lines"`
+}
+
+// A CrashReportLine is a line captured before a crash, as written by the process.
+type CrashReportLine struct {
+	CapturedAt time.Time    `json:"captured_at"`
+	Stream     OutputStream `json:"stream"`
+	Line       string       `json:"line"`
+}
+
+// writeCrashReport saves the crash report of a node directory, replacing the previous one.
+func writeCrashReport(dir string, report *CrashReport) error {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, CRASH_REPORT_FILE)
+	if err := os.WriteFile(path+".tmp", encoded, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ReadCrashReport returns the last crash report of a node directory, or nil if the node never crashed.
+func ReadCrashReport(dir string) (*CrashReport, error) {
+	encoded, err := os.ReadFile(filepath.Join(dir, CRASH_REPORT_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var report CrashReport
+	if err := json.Unmarshal(encoded, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -0,0 +1,389 @@
+package xecute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DOCKER_POLL_INTERVAL = 500 * time.Millisecond
+	DOCKER_STOP_TIMEOUT  = 10 // seconds
+
+	// Label set on every container started by the agent.
+	DOCKER_WORKDIR_LABEL = "io.menmos.agent.workdir"
+)
+
+type DockerParams struct {
+	// The docker engine host, e.g. unix:///var/run/docker.sock
+	Host          string
+	Image         string
+	ContainerName string
+	Workdir       string
+	RestartPolicy RestartPolicy
+
+	// The host port of the container. A free port is picked if it is zero.
+	Port uint16
+
+	LogRotation LogRotation
+}
+
+// Docker manages a menmos process running in a docker container.
+type Docker struct {
+	// Container information.
+	client        *dockerClient
+	image         string
+	containerName string
+	containerID   string
+	workdir       string
+	logWriter     *logWriter
+	port          uint16
+	restartPolicy RestartPolicy
+
+	// Management stuff
+	logger       *zap.SugaredLogger
+	pollInterval time.Duration
+	started      bool
+	stopRequest  chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+
+	// Guards the state reported by the watcher.
+	mutex    sync.Mutex
+	status   Status
+	restarts uint
+	exitCode int
+}
+
+func NewDockerProcess(params DockerParams, logger *zap.Logger) (*Docker, error) {
+	client, err := newDockerClient(params.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The node directory is mounted at the same path in the container, so the
+	// paths in the generated config stay valid.
+	workdir, err := filepath.Abs(params.Workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	logWriter, err := newLogWriter(workdir, params.LogRotation, logger.Sugar())
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate a host port for our container if none was assigned.
+	port, err := portOrFree(params.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Docker{
+		client:        client,
+		image:         params.Image,
+		containerName: params.ContainerName,
+		workdir:       workdir,
+		logWriter:     logWriter,
+		port:          port,
+		restartPolicy: params.RestartPolicy,
+
+		logger:       logger.Sugar(),
+		pollInterval: DOCKER_POLL_INTERVAL,
+		stopRequest:  make(chan struct{}),
+		done:         make(chan struct{}),
+		status:       StatusStopped,
+		exitCode:     -1,
+	}, nil
+}
+
+func isDockerNotFound(err error) bool {
+	var dockerErr *DockerError
+	return errors.As(err, &dockerErr) && dockerErr.StatusCode == http.StatusNotFound
+}
+
+func dockerRestartPolicyFrom(policy RestartPolicy) dockerRestartPolicy {
+	switch policy.Mode {
+	case RestartOnFailure:
+		return dockerRestartPolicy{Name: "on-failure", MaximumRetryCount: policy.MaxRetries}
+	case RestartAlways:
+		return dockerRestartPolicy{Name: "unless-stopped"}
+	default:
+		return dockerRestartPolicy{Name: "no"}
+	}
+}
+
+func (d *Docker) setStatus(status Status) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.status == status {
+		return
+	}
+	d.status = status
+	d.logger.Infof("setting status to '%v'", status)
+}
+
+func (d *Docker) setExitCode(exitCode int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.exitCode = exitCode
+}
+
+func (d *Docker) containerConfig(logLevel LogLevel) (*dockerContainerConfig, error) {
+	// Relative paths in the config are resolved from the agent working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	portSpec := fmt.Sprintf("%d/tcp", d.port)
+
+	return &dockerContainerConfig{
+		Image: d.image,
+		Cmd:   []string{"--cfg", path.Join(d.workdir, "config.toml")},
+		Env: []string{
+			fmt.Sprintf("MENMOS_LOG_LEVEL=%s", logLevel),
+			"MENMOS_LOG_JSON=true",
+			fmt.Sprintf("MENMOS_SERVER_PORT=%d", d.port),
+		},
+		WorkingDir:   cwd,
+		ExposedPorts: map[string]struct{}{portSpec: {}},
+		StopSignal:   "SIGINT",
+		Labels:       map[string]string{DOCKER_WORKDIR_LABEL: d.workdir},
+		HostConfig: dockerHostConfig{
+			Binds:         []string{fmt.Sprintf("%s:%s", d.workdir, d.workdir)},
+			PortBindings:  map[string][]dockerPortBinding{portSpec: {{HostPort: fmt.Sprint(d.port)}}},
+			RestartPolicy: dockerRestartPolicyFrom(d.restartPolicy),
+		},
+	}, nil
+}
+
+func (d *Docker) followLogs(since int64) {
+	stream, err := d.client.containerLogs(context.Background(), d.containerID, since)
+	if err != nil {
+		d.logger.Errorf("failed to follow container logs: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	stdout, stderr := d.logWriter.output(StreamStdout), d.logWriter.output(StreamStderr)
+	if err := demuxDockerStream(stream, stdout, stderr); err != nil {
+		d.logger.Debugf("container log stream ended: %v", err)
+	}
+	stdout.Flush()
+	stderr.Flush()
+}
+
+// reportCrash saves the crash report of a container run that exited abnormally.
+func (d *Docker) reportCrash(state dockerContainerState) {
+	startedAt, err := time.Parse(time.RFC3339Nano, state.StartedAt)
+	if err != nil {
+		d.logger.Debugf("invalid container start time '%s': %v", state.StartedAt, err)
+	}
+	d.logWriter.reportCrash(startedAt, state.ExitCode)
+}
+
+func (d *Docker) stateWatcher() {
+	defer close(d.done)
+
+	ctx := context.Background()
+	healthyRun := ""
+	startingSince := time.Now()
+
+	for {
+		select {
+		case <-d.stopRequest:
+			return
+		case <-time.After(d.pollInterval):
+		}
+
+		container, err := d.client.inspectContainer(ctx, d.containerID)
+		if err != nil {
+			d.logger.Errorf("failed to inspect container: %v", err)
+			d.setStatus(StatusError)
+			return
+		}
+
+		d.mutex.Lock()
+		d.restarts = container.RestartCount
+		d.mutex.Unlock()
+
+		state := container.State
+
+		switch state.Status {
+		case "created":
+			d.setStatus(StatusStarting)
+		case "running":
+			if healthyRun == state.StartedAt {
+				continue
+			}
+
+			if isHealthy(d.port) {
+				healthyRun = state.StartedAt
+				d.setStatus(StatusHealthy)
+				continue
+			}
+
+			if d.Status() != StatusStarting {
+				startingSince = time.Now()
+				d.setStatus(StatusStarting)
+			}
+
+			if time.Since(startingSince) > HEALTH_CHECK_TIMEOUT {
+				d.logger.Error("retries exceeded: container failed to come up")
+				if err := d.client.stopContainer(ctx, d.containerID, DOCKER_STOP_TIMEOUT); err != nil {
+					d.logger.Errorf("failed to stop container: %v", err)
+				}
+				d.setStatus(StatusError)
+				return
+			}
+		case "restarting":
+			// Docker applies the restart policy itself.
+			d.setExitCode(state.ExitCode)
+			if state.ExitCode != 0 {
+				d.reportCrash(state)
+			}
+			d.setStatus(StatusBackoff)
+		case "exited", "dead":
+			d.setExitCode(state.ExitCode)
+			if state.ExitCode == 0 && state.Status == "exited" {
+				d.setStatus(StatusStopped)
+			} else {
+				d.reportCrash(state)
+				d.setStatus(StatusError)
+			}
+			return
+		}
+	}
+}
+
+func (d *Docker) Start(logLevel LogLevel) error {
+	ctx := context.Background()
+
+	config, err := d.containerConfig(logLevel)
+	if err != nil {
+		return err
+	}
+
+	d.logger.Debugf("pulling image '%s'", d.image)
+	if err := d.client.pullImage(ctx, d.image); err != nil {
+		return err
+	}
+
+	// Remove any container left over from a previous run of the node.
+	if err := d.client.removeContainer(ctx, d.containerName); err != nil && !isDockerNotFound(err) {
+		return err
+	}
+
+	containerID, err := d.client.createContainer(ctx, d.containerName, config)
+	if err != nil {
+		return err
+	}
+	d.containerID = containerID
+
+	since := time.Now().Unix()
+	if err := d.client.startContainer(ctx, containerID); err != nil {
+		return err
+	}
+
+	d.started = true
+	d.setStatus(StatusStarting)
+
+	go d.followLogs(since)
+	go d.stateWatcher()
+
+	return nil
+}
+
+func (d *Docker) Stop() error {
+	if !d.started {
+		return nil // We never started.
+	}
+
+	ctx := context.Background()
+
+	select {
+	case <-d.done:
+		// The container already exited, we only need to clean it up.
+	default:
+		d.setStatus(StatusStopping)
+		if err := d.client.stopContainer(ctx, d.containerID, DOCKER_STOP_TIMEOUT); err != nil && !isDockerNotFound(err) {
+			return err
+		}
+
+		d.stopOnce.Do(func() { close(d.stopRequest) })
+		<-d.done
+		d.setStatus(StatusStopped)
+	}
+
+	if err := d.client.removeContainer(ctx, d.containerID); err != nil && !isDockerNotFound(err) {
+		d.logger.Errorf("failed to remove container: %v", err)
+	}
+
+	return nil
+}
+
+func (d *Docker) GetLogs(numberOfLines uint) []LogLine {
+	return d.logWriter.stream.Last(int(numberOfLines))
+}
+
+func (d *Docker) QueryLogs(query LogQuery) (LogPage, error) {
+	return d.logWriter.QueryLogs(query)
+}
+
+func (d *Docker) FollowLogs(after Cursor) *LogSubscription {
+	return d.logWriter.FollowLogs(after)
+}
+
+// Close releases the log file of the process, once it is stopped.
+func (d *Docker) Close() error {
+	return d.logWriter.Close()
+}
+
+// Delete has nothing to remove, all the data of the process is in its node directory.
+func (d *Docker) Delete() error {
+	return nil
+}
+
+func (d *Docker) Status() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.status
+}
+
+func (d *Docker) Port() uint16 {
+	return d.port
+}
+
+// Restarts returns the number of times docker restarted the container.
+func (d *Docker) Restarts() uint {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.restarts
+}
+
+// LastExitCode returns the exit code of the last run of the container, or -1 if it never exited.
+func (d *Docker) LastExitCode() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.exitCode
+}
+
+// CrashLoop always returns nil, crash loops are handled by the docker restart policy.
+func (d *Docker) CrashLoop() *CrashLoop {
+	return nil
+}
+
+// NextRetry always returns the zero time, restarts are scheduled by docker.
+func (d *Docker) NextRetry() time.Time {
+	return time.Time{}
+}
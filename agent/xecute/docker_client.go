@@ -0,0 +1,247 @@
+package xecute
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	DOCKER_API_VERSION  = "v1.41"
+	DEFAULT_DOCKER_HOST = "unix:///var/run/docker.sock"
+)
+
+// A DockerError is returned when the Docker Engine API answers with an error status.
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("docker engine error (%d): %s", e.StatusCode, e.Message)
+}
+
+// dockerClient is a minimal client for the subset of the Docker Engine API used by the agent.
+type dockerClient struct {
+	client  *http.Client
+	baseURL string
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	if host == "" {
+		host = DEFAULT_DOCKER_HOST
+	}
+
+	hostURL, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch hostURL.Scheme {
+	case "unix":
+		socketPath := hostURL.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &dockerClient{client: &http.Client{Transport: transport}, baseURL: "http://docker"}, nil
+	case "tcp", "http":
+		return &dockerClient{client: &http.Client{}, baseURL: "http://" + hostURL.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host '%s'", host)
+	}
+}
+
+func (c *dockerClient) request(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(raw)
+	}
+
+	reqURL := fmt.Sprintf("%s/%s%s", c.baseURL, DOCKER_API_VERSION, path)
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(raw, &errBody); err != nil || errBody.Message == "" {
+			errBody.Message = strings.TrimSpace(string(raw))
+		}
+		return nil, &DockerError{StatusCode: resp.StatusCode, Message: errBody.Message}
+	}
+
+	return resp, nil
+}
+
+// do performs a request and decodes the JSON response in out, if out is not nil.
+func (c *dockerClient) do(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:"HostPort"`
+}
+
+type dockerRestartPolicy struct {
+	Name              string `json:"Name"`
+	MaximumRetryCount uint   `json:"MaximumRetryCount,omitempty"`
+}
+
+type dockerHostConfig struct {
+	Binds         []string                       `json:"Binds,omitempty"`
+	PortBindings  map[string][]dockerPortBinding `json:"PortBindings,omitempty"`
+	RestartPolicy dockerRestartPolicy            `json:"RestartPolicy"`
+}
+
+type dockerContainerConfig struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	HostConfig   dockerHostConfig    `json:"HostConfig"`
+}
+
+type dockerContainerState struct {
+	Status    string `json:"Status"`
+	Running   bool   `json:"Running"`
+	ExitCode  int    `json:"ExitCode"`
+	StartedAt string `json:"StartedAt"`
+	Error     string `json:"Error"`
+}
+
+type dockerContainer struct {
+	ID           string               `json:"Id"`
+	RestartCount uint                 `json:"RestartCount"`
+	State        dockerContainerState `json:"State"`
+}
+
+func (c *dockerClient) pullImage(ctx context.Context, image string) error {
+	name, tag := image, "latest"
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		name, tag = image[:idx], image[idx+1:]
+	}
+
+	// The pull progress is streamed back, we only need to wait for it to complete.
+	return c.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {name}, "tag": {tag}}, nil, nil)
+}
+
+func (c *dockerClient) createContainer(ctx context.Context, name string, config *dockerContainerConfig) (string, error) {
+	var resp struct {
+		ID string `json:"Id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/containers/create", url.Values{"name": {name}}, config, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (c *dockerClient) startContainer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/containers/%s/start", id), nil, nil, nil)
+}
+
+func (c *dockerClient) stopContainer(ctx context.Context, id string, timeoutSeconds int) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/containers/%s/stop", id), url.Values{"t": {fmt.Sprint(timeoutSeconds)}}, nil, nil)
+}
+
+func (c *dockerClient) removeContainer(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/containers/%s", id), url.Values{"force": {"true"}}, nil, nil)
+}
+
+func (c *dockerClient) inspectContainer(ctx context.Context, id string) (*dockerContainer, error) {
+	var container dockerContainer
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/containers/%s/json", id), nil, nil, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+// containerLogs returns the multiplexed log stream of a container.
+func (c *dockerClient) containerLogs(ctx context.Context, id string, since int64) (io.ReadCloser, error) {
+	query := url.Values{
+		"follow": {"true"},
+		"stdout": {"true"},
+		"stderr": {"true"},
+		"since":  {fmt.Sprint(since)},
+	}
+	resp, err := c.request(ctx, http.MethodGet, fmt.Sprintf("/containers/%s/logs", id), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// demuxDockerStream splits a multiplexed docker log stream into its stdout and stderr parts.
+// Every frame starts with an 8 bytes header: the stream type, three padding bytes
+// and the big-endian size of the frame payload.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var out io.Writer
+		switch header[0] {
+		case 0, 1:
+			out = stdout
+		case 2:
+			out = stderr
+		default:
+			return fmt.Errorf("unknown docker stream type %d", header[0])
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(out, r, size); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package xecute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeDockerEngine implements the subset of the Docker Engine API used by the agent.
+type fakeDockerEngine struct {
+	mutex      sync.Mutex
+	ts         *httptest.Server
+	containers map[string]*fakeContainer
+	pulled     []string
+	logLines   []string
+}
+
+type fakeContainer struct {
+	name   string
+	config dockerContainerConfig
+	state  dockerContainerState
+}
+
+func newFakeDockerEngine(t *testing.T) *fakeDockerEngine {
+	engine := &fakeDockerEngine{containers: make(map[string]*fakeContainer)}
+
+	socketPath := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.ts = httptest.NewUnstartedServer(http.HandlerFunc(engine.serve))
+	engine.ts.Listener = listener
+	engine.ts.Start()
+	t.Cleanup(engine.ts.Close)
+
+	return engine
+}
+
+func (e *fakeDockerEngine) Host() string {
+	return "unix://" + e.ts.Listener.Addr().String()
+}
+
+func (e *fakeDockerEngine) container(idOrName string) *fakeContainer {
+	if c, ok := e.containers[idOrName]; ok {
+		return c
+	}
+	for _, c := range e.containers {
+		if c.name == idOrName {
+			return c
+		}
+	}
+	return nil
+}
+
+func (e *fakeDockerEngine) notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"message": "no such container"}`))
+}
+
+func (e *fakeDockerEngine) serve(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+DOCKER_API_VERSION)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && path == "/images/create":
+		e.pulled = append(e.pulled, r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag"))
+		w.Write([]byte(`{"status": "done"}`))
+	case r.Method == http.MethodPost && path == "/containers/create":
+		var config dockerContainerConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := fmt.Sprintf("container%d", len(e.containers))
+		e.containers[id] = &fakeContainer{name: r.URL.Query().Get("name"), config: config, state: dockerContainerState{Status: "created"}}
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		c := e.container(parts[1])
+		if c == nil {
+			e.notFound(w)
+			return
+		}
+		for id, other := range e.containers {
+			if other == c {
+				delete(e.containers, id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3:
+		c := e.container(parts[1])
+		if c == nil {
+			e.notFound(w)
+			return
+		}
+
+		switch parts[2] {
+		case "start":
+			c.state = dockerContainerState{Status: "running", Running: true, StartedAt: time.Now().String()}
+			w.WriteHeader(http.StatusNoContent)
+		case "stop":
+			c.state = dockerContainerState{Status: "exited", ExitCode: 0}
+			w.WriteHeader(http.StatusNoContent)
+		case "json":
+			json.NewEncoder(w).Encode(dockerContainer{ID: parts[1], State: c.state})
+		case "logs":
+			// Plain lines are written to stderr.
+			for _, line := range e.logLines {
+				header := make([]byte, 8)
+				header[0] = 1
+				if !strings.HasPrefix(line, "{") {
+					header[0] = 2
+				}
+				binary.BigEndian.PutUint32(header[4:], uint32(len(line)+1))
+				w.Write(header)
+				w.Write([]byte(line + "\n"))
+			}
+		default:
+			e.notFound(w)
+		}
+	default:
+		e.notFound(w)
+	}
+}
+
+func (e *fakeDockerEngine) setState(name string, state dockerContainerState) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.container(name).state = state
+}
+
+func waitForStatus(t *testing.T, getStatus func() Status, expected Status) {
+	deadline := time.Now().Add(5 * time.Second)
+	for getStatus() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected status '%s', got '%s'", expected, getStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestDockerProcess(t *testing.T, engine *fakeDockerEngine, policy RestartPolicy) *Docker {
+	process, err := NewDockerProcess(DockerParams{
+		Host:          engine.Host(),
+		Image:         "menmos/menmosd:v0.2.0",
+		ContainerName: "menmos-test",
+		Workdir:       t.TempDir(),
+		RestartPolicy: policy,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.pollInterval = 10 * time.Millisecond
+
+	return process
+}
+
+// serveHealth answers the health check of a process on its port.
+func serveHealth(t *testing.T, port uint16) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestDocker_Lifecycle(t *testing.T) {
+	engine := newFakeDockerEngine(t)
+	engine.logLines = []string{`{"level": "INFO", "message": "hello"}`, "plain line"}
+
+	process := newTestDockerProcess(t, engine, RestartPolicy{Mode: RestartOnFailure, MaxRetries: 3})
+	serveHealth(t, process.Port())
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, process.Status, StatusHealthy)
+
+	if len(engine.pulled) != 1 || engine.pulled[0] != "menmos/menmosd:v0.2.0" {
+		t.Errorf("unexpected pulled images: %v", engine.pulled)
+	}
+
+	engine.mutex.Lock()
+	config := engine.container("menmos-test").config
+	engine.mutex.Unlock()
+
+	if len(config.HostConfig.Binds) != 1 || config.HostConfig.Binds[0] != fmt.Sprintf("%s:%s", process.workdir, process.workdir) {
+		t.Errorf("node directory is not mounted: %v", config.HostConfig.Binds)
+	}
+
+	if config.HostConfig.RestartPolicy.Name != "on-failure" || config.HostConfig.RestartPolicy.MaximumRetryCount != 3 {
+		t.Errorf("unexpected restart policy: %+v", config.HostConfig.RestartPolicy)
+	}
+
+	portSpec := fmt.Sprintf("%d/tcp", process.Port())
+	if bindings := config.HostConfig.PortBindings[portSpec]; len(bindings) != 1 || bindings[0].HostPort != fmt.Sprint(process.Port()) {
+		t.Errorf("port is not published: %v", config.HostConfig.PortBindings)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(process.GetLogs(10)) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	logs := process.GetLogs(10)
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 log lines, got %v", logs)
+	}
+	if entry, ok := logs[0].Entry().(map[string]interface{}); !ok || entry["message"] != "hello" || entry["level"] != "INFO" ||
+		entry[LOG_STREAM_FIELD] != StreamStdout {
+		t.Errorf("expected a JSON log entry from stdout, got %v", logs[0].Entry())
+	}
+	if entry, ok := logs[1].Entry().(map[string]interface{}); !ok || entry["message"] != "plain line" || entry[LOG_STREAM_FIELD] != StreamStderr {
+		t.Errorf("expected a plain log line from stderr, got %v", logs[1].Entry())
+	}
+
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if process.Status() != StatusStopped {
+		t.Errorf("expected stopped status, got '%s'", process.Status())
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if len(engine.containers) != 0 {
+		t.Errorf("expected container to be removed")
+	}
+}
+
+func TestDocker_ContainerCrash(t *testing.T) {
+	engine := newFakeDockerEngine(t)
+	process := newTestDockerProcess(t, engine, RestartPolicy{})
+	serveHealth(t, process.Port())
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, process.Status, StatusHealthy)
+
+	engine.setState("menmos-test", dockerContainerState{Status: "exited", ExitCode: 137})
+	waitForStatus(t, process.Status, StatusError)
+
+	if process.LastExitCode() != 137 {
+		t.Errorf("expected exit code 137, got %d", process.LastExitCode())
+	}
+
+	// Stopping a crashed container only cleans it up.
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if process.Status() != StatusError {
+		t.Errorf("expected error status to be kept, got '%s'", process.Status())
+	}
+}
+
+func TestDocker_StartReplacesLeftoverContainer(t *testing.T) {
+	engine := newFakeDockerEngine(t)
+	engine.containers["leftover"] = &fakeContainer{name: "menmos-test", state: dockerContainerState{Status: "exited"}}
+
+	process := newTestDockerProcess(t, engine, RestartPolicy{})
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	defer process.Stop()
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if _, ok := engine.containers["leftover"]; ok {
+		t.Errorf("expected leftover container to be removed")
+	}
+}
+
+func TestDocker_UnsupportedHost(t *testing.T) {
+	_, err := NewDockerProcess(DockerParams{Host: "ssh://somewhere", Workdir: t.TempDir()}, zap.NewNop())
+	if err == nil {
+		t.Errorf("expected an error for an unsupported docker host")
+	}
+}
+
+func Test_demuxDockerStream(t *testing.T) {
+	var stream bytes.Buffer
+	for _, frame := range []struct {
+		streamType byte
+		payload    string
+	}{{1, "out1\n"}, {2, "err1\n"}, {1, "out2\n"}} {
+		header := make([]byte, 8)
+		header[0] = frame.streamType
+		binary.BigEndian.PutUint32(header[4:], uint32(len(frame.payload)))
+		stream.Write(header)
+		stream.WriteString(frame.payload)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := demuxDockerStream(&stream, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.String() != "out1\nout2\n" {
+		t.Errorf("unexpected stdout: %q", stdout.String())
+	}
+	if stderr.String() != "err1\n" {
+		t.Errorf("unexpected stderr: %q", stderr.String())
+	}
+}
+
+func Test_demuxDockerStream_truncated(t *testing.T) {
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], 10)
+
+	var stdout, stderr bytes.Buffer
+	if err := demuxDockerStream(bytes.NewReader(append(header, []byte("abc")...)), &stdout, &stderr); err == nil {
+		t.Errorf("expected an error for a truncated frame")
+	}
+}
@@ -0,0 +1,138 @@
+package xecute
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A Process is a menmos node managed by an executor.
+type Process interface {
+	Start(logLevel LogLevel) error
+	Stop() error
+	Status() Status
+	Port() uint16
+	GetLogs(numberOfLines uint) []LogLine
+
+	// QueryLogs returns the lines matching a query, including the lines of previous runs.
+	QueryLogs(query LogQuery) (LogPage, error)
+
+	// FollowLogs subscribes to the log lines after a cursor.
+	FollowLogs(after Cursor) *LogSubscription
+
+	// Close releases the log file of a stopped process, once it is replaced or its node is deleted.
+	Close() error
+
+	// Delete removes what a stopped process keeps between runs outside of its node directory, once its node is deleted.
+	Delete() error
+
+	// Restart tracking.
+	Restarts() uint
+	NextRetry() time.Time
+	LastExitCode() int
+	CrashLoop() *CrashLoop
+}
+
+var (
+	_ Process = &Native{}
+	_ Process = &Docker{}
+	_ Process = &Kubernetes{}
+)
+
+// A ProcessSpec describes the node a process is created for.
+type ProcessSpec struct {
+	NodeID  string
+	Binary  string
+	Version string
+
+	// The node directory, holding the node config.
+	Workdir       string
+	RestartPolicy RestartPolicy
+
+	// The port assigned to the node. Executors pick one if it is zero.
+	Port uint16
+}
+
+// An Executor creates processes on a given runtime.
+type Executor interface {
+	NewProcess(spec ProcessSpec, logger *zap.Logger) (Process, error)
+}
+
+// A BinaryResolver returns the path of a menmos binary for a given version.
+type BinaryResolver func(version, binary string) (string, error)
+
+// NativeExecutor runs nodes as processes on the host.
+type NativeExecutor struct {
+	ResolveBinary BinaryResolver
+	LogRotation   LogRotation
+}
+
+func (e *NativeExecutor) NewProcess(spec ProcessSpec, logger *zap.Logger) (Process, error) {
+	binPath, err := e.ResolveBinary(spec.Version, spec.Binary)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNativeProcess(NativeParams{
+		Workdir:       spec.Workdir,
+		BinaryPath:    binPath,
+		Port:          spec.Port,
+		RestartPolicy: spec.RestartPolicy,
+		LogRotation:   e.LogRotation,
+	}, logger)
+}
+
+// ContainerImage returns the image of a node from an image template.
+// "{binary}" and "{version}" are replaced by the node binary and version.
+func ContainerImage(template string, spec ProcessSpec) string {
+	version := spec.Version
+	if version == "" {
+		version = "latest"
+	}
+
+	return strings.NewReplacer("{binary}", spec.Binary, "{version}", version).Replace(template)
+}
+
+// DockerExecutor runs nodes in containers on a docker engine.
+type DockerExecutor struct {
+	Host          string
+	ImageTemplate string
+	LogRotation   LogRotation
+}
+
+func (e *DockerExecutor) NewProcess(spec ProcessSpec, logger *zap.Logger) (Process, error) {
+	return NewDockerProcess(DockerParams{
+		Host:          e.Host,
+		Image:         ContainerImage(e.ImageTemplate, spec),
+		ContainerName: fmt.Sprintf("menmos-%s", spec.NodeID),
+		Workdir:       spec.Workdir,
+		RestartPolicy: spec.RestartPolicy,
+		Port:          spec.Port,
+		LogRotation:   e.LogRotation,
+	}, logger)
+}
+
+// KubernetesExecutor runs nodes as pods in a kubernetes cluster.
+type KubernetesExecutor struct {
+	Client        kubernetes.Interface
+	Namespace     string
+	ImageTemplate string
+	StorageSize   string
+	LogRotation   LogRotation
+}
+
+func (e *KubernetesExecutor) NewProcess(spec ProcessSpec, logger *zap.Logger) (Process, error) {
+	return NewKubernetesProcess(KubernetesParams{
+		Client:      e.Client,
+		Namespace:   e.Namespace,
+		Image:       ContainerImage(e.ImageTemplate, spec),
+		Name:        fmt.Sprintf("menmos-%s", spec.NodeID),
+		Workdir:     spec.Workdir,
+		StorageSize: e.StorageSize,
+		Port:        spec.Port,
+		LogRotation: e.LogRotation,
+	}, logger)
+}
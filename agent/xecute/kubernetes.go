@@ -0,0 +1,586 @@
+package xecute
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	KUBERNETES_POLL_INTERVAL = 1 * time.Second
+	KUBERNETES_STOP_TIMEOUT  = 30 * time.Second
+	DEFAULT_KUBERNETES_PORT  = 3030
+
+	DEFAULT_KUBERNETES_STORAGE_SIZE = "10Gi"
+
+	// Labels set on every kubernetes resource created by the agent.
+	KUBERNETES_INSTANCE_LABEL   = "app.kubernetes.io/instance"
+	KUBERNETES_MANAGED_BY_LABEL = "app.kubernetes.io/managed-by"
+
+	kubernetesConfigDir = "/etc/menmos"
+)
+
+type KubernetesParams struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Image     string
+
+	// The name of the kubernetes resources of the node.
+	Name    string
+	Workdir string
+
+	// The size of the volume claimed for the node data.
+	StorageSize string
+
+	// The port of the node container and service. Defaults to DEFAULT_KUBERNETES_PORT.
+	Port uint16
+
+	LogRotation LogRotation
+}
+
+// Kubernetes manages a menmos node running as a single-pod StatefulSet.
+//
+// The node data is kept on a persistent volume mounted at the node directory path,
+// so the paths in the generated config stay valid inside the pod.
+// Kubernetes restarts exited pods on its own, so nodes are only created with the "always" restart policy.
+type Kubernetes struct {
+	// Workload information.
+	client      kubernetes.Interface
+	namespace   string
+	image       string
+	name        string
+	workdir     string
+	storageSize string
+	port        uint16
+	logWriter   *logWriter
+
+	// Management stuff
+	logger       *zap.SugaredLogger
+	pollInterval time.Duration
+	started      bool
+	stopRequest  chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+
+	// Guards the state reported by the watcher.
+	mutex     sync.Mutex
+	status    Status
+	restarts  uint
+	exitCode  int
+	crashLoop *CrashLoop
+}
+
+func NewKubernetesProcess(params KubernetesParams, logger *zap.Logger) (*Kubernetes, error) {
+	workdir, err := filepath.Abs(params.Workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	logWriter, err := newLogWriter(workdir, params.LogRotation, logger.Sugar())
+	if err != nil {
+		return nil, err
+	}
+
+	storageSize := params.StorageSize
+	if storageSize == "" {
+		storageSize = DEFAULT_KUBERNETES_STORAGE_SIZE
+	}
+	if _, err := resource.ParseQuantity(storageSize); err != nil {
+		return nil, fmt.Errorf("invalid storage size '%s': %v", storageSize, err)
+	}
+
+	port := params.Port
+	if port == 0 {
+		port = DEFAULT_KUBERNETES_PORT
+	}
+
+	return &Kubernetes{
+		client:      params.Client,
+		namespace:   params.Namespace,
+		image:       params.Image,
+		name:        params.Name,
+		workdir:     workdir,
+		storageSize: storageSize,
+		port:        port,
+		logWriter:   logWriter,
+
+		logger:       logger.Sugar(),
+		pollInterval: KUBERNETES_POLL_INTERVAL,
+		stopRequest:  make(chan struct{}),
+		done:         make(chan struct{}),
+		status:       StatusStopped,
+		exitCode:     -1,
+	}, nil
+}
+
+func (k *Kubernetes) setStatus(status Status) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.status == status {
+		return
+	}
+	k.status = status
+	k.logger.Infof("setting status to '%v'", status)
+}
+
+func (k *Kubernetes) labels() map[string]string {
+	return map[string]string{
+		KUBERNETES_INSTANCE_LABEL:   k.name,
+		KUBERNETES_MANAGED_BY_LABEL: "menmos-agent",
+	}
+}
+
+func (k *Kubernetes) selector() string {
+	return fmt.Sprintf("%s=%s", KUBERNETES_INSTANCE_LABEL, k.name)
+}
+
+func (k *Kubernetes) configMapName() string {
+	return k.name + "-config"
+}
+
+func (k *Kubernetes) configMap() (*corev1.ConfigMap, error) {
+	config, err := os.ReadFile(path.Join(k.workdir, "config.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: k.configMapName(), Namespace: k.namespace, Labels: k.labels()},
+		Data:       map[string]string{"config.toml": string(config)},
+	}, nil
+}
+
+func (k *Kubernetes) statefulSet(logLevel LogLevel) (*appsv1.StatefulSet, error) {
+	// Relative paths in the config are resolved from the agent working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := int32(1)
+	labels := k.labels()
+
+	container := corev1.Container{
+		Name:       "menmos",
+		Image:      k.image,
+		Args:       []string{"--cfg", path.Join(kubernetesConfigDir, "config.toml")},
+		WorkingDir: cwd,
+		Env: []corev1.EnvVar{
+			{Name: "MENMOS_LOG_LEVEL", Value: logLevel},
+			{Name: "MENMOS_LOG_JSON", Value: "true"},
+			{Name: "MENMOS_SERVER_PORT", Value: fmt.Sprint(k.port)},
+		},
+		Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: int32(k.port)}},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromString("http")},
+			},
+			PeriodSeconds: 5,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "config", MountPath: kubernetesConfigDir, ReadOnly: true},
+			{Name: "data", MountPath: k.workdir},
+		},
+	}
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: k.name, Namespace: k.namespace, Labels: labels},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			ServiceName: k.name,
+			Selector:    &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{container},
+					Volumes: []corev1.Volume{{
+						Name: "config",
+						VolumeSource: corev1.VolumeSource{
+							ConfigMap: &corev1.ConfigMapVolumeSource{
+								LocalObjectReference: corev1.LocalObjectReference{Name: k.configMapName()},
+							},
+						},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Labels: labels},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(k.storageSize)},
+					},
+				},
+			}},
+		},
+	}, nil
+}
+
+func (k *Kubernetes) service() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: k.name, Namespace: k.namespace, Labels: k.labels()},
+		Spec: corev1.ServiceSpec{
+			Selector: k.labels(),
+			Ports: []corev1.ServicePort{{
+				Name:       "http",
+				Port:       int32(k.port),
+				TargetPort: intstr.FromString("http"),
+			}},
+		},
+	}
+}
+
+func (k *Kubernetes) applyConfigMap(ctx context.Context, configMap *corev1.ConfigMap) error {
+	configMaps := k.client.CoreV1().ConfigMaps(k.namespace)
+	if _, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		return err
+	}
+	return nil
+}
+
+func (k *Kubernetes) applyStatefulSet(ctx context.Context, statefulSet *appsv1.StatefulSet) error {
+	statefulSets := k.client.AppsV1().StatefulSets(k.namespace)
+	if _, err := statefulSets.Create(ctx, statefulSet, metav1.CreateOptions{}); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		_, err = statefulSets.Update(ctx, statefulSet, metav1.UpdateOptions{})
+		return err
+	}
+	return nil
+}
+
+func (k *Kubernetes) applyService(ctx context.Context, service *corev1.Service) error {
+	if _, err := k.client.CoreV1().Services(k.namespace).Create(ctx, service, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+func (k *Kubernetes) getPod(ctx context.Context) (*corev1.Pod, error) {
+	pods, err := k.client.CoreV1().Pods(k.namespace).List(ctx, metav1.ListOptions{LabelSelector: k.selector()})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pods.Items) == 0 {
+		return nil, nil
+	}
+
+	return &pods.Items[0], nil
+}
+
+func (k *Kubernetes) followLogs(podName string) {
+	options := &corev1.PodLogOptions{Container: "menmos", Follow: true}
+	stream, err := k.client.CoreV1().Pods(k.namespace).GetLogs(podName, options).Stream(context.Background())
+	if err != nil {
+		k.logger.Errorf("failed to follow pod logs: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	// Pod logs don't separate stdout from stderr.
+	output := k.logWriter.output(StreamCombined)
+	if _, err := io.Copy(output, stream); err != nil {
+		k.logger.Debugf("pod log stream ended: %v", err)
+	}
+	output.Flush()
+}
+
+// menmosContainer returns the status of the menmos container of the node pod, nil if it isn't created yet.
+func menmosContainer(pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == "menmos" {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+// updateFromPod maps the state of the node pod onto the process status.
+func (k *Kubernetes) updateFromPod(pod *corev1.Pod) {
+	containerStatus := menmosContainer(pod)
+
+	var crashed *corev1.ContainerStateTerminated
+	k.mutex.Lock()
+	if containerStatus != nil {
+		k.restarts = uint(containerStatus.RestartCount)
+		if terminated := containerStatus.LastTerminationState.Terminated; terminated != nil {
+			k.exitCode = int(terminated.ExitCode)
+			crashed = terminated
+		}
+		if terminated := containerStatus.State.Terminated; terminated != nil {
+			k.exitCode = int(terminated.ExitCode)
+			crashed = terminated
+		}
+	}
+	k.mutex.Unlock()
+
+	if crashed != nil && crashed.ExitCode != 0 {
+		k.logWriter.reportCrash(crashed.StartedAt.Time, int(crashed.ExitCode))
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded:
+		k.setStatus(StatusStopped)
+		return
+	case corev1.PodFailed:
+		k.setStatus(StatusError)
+		return
+	}
+
+	if containerStatus == nil {
+		k.setStatus(StatusStarting)
+		return
+	}
+
+	if waiting := containerStatus.State.Waiting; waiting != nil && waiting.Reason == "CrashLoopBackOff" {
+		k.mutex.Lock()
+		if k.crashLoop == nil {
+			k.crashLoop = &CrashLoop{
+				Since:        time.Now(),
+				Crashes:      uint(containerStatus.RestartCount),
+				LastExitCode: k.exitCode,
+				LogTail:      k.logWriter.GetLastNLines(CRASH_LOOP_LOG_LINES),
+			}
+		}
+		k.mutex.Unlock()
+		k.setStatus(StatusCrashLoop)
+		return
+	}
+
+	k.mutex.Lock()
+	k.crashLoop = nil
+	k.mutex.Unlock()
+
+	if containerStatus.Ready {
+		k.setStatus(StatusHealthy)
+	} else if containerStatus.State.Waiting != nil && containerStatus.RestartCount > 0 {
+		k.setStatus(StatusBackoff)
+	} else {
+		k.setStatus(StatusStarting)
+	}
+}
+
+func (k *Kubernetes) stateWatcher() {
+	defer close(k.done)
+
+	ctx := context.Background()
+
+	// The container whose logs are followed. A restarted container keeps its pod, so its logs are followed again
+	// once its restart count changes.
+	type container struct {
+		pod      string
+		restarts int32
+	}
+	var followed container
+
+	for {
+		select {
+		case <-k.stopRequest:
+			return
+		case <-time.After(k.pollInterval):
+		}
+
+		pod, err := k.getPod(ctx)
+		if err != nil {
+			k.logger.Errorf("failed to get node pod: %v", err)
+			continue
+		}
+
+		if pod == nil {
+			k.setStatus(StatusStarting)
+			continue
+		}
+
+		if containerStatus := menmosContainer(pod); containerStatus != nil && containerStatus.State.Running != nil {
+			running := container{pod: pod.Name, restarts: containerStatus.RestartCount}
+			if running != followed {
+				followed = running
+				go k.followLogs(pod.Name)
+			}
+		}
+
+		k.updateFromPod(pod)
+	}
+}
+
+func (k *Kubernetes) Start(logLevel LogLevel) error {
+	ctx := context.Background()
+
+	configMap, err := k.configMap()
+	if err != nil {
+		return err
+	}
+
+	statefulSet, err := k.statefulSet(logLevel)
+	if err != nil {
+		return err
+	}
+
+	if err := k.applyConfigMap(ctx, configMap); err != nil {
+		return err
+	}
+
+	if err := k.applyStatefulSet(ctx, statefulSet); err != nil {
+		return err
+	}
+
+	if err := k.applyService(ctx, k.service()); err != nil {
+		return err
+	}
+
+	k.started = true
+	k.setStatus(StatusStarting)
+
+	go k.stateWatcher()
+
+	return nil
+}
+
+func (k *Kubernetes) Stop() error {
+	if !k.started {
+		return nil // We never started.
+	}
+
+	k.setStatus(StatusStopping)
+	k.stopOnce.Do(func() { close(k.stopRequest) })
+	<-k.done
+
+	ctx := context.Background()
+
+	// The persistent volume claims of the StatefulSet are kept, so the node
+	// gets its data back when it is started again. Delete removes them.
+	propagation := metav1.DeletePropagationForeground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if err := k.client.AppsV1().StatefulSets(k.namespace).Delete(ctx, k.name, deleteOptions); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := k.deleteServiceAndConfig(ctx); err != nil {
+		return err
+	}
+
+	// Wait for the pod to go away.
+	deadline := time.Now().Add(KUBERNETES_STOP_TIMEOUT)
+	for {
+		pod, err := k.getPod(ctx)
+		if err != nil {
+			return err
+		}
+		if pod == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for pod '%s' to terminate", pod.Name)
+		}
+		time.Sleep(k.pollInterval)
+	}
+
+	k.setStatus(StatusStopped)
+	return nil
+}
+
+func (k *Kubernetes) deleteServiceAndConfig(ctx context.Context) error {
+	if err := k.client.CoreV1().Services(k.namespace).Delete(ctx, k.name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err := k.client.CoreV1().ConfigMaps(k.namespace).Delete(ctx, k.configMapName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// dataClaimName returns the name of the persistent volume claim created for the node pod by the StatefulSet.
+func (k *Kubernetes) dataClaimName() string {
+	return fmt.Sprintf("data-%s-0", k.name)
+}
+
+// Delete removes the persistent volume claim holding the node data, along with
+// the Service and ConfigMap if stopping the node didn't.
+func (k *Kubernetes) Delete() error {
+	ctx := context.Background()
+
+	if err := k.deleteServiceAndConfig(ctx); err != nil {
+		return err
+	}
+
+	claims := k.client.CoreV1().PersistentVolumeClaims(k.namespace)
+	if err := claims.Delete(ctx, k.dataClaimName(), metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (k *Kubernetes) GetLogs(numberOfLines uint) []LogLine {
+	return k.logWriter.stream.Last(int(numberOfLines))
+}
+
+func (k *Kubernetes) QueryLogs(query LogQuery) (LogPage, error) {
+	return k.logWriter.QueryLogs(query)
+}
+
+func (k *Kubernetes) FollowLogs(after Cursor) *LogSubscription {
+	return k.logWriter.FollowLogs(after)
+}
+
+// Close releases the log file of the process, once it is stopped.
+func (k *Kubernetes) Close() error {
+	return k.logWriter.Close()
+}
+
+func (k *Kubernetes) Status() string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.status
+}
+
+// Port returns the port of the node service.
+func (k *Kubernetes) Port() uint16 {
+	return k.port
+}
+
+// Restarts returns the number of times kubernetes restarted the node container.
+func (k *Kubernetes) Restarts() uint {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.restarts
+}
+
+// LastExitCode returns the exit code of the last run of the node container, or -1 if it never exited.
+func (k *Kubernetes) LastExitCode() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.exitCode
+}
+
+// CrashLoop returns the crash loop info when the node pod is in CrashLoopBackOff.
+func (k *Kubernetes) CrashLoop() *CrashLoop {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.crashLoop
+}
+
+// NextRetry always returns the zero time, restarts are scheduled by kubernetes.
+func (k *Kubernetes) NextRetry() time.Time {
+	return time.Time{}
+}
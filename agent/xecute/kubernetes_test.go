@@ -0,0 +1,259 @@
+package xecute
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "menmos"
+
+func newTestKubernetesProcess(t *testing.T) (*Kubernetes, *fake.Clientset) {
+	workdir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workdir, "config.toml"), []byte("[node]\nname = \"test\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := fake.NewSimpleClientset()
+	process, err := NewKubernetesProcess(KubernetesParams{
+		Client:    client,
+		Namespace: testNamespace,
+		Image:     "menmos/amphora:v0.2.0",
+		Name:      "menmos-test",
+		Workdir:   workdir,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.pollInterval = 10 * time.Millisecond
+
+	return process, client
+}
+
+// setPod creates or replaces the pod of the test node, as the StatefulSet controller would.
+func setPod(t *testing.T, client *fake.Clientset, status corev1.PodStatus) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "menmos-test-0",
+			Namespace: testNamespace,
+			Labels:    map[string]string{KUBERNETES_INSTANCE_LABEL: "menmos-test"},
+		},
+		Status: status,
+	}
+
+	pods := client.CoreV1().Pods(testNamespace)
+	if _, err := pods.Get(context.Background(), pod.Name, metav1.GetOptions{}); err == nil {
+		if _, err := pods.Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if _, err := pods.Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForPodLogs waits until the fake pod logs were written the given number of times to the node log file.
+func waitForPodLogs(t *testing.T, process *Kubernetes, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		logs, _ := os.ReadFile(filepath.Join(process.workdir, "log.json"))
+		if strings.Count(string(logs), "fake logs") >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pod logs were not written %d times to the log file", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKubernetes_StartCreatesResources(t *testing.T) {
+	process, client := newTestKubernetesProcess(t)
+	ctx := context.Background()
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps(testNamespace).Get(ctx, "menmos-test-config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(configMap.Data["config.toml"], `name = "test"`) {
+		t.Errorf("config map doesn't hold the node config: %v", configMap.Data)
+	}
+
+	statefulSet, err := client.AppsV1().StatefulSets(testNamespace).Get(ctx, "menmos-test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := statefulSet.Spec.Template.Spec.Containers[0]
+	if container.Image != "menmos/amphora:v0.2.0" {
+		t.Errorf("unexpected image '%s'", container.Image)
+	}
+
+	var dataMounted bool
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == "data" && mount.MountPath == process.workdir {
+			dataMounted = true
+		}
+	}
+	if !dataMounted {
+		t.Errorf("node directory is not mounted: %v", container.VolumeMounts)
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(ctx, "menmos-test", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Ports[0].Port != int32(process.Port()) {
+		t.Errorf("service doesn't expose the node port: %v", service.Spec.Ports)
+	}
+
+	// Starting again must update the existing resources instead of failing.
+	process.Stop()
+	restarted, _ := NewKubernetesProcess(KubernetesParams{Client: client, Namespace: testNamespace, Name: "menmos-test", Workdir: process.workdir}, zap.NewNop())
+	if err := restarted.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Stop()
+}
+
+func TestKubernetes_StatusFromPod(t *testing.T) {
+	process, client := newTestKubernetesProcess(t)
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, process.Status, StatusStarting)
+
+	setPod(t, client, corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:         "menmos",
+			Ready:        true,
+			RestartCount: 2,
+			State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			LastTerminationState: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 101},
+			},
+		}},
+	})
+	waitForStatus(t, process.Status, StatusHealthy)
+
+	if process.Restarts() != 2 {
+		t.Errorf("expected 2 restarts, got %d", process.Restarts())
+	}
+	if process.LastExitCode() != 101 {
+		t.Errorf("expected exit code 101, got %d", process.LastExitCode())
+	}
+
+	// The pod logs are streamed to the node log file.
+	waitForPodLogs(t, process, 1)
+
+	// The logs of a restarted container are followed again.
+	setPod(t, client, corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:         "menmos",
+			Ready:        true,
+			RestartCount: 3,
+			State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+		}},
+	})
+	waitForPodLogs(t, process, 2)
+
+	setPod(t, client, corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:         "menmos",
+			RestartCount: 6,
+			State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+			},
+			LastTerminationState: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 3},
+			},
+		}},
+	})
+	waitForStatus(t, process.Status, StatusCrashLoop)
+
+	crashLoop := process.CrashLoop()
+	if crashLoop == nil || crashLoop.LastExitCode != 3 || crashLoop.Crashes != 6 {
+		t.Errorf("unexpected crash loop info: %+v", crashLoop)
+	}
+
+	// The StatefulSet controller would remove the pod once the StatefulSet is deleted.
+	if err := client.CoreV1().Pods(testNamespace).Delete(context.Background(), "menmos-test-0", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if process.Status() != StatusStopped {
+		t.Errorf("expected stopped status, got '%s'", process.Status())
+	}
+
+	if _, err := client.AppsV1().StatefulSets(testNamespace).Get(context.Background(), "menmos-test", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected the StatefulSet to be deleted")
+	}
+}
+
+func TestKubernetes_DeleteRemovesClaim(t *testing.T) {
+	process, client := newTestKubernetesProcess(t)
+	ctx := context.Background()
+
+	// The StatefulSet controller would create the claim of the node pod.
+	claims := client.CoreV1().PersistentVolumeClaims(testNamespace)
+	claim := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-menmos-test-0", Namespace: testNamespace}}
+	if _, err := claims.Create(ctx, claim, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := claims.Get(ctx, "data-menmos-test-0", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the claim to be kept when the node is stopped: %v", err)
+	}
+
+	if err := process.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := claims.Get(ctx, "data-menmos-test-0", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected the claim to be deleted")
+	}
+	if _, err := client.CoreV1().Services(testNamespace).Get(ctx, "menmos-test", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected the service to be deleted")
+	}
+	if _, err := client.CoreV1().ConfigMaps(testNamespace).Get(ctx, "menmos-test-config", metav1.GetOptions{}); err == nil {
+		t.Errorf("expected the config map to be deleted")
+	}
+}
+
+func TestKubernetes_InvalidStorageSize(t *testing.T) {
+	_, err := NewKubernetesProcess(KubernetesParams{Client: fake.NewSimpleClientset(), Workdir: t.TempDir(), StorageSize: "lots"}, zap.NewNop())
+	if err == nil {
+		t.Errorf("expected an error for an invalid storage size")
+	}
+}
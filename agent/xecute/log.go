@@ -1,64 +1,372 @@
 package xecute
 
 import (
-	"encoding/json"
-	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/menmos/menmos-agent/agent/xecute/ring"
+	"go.uber.org/zap"
 )
 
 const BUFFER_LOG_LINES = 512
 
+// How long the log writer waits before trying to rotate a log file again after failing to.
+const LOG_ROTATION_RETRY_DELAY = time.Minute
+
 type logWriter struct {
-	out         io.WriteCloser
-	lineBuffer  *ring.Buffer[[]byte]
-	currentLine []byte
+	// Stdout and stderr are captured from separate goroutines.
+	mutex sync.Mutex
+
+	dir      string
+	rotation LogRotation
+	log      *zap.SugaredLogger
+	file     *os.File
+	stream   *LogStream
+
+	// The generation and size of the current log file, and when lines started being appended to it.
+	generation uint64
+	offset     int64
+	startedAt  time.Time
+
+	// Set after failing to rotate the log file, so rotation isn't attempted for every line.
+	retryRotationAt time.Time
+
+	// Rotated files are compressed and pruned in the background, one rotation at a time.
+	archiveMutex sync.Mutex
+	archives     sync.WaitGroup
+
+	// The last stderr lines, and the start of the last run reported as a crash.
+	crashLines  *ring.Buffer[CrashReportLine]
+	reported    bool
+	reportedRun time.Time
+}
+
+// newLogWriter opens the log file of a node directory. Lines are appended to the log file, their cursors follow the
+// lines of previous runs.
+func newLogWriter(dir string, rotation LogRotation, log *zap.SugaredLogger) (*logWriter, error) {
+	file, err := os.OpenFile(filepath.Join(dir, LOG_FILE), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	rotated, err := listRotatedLogs(dir)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The current file is the one after the last rotated file, it was started when that file was rotated.
+	var generation uint64
+	startedAt := time.Now()
+	if len(rotated) > 0 {
+		last := rotated[len(rotated)-1]
+		generation = last.generation + 1
+		if lastInfo, err := os.Stat(last.path); err == nil {
+			startedAt = lastInfo.ModTime()
+		}
+	}
+
+	w := &logWriter{
+		dir:        dir,
+		rotation:   rotation,
+		log:        log,
+		file:       file,
+		stream:     NewLogStream(BUFFER_LOG_LINES, Cursor{Generation: generation, Offset: info.Size()}),
+		generation: generation,
+		offset:     info.Size(),
+		startedAt:  startedAt,
+		crashLines: ring.New[CrashReportLine](CRASH_REPORT_LINES),
+	}
+
+	if len(rotated) > 0 {
+		// Rotations interrupted by a restart are archived.
+		w.archive()
+	}
+
+	return w, nil
+}
+
+// output returns a writer capturing an output stream of the process. Each stream needs its own writer, so the
+// lines of concurrent streams aren't mixed.
+func (w *logWriter) output(stream OutputStream) *outputWriter {
+	return &outputWriter{log: w, stream: stream}
 }
 
-func newLogWriter(out io.WriteCloser) *logWriter {
-	return &logWriter{
-		out:        out,
-		lineBuffer: ring.New[[]byte](BUFFER_LOG_LINES),
+// writeLine tags a captured line and appends it to the log file. The file is only rotated between lines, so lines
+// are never split across files. Rotating holds the writer: the output of the process waits in its pipe meanwhile,
+// and no line is lost.
+func (w *logWriter) writeLine(stream OutputStream, raw []byte) error {
+	capturedAt := time.Now().UTC()
+	tagged := append(tagLine(stream, capturedAt, raw), '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// The file is rotated when the next line is written, so the log of a previous run isn't left in a rotated file
+	// followed by an empty one.
+	if w.shouldRotate() {
+		if err := w.rotate(); err != nil {
+			w.log.Errorf("failed to rotate log file: %v", err)
+			w.retryRotationAt = time.Now().Add(LOG_ROTATION_RETRY_DELAY)
+		}
+	}
+
+	written, err := w.file.Write(tagged)
+	w.offset += int64(written)
+	if err != nil {
+		return err
+	}
+
+	w.stream.Publish(LogLine{Cursor: Cursor{Generation: w.generation, Offset: w.offset}, Raw: tagged[:len(tagged)-1]})
+	if stream != StreamStdout {
+		w.crashLines.Write(CrashReportLine{CapturedAt: capturedAt, Stream: stream, Line: string(raw)})
 	}
+
+	return nil
 }
 
-func (w *logWriter) Write(p []byte) (n int, err error) {
-	for i := 0; i < len(p); i++ {
-		if p[i] == '\n' {
-			w.lineBuffer.Write(w.currentLine)
-			w.currentLine = []byte{}
+// reportCrash saves the stderr lines captured since a run of the process started, once it exited abnormally. A run
+// is only reported once.
+func (w *logWriter) reportCrash(startedAt time.Time, exitCode int) {
+	w.mutex.Lock()
+	if w.reported && w.reportedRun.Equal(startedAt) {
+		w.mutex.Unlock()
+		return
+	}
+	w.reported, w.reportedRun = true, startedAt
+
+	report := &CrashReport{StartedAt: startedAt, ExitedAt: time.Now().UTC(), ExitCode: exitCode, Lines: []CrashReportLine{}}
+	for _, line := range w.crashLines.Last(CRASH_REPORT_LINES) {
+		if !line.CapturedAt.Before(startedAt) {
+			report.Lines = append(report.Lines, line)
 		}
-		w.currentLine = append(w.currentLine, p[i])
 	}
-	return w.out.Write(p)
+	w.mutex.Unlock()
+
+	if err := writeCrashReport(w.dir, report); err != nil {
+		w.log.Errorf("failed to save crash report: %v", err)
+	}
 }
 
+func (w *logWriter) shouldRotate() bool {
+	if w.offset == 0 || time.Now().Before(w.retryRotationAt) {
+		return false
+	}
+
+	return (w.rotation.MaxSize > 0 && w.offset >= w.rotation.MaxSize) ||
+		(w.rotation.MaxAge > 0 && time.Since(w.startedAt) >= w.rotation.MaxAge)
+}
+
+// rotate moves the current log file aside and opens a new one. It is called with the writer locked.
+func (w *logWriter) rotate() error {
+	path := filepath.Join(w.dir, LOG_FILE)
+	rotatedPath := rotatedLogPath(w.dir, w.generation, false)
+
+	// Open files can't be renamed on every platform.
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	reopen := func(rotateErr error) error {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			// Nothing can be logged anymore.
+			w.log.Errorf("failed to reopen log file: %v", err)
+			return rotateErr
+		}
+		w.file = file
+		return rotateErr
+	}
+
+	if err := os.Rename(path, rotatedPath); err != nil {
+		return reopen(err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		// Keep appending to the previous file, rather than losing lines.
+		if renameErr := os.Rename(rotatedPath, path); renameErr != nil {
+			w.log.Errorf("failed to restore log file: %v", renameErr)
+		}
+		return reopen(err)
+	}
+
+	w.file = file
+	w.generation++
+	w.offset = 0
+	w.startedAt = time.Now()
+
+	w.log.Debugf("rotated log file to '%s'", rotatedPath)
+	w.archive()
+	return nil
+}
+
+// archive compresses and prunes the rotated log files in the background.
+func (w *logWriter) archive() {
+	w.archives.Add(1)
+	go func() {
+		defer w.archives.Done()
+
+		w.archiveMutex.Lock()
+		defer w.archiveMutex.Unlock()
+
+		if err := archiveLogs(w.dir, w.rotation); err != nil {
+			w.log.Errorf("failed to archive rotated log files: %v", err)
+		}
+	}()
+}
+
+// Close closes the log file, once the rotated files are archived, and ends the subscriptions to the log.
 func (w *logWriter) Close() error {
-	return w.out.Close()
+	w.stream.Close()
+	w.archives.Wait()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
 }
 
-func (w *logWriter) GetLastNLines(n int) (lines []interface{}) {
-	if n < BUFFER_LOG_LINES {
-		n = BUFFER_LOG_LINES
+// QueryLogs returns the lines matching a query, from the buffered lines when possible and from the log files
+// otherwise.
+func (w *logWriter) QueryLogs(query LogQuery) (LogPage, error) {
+	if page, ok := w.stream.Query(query); ok {
+		return page, nil
+	}
+	return w.readLogs(query)
+}
+
+// readLogs reads the lines matching a query from the log files.
+func (w *logWriter) readLogs(query LogQuery) (LogPage, error) {
+	// The log file isn't rotated while the files are listed.
+	w.mutex.Lock()
+	files, err := openLogFiles(w.dir)
+	w.mutex.Unlock()
+	if err != nil {
+		return LogPage{}, err
 	}
+	defer files.Close()
 
-	// FIXME(prod): swap log files after a given amount of time and/or entries.
+	return files.query(query)
+}
+
+// FollowLogs subscribes to the lines after a cursor. Lines no longer buffered, like the lines of a previous run of
+// the agent, are read from the log files first. They are only reported as skipped once their files were pruned.
+func (w *logWriter) FollowLogs(after Cursor) *LogSubscription {
+	live := w.stream.Follow(after)
+	if !live.Truncated {
+		return live
+	}
+
+	logged, err := w.logsAfter(after)
+	if err != nil {
+		w.log.Errorf("failed to list log files: %v", err)
+	}
+	if !logged {
+		return live
+	}
+	live.Close()
 
-	for i := 0; i < n; i++ {
-		raw := w.lineBuffer.Peek(i)
-		if raw == nil {
-			// We're at the end of the line buffer.
-			break
+	subscription := &LogSubscription{
+		stream: w.stream,
+		lines:  make(chan LogLine, SUBSCRIBER_BUFFER_LINES),
+		closed: make(chan struct{}),
+	}
+	go w.backfill(subscription, after)
+
+	return subscription
+}
+
+// logsAfter returns whether the log files still hold the lines after a cursor. Files are pruned oldest first.
+func (w *logWriter) logsAfter(after Cursor) (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	rotated, err := listRotatedLogs(w.dir)
+	if err != nil {
+		return false, err
+	}
+
+	oldest := w.generation
+	if len(rotated) > 0 {
+		oldest = rotated[0].generation
+	}
+	return oldest <= after.Generation, nil
+}
+
+// backfill sends the lines after a cursor to a subscription, reading them from the log files until the buffered lines
+// follow them. It then forwards the lines published to the stream, until the subscription ends.
+func (w *logWriter) backfill(subscription *LogSubscription, after Cursor) {
+	defer close(subscription.lines)
+
+	send := func(line LogLine) bool {
+		select {
+		case subscription.lines <- line:
+			return true
+		case <-subscription.closed:
+			return false
+		}
+	}
+
+	cursor := after
+	for {
+		page, err := w.readLogs(LogQuery{After: &cursor, Limit: SUBSCRIBER_BUFFER_LINES})
+		if err != nil {
+			subscription.err = err
+			return
+		}
+		for _, line := range page.Lines {
+			if !send(line) {
+				return
+			}
+			cursor = line.Cursor
+		}
+		if page.More {
+			continue
 		}
 
-		// Try reading the log as JSON.
-		var entry map[string]interface{}
-		if err := json.Unmarshal(raw, &entry); err != nil {
-			// Just add the log as string.
-			lines = append(lines, string(raw))
-		} else {
-			lines = append(lines, entry)
+		// Lines may have been evicted while the files were read, they are read from the files again.
+		live := w.stream.Follow(cursor)
+		if live.Truncated {
+			live.Close()
+			if len(page.Lines) == 0 {
+				// The files no longer hold the lines, the subscriber resumes from its last line and learns whether
+				// they were pruned.
+				subscription.err = ErrSubscriberLagging
+				return
+			}
+			continue
 		}
+		defer live.Close()
+
+		for {
+			select {
+			case line, ok := <-live.Lines():
+				if !ok {
+					subscription.err = live.Err()
+					return
+				}
+				if !send(line) {
+					return
+				}
+			case <-subscription.closed:
+				return
+			}
+		}
+	}
+}
+
+// GetLastNLines returns up to the n last lines, parsed as JSON when possible.
+func (w *logWriter) GetLastNLines(n int) (lines []interface{}) {
+	for _, line := range w.stream.Last(n) {
+		lines = append(lines, line.Entry())
 	}
 
 	return
@@ -0,0 +1,369 @@
+package xecute
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestLogWriter(t *testing.T, dir string, rotation LogRotation) *logWriter {
+	t.Helper()
+
+	w, err := newLogWriter(dir, rotation, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// logMessage returns the message of a captured line.
+func logMessage(t *testing.T, raw []byte) string {
+	t.Helper()
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		t.Fatalf("expected a tagged line, got %s", raw)
+	}
+	message, _ := entry[LOG_MESSAGE_FIELD].(string)
+	return message
+}
+
+// readLogLines returns the messages of the lines of the rotated and current log files of a directory, oldest first.
+func readLogLines(t *testing.T, dir string) []string {
+	t.Helper()
+
+	rotated, err := listRotatedLogs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for _, log := range rotated {
+		paths = append(paths, log.path)
+	}
+	paths = append(paths, filepath.Join(dir, LOG_FILE))
+
+	var lines []string
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var reader io.Reader = file
+		if filepath.Ext(path) == COMPRESSED_LOG_SUFFIX {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader = gz
+		}
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			lines = append(lines, logMessage(t, scanner.Bytes()))
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return lines
+}
+
+func TestLogWriter_Rotate(t *testing.T) {
+	tests := []struct {
+		name           string
+		rotation       LogRotation
+		wantRotated    []string
+		wantFirstLine  string
+		wantGeneration uint64
+	}{
+		{"noRotation", LogRotation{}, []string{}, "line-0", 0},
+		{"bySize", LogRotation{MaxSize: 1}, []string{"log.0.json", "log.1.json", "log.2.json", "log.3.json", "log.4.json"}, "line-0", 5},
+		{"compressed", LogRotation{MaxSize: 1, Compress: true}, []string{"log.0.json.gz", "log.1.json.gz", "log.2.json.gz", "log.3.json.gz", "log.4.json.gz"}, "line-0", 5},
+		{"retention", LogRotation{MaxSize: 1, MaxFiles: 2, Compress: true}, []string{"log.3.json.gz", "log.4.json.gz"}, "line-3", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w := newTestLogWriter(t, dir, tt.rotation)
+			stdout := w.output(StreamStdout)
+
+			// Every line fills a file. The last line is split across writes.
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(stdout, "line-%d\n", i)
+			}
+			fmt.Fprint(stdout, "line")
+			fmt.Fprint(stdout, "-5\n")
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			rotated, err := listRotatedLogs(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, log := range rotated {
+				names = append(names, filepath.Base(log.path))
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantRotated) {
+				t.Errorf("expected rotated files %v, got %v", tt.wantRotated, names)
+			}
+
+			lines := readLogLines(t, dir)
+			if len(lines) == 0 || lines[0] != tt.wantFirstLine || lines[len(lines)-1] != "line-5" {
+				t.Errorf("unexpected lines: %v", lines)
+			}
+
+			last := w.stream.Last(1)[0]
+			if last.Cursor.Generation != tt.wantGeneration {
+				t.Errorf("expected the last line in generation %d, got %v", tt.wantGeneration, last.Cursor)
+			}
+		})
+	}
+}
+
+func TestLogWriter_RotateByAge(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestLogWriter(t, dir, LogRotation{MaxAge: time.Hour})
+	stdout := w.output(StreamStdout)
+
+	fmt.Fprintln(stdout, "fresh")
+	w.startedAt = time.Now().Add(-2 * time.Hour)
+	fmt.Fprintln(stdout, "stale")
+	fmt.Fprintln(stdout, "next")
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := listRotatedLogs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("expected a single rotated file, got %v", rotated)
+	}
+
+	if lines := readLogLines(t, dir); fmt.Sprint(lines) != "[fresh stale next]" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+}
+
+func TestLogWriter_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	rotation := LogRotation{MaxSize: 1}
+
+	w := newTestLogWriter(t, dir, rotation)
+	fmt.Fprintln(w.output(StreamStdout), "first")
+	fmt.Fprintln(w.output(StreamStdout), "second")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	previous := w.stream.Last(1)[0].Cursor
+
+	// Cursors of a new run follow the cursors of the previous one.
+	w = newTestLogWriter(t, dir, rotation)
+	defer w.Close()
+	fmt.Fprintln(w.output(StreamStdout), "third")
+
+	subscription := w.stream.Follow(previous)
+	defer subscription.Close()
+	if subscription.Truncated {
+		t.Error("expected no line to be missing after the last line of the previous run")
+	}
+
+	current := w.stream.Last(1)[0].Cursor
+	if !previous.Before(current) || current.Generation != 2 {
+		t.Errorf("expected %v to follow %v in generation 2", current, previous)
+	}
+}
+
+// receiveMessages receives the messages of n lines from a subscription.
+func receiveMessages(t *testing.T, subscription *LogSubscription, n int) []string {
+	t.Helper()
+
+	var messages []string
+	for _, raw := range receiveLines(t, subscription, n) {
+		messages = append(messages, logMessage(t, []byte(raw)))
+	}
+	return messages
+}
+
+func TestLogWriter_FollowLogs(t *testing.T) {
+	dir := t.TempDir()
+	rotation := LogRotation{MaxSize: 4096, MaxFiles: 1000, Compress: true}
+
+	w := newTestLogWriter(t, dir, rotation)
+	fmt.Fprintln(w.output(StreamStdout), "previous-0")
+	first := w.stream.Last(1)[0].Cursor
+	fmt.Fprintln(w.output(StreamStdout), "previous-1")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lines of the previous run are only in the log files.
+	w = newTestLogWriter(t, dir, rotation)
+	defer w.Close()
+	for i := 0; i < BUFFER_LOG_LINES*2; i++ {
+		fmt.Fprintf(w.output(StreamStdout), "current-%d\n", i)
+	}
+
+	subscription := w.FollowLogs(first)
+	defer subscription.Close()
+	if subscription.Truncated {
+		t.Error("expected the lines still in the log files not to be reported as missing")
+	}
+
+	messages := receiveMessages(t, subscription, BUFFER_LOG_LINES*2+1)
+	if messages[0] != "previous-1" {
+		t.Errorf("expected the lines of the previous run first, got %s", messages[0])
+	}
+	for i, message := range messages[1:] {
+		if message != fmt.Sprintf("current-%d", i) {
+			t.Fatalf("expected current-%d, got %s", i, message)
+		}
+	}
+
+	// Lines written once caught up are followed live.
+	fmt.Fprintln(w.output(StreamStdout), "live")
+	if messages := receiveMessages(t, subscription, 1); messages[0] != "live" {
+		t.Errorf("expected the line written last, got %s", messages[0])
+	}
+}
+
+func TestLogWriter_FollowPrunedLogs(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestLogWriter(t, dir, LogRotation{MaxSize: 256, MaxFiles: 1})
+	defer w.Close()
+
+	fmt.Fprintln(w.output(StreamStdout), "first")
+	first := w.stream.Last(1)[0].Cursor
+	for i := 0; i < BUFFER_LOG_LINES*2; i++ {
+		fmt.Fprintf(w.output(StreamStdout), "line-%d\n", i)
+	}
+	w.archives.Wait()
+
+	subscription := w.FollowLogs(first)
+	defer subscription.Close()
+	if !subscription.Truncated {
+		t.Error("expected the lines of pruned log files to be reported as missing")
+	}
+	if messages := receiveMessages(t, subscription, 1); messages[0] != fmt.Sprintf("line-%d", BUFFER_LOG_LINES) {
+		t.Errorf("expected the oldest buffered line first, got %s", messages[0])
+	}
+}
+
+func TestLogWriter_ConcurrentRotation(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestLogWriter(t, dir, LogRotation{MaxSize: 256, MaxFiles: 1000, Compress: true})
+
+	// Stdout and stderr write concurrently while the file rotates, their lines aren't mixed.
+	var wg sync.WaitGroup
+	for i, stream := range []OutputStream{StreamStdout, StreamStderr} {
+		wg.Add(1)
+		go func(i int, output *outputWriter) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				fmt.Fprintf(output, "stream-%d-", i)
+				fmt.Fprintf(output, "line-%03d\n", j)
+			}
+		}(i, w.output(stream))
+	}
+	wg.Wait()
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLogLines(t, dir)
+	if len(lines) != 1000 {
+		t.Fatalf("expected 1000 lines, got %d", len(lines))
+	}
+
+	sort.Strings(lines)
+	for i, line := range lines {
+		if want := fmt.Sprintf("stream-%d-line-%03d", i/500, i%500); line != want {
+			t.Fatalf("expected line %s, got %s", want, line)
+		}
+	}
+}
+
+func TestLogWriter_ReportCrash(t *testing.T) {
+	dir := t.TempDir()
+	w := newTestLogWriter(t, dir, LogRotation{})
+	defer w.Close()
+
+	stdout, stderr := w.output(StreamStdout), w.output(StreamStderr)
+	fmt.Fprintln(stderr, "previous run")
+	time.Sleep(time.Millisecond)
+
+	startedAt := time.Now().UTC()
+	fmt.Fprintln(stdout, `{"level":"INFO"}`)
+	fmt.Fprintln(stderr, "thread 'main' panicked")
+	fmt.Fprint(stderr, "no line break")
+	stderr.Flush()
+
+	w.reportCrash(startedAt, 101)
+
+	report, err := ReadCrashReport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.ExitCode != 101 || !report.StartedAt.Equal(startedAt) {
+		t.Fatalf("unexpected crash report: %+v", report)
+	}
+
+	// Only the stderr lines of the run are reported.
+	var lines []string
+	for _, line := range report.Lines {
+		lines = append(lines, line.Line)
+	}
+	if fmt.Sprint(lines) != "[thread 'main' panicked no line break]" {
+		t.Errorf("unexpected crash report lines: %q", lines)
+	}
+
+	// A run is only reported once.
+	fmt.Fprintln(stderr, "after the report")
+	w.reportCrash(startedAt, 101)
+	if report, _ := ReadCrashReport(dir); len(report.Lines) != 2 {
+		t.Errorf("expected the crash report to be kept, got %+v", report)
+	}
+}
+
+func TestListRotatedLogs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"log.json", "log.2.json", "log.10.json.gz", "log.3.json", "log.3.json.gz", "log.x.json", ".compress-123", "config.toml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := listRotatedLogs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []rotatedLog{
+		{generation: 2, path: filepath.Join(dir, "log.2.json")},
+		{generation: 3, path: filepath.Join(dir, "log.3.json.gz"), compressed: true},
+		{generation: 10, path: filepath.Join(dir, "log.10.json.gz"), compressed: true},
+	}
+	if fmt.Sprint(rotated) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, rotated)
+	}
+}
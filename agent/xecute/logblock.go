@@ -0,0 +1,244 @@
+package xecute
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// The suffix of the block index of a compressed log file.
+	LOG_INDEX_SUFFIX = ".idx"
+
+	// The uncompressed size past which a block of a compressed log file ends, at the next line break. Blocks are
+	// compressed separately, so lines can be read from the middle or the end of the file without decompressing it
+	// from the start.
+	LOG_BLOCK_SIZE = 1 << 20
+
+	// The size of the chunks read when reading a log file backward.
+	LOG_READ_CHUNK_SIZE = 64 << 10
+)
+
+// A logBlock is a gzip member of a compressed log file, holding complete lines.
+type logBlock struct {
+	// The offset of the member in the compressed file.
+	Offset int64 `json:"offset"`
+
+	// The offset of the first line of the block in the uncompressed file.
+	Start int64 `json:"start"`
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it. It reads byte by byte when asked to, so gzip doesn't read past
+// the member it decompresses.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// compressBlocks compresses lines into consecutive gzip members of about LOG_BLOCK_SIZE bytes, and returns the
+// blocks written. The output is a regular gzip file.
+func compressBlocks(dst io.Writer, src io.Reader) ([]logBlock, error) {
+	counter := &countingWriter{w: dst}
+	reader := bufio.NewReader(src)
+
+	blocks := []logBlock{}
+	var start int64
+	for {
+		block := logBlock{Offset: counter.n, Start: start}
+		gz := gzip.NewWriter(counter)
+
+		var size int64
+		var err error
+		for size < LOG_BLOCK_SIZE && err == nil {
+			var line []byte
+			line, err = reader.ReadBytes('\n')
+			if len(line) == 0 {
+				continue
+			}
+			if _, writeErr := gz.Write(line); writeErr != nil {
+				return nil, writeErr
+			}
+			size += int64(len(line))
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		// Empty files still get a member, so they are valid gzip files.
+		if size > 0 || len(blocks) == 0 {
+			if err := gz.Close(); err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		}
+		start += size
+
+		if err == io.EOF {
+			return blocks, nil
+		}
+	}
+}
+
+// writeLogIndex saves the block index of a compressed log file.
+func writeLogIndex(path string, blocks []logBlock) error {
+	encoded, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+LOG_INDEX_SUFFIX, encoded, 0644)
+}
+
+// readLogIndex returns the block index of a compressed log file. Files without an index are indexed by
+// decompressing them once.
+func readLogIndex(file *os.File) ([]logBlock, error) {
+	encoded, err := os.ReadFile(file.Name() + LOG_INDEX_SUFFIX)
+	if err == nil {
+		var blocks []logBlock
+		if err := json.Unmarshal(encoded, &blocks); err == nil && len(blocks) > 0 {
+			return blocks, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	counter := &countingReader{r: bufio.NewReader(file)}
+	var blocks []logBlock
+	var start int64
+	for {
+		if _, err := counter.r.Peek(1); err == io.EOF {
+			return blocks, nil
+		}
+
+		block := logBlock{Offset: counter.n, Start: start}
+		gz, err := gzip.NewReader(counter)
+		if err != nil {
+			return nil, err
+		}
+		gz.Multistream(false)
+
+		size, err := io.Copy(io.Discard, gz)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		start += size
+	}
+}
+
+// findBlock returns the index of the block holding an uncompressed offset.
+func findBlock(blocks []logBlock, offset int64) int {
+	i := sort.Search(len(blocks), func(i int) bool { return blocks[i].Start > offset }) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// readBlock returns the uncompressed lines of a block of a compressed log file.
+func readBlock(file *os.File, blocks []logBlock, i int) ([]byte, error) {
+	var end int64
+	if i+1 < len(blocks) {
+		end = blocks[i+1].Offset
+	} else if info, err := file.Stat(); err != nil {
+		return nil, err
+	} else {
+		end = info.Size()
+	}
+
+	gz, err := gzip.NewReader(io.NewSectionReader(file, blocks[i].Offset, end-blocks[i].Offset))
+	if err != nil {
+		return nil, err
+	}
+	gz.Multistream(false)
+
+	return io.ReadAll(gz)
+}
+
+// scanLinesBackward reads the complete lines of the first end bytes of a reader, starting with the last one, until
+// fn returns false. Lines are given along with the offset of their end, base being the offset of the reader.
+// It returns false if fn stopped the scan.
+func scanLinesBackward(r io.ReaderAt, base, end int64, fn func(raw []byte, lineEnd int64) bool) (bool, error) {
+	// buf holds the bytes from pos not scanned yet. Once trimmed, it ends with a line break.
+	var buf []byte
+	pos, trimmed := end, false
+	for {
+		if pos > 0 {
+			size := int64(LOG_READ_CHUNK_SIZE)
+			if size > pos {
+				size = pos
+			}
+
+			chunk := make([]byte, size, size+int64(len(buf)))
+			if _, err := r.ReadAt(chunk, pos-size); err != nil && err != io.EOF {
+				return true, err
+			}
+			buf = append(chunk, buf...)
+			pos -= size
+		}
+
+		if !trimmed {
+			// A line being written is only read once complete.
+			i := bytes.LastIndexByte(buf, '\n')
+			if i < 0 {
+				if pos == 0 {
+					return true, nil
+				}
+				continue
+			}
+			buf, trimmed = buf[:i+1], true
+		}
+
+		for len(buf) > 0 {
+			i := bytes.LastIndexByte(buf[:len(buf)-1], '\n')
+			if i < 0 && pos > 0 {
+				// The line starts in a chunk not read yet.
+				break
+			}
+
+			raw := append([]byte(nil), buf[i+1:len(buf)-1]...)
+			if !fn(raw, base+pos+int64(len(buf))) {
+				return false, nil
+			}
+			buf = buf[:i+1]
+		}
+
+		if pos == 0 {
+			return true, nil
+		}
+	}
+}
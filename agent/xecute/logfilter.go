@@ -0,0 +1,154 @@
+package xecute
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidFilter is returned when parsing a malformed log filter.
+var ErrInvalidFilter = errors.New("invalid log filter")
+
+// The severity of a JSON log line, as logged by menmos in its "level" field.
+type Severity = string
+
+const (
+	SeverityTrace = "TRACE"
+	SeverityDebug = "DEBUG"
+	SeverityInfo  = "INFO"
+	SeverityWarn  = "WARN"
+	SeverityError = "ERROR"
+)
+
+var severityRanks = map[Severity]int{
+	SeverityTrace: 0,
+	SeverityDebug: 1,
+	SeverityInfo:  2,
+	SeverityWarn:  3,
+	SeverityError: 4,
+}
+
+// ParseSeverity parses a severity, regardless of its case.
+func ParseSeverity(raw string) (Severity, error) {
+	severity := strings.ToUpper(raw)
+	if _, ok := severityRanks[severity]; !ok {
+		return "", fmt.Errorf("%w: unknown severity '%s'", ErrInvalidFilter, raw)
+	}
+	return severity, nil
+}
+
+// ParseFieldFilter parses a field equality filter formatted as "<field>=<value>".
+func ParseFieldFilter(raw string) (field string, value string, err error) {
+	field, value, ok := strings.Cut(raw, "=")
+	if !ok || field == "" {
+		return "", "", fmt.Errorf("%w: field filter '%s' isn't formatted as '<field>=<value>'", ErrInvalidFilter, raw)
+	}
+	return field, value, nil
+}
+
+// A LogFilter selects log lines by their content. The structured filters only keep JSON lines, and the empty filter
+// keeps every line.
+type LogFilter struct {
+	// Only the JSON lines at or above this severity are kept.
+	MinSeverity Severity
+
+	// Only the JSON lines at or below this severity are kept.
+	MaxSeverity Severity
+
+	// Only the JSON lines logged by this target or its submodules are kept, e.g. "amphora" keeps "amphora::node".
+	Target string
+
+	// Only the JSON lines with these field values are kept. Nested fields are named with dots, and fields missing
+	// from the line are looked up in its "fields" object, where menmos logs the fields of its events.
+	Fields map[string]string
+
+	// Only the lines containing this text are kept, regardless of its case. The text filters apply to the lines as the
+	// process wrote them, without the fields added by the agent.
+	Search string
+
+	// Only the lines matching this expression are kept.
+	Pattern *regexp.Regexp
+}
+
+// structured returns whether the filter needs the lines to be parsed.
+func (f LogFilter) structured() bool {
+	return f.MinSeverity != "" || f.MaxSeverity != "" || f.Target != "" || len(f.Fields) > 0
+}
+
+// match returns whether a line is kept by the filter. Its entry is nil if the line isn't JSON.
+func (f LogFilter) match(raw []byte, entry map[string]interface{}) bool {
+	if f.Search != "" || f.Pattern != nil {
+		text := lineText(raw)
+		if f.Search != "" && !bytes.Contains(bytes.ToLower(text), bytes.ToLower([]byte(f.Search))) {
+			return false
+		}
+		if f.Pattern != nil && !f.Pattern.Match(text) {
+			return false
+		}
+	}
+
+	if !f.structured() {
+		return true
+	} else if entry == nil {
+		return false
+	}
+
+	if f.MinSeverity != "" || f.MaxSeverity != "" {
+		level, _ := entry["level"].(string)
+		rank, ok := severityRanks[strings.ToUpper(level)]
+		if !ok || (f.MinSeverity != "" && rank < severityRanks[f.MinSeverity]) ||
+			(f.MaxSeverity != "" && rank > severityRanks[f.MaxSeverity]) {
+			return false
+		}
+	}
+
+	if f.Target != "" {
+		target, _ := entry["target"].(string)
+		if target != f.Target && !strings.HasPrefix(target, f.Target+"::") {
+			return false
+		}
+	}
+
+	for field, want := range f.Fields {
+		value, ok := lookupField(entry, field)
+		if !ok {
+			value, ok = lookupField(entry, "fields."+field)
+		}
+		if !ok || fieldString(value) != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lookupField returns the value of a field of a JSON entry, nested fields being named with dots.
+func lookupField(entry map[string]interface{}, field string) (interface{}, bool) {
+	var value interface{} = entry
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// fieldString formats a field value for comparison. Strings are compared as is, other values as JSON.
+func fieldString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
@@ -0,0 +1,148 @@
+package xecute
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLogFilter(t *testing.T) {
+	lines := map[string]string{
+		"info":  `{"timestamp":"2022-01-01T10:00:00Z","level":"INFO","target":"amphora::node","fields":{"message":"registered","port":3030}}`,
+		"warn":  `{"timestamp":"2022-01-01T10:00:01Z","level":"WARN","target":"amphoraclient","fields":{"message":"slow upload"}}`,
+		"error": `{"timestamp":"2022-01-01T10:00:02Z","level":"ERROR","target":"amphora","fields":{"message":"disk full"},"span":{"name":"upload"}}`,
+		"plain": `thread 'main' panicked at 'disk full'`,
+	}
+
+	tests := []struct {
+		name   string
+		filter LogFilter
+		want   []string
+	}{
+		{"empty", LogFilter{}, []string{"error", "info", "plain", "warn"}},
+		{"minSeverity", LogFilter{MinSeverity: SeverityWarn}, []string{"error", "warn"}},
+		{"maxSeverity", LogFilter{MaxSeverity: SeverityWarn}, []string{"info", "warn"}},
+		{"severityRange", LogFilter{MinSeverity: SeverityWarn, MaxSeverity: SeverityWarn}, []string{"warn"}},
+		{"target", LogFilter{Target: "amphora"}, []string{"error", "info"}},
+		{"submodule", LogFilter{Target: "amphora::node"}, []string{"info"}},
+		{"field", LogFilter{Fields: map[string]string{"fields.message": "slow upload"}}, []string{"warn"}},
+		{"eventField", LogFilter{Fields: map[string]string{"message": "registered"}}, []string{"info"}},
+		{"nonStringField", LogFilter{Fields: map[string]string{"port": "3030"}}, []string{"info"}},
+		{"nestedField", LogFilter{Fields: map[string]string{"span.name": "upload", "level": "ERROR"}}, []string{"error"}},
+		{"missingField", LogFilter{Fields: map[string]string{"span.id": "1"}}, nil},
+		{"search", LogFilter{Search: "DISK FULL"}, []string{"error", "plain"}},
+		{"pattern", LogFilter{Pattern: regexp.MustCompile(`panicked|"slow`)}, []string{"plain", "warn"}},
+		{"searchAndSeverity", LogFilter{Search: "disk", MinSeverity: SeverityError}, []string{"error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, name := range []string{"error", "info", "plain", "warn"} {
+				line := LogLine{Raw: []byte(lines[name])}
+				entry, _ := line.Entry().(map[string]interface{})
+				if tt.filter.match(line.Raw, entry) {
+					got = append(got, name)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestLogFilter_TaggedLines(t *testing.T) {
+	capturedAt := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	lines := map[string][]byte{
+		"panic":  tagLine(StreamStderr, capturedAt, []byte(`panic: "disk" full at C:\data`)),
+		"stdout": tagLine(StreamStdout, capturedAt, []byte(`{"level":"INFO","fields":{"message":"registered"}}`)),
+	}
+
+	tests := []struct {
+		name   string
+		filter LogFilter
+		want   []string
+	}{
+		{"anchored", LogFilter{Pattern: regexp.MustCompile(`^panic`)}, []string{"panic"}},
+		{"quotes", LogFilter{Pattern: regexp.MustCompile(`"disk" full`)}, []string{"panic"}},
+		{"backslash", LogFilter{Pattern: regexp.MustCompile(`C:\\data$`)}, []string{"panic"}},
+		{"search", LogFilter{Search: `"DISK"`}, []string{"panic"}},
+		{"jsonPayload", LogFilter{Pattern: regexp.MustCompile(`^\{"level":"INFO"`)}, []string{"stdout"}},
+		{"injectedFields", LogFilter{Search: "stderr"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, name := range []string{"panic", "stdout"} {
+				line := LogLine{Raw: lines[name]}
+				entry, _ := line.Entry().(map[string]interface{})
+				if tt.filter.match(line.Raw, entry) {
+					got = append(got, name)
+				}
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    Severity
+		wantErr bool
+	}{
+		{"warn", SeverityWarn, false},
+		{"ERROR", SeverityError, false},
+		{"Trace", SeverityTrace, false},
+		{"fatal", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseSeverity(tt.raw)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidFilter)) {
+				t.Fatalf("ParseSeverity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSeverity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldFilter(t *testing.T) {
+	tests := []struct {
+		raw       string
+		wantField string
+		wantValue string
+		wantErr   bool
+	}{
+		{"target=amphora", "target", "amphora", false},
+		{"fields.message=a=b", "fields.message", "a=b", false},
+		{"message=", "message", "", false},
+		{"=value", "", "", true},
+		{"message", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			field, value, err := ParseFieldFilter(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFieldFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if field != tt.wantField || value != tt.wantValue {
+				t.Errorf("ParseFieldFilter() = %s, %s, want %s, %s", field, value, tt.wantField, tt.wantValue)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package xecute
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The JSON field holding the time of a log line, set by menmos when logging as JSON.
+const LOG_TIMESTAMP_FIELD = "timestamp"
+
+// A LogQuery selects lines of the log of a node.
+type LogQuery struct {
+	// Only the lines after this cursor are returned, starting with the oldest. Without it, the last lines are returned.
+	After *Cursor
+
+	// Only the lines before this cursor are returned. Following the start cursor of a page returns the previous page.
+	Before *Cursor
+
+	// Only the lines written in this time range are returned, zero times don't bound the range. Lines without a
+	// timestamp take the time they were captured at, or the time of the line before them if they weren't tagged.
+	Since time.Time
+	Until time.Time
+
+	// Only the lines kept by this filter are returned.
+	Filter LogFilter
+
+	// The maximum number of lines returned, all the matching lines if zero.
+	Limit int
+}
+
+// A LogPage holds the lines matching a log query, oldest first.
+type LogPage struct {
+	Lines []LogLine
+
+	// Whether lines past the limit also match the query: after the page when following a cursor, before it otherwise.
+	More bool
+}
+
+// includes returns whether the line ending at a cursor is within the cursor range of the query.
+func (q LogQuery) includes(cursor Cursor) bool {
+	return (q.After == nil || q.After.Before(cursor)) && (q.Before == nil || !q.Before.Before(cursor))
+}
+
+// past returns whether the line ending at a cursor, and the lines after it, are past the cursor range of the query.
+func (q LogQuery) past(cursor Cursor) bool {
+	return q.Before != nil && q.Before.Before(cursor)
+}
+
+func (q LogQuery) timeBounded() bool {
+	return !q.Since.IsZero() || !q.Until.IsZero()
+}
+
+func (q LogQuery) inTimeRange(t time.Time) bool {
+	return !t.Before(q.Since) && (q.Until.IsZero() || t.Before(q.Until))
+}
+
+// entryTime returns the timestamp of a JSON log entry, or the time it was captured at if menmos didn't log one.
+func entryTime(entry map[string]interface{}) (time.Time, bool) {
+	timestamp, ok := entry[LOG_TIMESTAMP_FIELD].(string)
+	if !ok {
+		if timestamp, ok = entry[LOG_CAPTURED_AT_FIELD].(string); !ok {
+			return time.Time{}, false
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// A lineMatcher matches the lines of a log read in order against a query.
+type lineMatcher struct {
+	query LogQuery
+
+	// The time of the last line with a timestamp.
+	last    time.Time
+	hasTime bool
+}
+
+func newLineMatcher(query LogQuery) *lineMatcher {
+	return &lineMatcher{query: query}
+}
+
+func (m *lineMatcher) match(line LogLine) bool {
+	// Lines are only parsed when needed.
+	var entry map[string]interface{}
+	if m.query.timeBounded() || m.query.Filter.structured() {
+		entry, _ = line.Entry().(map[string]interface{})
+	}
+
+	if m.query.timeBounded() {
+		if t, ok := entryTime(entry); ok {
+			m.last, m.hasTime = t, true
+		}
+	}
+	if !m.query.includes(line.Cursor) {
+		return false
+	}
+
+	if m.query.timeBounded() && (!m.hasTime || !m.query.inTimeRange(m.last)) {
+		return false
+	}
+
+	return m.query.Filter.match(line.Raw, entry)
+}
+
+// A backwardMatcher matches the lines of a log read backward against a query. Lines without a time take the time of
+// the line before them, so they are only matched once that line is read.
+type backwardMatcher struct {
+	query LogQuery
+
+	// The lines waiting for a time, newest first.
+	pending []matchedLine
+}
+
+type matchedLine struct {
+	line  LogLine
+	entry map[string]interface{}
+}
+
+// match returns the lines matching the query among a line and the lines after it that were waiting for a time,
+// newest first.
+func (m *backwardMatcher) match(line LogLine) []LogLine {
+	var entry map[string]interface{}
+	if m.query.timeBounded() || m.query.Filter.structured() {
+		entry, _ = line.Entry().(map[string]interface{})
+	}
+
+	if !m.query.timeBounded() {
+		if m.query.Filter.match(line.Raw, entry) {
+			return []LogLine{line}
+		}
+		return nil
+	}
+
+	m.pending = append(m.pending, matchedLine{line: line, entry: entry})
+	t, ok := entryTime(entry)
+	if !ok {
+		return nil
+	}
+
+	var matched []LogLine
+	if m.query.inTimeRange(t) {
+		for _, pending := range m.pending {
+			if m.query.Filter.match(pending.line.Raw, pending.entry) {
+				matched = append(matched, pending.line)
+			}
+		}
+	}
+	m.pending = m.pending[:0]
+	return matched
+}
+
+// A pageCollector gathers the lines of a page, read forward when following a cursor and backward otherwise.
+type pageCollector struct {
+	query LogQuery
+	page  LogPage
+}
+
+// add appends a line read forward, and returns whether more lines are needed.
+func (c *pageCollector) add(line LogLine) bool {
+	if c.query.Limit > 0 && len(c.page.Lines) >= c.query.Limit {
+		c.page.More = true
+		return false
+	}
+
+	c.page.Lines = append(c.page.Lines, line)
+	return true
+}
+
+// needed returns how many lines before the collected ones complete the page, one more than the limit to tell
+// whether more lines match. It is zero if there is no limit.
+func (c *pageCollector) needed() int {
+	if c.query.Limit <= 0 {
+		return 0
+	}
+	return c.query.Limit - len(c.page.Lines) + 1
+}
+
+// prepend adds lines read backward before the collected ones, and returns whether more lines are needed.
+func (c *pageCollector) prepend(lines []LogLine) bool {
+	c.page.Lines = append(lines, c.page.Lines...)
+
+	if c.query.Limit > 0 && len(c.page.Lines) > c.query.Limit {
+		c.page.Lines = c.page.Lines[len(c.page.Lines)-c.query.Limit:]
+		c.page.More = true
+		return false
+	}
+	return true
+}
+
+// A lineWindow keeps the last lines added to it, all of them if its size is zero.
+type lineWindow struct {
+	size  int
+	lines []LogLine
+}
+
+func (w *lineWindow) add(line LogLine) {
+	w.lines = append(w.lines, line)
+
+	// Lines are dropped in batches, so they aren't copied on every line.
+	if w.size > 0 && len(w.lines) >= 2*w.size {
+		w.lines = append(w.lines[:0], w.lines[len(w.lines)-w.size:]...)
+	}
+}
+
+func (w *lineWindow) last() []LogLine {
+	if w.size > 0 && len(w.lines) > w.size {
+		return w.lines[len(w.lines)-w.size:]
+	}
+	return w.lines
+}
+
+// A logFile is a log file of a node, rotated or current.
+type logFile struct {
+	generation uint64
+
+	// The current log file is opened when the files are listed, so it can't be rotated before it is read.
+	current *os.File
+	rotated rotatedLog
+}
+
+// open opens the log file. It returns nil if the file was removed since it was listed.
+func (f *logFile) open() (file *os.File, compressed bool, err error) {
+	if f.current != nil {
+		return f.current, false, nil
+	}
+	return openRotatedLog(f.rotated)
+}
+
+// scan reads the complete lines of the log file from an offset, until fn returns false. The file is skipped if
+// skip returns true for its modification time.
+func (f *logFile) scan(offset int64, skip func(modTime time.Time) bool, fn func(line LogLine) bool) error {
+	file, compressed, err := f.open()
+	if err != nil || file == nil {
+		return err
+	}
+	if f.current == nil {
+		defer file.Close()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if skip(info.ModTime()) {
+		return nil
+	}
+
+	var reader io.Reader = file
+	if compressed {
+		// Decompressing starts with the block holding the offset.
+		blocks, err := readLogIndex(file)
+		if err != nil {
+			return err
+		}
+		block := blocks[findBlock(blocks, offset)]
+		if _, err := file.Seek(block.Offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, gz, offset-block.Start); err != nil && err != io.EOF {
+			return err
+		}
+		reader = gz
+	} else if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	buffered := bufio.NewReader(reader)
+	for {
+		raw, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			// A line being written is only read once complete.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		offset += int64(len(raw))
+		if !fn(LogLine{Cursor: Cursor{Generation: f.generation, Offset: offset}, Raw: raw[:len(raw)-1]}) {
+			return nil
+		}
+	}
+}
+
+// scanBackward reads the complete lines of the log file ending at or before an offset, starting with the last one,
+// until fn returns false. A negative offset reads the whole file. The file is skipped if skip returns true for its
+// modification time. It returns false if fn stopped the scan.
+func (f *logFile) scanBackward(end int64, skip func(modTime time.Time) bool, fn func(line LogLine) bool) (bool, error) {
+	file, compressed, err := f.open()
+	if err != nil || file == nil {
+		return true, err
+	}
+	if f.current == nil {
+		defer file.Close()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return true, err
+	}
+	if skip(info.ModTime()) {
+		return true, nil
+	}
+
+	emit := func(raw []byte, lineEnd int64) bool {
+		return fn(LogLine{Cursor: Cursor{Generation: f.generation, Offset: lineEnd}, Raw: raw})
+	}
+
+	if !compressed {
+		if end < 0 || end > info.Size() {
+			end = info.Size()
+		}
+		return scanLinesBackward(file, 0, end, emit)
+	}
+
+	// Compressed files are read one block at a time, starting with the block holding the offset.
+	blocks, err := readLogIndex(file)
+	if err != nil {
+		return true, err
+	}
+	last := len(blocks) - 1
+	if end >= 0 {
+		last = findBlock(blocks, end-1)
+	}
+
+	for i := last; i >= 0; i-- {
+		data, err := readBlock(file, blocks, i)
+		if err != nil {
+			return true, err
+		}
+
+		blockEnd := int64(len(data))
+		if end >= 0 && end-blocks[i].Start < blockEnd {
+			blockEnd = end - blocks[i].Start
+		}
+		if ok, err := scanLinesBackward(bytes.NewReader(data), blocks[i].Start, blockEnd, emit); !ok || err != nil {
+			return ok, err
+		}
+	}
+	return true, nil
+}
+
+// openRotatedLog opens a rotated log file. The file may have been compressed or pruned since it was listed, it
+// returns nil if it was pruned.
+func openRotatedLog(log rotatedLog) (file *os.File, compressed bool, err error) {
+	file, err = os.Open(log.path)
+	if err == nil {
+		return file, log.compressed, nil
+	} else if !errors.Is(err, os.ErrNotExist) || log.compressed {
+		return nil, false, ignoreNotExist(err)
+	}
+
+	file, err = os.Open(log.path + COMPRESSED_LOG_SUFFIX)
+	if err != nil {
+		return nil, false, ignoreNotExist(err)
+	}
+	return file, true, nil
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// logFiles are the log files of a node directory, oldest first.
+type logFiles []*logFile
+
+// openLogFiles lists the log files of a node directory, and opens the current one. Rotating the log file while
+// listing the files would skip lines.
+func openLogFiles(dir string) (logFiles, error) {
+	rotated, err := listRotatedLogs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files logFiles
+	var generation uint64
+	for _, log := range rotated {
+		files = append(files, &logFile{generation: log.generation, rotated: log})
+		generation = log.generation + 1
+	}
+
+	current, err := os.Open(filepath.Join(dir, LOG_FILE))
+	if err == nil {
+		files = append(files, &logFile{generation: generation, current: current})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (files logFiles) Close() error {
+	if len(files) > 0 && files[len(files)-1].current != nil {
+		return files[len(files)-1].current.Close()
+	}
+	return nil
+}
+
+// query reads the lines matching a query from the log files.
+func (files logFiles) query(query LogQuery) (LogPage, error) {
+	collector := pageCollector{query: query}
+
+	// Files last modified before the time range only hold older lines.
+	before := func(modTime time.Time) bool {
+		return !query.Since.IsZero() && modTime.Before(query.Since)
+	}
+
+	if query.After != nil {
+		done := false
+		for _, file := range files {
+			if done || file.generation < query.After.Generation || (query.Before != nil && file.generation > query.Before.Generation) {
+				continue
+			}
+
+			var offset int64
+			if file.generation == query.After.Generation {
+				offset = query.After.Offset
+			}
+
+			matcher := newLineMatcher(query)
+			err := file.scan(offset, before, func(line LogLine) bool {
+				if query.past(line.Cursor) {
+					done = true
+					return false
+				}
+				if matcher.match(line) && !collector.add(line) {
+					done = true
+				}
+				return !done
+			})
+			if err != nil {
+				return LogPage{}, err
+			}
+		}
+
+		return collector.page, nil
+	}
+
+	// Lines are read backward, newest first, until the page is complete.
+	var newest []LogLine
+	complete := func() bool {
+		return query.Limit > 0 && len(newest) > query.Limit
+	}
+
+	matcher := backwardMatcher{query: query}
+	for i := len(files) - 1; i >= 0 && !complete(); i-- {
+		file := files[i]
+		if query.Before != nil && file.generation > query.Before.Generation {
+			continue
+		}
+
+		end := int64(-1)
+		if query.Before != nil && file.generation == query.Before.Generation {
+			end = query.Before.Offset
+		}
+
+		skipped := false
+		_, err := file.scanBackward(end, func(modTime time.Time) bool {
+			skipped = before(modTime)
+			return skipped
+		}, func(line LogLine) bool {
+			newest = append(newest, matcher.match(line)...)
+			return !complete()
+		})
+		if err != nil {
+			return LogPage{}, err
+		}
+
+		// Older files are older still.
+		if skipped {
+			break
+		}
+	}
+
+	var page LogPage
+	if complete() {
+		newest, page.More = newest[:query.Limit], true
+	}
+	page.Lines = make([]LogLine, len(newest))
+	for i, line := range newest {
+		page.Lines[len(newest)-1-i] = line
+	}
+
+	return page, nil
+}
+
+// ReadLogs reads the lines matching a query from the log files of a node directory.
+func ReadLogs(dir string, query LogQuery) (LogPage, error) {
+	files, err := openLogFiles(dir)
+	if err != nil {
+		return LogPage{}, err
+	}
+	defer files.Close()
+
+	return files.query(query)
+}
@@ -0,0 +1,364 @@
+package xecute
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var logQueryStart = time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+// writeQueryFixture writes a compressed rotated file, a rotated file and the current log file. Lines are named
+// "n<minute>" and logged at that minute, "panic" is a plain line. It returns the cursor of every line.
+func writeQueryFixture(t *testing.T, dir string) map[string]Cursor {
+	t.Helper()
+
+	files := []struct {
+		generation uint64
+		name       string
+		compressed bool
+		lines      []string
+		modTime    time.Time
+	}{
+		{0, "log.0.json.gz", true, []string{"n0", "n1"}, logQueryStart.Add(90 * time.Second)},
+		{1, "log.1.json", false, []string{"n2", "panic", "n3"}, logQueryStart.Add(210 * time.Second)},
+		{2, LOG_FILE, false, []string{"n4", "n5"}, logQueryStart.Add(330 * time.Second)},
+	}
+
+	cursors := make(map[string]Cursor)
+	for _, file := range files {
+		var content bytes.Buffer
+		for _, line := range file.lines {
+			if line != "panic" {
+				var minute int
+				fmt.Sscanf(line, "n%d", &minute)
+				line = fmt.Sprintf(`{"timestamp":"%s","message":"%s"}`, logQueryStart.Add(time.Duration(minute)*time.Minute).Format(time.RFC3339Nano), line)
+			}
+			content.WriteString(line + "\n")
+		}
+
+		// Cursors are computed from the uncompressed content.
+		var offset int64
+		for _, raw := range bytes.SplitAfter(content.Bytes(), []byte("\n")) {
+			if len(raw) == 0 {
+				continue
+			}
+			offset += int64(len(raw))
+			cursors[logQueryLabel(LogLine{Raw: raw[:len(raw)-1]})] = Cursor{Generation: file.generation, Offset: offset}
+		}
+
+		data := content.Bytes()
+		if file.compressed {
+			var compressed bytes.Buffer
+			gz := gzip.NewWriter(&compressed)
+			gz.Write(data)
+			gz.Close()
+			data = compressed.Bytes()
+		}
+
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, file.modTime, file.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cursors
+}
+
+// logQueryLabel returns the message of a fixture line, or the line itself if it is plain.
+func logQueryLabel(line LogLine) string {
+	if entry, ok := line.Entry().(map[string]interface{}); ok {
+		return fmt.Sprint(entry["message"])
+	}
+	return string(line.Raw)
+}
+
+func TestReadLogs(t *testing.T) {
+	dir := t.TempDir()
+	cursors := writeQueryFixture(t, dir)
+
+	cursor := func(label string) *Cursor {
+		c := cursors[label]
+		return &c
+	}
+	at := func(minutes float64) time.Time {
+		return logQueryStart.Add(time.Duration(minutes * float64(time.Minute)))
+	}
+
+	tests := []struct {
+		name     string
+		query    LogQuery
+		want     string
+		wantMore bool
+	}{
+		{"tail", LogQuery{Limit: 2}, "[n4 n5]", true},
+		{"all", LogQuery{}, "[n0 n1 n2 panic n3 n4 n5]", false},
+		{"tailAcrossFiles", LogQuery{Limit: 4}, "[panic n3 n4 n5]", true},
+		{"afterCompressed", LogQuery{After: cursor("n0"), Limit: 1}, "[n1]", true},
+		{"afterRotated", LogQuery{After: cursor("n1"), Limit: 3}, "[n2 panic n3]", true},
+		{"afterEnd", LogQuery{After: cursor("n5")}, "[]", false},
+		{"afterLast", LogQuery{After: cursor("n3")}, "[n4 n5]", false},
+		{"before", LogQuery{Before: &Cursor{Generation: 2}, Limit: 2}, "[panic n3]", true},
+		{"beforeLine", LogQuery{Before: cursor("n2"), Limit: 10}, "[n0 n1 n2]", false},
+		{"range", LogQuery{After: cursor("n1"), Before: cursor("n2")}, "[n2]", false},
+		{"timeRange", LogQuery{Since: at(2), Until: at(4)}, "[n2 panic n3]", false},
+		{"since", LogQuery{Since: at(3)}, "[n3 n4 n5]", false},
+		{"sinceSkipsFiles", LogQuery{Since: at(3.5), Limit: 10}, "[n4 n5]", false},
+		{"until", LogQuery{Until: at(1.5), Limit: 1}, "[n1]", true},
+		{"afterWithTime", LogQuery{After: cursor("n0"), Since: at(3), Limit: 2}, "[n3 n4]", true},
+		{"search", LogQuery{Filter: LogFilter{Search: "PANIC"}, Limit: 10}, "[panic]", false},
+		{"filteredTail", LogQuery{Filter: LogFilter{Pattern: regexp.MustCompile(`"n[0-3]"`)}, Limit: 2}, "[n2 n3]", true},
+		{"filteredAfter", LogQuery{After: cursor("n0"), Filter: LogFilter{Fields: map[string]string{"message": "n4"}}}, "[n4]", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := ReadLogs(dir, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			labels := []string{}
+			for _, line := range page.Lines {
+				labels = append(labels, logQueryLabel(line))
+				if line.Cursor != cursors[logQueryLabel(line)] {
+					t.Errorf("expected %s to end at %v, got %v", logQueryLabel(line), cursors[logQueryLabel(line)], line.Cursor)
+				}
+			}
+
+			if got := fmt.Sprint(labels); got != tt.want {
+				t.Errorf("expected lines %s, got %s", tt.want, got)
+			}
+			if page.More != tt.wantMore {
+				t.Errorf("expected more to be %v", tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestReadLogs_Empty(t *testing.T) {
+	page, err := ReadLogs(t.TempDir(), LogQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != 0 || page.More {
+		t.Errorf("expected no lines, got %+v", page)
+	}
+}
+
+func TestOpenRotatedLog(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(rotatedLogPath(dir, 1, true), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file was compressed since it was listed.
+	file, compressed, err := openRotatedLog(rotatedLog{generation: 1, path: rotatedLogPath(dir, 1, false)})
+	if err != nil || file == nil || !compressed {
+		t.Fatalf("expected the compressed file, got %v, %v", file, err)
+	}
+	file.Close()
+
+	// The file was pruned since it was listed.
+	file, _, err = openRotatedLog(rotatedLog{generation: 2, path: rotatedLogPath(dir, 2, false)})
+	if err != nil || file != nil {
+		t.Errorf("expected no file, got %v, %v", file, err)
+	}
+}
+
+func TestLogStream_Query(t *testing.T) {
+	tests := []struct {
+		name        string
+		start       Cursor
+		published   int
+		query       func(lines []LogLine) LogQuery
+		want        string
+		wantMore    bool
+		wantCovered bool
+	}{
+		{"tail", Cursor{}, 3, func([]LogLine) LogQuery { return LogQuery{Limit: 2} }, "[line-1 line-2]", true, true},
+		{"wholeLog", Cursor{}, 3, func([]LogLine) LogQuery { return LogQuery{Limit: 5} }, "[line-0 line-1 line-2]", false, true},
+		{"previousRun", Cursor{Offset: 100}, 3, func([]LogLine) LogQuery { return LogQuery{Limit: 5} }, "", false, false},
+		{"after", Cursor{Offset: 100}, 3, func(lines []LogLine) LogQuery { return LogQuery{After: &lines[0].Cursor} }, "[line-1 line-2]", false, true},
+		{"afterPreviousRun", Cursor{Offset: 100}, 3, func([]LogLine) LogQuery { return LogQuery{After: &Cursor{Offset: 50}} }, "", false, false},
+		{"evictedTail", Cursor{}, 6, func([]LogLine) LogQuery { return LogQuery{Limit: 3} }, "[line-3 line-4 line-5]", true, true},
+		{"filtered", Cursor{}, 3, func([]LogLine) LogQuery { return LogQuery{Filter: LogFilter{Search: "line-1"}, Limit: 2} }, "[line-1]", false, true},
+		{"filteredEvicted", Cursor{}, 6, func([]LogLine) LogQuery { return LogQuery{Filter: LogFilter{Search: "line-1"}, Limit: 2} }, "", false, false},
+		{"evictedPage", Cursor{}, 6, func([]LogLine) LogQuery { return LogQuery{Limit: 4} }, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := NewLogStream(4, tt.start)
+			publishLines(stream, tt.start, 0, tt.published)
+
+			page, covered := stream.Query(tt.query(stream.Last(4)))
+			if covered != tt.wantCovered {
+				t.Fatalf("expected covered to be %v", tt.wantCovered)
+			}
+			if !covered {
+				return
+			}
+
+			var lines []string
+			for _, line := range page.Lines {
+				lines = append(lines, string(line.Raw))
+			}
+			if got := fmt.Sprint(lines); got != tt.want {
+				t.Errorf("expected lines %s, got %s", tt.want, got)
+			}
+			if page.More != tt.wantMore {
+				t.Errorf("expected more to be %v", tt.wantMore)
+			}
+		})
+	}
+}
+
+func TestLogWriter_QueryLogs(t *testing.T) {
+	dir := t.TempDir()
+	rotation := LogRotation{MaxSize: 8}
+
+	w := newTestLogWriter(t, dir, rotation)
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(w.output(StreamStdout), "line-%d\n", i)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, nothing is buffered and lines are read from the log files.
+	w = newTestLogWriter(t, dir, rotation)
+	defer w.Close()
+
+	page, err := w.QueryLogs(LogQuery{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != 3 || logMessage(t, page.Lines[0].Raw) != "line-1" || !page.More {
+		t.Errorf("expected the last lines of the previous run, got %+v", page)
+	}
+
+	fmt.Fprintln(w.output(StreamStdout), "line-4")
+	page, err = w.QueryLogs(LogQuery{After: &page.Lines[2].Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != 1 || logMessage(t, page.Lines[0].Raw) != "line-4" {
+		t.Errorf("expected the new line, got %+v", page)
+	}
+}
+
+func TestScanLinesBackward(t *testing.T) {
+	long := strings.Repeat("a", 2*LOG_READ_CHUNK_SIZE+10)
+
+	tests := []struct {
+		name string
+		data string
+		end  int
+		want []string
+	}{
+		{"lines", "a\nbb\nccc\n", -1, []string{"ccc:9", "bb:5", "a:2"}},
+		{"partialLine", "a\nbb\ncc", -1, []string{"bb:5", "a:2"}},
+		{"emptyLines", "\n\na\n", -1, []string{"a:4", ":2", ":1"}},
+		{"bounded", "a\nbb\nccc\n", 5, []string{"bb:5", "a:2"}},
+		{"noLine", "abc", -1, nil},
+		{"longLines", "a\n" + long + "\nb\n", -1, []string{"b:" + fmt.Sprint(len(long)+5), long + ":" + fmt.Sprint(len(long)+3), "a:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end := int64(tt.end)
+			if end < 0 {
+				end = int64(len(tt.data))
+			}
+
+			var got []string
+			ok, err := scanLinesBackward(strings.NewReader(tt.data), 0, end, func(raw []byte, lineEnd int64) bool {
+				got = append(got, fmt.Sprintf("%s:%d", raw, lineEnd))
+				return true
+			})
+			if err != nil || !ok {
+				t.Fatalf("scanLinesBackward() = %v, %v", ok, err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected lines %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReadLogs_CompressedBlocks(t *testing.T) {
+	dir := t.TempDir()
+
+	// The rotated file spans a few blocks.
+	var content bytes.Buffer
+	var cursors []Cursor
+	for i := 0; content.Len() < 3*LOG_BLOCK_SIZE; i++ {
+		fmt.Fprintf(&content, `{"message":"line-%06d","padding":"%s"}`+"\n", i, strings.Repeat("x", 100))
+		cursors = append(cursors, Cursor{Offset: int64(content.Len())})
+	}
+	path := rotatedLogPath(dir, 0, false)
+	if err := os.WriteFile(path, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressLog(path); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path + COMPRESSED_LOG_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	blocks, err := readLogIndex(file)
+	if err != nil || len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %v: %v", blocks, err)
+	}
+
+	// The compressed file is a regular gzip file.
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressed, err := io.ReadAll(gz); err != nil || !bytes.Equal(decompressed, content.Bytes()) {
+		t.Fatalf("expected the compressed file to hold the log file: %v", err)
+	}
+
+	last := len(cursors) - 1
+	tests := []struct {
+		name  string
+		query LogQuery
+		want  []int
+	}{
+		{"tail", LogQuery{Limit: 2}, []int{last - 1, last}},
+		{"beforeBlock", LogQuery{Before: &cursors[2000], Limit: 2}, []int{1999, 2000}},
+		{"afterBlock", LogQuery{After: &cursors[20000], Limit: 2}, []int{20001, 20002}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := ReadLogs(dir, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, want []string
+			for _, line := range page.Lines {
+				got = append(got, fmt.Sprintf("%s@%d", logQueryLabel(line), line.Cursor.Offset))
+			}
+			for _, i := range tt.want {
+				want = append(want, fmt.Sprintf("line-%06d@%d", i, cursors[i].Offset))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("expected lines %v, got %v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package xecute
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The log file of a node, in the node directory.
+	LOG_FILE = "log.json"
+
+	// The suffix of compressed rotated log files.
+	COMPRESSED_LOG_SUFFIX = ".gz"
+)
+
+// LogRotation describes when the log file of a node is rotated, and how many rotated files are kept.
+// Rotated files are named "log.<generation>.json", and "log.<generation>.json.gz" once compressed.
+type LogRotation struct {
+	// The size in bytes past which the log file is rotated, no limit if zero.
+	MaxSize int64 `json:"max_size" mapstructure:"MAX_SIZE" toml:"max_size"`
+
+	// How long lines are appended to a log file before it is rotated, no limit if zero.
+	MaxAge time.Duration `json:"max_age" mapstructure:"MAX_AGE" toml:"max_age"`
+
+	// The number of rotated files kept, no limit if zero. The oldest files are removed first.
+	MaxFiles int `json:"max_files" mapstructure:"MAX_FILES" toml:"max_files"`
+
+	// Whether rotated files are compressed with gzip.
+	Compress bool `json:"compress" mapstructure:"COMPRESS" toml:"compress"`
+}
+
+// A rotatedLog is a log file that was rotated.
+type rotatedLog struct {
+	generation uint64
+	path       string
+	compressed bool
+}
+
+// rotatedLogPath returns the path of a rotated log file.
+func rotatedLogPath(dir string, generation uint64, compressed bool) string {
+	name := fmt.Sprintf("log.%d.json", generation)
+	if compressed {
+		name += COMPRESSED_LOG_SUFFIX
+	}
+	return filepath.Join(dir, name)
+}
+
+// parseRotatedLog returns the generation of a rotated log file from its name.
+func parseRotatedLog(name string) (generation uint64, compressed bool, ok bool) {
+	compressed = strings.HasSuffix(name, COMPRESSED_LOG_SUFFIX)
+	name = strings.TrimSuffix(name, COMPRESSED_LOG_SUFFIX)
+
+	if !strings.HasPrefix(name, "log.") || !strings.HasSuffix(name, ".json") {
+		return 0, false, false
+	}
+
+	generation, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "log."), ".json"), 10, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return generation, compressed, true
+}
+
+// listRotatedLogs returns the rotated log files of a directory, oldest first. A generation being compressed is
+// listed once, compressed files are only listed once complete.
+func listRotatedLogs(dir string) ([]rotatedLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byGeneration := make(map[uint64]rotatedLog)
+	for _, entry := range entries {
+		generation, compressed, ok := parseRotatedLog(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		// The uncompressed file is only removed once the compressed file is complete, which is preferred.
+		if existing, ok := byGeneration[generation]; ok && existing.compressed {
+			continue
+		}
+		byGeneration[generation] = rotatedLog{generation: generation, path: filepath.Join(dir, entry.Name()), compressed: compressed}
+	}
+
+	logs := make([]rotatedLog, 0, len(byGeneration))
+	for _, log := range byGeneration {
+		logs = append(logs, log)
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].generation < logs[j].generation })
+
+	return logs, nil
+}
+
+// compressLog compresses a rotated log file in blocks along with its block index, and removes the uncompressed file.
+func compressLog(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".compress-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	blocks, err := compressBlocks(tmp, src)
+	if err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// The index is written first, so compressed files always have one.
+	if err := writeLogIndex(path+COMPRESSED_LOG_SUFFIX, blocks); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path+COMPRESSED_LOG_SUFFIX); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(path)
+}
+
+// archiveLogs compresses the rotated log files of a directory and removes the files past the retention count.
+func archiveLogs(dir string, rotation LogRotation) error {
+	logs, err := listRotatedLogs(dir)
+	if err != nil {
+		return err
+	}
+
+	if rotation.MaxFiles > 0 && len(logs) > rotation.MaxFiles {
+		for _, log := range logs[:len(logs)-rotation.MaxFiles] {
+			if err := os.Remove(log.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// A generation interrupted while being compressed has both files.
+			os.Remove(rotatedLogPath(dir, log.generation, !log.compressed))
+			os.Remove(rotatedLogPath(dir, log.generation, true) + LOG_INDEX_SUFFIX)
+		}
+		logs = logs[len(logs)-rotation.MaxFiles:]
+	}
+
+	for _, log := range logs {
+		if log.compressed {
+			// Left behind if compressing was interrupted after the compressed file was complete.
+			if err := os.Remove(rotatedLogPath(dir, log.generation, false)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if rotation.Compress {
+			if err := compressLog(log.path); err != nil {
+				return fmt.Errorf("failed to compress '%s': %w", log.path, err)
+			}
+		}
+	}
+
+	return nil
+}
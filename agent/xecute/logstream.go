@@ -0,0 +1,272 @@
+package xecute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/menmos/menmos-agent/agent/xecute/ring"
+)
+
+// The number of lines a subscriber can fall behind before it is disconnected.
+const SUBSCRIBER_BUFFER_LINES = 256
+
+var (
+	// ErrInvalidCursor is returned when following logs from a malformed cursor.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrSubscriberLagging ends the subscriptions that couldn't keep up with the log. They can resume from the
+	// cursor of the last line they received.
+	ErrSubscriberLagging = errors.New("subscriber fell behind the log")
+
+	// ErrLogClosed ends the subscriptions of the log of a process that was replaced or deleted. They can resume from
+	// the cursor of the last line they received, once the node is started again.
+	ErrLogClosed = errors.New("log closed")
+)
+
+// A Cursor is the position of a line in the log of a node. Following the log from a cursor returns the lines after it.
+type Cursor struct {
+	// The generation of the log file holding the line, incremented every time the log file is rotated.
+	Generation uint64
+
+	// The offset of the end of the line in its log file.
+	Offset int64
+}
+
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.Generation, c.Offset)
+}
+
+// Before returns whether the cursor is before another one.
+func (c Cursor) Before(other Cursor) bool {
+	if c.Generation != other.Generation {
+		return c.Generation < other.Generation
+	}
+	return c.Offset < other.Offset
+}
+
+func ParseCursor(raw string) (Cursor, error) {
+	rawGeneration, rawOffset, ok := strings.Cut(raw, "-")
+	if !ok {
+		return Cursor{}, fmt.Errorf("%w '%s'", ErrInvalidCursor, raw)
+	}
+
+	generation, err := strconv.ParseUint(rawGeneration, 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w '%s'", ErrInvalidCursor, raw)
+	}
+	offset, err := strconv.ParseInt(rawOffset, 10, 64)
+	if err != nil || offset < 0 {
+		return Cursor{}, fmt.Errorf("%w '%s'", ErrInvalidCursor, raw)
+	}
+
+	return Cursor{Generation: generation, Offset: offset}, nil
+}
+
+// A LogLine is a line of the log of a node, without its line break.
+type LogLine struct {
+	Cursor Cursor
+	Raw    []byte
+}
+
+// Start returns the cursor before the line, following the log from it starts with the line.
+func (l LogLine) Start() Cursor {
+	return Cursor{Generation: l.Cursor.Generation, Offset: l.Cursor.Offset - int64(len(l.Raw)) - 1}
+}
+
+// Entry returns the line parsed as JSON, or as a string if it isn't JSON.
+func (l LogLine) Entry() interface{} {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(l.Raw, &entry); err != nil {
+		return string(l.Raw)
+	}
+	return entry
+}
+
+// A LogStream buffers the last lines of a log, and publishes new lines to its subscribers.
+type LogStream struct {
+	mutex sync.Mutex
+	lines *ring.Buffer[LogLine]
+	size  int
+
+	// The cursor of the last line no longer buffered. Lines up to it can't be followed.
+	evicted     Cursor
+	subscribers map[*LogSubscription]struct{}
+	closed      bool
+}
+
+// NewLogStream returns a stream buffering up to size lines. Its first line starts at the given cursor, the lines
+// before it were written before the stream was created.
+func NewLogStream(size uint32, start Cursor) *LogStream {
+	return &LogStream{
+		lines:       ring.New[LogLine](size),
+		size:        int(size),
+		evicted:     start,
+		subscribers: make(map[*LogSubscription]struct{}),
+	}
+}
+
+// Publish appends a line to the stream and sends it to the subscribers. It never blocks, subscribers that fell
+// too far behind are disconnected.
+func (s *LogStream) Publish(line LogLine) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if overwritten, ok := s.lines.Overwritten(); ok {
+		s.evicted = overwritten.Cursor
+	}
+	s.lines.Write(line)
+
+	for subscription := range s.subscribers {
+		select {
+		case subscription.lines <- line:
+		default:
+			delete(s.subscribers, subscription)
+			subscription.end(ErrSubscriberLagging)
+		}
+	}
+}
+
+// Last returns up to the n last buffered lines, oldest first.
+func (s *LogStream) Last(n int) []LogLine {
+	if n > s.size {
+		n = s.size
+	}
+	return s.lines.Last(n)
+}
+
+// Follow subscribes to the lines after a cursor. The buffered lines after the cursor are sent first.
+func (s *LogStream) Follow(after Cursor) *LogSubscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var backlog []LogLine
+	for _, line := range s.lines.Last(s.size) {
+		if after.Before(line.Cursor) {
+			backlog = append(backlog, line)
+		}
+	}
+
+	subscription := &LogSubscription{
+		stream:    s,
+		lines:     make(chan LogLine, len(backlog)+SUBSCRIBER_BUFFER_LINES),
+		Truncated: after.Before(s.evicted),
+	}
+	for _, line := range backlog {
+		subscription.lines <- line
+	}
+
+	if s.closed {
+		subscription.end(ErrLogClosed)
+		return subscription
+	}
+	s.subscribers[subscription] = struct{}{}
+
+	return subscription
+}
+
+// Close ends the subscriptions of the stream, and the subscriptions made afterward once they received the buffered
+// lines.
+func (s *LogStream) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for subscription := range s.subscribers {
+		delete(s.subscribers, subscription)
+		subscription.end(ErrLogClosed)
+	}
+}
+
+// Query returns the buffered lines matching a query. It returns false if lines that are no longer buffered could
+// match the query, they are read from the log files instead.
+func (s *LogStream) Query(query LogQuery) (LogPage, bool) {
+	s.mutex.Lock()
+	lines := s.lines.Last(s.size)
+	evicted := s.evicted
+	s.mutex.Unlock()
+
+	collector := pageCollector{query: query}
+	matcher := newLineMatcher(query)
+
+	if query.After != nil {
+		if query.After.Before(evicted) {
+			return LogPage{}, false
+		}
+
+		for _, line := range lines {
+			if query.past(line.Cursor) || (matcher.match(line) && !collector.add(line)) {
+				break
+			}
+		}
+		return collector.page, true
+	}
+
+	window := lineWindow{size: collector.needed()}
+	for _, line := range lines {
+		if query.past(line.Cursor) {
+			break
+		}
+		if matcher.match(line) {
+			window.add(line)
+		}
+	}
+
+	// Unless the whole log is buffered, older lines may complete the page.
+	if collector.prepend(window.last()) && evicted != (Cursor{}) {
+		return LogPage{}, false
+	}
+	return collector.page, true
+}
+
+func (s *LogStream) unsubscribe(subscription *LogSubscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.subscribers[subscription]; ok {
+		delete(s.subscribers, subscription)
+		subscription.end(nil)
+	}
+}
+
+// A LogSubscription receives the lines published to a log stream.
+type LogSubscription struct {
+	stream *LogStream
+	lines  chan LogLine
+	err    error
+
+	// Set on the subscriptions reading lines no longer buffered from the log files, closed to stop them.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Whether lines between the cursor and the first line received are no longer available, and were skipped.
+	Truncated bool
+}
+
+// Lines returns the lines of the subscription. The channel is closed when the subscription ends.
+func (s *LogSubscription) Lines() <-chan LogLine {
+	return s.lines
+}
+
+// Err returns why the subscription ended, once its lines are closed. It is nil if the subscription was closed.
+func (s *LogSubscription) Err() error {
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *LogSubscription) Close() {
+	if s.closed != nil {
+		s.closeOnce.Do(func() { close(s.closed) })
+		return
+	}
+	s.stream.unsubscribe(s)
+}
+
+// end closes the lines of the subscription. It is called with the stream locked.
+func (s *LogSubscription) end(err error) {
+	s.err = err
+	close(s.lines)
+}
@@ -0,0 +1,189 @@
+package xecute
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// publishLines publishes lines "line-<from>" to "line-<to - 1>", and returns the cursor after the last one.
+func publishLines(stream *LogStream, start Cursor, from, to int) Cursor {
+	cursor := start
+	for i := from; i < to; i++ {
+		raw := []byte(fmt.Sprintf("line-%d", i))
+		cursor = Cursor{Offset: cursor.Offset + int64(len(raw)) + 1}
+		stream.Publish(LogLine{Cursor: cursor, Raw: raw})
+	}
+	return cursor
+}
+
+// receiveLines receives n lines from a subscription.
+func receiveLines(t *testing.T, subscription *LogSubscription, n int) []string {
+	t.Helper()
+
+	var lines []string
+	for len(lines) < n {
+		select {
+		case line, ok := <-subscription.Lines():
+			if !ok {
+				t.Fatalf("subscription ended after %v: %v", lines, subscription.Err())
+			}
+			lines = append(lines, string(line.Raw))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for lines, got %v", lines)
+		}
+	}
+	return lines
+}
+
+func TestLogStream_Follow(t *testing.T) {
+	tests := []struct {
+		name          string
+		start         Cursor
+		after         func(lines []LogLine) Cursor
+		wantFirst     string
+		wantTruncated bool
+	}{
+		{"fromStart", Cursor{}, func(lines []LogLine) Cursor { return Cursor{} }, "line-0", false},
+		{"fromCursor", Cursor{}, func(lines []LogLine) Cursor { return lines[2].Cursor }, "line-3", false},
+		{"fromLineStart", Cursor{}, func(lines []LogLine) Cursor { return lines[2].Start() }, "line-2", false},
+		{"fromEnd", Cursor{}, func(lines []LogLine) Cursor { return lines[len(lines)-1].Cursor }, "line-4", false},
+		{"afterPreviousRun", Cursor{Offset: 100}, func(lines []LogLine) Cursor { return Cursor{Offset: 50} }, "line-0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := NewLogStream(8, tt.start)
+			end := publishLines(stream, tt.start, 0, 4)
+
+			subscription := stream.Follow(tt.after(stream.Last(8)))
+			defer subscription.Close()
+
+			if subscription.Truncated != tt.wantTruncated {
+				t.Errorf("expected truncated to be %v", tt.wantTruncated)
+			}
+
+			// Buffered and new lines are received in order.
+			publishLines(stream, end, 4, 5)
+			if lines := receiveLines(t, subscription, 1); lines[0] != tt.wantFirst {
+				t.Errorf("expected the first line to be %s, got %s", tt.wantFirst, lines[0])
+			}
+		})
+	}
+}
+
+func TestLogStream_FollowEvictedLines(t *testing.T) {
+	stream := NewLogStream(4, Cursor{})
+	first := publishLines(stream, Cursor{}, 0, 1)
+	publishLines(stream, first, 1, 10)
+
+	subscription := stream.Follow(first)
+	defer subscription.Close()
+
+	if !subscription.Truncated {
+		t.Error("expected lines evicted from the buffer to be reported")
+	}
+	if lines := receiveLines(t, subscription, 4); lines[0] != "line-6" {
+		t.Errorf("expected the oldest buffered line first, got %v", lines)
+	}
+}
+
+func TestLogStream_SlowSubscriber(t *testing.T) {
+	stream := NewLogStream(4, Cursor{})
+
+	slow := stream.Follow(Cursor{})
+	fast := stream.Follow(Cursor{})
+	defer fast.Close()
+
+	// The stream never waits for subscribers.
+	cursor := Cursor{}
+	for i := 0; i < SUBSCRIBER_BUFFER_LINES+1; i++ {
+		cursor = publishLines(stream, cursor, i, i+1)
+		receiveLines(t, fast, 1)
+	}
+
+	received := 0
+	for range slow.Lines() {
+		received++
+	}
+	if received != SUBSCRIBER_BUFFER_LINES {
+		t.Errorf("expected %d lines before the disconnection, got %d", SUBSCRIBER_BUFFER_LINES, received)
+	}
+	if !errors.Is(slow.Err(), ErrSubscriberLagging) {
+		t.Errorf("expected the slow subscriber to be disconnected, got %v", slow.Err())
+	}
+
+	// Closing an ended subscription is harmless.
+	slow.Close()
+}
+
+func TestLogStream_Close(t *testing.T) {
+	stream := NewLogStream(4, Cursor{})
+	subscription := stream.Follow(Cursor{})
+	subscription.Close()
+	subscription.Close()
+
+	if _, ok := <-subscription.Lines(); ok {
+		t.Error("expected the lines of a closed subscription to be closed")
+	}
+	if subscription.Err() != nil {
+		t.Errorf("expected no error closing a subscription, got %v", subscription.Err())
+	}
+
+	// Lines published after closing aren't sent.
+	publishLines(stream, Cursor{}, 0, 1)
+}
+
+func TestLogStream_CloseStream(t *testing.T) {
+	stream := NewLogStream(4, Cursor{})
+	cursor := publishLines(stream, Cursor{}, 0, 2)
+
+	subscription := stream.Follow(Cursor{})
+	receiveLines(t, subscription, 2)
+	stream.Close()
+
+	if _, ok := <-subscription.Lines(); ok || !errors.Is(subscription.Err(), ErrLogClosed) {
+		t.Errorf("expected the subscription to end once the stream is closed, got %v", subscription.Err())
+	}
+
+	// Subscribers following a closed stream still get the buffered lines.
+	late := stream.Follow(cursor)
+	if _, ok := <-late.Lines(); ok || !errors.Is(late.Err(), ErrLogClosed) {
+		t.Errorf("expected the subscription to a closed stream to end, got %v", late.Err())
+	}
+	late = stream.Follow(Cursor{})
+	if lines := receiveLines(t, late, 2); lines[0] != "line-0" {
+		t.Errorf("expected the buffered lines, got %v", lines)
+	}
+	late.Close()
+}
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    Cursor
+		wantErr bool
+	}{
+		{"0-0", Cursor{}, false},
+		{"3-1234", Cursor{Generation: 3, Offset: 1234}, false},
+		{"1234", Cursor{}, true},
+		{"-1", Cursor{}, true},
+		{"1--1", Cursor{}, true},
+		{"a-b", Cursor{}, true},
+		{"", Cursor{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseCursor(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCursor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseCursor() = %v, want %v", got, tt.want)
+			}
+			if err == nil && got.String() != tt.raw {
+				t.Errorf("expected %v to format as %s", got, tt.raw)
+			}
+		})
+	}
+}
@@ -2,10 +2,10 @@ package xecute
 
 import (
 	"fmt"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,92 +14,174 @@ import (
 /// Manages a native xecute process.
 type Native struct {
 	// Executable information.
-	binaryPath string
-	workdir    string
-	cmd        *exec.Cmd
-	logWriter  *logWriter
-	port       uint16
+	binaryPath    string
+	workdir       string
+	cmd           *exec.Cmd
+	logWriter     *logWriter
+	port          uint16
+	restartPolicy RestartPolicy
 
 	// Management stuff
-	logger *zap.SugaredLogger
-	stop   chan bool
-	status Status
+	logger      *zap.SugaredLogger
+	stopRequest chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+
+	// State, updated by the state watcher while being read by the agent.
+	mutex     sync.Mutex
+	started   bool
+	status    Status
+	restarts  uint
+	nextRetry time.Time
+	exitCode  int
+	crashLoop *CrashLoop
 }
 
-func NewNativeProcess(workdir, binaryPath string, logger *zap.Logger) (*Native, error) {
-	logPath := path.Join(workdir, "log.json")
-	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+type NativeParams struct {
+	Workdir    string
+	BinaryPath string
+
+	// The port of the process. A free port is picked if it is zero.
+	Port          uint16
+	RestartPolicy RestartPolicy
+	LogRotation   LogRotation
+}
+
+func NewNativeProcess(params NativeParams, logger *zap.Logger) (*Native, error) {
+	logWriter, err := newLogWriter(params.Workdir, params.LogRotation, logger.Sugar())
 	if err != nil {
 		return nil, err
 	}
-	logWriter := newLogWriter(logFile)
 
-	// Allocate a port for our process.
-	port, err := getFreePort()
+	// Allocate a port for our process if none was assigned.
+	port, err := portOrFree(params.Port)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Native{
-		binaryPath: binaryPath,
-		workdir:    workdir,
-		cmd:        nil,
-		logWriter:  logWriter,
-		port:       port,
-
-		logger: logger.Sugar(),
-		stop:   make(chan bool),
-		status: StatusStopped,
+		binaryPath:    params.BinaryPath,
+		workdir:       params.Workdir,
+		cmd:           nil,
+		logWriter:     logWriter,
+		port:          port,
+		restartPolicy: params.RestartPolicy,
+
+		logger:      logger.Sugar(),
+		stopRequest: make(chan struct{}),
+		done:        make(chan struct{}),
+		status:      StatusStopped,
+		exitCode:    -1,
 	}, nil
 }
 
 func (p *Native) setStatus(status Status) {
+	p.mutex.Lock()
 	p.status = status
+	p.mutex.Unlock()
+
 	p.logger.Infof("setting status to '%v'", status)
 }
 
-func (p *Native) stateWatcher(logLevel LogLevel, configPath string) {
-	p.setStatus(StatusStarting)
+func (p *Native) setExitCode(exitCode int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.exitCode = exitCode
+}
 
-	defer func() {
-		p.stop <- true
-	}()
+func (p *Native) setNextRetry(nextRetry time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.nextRetry = nextRetry
+}
+
+func (p *Native) stopRequested() bool {
+	select {
+	case <-p.stopRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+// run starts the process and blocks until it exits.
+// It returns whether the process exited cleanly, and whether it ever became healthy.
+func (p *Native) run(logLevel LogLevel, configPath string) (cleanExit bool, wasHealthy bool) {
+	if p.stopRequested() {
+		p.setStatus(StatusStopped)
+		return true, false
+	}
+
+	p.setStatus(StatusStarting)
 
 	// Build the command.
-	p.cmd = exec.Command(p.binaryPath, "--cfg", configPath)
+	cmd := exec.Command(p.binaryPath, "--cfg", configPath)
 
-	// Redirect both outputs to the log file.
-	p.cmd.Stdout = p.logWriter
-	p.cmd.Stderr = p.logWriter
+	// Capture both outputs to the log file, each line tagged with its stream.
+	stdout, stderr := p.logWriter.output(StreamStdout), p.logWriter.output(StreamStderr)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	// Set the log level to the requested level.
-	p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("MENMOS_LOG_LEVEL=%s", logLevel))
-	p.cmd.Env = append(p.cmd.Env, "MENMOS_LOG_JSON=true")
-	p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("MENMOS_SERVER_PORT=%d", p.port))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MENMOS_LOG_LEVEL=%s", logLevel))
+	cmd.Env = append(cmd.Env, "MENMOS_LOG_JSON=true")
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MENMOS_SERVER_PORT=%d", p.port))
 
-	// Start the process
+	// Start the process. The command is published once started, so Stop can signal it.
 	p.logger.Debugf("starting the process")
-	if err := p.cmd.Start(); err != nil {
+	startedAt := time.Now().UTC()
+	p.mutex.Lock()
+	err := cmd.Start()
+	if err == nil {
+		p.cmd = cmd
+	}
+	p.mutex.Unlock()
+	if err != nil {
 		p.logger.Errorf("failed to start process: %v", err)
 		p.setStatus(StatusError)
-		return
+		return false, false
 	}
 
-	// All xecute processes have the same health URL.
-	// FIXME(prod): support HTTPS if required
-	healthCheckURL := fmt.Sprintf("http://localhost:%d/health", p.port)
+	// The output is completely captured once the process exited, abnormal exits are reported with the last stderr
+	// lines.
+	exited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		stdout.Flush()
+		stderr.Flush()
+		if !cmd.ProcessState.Success() && !p.stopRequested() {
+			p.logWriter.reportCrash(startedAt, cmd.ProcessState.ExitCode())
+		}
+		exited <- err
+	}()
+
+	if p.stopRequested() {
+		// We were asked to stop while the process was being spawned.
+		cmd.Process.Signal(os.Interrupt)
+	}
 
 	retry := 100
-	for {
+	for !wasHealthy {
+		select {
+		case err := <-exited:
+			p.logger.Errorf("process exited before becoming healthy: %v", err)
+			p.setExitCode(cmd.ProcessState.ExitCode())
+			p.setStatus(StatusError)
+			return false, false
+		default:
+		}
+
 		p.logger.Debug("checking if process is healthy")
-		resp, err := http.Get(healthCheckURL)
-		if err != nil || resp.StatusCode != 200 {
+		if !isHealthy(p.port) {
 			p.logger.Debug("process is not up yet")
 			retry -= 1
 			if retry == 0 {
-				p.setStatus(StatusError)
 				p.logger.Error("retries exceeded: process failed to come up")
-				return
+				cmd.Process.Kill()
+				<-exited
+				p.setExitCode(cmd.ProcessState.ExitCode())
+				p.setStatus(StatusError)
+				return false, false
 			}
 
 			time.Sleep(100 * time.Millisecond)
@@ -107,63 +189,209 @@ func (p *Native) stateWatcher(logLevel LogLevel, configPath string) {
 		}
 
 		p.setStatus(StatusHealthy)
-		break
+		wasHealthy = true
 	}
 
 	// We wait for the process to stop - either from a crash or from a stop signal.
-	if err := p.cmd.Wait(); err != nil {
+	err = <-exited
+	exitCode := cmd.ProcessState.ExitCode()
+	p.setExitCode(exitCode)
+	if err != nil {
 		p.setStatus(StatusError)
-		return
+		return false, true
 	}
 
-	if p.cmd.ProcessState.ExitCode() != 0 {
+	if exitCode != 0 {
 		p.setStatus(StatusError)
-	} else {
-		p.setStatus(StatusStopped)
+		return false, true
+	}
+
+	p.setStatus(StatusStopped)
+	return true, true
+}
+
+func (p *Native) stateWatcher(logLevel LogLevel, configPath string) {
+	defer close(p.done)
+
+	crashes := NewCrashLoopDetector(p.restartPolicy)
+	attempt := uint(0)
+	for {
+		cleanExit, wasHealthy := p.run(logLevel, configPath)
+
+		if p.stopRequested() {
+			return
+		}
+
+		if wasHealthy {
+			// The process came up properly, so we start counting failures anew.
+			attempt = 0
+		}
+
+		if !p.restartPolicy.ShouldRestart(cleanExit, attempt) {
+			if p.restartPolicy.Mode != RestartNever && p.restartPolicy.Mode != "" {
+				p.logger.Errorf("not restarting process after %d attempts", attempt)
+			}
+			return
+		}
+
+		if !cleanExit && crashes.Record(time.Now()) {
+			crashLoop := &CrashLoop{
+				Since:        time.Now(),
+				Crashes:      crashes.Count(),
+				Window:       crashes.window,
+				LastExitCode: p.LastExitCode(),
+				LogTail:      p.logWriter.GetLastNLines(CRASH_LOOP_LOG_LINES),
+			}
+			p.mutex.Lock()
+			p.crashLoop = crashLoop
+			p.mutex.Unlock()
+			p.setStatus(StatusCrashLoop)
+			p.logger.Errorf("process crashed %d times in %v, giving up on restarts", crashes.Count(), crashes.window)
+			return
+		}
+
+		delay := p.restartPolicy.Backoff(attempt)
+		attempt += 1
+		p.mutex.Lock()
+		p.restarts += 1
+		p.mutex.Unlock()
+		p.setNextRetry(time.Now().Add(delay))
+		p.setStatus(StatusBackoff)
+		p.logger.Infof("restarting process in %v (attempt %d)", delay, attempt)
+
+		select {
+		case <-time.After(delay):
+			p.setNextRetry(time.Time{})
+		case <-p.stopRequest:
+			p.setNextRetry(time.Time{})
+			p.setStatus(StatusStopped)
+			return
+		}
 	}
 }
 
 func (p *Native) Start(logLevel LogLevel) error {
 	configPath := path.Join(p.workdir, "config.toml")
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.started {
+		return fmt.Errorf("process was already started")
+	}
+
+	p.started = true
 	go p.stateWatcher(logLevel, configPath)
 
 	return nil
 }
 
 func (p *Native) Stop() error {
-	if p.status != StatusHealthy && p.status == StatusStarting {
+	p.mutex.Lock()
+	started := p.started
+	p.mutex.Unlock()
+
+	if !started {
+		return nil // We never started.
+	}
+
+	select {
+	case <-p.done:
 		return nil // We're already stopped
+	default:
+	}
+
+	p.stopOnce.Do(func() { close(p.stopRequest) })
+
+	// The command is read after the stop request, so the state watcher can't spawn a new one without noticing it.
+	p.mutex.Lock()
+	status := p.status
+	cmd := p.cmd
+	p.mutex.Unlock()
+
+	if status == StatusBackoff {
+		// The process isn't running, the state watcher will exit on its own.
+		<-p.done
+		return nil
 	}
 
-	if p.cmd == nil || p.cmd.Process == nil {
+	if cmd == nil || cmd.Process == nil {
 		p.logger.Info("process never started. maybe a crash?")
+		<-p.done
 		return nil
 	}
 
 	p.logger.Info("asking nicely for process to quit")
-	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+	if err := cmd.Process.Signal(os.Interrupt); err != nil && err != os.ErrProcessDone {
 		return err
 	}
 
 	timer := time.AfterFunc(10*time.Second, func() {
 		p.logger.Info("asking rudely for process to quit")
-		p.cmd.Process.Kill()
+		cmd.Process.Kill()
 	})
-	<-p.stop
+	<-p.done
 	timer.Stop()
 
 	return nil
 }
 
-func (p *Native) GetLogs(numberOfLines uint) []interface{} {
-	return p.logWriter.GetLastNLines(int(numberOfLines))
+func (p *Native) GetLogs(numberOfLines uint) []LogLine {
+	return p.logWriter.stream.Last(int(numberOfLines))
+}
+
+func (p *Native) QueryLogs(query LogQuery) (LogPage, error) {
+	return p.logWriter.QueryLogs(query)
+}
+
+func (p *Native) FollowLogs(after Cursor) *LogSubscription {
+	return p.logWriter.FollowLogs(after)
+}
+
+// Close releases the log file of the process, once it is stopped.
+func (p *Native) Close() error {
+	return p.logWriter.Close()
+}
+
+// Delete has nothing to remove, all the data of the process is in its node directory.
+func (p *Native) Delete() error {
+	return nil
 }
 
 func (p *Native) Status() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	return p.status
 }
 
 func (p *Native) Port() uint16 {
 	return p.port
 }
+
+// Restarts returns the number of times the process was restarted by its restart policy.
+func (p *Native) Restarts() uint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.restarts
+}
+
+// LastExitCode returns the exit code of the last run of the process, or -1 if it never exited.
+func (p *Native) LastExitCode() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.exitCode
+}
+
+// CrashLoop returns why the process was parked in the crash loop status, or nil if it isn't crash looping.
+func (p *Native) CrashLoop() *CrashLoop {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.crashLoop
+}
+
+// NextRetry returns when the process will next be restarted, or the zero time if no restart is pending.
+func (p *Native) NextRetry() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.nextRetry
+}
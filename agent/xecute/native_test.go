@@ -0,0 +1,219 @@
+package xecute
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestMain lets the test binary stand in for a menmos node when it is spawned by a native process.
+func TestMain(m *testing.M) {
+	if os.Getenv("MENMOS_LOG_JSON") == "true" && len(os.Args) == 3 && os.Args[1] == "--cfg" {
+		fakeNode(os.Args[2], os.Getenv("MENMOS_SERVER_PORT"))
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeNode serves the health endpoint until it is interrupted, or crashes if its config asks it to.
+func fakeNode(configPath, port string) {
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		os.Exit(2)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%s", port))
+	if err != nil {
+		os.Exit(2)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	fmt.Println(`{"level":"INFO","fields":{"message":"node started"}}`)
+	fmt.Fprintln(os.Stderr, "some stderr output")
+
+	if strings.Contains(string(config), "crash") {
+		time.Sleep(200 * time.Millisecond)
+		os.Exit(3)
+	}
+
+	<-interrupt
+	os.Exit(0)
+}
+
+func newTestNativeProcess(t *testing.T, config string, policy RestartPolicy) *Native {
+	workdir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workdir, "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	binaryPath, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process, err := NewNativeProcess(NativeParams{
+		Workdir:       workdir,
+		BinaryPath:    binaryPath,
+		RestartPolicy: policy,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return process
+}
+
+// readConcurrently reads the state of a process from several goroutines until the returned function is called.
+func readConcurrently(process Process) func() {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				process.Status()
+				process.Restarts()
+				process.NextRetry()
+				process.LastExitCode()
+				process.CrashLoop()
+				process.GetLogs(10)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestNative_Lifecycle(t *testing.T) {
+	process := newTestNativeProcess(t, "", RestartPolicy{Mode: RestartNever})
+	stopReading := readConcurrently(process)
+	defer stopReading()
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(LogNormal); err == nil {
+		t.Errorf("expected starting a process twice to fail")
+	}
+
+	waitForStatus(t, process.Status, StatusHealthy)
+
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if process.Status() != StatusStopped {
+		t.Errorf("expected stopped status, got '%s'", process.Status())
+	}
+	if process.LastExitCode() != 0 {
+		t.Errorf("expected a clean exit, got %d", process.LastExitCode())
+	}
+
+	if logs := process.GetLogs(10); len(logs) != 2 {
+		t.Errorf("expected stdout and stderr to be logged, got %v", logs)
+	}
+
+	// Stopping the process isn't a crash.
+	if report, err := ReadCrashReport(process.workdir); report != nil || err != nil {
+		t.Errorf("expected no crash report, got %+v, %v", report, err)
+	}
+}
+
+func TestNative_ConcurrentStop(t *testing.T) {
+	process := newTestNativeProcess(t, "", RestartPolicy{Mode: RestartNever})
+	stopReading := readConcurrently(process)
+	defer stopReading()
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, process.Status, StatusHealthy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := process.Stop(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if process.Status() != StatusStopped {
+		t.Errorf("expected stopped status, got '%s'", process.Status())
+	}
+}
+
+func TestNative_CrashLoop(t *testing.T) {
+	process := newTestNativeProcess(t, "crash", RestartPolicy{
+		Mode:               RestartAlways,
+		InitialBackoff:     time.Millisecond,
+		MaxBackoff:         time.Millisecond,
+		CrashLoopThreshold: 2,
+		CrashLoopWindow:    time.Minute,
+	})
+	stopReading := readConcurrently(process)
+	defer stopReading()
+
+	if err := process.Start(LogNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for process.Status() != StatusCrashLoop {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected crash loop status, got '%s'", process.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	crashLoop := process.CrashLoop()
+	if crashLoop == nil || crashLoop.LastExitCode != 3 {
+		t.Errorf("unexpected crash loop info: %+v", crashLoop)
+	}
+	if process.Restarts() != 1 {
+		t.Errorf("expected a single restart, got %d", process.Restarts())
+	}
+
+	// The last crash is reported with the stderr lines of its run.
+	report, err := ReadCrashReport(process.workdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.ExitCode != 3 || len(report.Lines) != 1 || report.Lines[0].Line != "some stderr output" ||
+		report.Lines[0].Stream != StreamStderr {
+		t.Errorf("unexpected crash report: %+v", report)
+	}
+
+	if err := process.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
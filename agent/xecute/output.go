@@ -0,0 +1,169 @@
+package xecute
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The output stream a log line was captured from.
+type OutputStream = string
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+
+	// The output of runtimes that don't separate stdout from stderr, like Kubernetes.
+	StreamCombined = "combined"
+)
+
+const (
+	// The fields the agent adds to every captured line. Lines that aren't JSON objects are logged in the message field.
+	LOG_STREAM_FIELD      = "stream"
+	LOG_CAPTURED_AT_FIELD = "captured_at"
+	LOG_MESSAGE_FIELD     = "message"
+
+	// The size past which a line being written is captured without waiting for its end.
+	MAX_LOG_LINE_SIZE = 64 << 10
+)
+
+// tagLine returns a line tagged with the stream it was captured from and the capture time. The fields are added
+// to JSON objects, unless the process logged them itself, other lines are wrapped in a JSON object.
+func tagLine(stream OutputStream, capturedAt time.Time, raw []byte) []byte {
+	trimmed := bytes.TrimSpace(raw)
+
+	var fields map[string]json.RawMessage
+	if bytes.HasPrefix(trimmed, []byte("{")) && json.Unmarshal(trimmed, &fields) == nil {
+		tagged := []byte("{")
+		if _, ok := fields[LOG_STREAM_FIELD]; !ok {
+			streamJSON, _ := json.Marshal(stream)
+			tagged = append(tagged, `"`+LOG_STREAM_FIELD+`":`...)
+			tagged = append(append(tagged, streamJSON...), ',')
+		}
+		if _, ok := fields[LOG_CAPTURED_AT_FIELD]; !ok {
+			tagged = append(tagged, `"`+LOG_CAPTURED_AT_FIELD+`":"`+capturedAt.Format(time.RFC3339Nano)+`",`...)
+		}
+
+		rest := bytes.TrimSpace(trimmed[1:])
+		if bytes.HasPrefix(rest, []byte("}")) {
+			tagged = bytes.TrimSuffix(tagged, []byte(","))
+		}
+		return append(tagged, rest...)
+	}
+
+	tagged, _ := json.Marshal(struct {
+		Stream     OutputStream `json:"stream"`
+		CapturedAt time.Time    `json:"captured_at"`
+		Message    string       `json:"message"`
+	}{stream, capturedAt, string(raw)})
+	return tagged
+}
+
+// untagLine returns a captured line without the fields tagLine added to it. Lines logged before they were tagged are
+// returned as is.
+func untagLine(raw []byte) []byte {
+	if !bytes.HasPrefix(raw, []byte("{")) {
+		return raw
+	}
+
+	rest, untagged := raw[1:], false
+	for _, field := range []string{LOG_STREAM_FIELD, LOG_CAPTURED_AT_FIELD} {
+		prefix := []byte(`"` + field + `":"`)
+		if !bytes.HasPrefix(rest, prefix) {
+			continue
+		}
+
+		// Neither the streams nor the capture times hold quotes.
+		end := bytes.IndexByte(rest[len(prefix):], '"')
+		if end < 0 {
+			return raw
+		}
+		rest = bytes.TrimPrefix(rest[len(prefix)+end+1:], []byte(","))
+		untagged = true
+	}
+
+	if !untagged {
+		return raw
+	}
+	return append([]byte("{"), rest...)
+}
+
+// lineText returns the text of a captured line, as written by the process: the message of a line wrapped by tagLine,
+// and the JSON object the process logged otherwise.
+func lineText(raw []byte) []byte {
+	text := untagLine(raw)
+	if bytes.HasPrefix(text, []byte(`{"`+LOG_MESSAGE_FIELD+`":`)) {
+		var wrapped map[string]interface{}
+		if json.Unmarshal(text, &wrapped) == nil && len(wrapped) == 1 {
+			if message, ok := wrapped[LOG_MESSAGE_FIELD].(string); ok {
+				return []byte(message)
+			}
+		}
+	}
+	return text
+}
+
+// An outputWriter captures an output stream of a process into its log, one line at a time.
+type outputWriter struct {
+	// Output streams are written to from a single goroutine, but flushed from another.
+	mutex sync.Mutex
+
+	log     *logWriter
+	stream  OutputStream
+	partial []byte
+}
+
+func (o *outputWriter) Write(p []byte) (n int, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			end = len(p)
+		}
+
+		// Lines too long are split.
+		if room := MAX_LOG_LINE_SIZE - len(o.partial); end > room {
+			o.partial = append(o.partial, p[:room]...)
+			n += room
+			p = p[room:]
+			if err := o.flushLocked(); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		o.partial = append(o.partial, p[:end]...)
+		n += end
+		p = p[end:]
+		if len(p) > 0 {
+			// The line break.
+			n++
+			p = p[1:]
+			if err := o.flushLocked(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Flush captures the line being written, once the stream ended without a final line break.
+func (o *outputWriter) Flush() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.partial) == 0 {
+		return nil
+	}
+	return o.flushLocked()
+}
+
+func (o *outputWriter) flushLocked() error {
+	line := bytes.TrimSuffix(o.partial, []byte("\r"))
+	o.partial = nil
+	return o.log.writeLine(o.stream, line)
+}
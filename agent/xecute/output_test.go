@@ -0,0 +1,85 @@
+package xecute
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagLine(t *testing.T) {
+	capturedAt := time.Date(2022, 1, 1, 10, 0, 0, 500, time.UTC)
+
+	tests := []struct {
+		name   string
+		stream OutputStream
+		raw    string
+		want   string
+	}{
+		{"json", StreamStdout, `{"level":"INFO"}`, `{"stream":"stdout","captured_at":"2022-01-01T10:00:00.0000005Z","level":"INFO"}`},
+		{"jsonWithSpaces", StreamStdout, ` { "level": "INFO" } `, `{"stream":"stdout","captured_at":"2022-01-01T10:00:00.0000005Z","level": "INFO" }`},
+		{"emptyObject", StreamStderr, `{}`, `{"stream":"stderr","captured_at":"2022-01-01T10:00:00.0000005Z"}`},
+		{"plain", StreamStderr, `thread 'main' panicked at "x"`, `{"stream":"stderr","captured_at":"2022-01-01T10:00:00.0000005Z","message":"thread 'main' panicked at \"x\""}`},
+		{"invalidJSON", StreamStderr, `{not json`, `{"stream":"stderr","captured_at":"2022-01-01T10:00:00.0000005Z","message":"{not json"}`},
+		{"ownStream", StreamStdout, `{"stream":"events","level":"INFO"}`, `{"captured_at":"2022-01-01T10:00:00.0000005Z","stream":"events","level":"INFO"}`},
+		{"ownFields", StreamStdout, `{"captured_at":"now","stream":"events"}`, `{"captured_at":"now","stream":"events"}`},
+		{"array", StreamCombined, `[1]`, `{"stream":"combined","captured_at":"2022-01-01T10:00:00.0000005Z","message":"[1]"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tagLine(tt.stream, capturedAt, []byte(tt.raw))
+			if string(got) != tt.want {
+				t.Errorf("tagLine() = %s, want %s", got, tt.want)
+			}
+			if !json.Valid(got) {
+				t.Errorf("expected a JSON line, got %s", got)
+			}
+		})
+	}
+}
+
+func TestOutputWriter(t *testing.T) {
+	long := strings.Repeat("a", MAX_LOG_LINE_SIZE)
+
+	tests := []struct {
+		name   string
+		writes []string
+		flush  bool
+		want   []string
+	}{
+		{"lines", []string{"a\nb\n"}, false, []string{"a", "b"}},
+		{"splitLine", []string{"a", "b\nc", "\n"}, false, []string{"ab", "c"}},
+		{"crlf", []string{"a\r\n"}, false, []string{"a"}},
+		{"emptyLine", []string{"\n"}, false, []string{""}},
+		{"partialLine", []string{"a\nb"}, false, []string{"a"}},
+		{"flushed", []string{"a\nb"}, true, []string{"a", "b"}},
+		{"longLine", []string{long + "b\n"}, false, []string{long, "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTestLogWriter(t, t.TempDir(), LogRotation{})
+			defer w.Close()
+
+			output := w.output(StreamStderr)
+			for _, write := range tt.writes {
+				if n, err := output.Write([]byte(write)); err != nil || n != len(write) {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			if tt.flush {
+				if err := output.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			for _, line := range w.stream.Last(10) {
+				got = append(got, logMessage(t, line.Raw))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected lines %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
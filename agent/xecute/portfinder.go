@@ -1,8 +1,12 @@
 package xecute
 
-import "net"
+import (
+	"fmt"
+	"net"
+)
 
-func getFreePort() (uint16, error) {
+// GetFreePort returns a port that is currently free on the host.
+func GetFreePort() (uint16, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
 		return 0, err
@@ -15,3 +19,21 @@ func getFreePort() (uint16, error) {
 	defer l.Close()
 	return uint16(l.Addr().(*net.TCPAddr).Port), nil
 }
+
+// IsPortAvailable returns whether the given port can be bound on the host.
+func IsPortAvailable(port uint16) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// portOrFree returns the given port, or a free port if it is zero.
+func portOrFree(port uint16) (uint16, error) {
+	if port != 0 {
+		return port, nil
+	}
+	return GetFreePort()
+}
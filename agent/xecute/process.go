@@ -1,5 +1,14 @@
 package xecute
 
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How long a process has to become healthy after being started.
+const HEALTH_CHECK_TIMEOUT = 10 * time.Second
+
 type LogLevel = string
 
 const (
@@ -22,10 +31,29 @@ const (
 	// Process stopping, management routine still running.
 	StatusStopping = "stopping"
 
+	// Process exited, management routine waiting before restarting it.
+	StatusBackoff = "backoff"
+
 	// Process and management routine stopped because of an error.
 	StatusError = "error"
+
+	// Process crashed repeatedly and won't be restarted until started manually.
+	StatusCrashLoop = "crashloop"
 )
 
 type ProcessConfig interface {
 	HealthCheckURL() string
 }
+
+// isHealthy returns whether the menmos process listening on the given port answers its health check.
+func isHealthy(port uint16) bool {
+	// All xecute processes have the same health URL.
+	// FIXME(prod): support HTTPS if required
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/health", port))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
@@ -0,0 +1,109 @@
+package xecute
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type RestartMode = string
+
+// ErrInvalidRestartPolicy is returned for restart policies that are unknown, or not supported by the runtime.
+var ErrInvalidRestartPolicy = errors.New("invalid restart policy")
+
+const (
+	// The process is never restarted by the agent.
+	RestartNever = "never"
+
+	// The process is restarted only when it exits abnormally.
+	RestartOnFailure = "on-failure"
+
+	// The process is restarted whenever it exits, unless it was stopped by the agent.
+	RestartAlways = "always"
+)
+
+const (
+	DefaultInitialBackoff = 1 * time.Second
+	DefaultMaxBackoff     = 5 * time.Minute
+)
+
+// A RestartPolicy describes what the agent should do when a process exits on its own.
+type RestartPolicy struct {
+	Mode RestartMode `json:"mode,omitempty"`
+
+	// The maximum number of consecutive restarts before giving up. Zero means no limit.
+	MaxRetries uint `json:"max_retries,omitempty"`
+
+	InitialBackoff time.Duration `json:"initial_backoff,omitempty"`
+	MaxBackoff     time.Duration `json:"max_backoff,omitempty"`
+
+	// A process that crashes CrashLoopThreshold times within CrashLoopWindow
+	// is parked in the crash loop status and isn't restarted anymore.
+	CrashLoopThreshold uint          `json:"crash_loop_threshold,omitempty"`
+	CrashLoopWindow    time.Duration `json:"crash_loop_window,omitempty"`
+}
+
+// Validate returns an error if the policy mode is unknown.
+func (r RestartPolicy) Validate() error {
+	switch r.Mode {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown mode '%s'", ErrInvalidRestartPolicy, r.Mode)
+	}
+}
+
+// ShouldRestart returns whether a process that exited should be restarted, given
+// how many consecutive restarts were already attempted.
+func (r RestartPolicy) ShouldRestart(cleanExit bool, attempt uint) bool {
+	switch r.Mode {
+	case RestartAlways:
+	case RestartOnFailure:
+		if cleanExit {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return r.MaxRetries == 0 || attempt < r.MaxRetries
+}
+
+// Remaining returns the policy of a process replacing processes that were already restarted the given number of
+// times, so they share the retries of the policy. The process isn't restarted once they are used up.
+func (r RestartPolicy) Remaining(restarts uint) RestartPolicy {
+	if r.MaxRetries == 0 {
+		return r
+	}
+
+	if restarts >= r.MaxRetries {
+		r.Mode = RestartNever
+	} else {
+		r.MaxRetries -= restarts
+	}
+	return r
+}
+
+// Backoff returns the delay to wait before the given restart attempt.
+// The delay doubles on every attempt, up to the max backoff of the policy.
+func (r RestartPolicy) Backoff(attempt uint) time.Duration {
+	delay := r.InitialBackoff
+	if delay <= 0 {
+		delay = DefaultInitialBackoff
+	}
+
+	maxDelay := r.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxBackoff
+	}
+
+	for i := uint(0); i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay
+}
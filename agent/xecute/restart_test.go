@@ -0,0 +1,87 @@
+package xecute
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartPolicy_ShouldRestart(t *testing.T) {
+	type args struct {
+		cleanExit bool
+		attempt   uint
+	}
+	tests := []struct {
+		name   string
+		policy RestartPolicy
+		args   args
+		want   bool
+	}{
+		{"emptyPolicy", RestartPolicy{}, args{false, 0}, false},
+		{"neverOnFailure", RestartPolicy{Mode: RestartNever}, args{false, 0}, false},
+		{"onFailureWithFailure", RestartPolicy{Mode: RestartOnFailure}, args{false, 0}, true},
+		{"onFailureWithCleanExit", RestartPolicy{Mode: RestartOnFailure}, args{true, 0}, false},
+		{"alwaysWithCleanExit", RestartPolicy{Mode: RestartAlways}, args{true, 0}, true},
+		{"underMaxRetries", RestartPolicy{Mode: RestartAlways, MaxRetries: 3}, args{false, 2}, true},
+		{"maxRetriesReached", RestartPolicy{Mode: RestartAlways, MaxRetries: 3}, args{false, 3}, false},
+		{"unlimitedRetries", RestartPolicy{Mode: RestartOnFailure}, args{false, 1000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.ShouldRestart(tt.args.cleanExit, tt.args.attempt); got != tt.want {
+				t.Errorf("RestartPolicy.ShouldRestart() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RestartPolicy
+		attempt uint
+		want    time.Duration
+	}{
+		{"defaultFirstAttempt", RestartPolicy{}, 0, DefaultInitialBackoff},
+		{"defaultCapped", RestartPolicy{}, 100, DefaultMaxBackoff},
+		{"exponential", RestartPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 3, 8 * time.Second},
+		{"capped", RestartPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}, 4, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Backoff(tt.attempt); got != tt.want {
+				t.Errorf("RestartPolicy.Backoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartPolicy_Remaining(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RestartPolicy
+		restarts uint
+		want     RestartPolicy
+	}{
+		{"unlimitedRetries", RestartPolicy{Mode: RestartAlways}, 5, RestartPolicy{Mode: RestartAlways}},
+		{"noRestart", RestartPolicy{Mode: RestartAlways, MaxRetries: 3}, 0, RestartPolicy{Mode: RestartAlways, MaxRetries: 3}},
+		{"retriesLeft", RestartPolicy{Mode: RestartAlways, MaxRetries: 3}, 1, RestartPolicy{Mode: RestartAlways, MaxRetries: 2}},
+		{"retriesUsedUp", RestartPolicy{Mode: RestartAlways, MaxRetries: 3}, 3, RestartPolicy{Mode: RestartNever, MaxRetries: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Remaining(tt.restarts); got != tt.want {
+				t.Errorf("RestartPolicy.Remaining() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartPolicy_Validate(t *testing.T) {
+	if err := (RestartPolicy{Mode: RestartOnFailure}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := (RestartPolicy{Mode: "sometimes"}).Validate(); err == nil {
+		t.Errorf("expected an error for an unknown mode")
+	}
+}
@@ -7,6 +7,7 @@ import (
 type Buffer[T any] struct {
 	entries   []T
 	size      uint32
+	count     uint32
 	writeHead uint32
 	readHead  uint32
 	mutex     *sync.Mutex
@@ -16,6 +17,7 @@ func New[T any](size uint32) *Buffer[T] {
 	return &Buffer[T]{
 		entries:   make([]T, size),
 		size:      size,
+		count:     0,
 		writeHead: 0,
 		readHead:  0,
 		mutex:     &sync.Mutex{},
@@ -37,6 +39,10 @@ func (b *Buffer[T]) Write(value T) {
 	if b.writeHead >= b.size {
 		b.writeHead = 0
 	}
+
+	if b.count < b.size {
+		b.count += 1
+	}
 }
 
 func (b *Buffer[T]) Read() T {
@@ -66,3 +72,38 @@ func (b *Buffer[T]) Peek(offset int) T {
 	idx := (int(b.readHead) + offset) % int(b.size)
 	return b.entries[idx]
 }
+
+// Last returns up to the n most recently written values, oldest first.
+func (b *Buffer[T]) Last(n int) []T {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if n > int(b.count) {
+		n = int(b.count)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	values := make([]T, n)
+	start := int(b.writeHead) - n
+	for i := 0; i < n; i++ {
+		idx := (start + i + int(b.size)) % int(b.size)
+		values[i] = b.entries[idx]
+	}
+
+	return values
+}
+
+// Overwritten returns the value the next write overwrites, or false if the buffer isn't full.
+func (b *Buffer[T]) Overwritten() (T, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.size == 0 || b.count < b.size {
+		var val T
+		return val, false
+	}
+
+	return b.entries[b.writeHead], true
+}
@@ -57,6 +57,67 @@ func TestBuffer_ZeroSized(t *testing.T) {
 	buf.Write(42)
 }
 
+func TestBuffer_Last(t *testing.T) {
+	buf := ring.New[int](5)
+
+	if values := buf.Last(3); len(values) != 0 {
+		t.Fatalf("expected empty buffer to return no values, got %v", values)
+	}
+
+	buf.Write(1)
+	buf.Write(2)
+
+	if values := buf.Last(3); len(values) != 2 || values[0] != 1 || values[1] != 2 {
+		t.Fatalf("expected [1 2] got %v", values)
+	}
+
+	for i := 3; i < 10; i++ {
+		buf.Write(i)
+	}
+
+	values := buf.Last(3)
+	for i, expected := range []int{7, 8, 9} {
+		if values[i] != expected {
+			t.Fatalf("expected %d at index %d got %d", expected, i, values[i])
+		}
+	}
+
+	if values := buf.Last(20); len(values) != 5 || values[0] != 5 {
+		t.Fatalf("expected the 5 last values got %v", values)
+	}
+}
+
+func TestBuffer_Overwritten(t *testing.T) {
+	buf := ring.New[int](3)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := buf.Overwritten(); ok {
+			t.Fatalf("expected nothing to be overwritten before the buffer is full")
+		}
+		buf.Write(i)
+	}
+
+	for expected := 0; expected < 5; expected++ {
+		if val, ok := buf.Overwritten(); !ok || val != expected {
+			t.Fatalf("expected %d to be overwritten, got %d (%v)", expected, val, ok)
+		}
+		buf.Write(expected + 3)
+	}
+
+	if _, ok := ring.New[int](0).Overwritten(); ok {
+		t.Fatalf("expected nothing to be overwritten in a zero-sized buffer")
+	}
+}
+
+func TestBuffer_LastZeroSized(t *testing.T) {
+	buf := ring.New[int](0)
+	buf.Write(42)
+
+	if values := buf.Last(1); len(values) != 0 {
+		t.Fatalf("expected no values got %v", values)
+	}
+}
+
 func FuzzBuffer(f *testing.F) {
 	raw, _ := json.Marshal(struct {
 		Chose string
@@ -0,0 +1,250 @@
+// Package xecutetest provides an in-memory executor, to test code managing
+// menmos nodes without spawning any process.
+package xecutetest
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"go.uber.org/zap"
+)
+
+// Executor creates fake processes and keeps track of them.
+type Executor struct {
+	mutex     sync.Mutex
+	processes map[string]*Process
+	nextPort  uint16
+
+	// If set, NewProcess fails with this error.
+	NewProcessError error
+
+	// If set, starting any process fails with this error.
+	StartError error
+}
+
+func NewExecutor() *Executor {
+	return &Executor{
+		processes: make(map[string]*Process),
+		nextPort:  10000,
+	}
+}
+
+func (e *Executor) NewProcess(spec xecute.ProcessSpec, logger *zap.Logger) (xecute.Process, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.NewProcessError != nil {
+		return nil, e.NewProcessError
+	}
+
+	port := spec.Port
+	if port == 0 {
+		port = e.nextPort
+		e.nextPort += 1
+	}
+
+	process := &Process{
+		Spec:       spec,
+		port:       port,
+		status:     xecute.StatusStopped,
+		exitCode:   -1,
+		startError: e.StartError,
+		logs:       xecute.NewLogStream(xecute.BUFFER_LOG_LINES, xecute.Cursor{}),
+	}
+	e.processes[spec.NodeID] = process
+
+	return process, nil
+}
+
+// SetStartError changes StartError while processes may be created concurrently.
+func (e *Executor) SetStartError(err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.StartError = err
+}
+
+// Process returns the last process created for a node, or nil if none was created.
+func (e *Executor) Process(nodeID string) *Process {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.processes[nodeID]
+}
+
+// ProcessCount returns the number of nodes processes were created for.
+func (e *Executor) ProcessCount() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.processes)
+}
+
+// Process is a fake process. It becomes healthy as soon as it is started.
+type Process struct {
+	Spec xecute.ProcessSpec
+
+	startError error
+
+	mutex     sync.Mutex
+	port      uint16
+	status    xecute.Status
+	logLevel  xecute.LogLevel
+	starts    uint
+	exitCode  int
+	crashLoop *xecute.CrashLoop
+	logs      *xecute.LogStream
+	logSize   int64
+	closed    bool
+	deleted   bool
+}
+
+func (p *Process) Start(logLevel xecute.LogLevel) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.startError != nil {
+		p.status = xecute.StatusError
+		return p.startError
+	}
+
+	p.logLevel = logLevel
+	p.starts += 1
+	p.status = xecute.StatusHealthy
+	return nil
+}
+
+func (p *Process) Stop() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.status != xecute.StatusError && p.status != xecute.StatusCrashLoop {
+		p.status = xecute.StatusStopped
+	}
+	return nil
+}
+
+func (p *Process) Status() xecute.Status {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
+
+func (p *Process) Port() uint16 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.port
+}
+
+func (p *Process) GetLogs(numberOfLines uint) []xecute.LogLine {
+	return p.logs.Last(int(numberOfLines))
+}
+
+// QueryLogs returns the lines matching a query. The fake process only has the buffered lines.
+func (p *Process) QueryLogs(query xecute.LogQuery) (xecute.LogPage, error) {
+	page, _ := p.logs.Query(query)
+	return page, nil
+}
+
+func (p *Process) FollowLogs(after xecute.Cursor) *xecute.LogSubscription {
+	return p.logs.Follow(after)
+}
+
+func (p *Process) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	p.logs.Close()
+	return nil
+}
+
+// Closed returns whether the process was closed.
+func (p *Process) Closed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.closed
+}
+
+func (p *Process) Delete() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deleted = true
+	return nil
+}
+
+// Deleted returns whether the process was deleted.
+func (p *Process) Deleted() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.deleted
+}
+
+func (p *Process) Restarts() uint {
+	return 0
+}
+
+func (p *Process) NextRetry() time.Time {
+	return time.Time{}
+}
+
+func (p *Process) LastExitCode() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.exitCode
+}
+
+func (p *Process) CrashLoop() *xecute.CrashLoop {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.crashLoop
+}
+
+// Starts returns how many times the process was started.
+func (p *Process) Starts() uint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.starts
+}
+
+// SetStatus forces the status of the process.
+func (p *Process) SetStatus(status xecute.Status) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status = status
+}
+
+// Crash simulates the process exiting with the given exit code.
+func (p *Process) Crash(exitCode int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.exitCode = exitCode
+	p.status = xecute.StatusError
+}
+
+// CrashLoopWith parks the process in the crash loop status.
+func (p *Process) CrashLoopWith(crashLoop xecute.CrashLoop) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.exitCode = crashLoop.LastExitCode
+	p.crashLoop = &crashLoop
+	p.status = xecute.StatusCrashLoop
+}
+
+// Log appends log entries to the process logs. Strings are logged as is, other entries as JSON.
+func (p *Process) Log(entries ...interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, entry := range entries {
+		raw, ok := entry.(string)
+		if !ok {
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				panic(err)
+			}
+			raw = string(encoded)
+		}
+
+		p.logSize += int64(len(raw)) + 1
+		p.logs.Publish(xecute.LogLine{Cursor: xecute.Cursor{Offset: p.logSize}, Raw: []byte(raw)})
+	}
+}
@@ -3,17 +3,30 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/menmos/menmos-agent/agent"
+	"github.com/menmos/menmos-agent/agent/artifact"
 	"github.com/menmos/menmos-agent/payload"
 	"go.uber.org/zap"
 )
 
+// The longest a client can wait on an operation in a single request.
+const MAX_OPERATION_WAIT = 60 * time.Second
+
+// The largest bundle that can be imported.
+const MAX_BUNDLE_SIZE = 4 << 30
+
 // API regroups the route of the agent API.
 type API struct {
 	agent  *agent.MenmosAgent
@@ -34,6 +47,26 @@ func (a *API) healthCheck(ctx context.Context, w http.ResponseWriter, r *http.Re
 	return payload.HealthCheckResponse{Status: "healthy"}, nil
 }
 
+// isAsync returns whether the client asked for an operation instead of waiting for the action to complete.
+func isAsync(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("async")
+	if raw == "" {
+		return false, nil
+	}
+
+	async, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, errBadRequest
+	}
+	return async, nil
+}
+
+// accepted answers with a running operation, that can be polled at its location.
+func accepted(w http.ResponseWriter, op *payload.Operation) statusResponse {
+	w.Header().Set("Location", fmt.Sprintf("/operation/%s", op.ID))
+	return statusResponse{status: http.StatusAccepted, body: op}
+}
+
 func (a *API) createNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	var request payload.CreateNodeRequest
 
@@ -46,6 +79,14 @@ func (a *API) createNode(ctx context.Context, w http.ResponseWriter, r *http.Req
 		return nil, errBadRequest
 	}
 
+	async, err := isAsync(r)
+	if err != nil {
+		return nil, err
+	}
+	if async {
+		return accepted(w, a.agent.CreateNodeAsync(&request)), nil
+	}
+
 	return a.agent.CreateNode(&request)
 }
 
@@ -73,6 +114,14 @@ func (a *API) getNode(ctx context.Context, w http.ResponseWriter, r *http.Reques
 func (a *API) deleteNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	if id, ok := vars["id"]; ok {
+		async, err := isAsync(r)
+		if err != nil {
+			return nil, err
+		}
+		if async {
+			return accepted(w, a.agent.DeleteNodeAsync(id)), nil
+		}
+
 		if err := a.agent.DeleteNode(id); err != nil {
 			return nil, err
 		}
@@ -81,19 +130,39 @@ func (a *API) deleteNode(ctx context.Context, w http.ResponseWriter, r *http.Req
 	panic("bad routing config")
 }
 
-func (a *API) getNodeLogs(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+func (a *API) startNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	if id, ok := vars["id"]; ok {
-		logs, err := a.agent.GetNodeLogs(id, 30) // TODO: take query param here
-		return logs, err
+		async, err := isAsync(r)
+		if err != nil {
+			return nil, err
+		}
+		if async {
+			return accepted(w, a.agent.StartNodeAsync(id)), nil
+		}
+
+		if err := a.agent.StartNode(id); err != nil {
+			return nil, err
+		}
+
+		return payload.MessageResponse{Message: "ok"}, nil
 	}
 	panic("bad routing config")
+
 }
 
-func (a *API) startNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+func (a *API) stopNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	if id, ok := vars["id"]; ok {
-		if err := a.agent.StartNode(id); err != nil {
+		async, err := isAsync(r)
+		if err != nil {
+			return nil, err
+		}
+		if async {
+			return accepted(w, a.agent.StopNodeAsync(id)), nil
+		}
+
+		if err := a.agent.StopNode(id); err != nil {
 			return nil, err
 		}
 
@@ -103,17 +172,160 @@ func (a *API) startNode(ctx context.Context, w http.ResponseWriter, r *http.Requ
 
 }
 
-func (a *API) stopNode(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+func (a *API) listOperations(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return a.agent.ListOperations(), nil
+}
+
+func (a *API) getOperation(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	vars := mux.Vars(r)
 	if id, ok := vars["id"]; ok {
-		if err := a.agent.StopNode(id); err != nil {
+		// Clients can wait for the operation to complete, e.g. "?wait=30s".
+		var wait time.Duration
+		if raw := r.URL.Query().Get("wait"); raw != "" {
+			var err error
+			if wait, err = time.ParseDuration(raw); err != nil {
+				return nil, errBadRequest
+			}
+			if wait > MAX_OPERATION_WAIT {
+				wait = MAX_OPERATION_WAIT
+			}
+		}
+
+		op := a.agent.GetOperation(r.Context(), id, wait)
+		if op == nil {
+			return nil, errNotFound
+		}
+
+		return op, nil
+	}
+	panic("bad routing config")
+}
+
+func (a *API) listPorts(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return a.agent.ListPorts(), nil
+}
+
+func (a *API) listArtifacts(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return a.agent.ListArtifacts()
+}
+
+func (a *API) getArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	if version, ok := vars["version"]; ok {
+		artifactVersion, err := a.agent.GetArtifact(version)
+		if err != nil {
 			return nil, err
 		}
 
+		if artifactVersion == nil {
+			return nil, errNotFound
+		}
+
+		return artifactVersion, nil
+	}
+	panic("bad routing config")
+}
+
+func (a *API) prefetchArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	if version, ok := vars["version"]; ok {
+		artifactVersion, started, err := a.agent.PrefetchArtifact(version)
+		if err != nil {
+			return nil, err
+		}
+
+		if started {
+			w.Header().Set("Location", fmt.Sprintf("/artifact/%s", url.PathEscape(artifactVersion.Version)))
+			return statusResponse{status: http.StatusAccepted, body: artifactVersion}, nil
+		}
+
+		return artifactVersion, nil
+	}
+	panic("bad routing config")
+}
+
+// exportArtifact sends the bundle of a version. The bundle is written to a temporary file first, so failures are
+// reported with an error status rather than as a truncated bundle.
+func (a *API) exportArtifact(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+
+	file, err := os.CreateTemp("", "menmos-bundle-")
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		handleError(w, err, r, a.log)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := a.agent.ExportArtifact(version, file); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		handleError(w, err, r, a.log)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": version + artifact.BUNDLE_EXTENSION}))
+	http.ServeContent(w, r, "", time.Time{}, file)
+	logStatus(a.log, r, http.StatusOK)
+}
+
+func (a *API) importArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	imported, err := a.agent.ImportArtifact(http.MaxBytesReader(w, r.Body, MAX_BUNDLE_SIZE))
+	if errors.Is(err, artifact.ErrVerification) {
+		// The bundle comes from the client, not from a release source.
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return imported, nil
+}
+
+func (a *API) deleteArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	if version, ok := vars["version"]; ok {
+		if err := a.agent.RemoveArtifact(version); err != nil {
+			return nil, err
+		}
 		return payload.MessageResponse{Message: "ok"}, nil
 	}
 	panic("bad routing config")
+}
 
+func (a *API) pinArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	if version, ok := vars["version"]; ok {
+		if err := a.agent.PinArtifact(version); err != nil {
+			return nil, err
+		}
+		return payload.MessageResponse{Message: "ok"}, nil
+	}
+	panic("bad routing config")
+}
+
+func (a *API) unpinArtifact(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	if version, ok := vars["version"]; ok {
+		if err := a.agent.UnpinArtifact(version); err != nil {
+			return nil, err
+		}
+		return payload.MessageResponse{Message: "ok"}, nil
+	}
+	panic("bad routing config")
+}
+
+func (a *API) collectArtifacts(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	dryRun := false
+	if raw := r.URL.Query().Get("dry_run"); raw != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			return nil, errBadRequest
+		}
+	}
+
+	return a.agent.CollectArtifacts(dryRun)
 }
 
 func (a *API) serve() {
@@ -124,10 +336,31 @@ func (a *API) serve() {
 	r.HandleFunc("/node", wrapRoute(a.log, a.listNodes)).Methods("GET")
 	r.HandleFunc("/node/{id}", wrapRoute(a.log, a.getNode)).Methods("GET")
 	r.HandleFunc("/node/{id}", wrapRoute(a.log, a.deleteNode)).Methods("DELETE")
+	r.HandleFunc("/node/{id}/logs", a.followNodeLogs).Methods("GET").MatcherFunc(isFollow)
 	r.HandleFunc("/node/{id}/logs", wrapRoute(a.log, a.getNodeLogs)).Methods("GET")
+	r.HandleFunc("/node/{id}/crash", wrapRoute(a.log, a.getNodeCrashReport)).Methods("GET")
 	r.HandleFunc("/node/{id}/start", wrapRoute(a.log, a.startNode)).Methods("POST")
 	r.HandleFunc("/node/{id}/stop", wrapRoute(a.log, a.stopNode)).Methods("POST")
 
+	// Operations.
+	r.HandleFunc("/operation", wrapRoute(a.log, a.listOperations)).Methods("GET")
+	r.HandleFunc("/operation/{id}", wrapRoute(a.log, a.getOperation)).Methods("GET")
+
+	// Port allocations.
+	r.HandleFunc("/port", wrapRoute(a.log, a.listPorts)).Methods("GET")
+
+	// Artifact cache. Garbage collection and imports are routed before "/artifact/{version}", so posting to them
+	// never prefetches a version named "gc" or "import".
+	r.HandleFunc("/artifact", wrapRoute(a.log, a.listArtifacts)).Methods("GET")
+	r.HandleFunc("/artifact/gc", wrapRoute(a.log, a.collectArtifacts)).Methods("POST")
+	r.HandleFunc("/artifact/import", wrapRoute(a.log, a.importArtifact)).Methods("POST")
+	r.HandleFunc("/artifact/{version}", wrapRoute(a.log, a.getArtifact)).Methods("GET")
+	r.HandleFunc("/artifact/{version}", wrapRoute(a.log, a.prefetchArtifact)).Methods("POST")
+	r.HandleFunc("/artifact/{version}", wrapRoute(a.log, a.deleteArtifact)).Methods("DELETE")
+	r.HandleFunc("/artifact/{version}/bundle", a.exportArtifact).Methods("GET")
+	r.HandleFunc("/artifact/{version}/pin", wrapRoute(a.log, a.pinArtifact)).Methods("PUT")
+	r.HandleFunc("/artifact/{version}/pin", wrapRoute(a.log, a.unpinArtifact)).Methods("DELETE")
+
 	// Misc.
 	r.HandleFunc("/health", wrapRoute(a.log, a.healthCheck)).Methods("GET")
 
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/menmos/menmos-agent/agent/xecute"
+	"github.com/menmos/menmos-agent/payload"
+)
+
+const (
+	// The number of lines returned when no line count is requested, and sent first when following logs without a cursor.
+	DEFAULT_LOG_LINES = 30
+
+	// The maximum number of lines returned at once.
+	MAX_LOG_LINES = 10000
+
+	// How often idle log streams send a heartbeat, so dead connections are detected.
+	LOG_STREAM_HEARTBEAT = 15 * time.Second
+
+	// How long sending an event to a log stream client can take.
+	LOG_STREAM_WRITE_TIMEOUT = 10 * time.Second
+)
+
+var logUpgrader = websocket.Upgrader{}
+
+// isFollow matches the requests following the logs of a node, e.g. "/node/{id}/logs?follow=true".
+func isFollow(r *http.Request, _ *mux.RouteMatch) bool {
+	follow, err := strconv.ParseBool(r.URL.Query().Get("follow"))
+	return err == nil && follow
+}
+
+// logLines returns the number of lines requested with the "lines" query parameter.
+func logLines(r *http.Request) (uint, error) {
+	raw := r.URL.Query().Get("lines")
+	if raw == "" {
+		return DEFAULT_LOG_LINES, nil
+	}
+
+	lines, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil || lines == 0 || lines > MAX_LOG_LINES {
+		return 0, fmt.Errorf("%w: 'lines' must be between 1 and %d", errBadRequest, MAX_LOG_LINES)
+	}
+	return uint(lines), nil
+}
+
+// logQuery returns the log query of a request. Pages are requested with the "after" or "before" cursors, and time
+// ranges with the "since" and "until" RFC 3339 times.
+func logQuery(r *http.Request) (xecute.LogQuery, error) {
+	lines, err := logLines(r)
+	if err != nil {
+		return xecute.LogQuery{}, err
+	}
+	query := xecute.LogQuery{Limit: int(lines)}
+
+	values := r.URL.Query()
+	for name, cursor := range map[string]**xecute.Cursor{"after": &query.After, "before": &query.Before} {
+		if raw := values.Get(name); raw != "" {
+			parsed, err := xecute.ParseCursor(raw)
+			if err != nil {
+				return xecute.LogQuery{}, err
+			}
+			*cursor = &parsed
+		}
+	}
+
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if raw := values.Get(name); raw != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+				return xecute.LogQuery{}, fmt.Errorf("%w: '%s' must be an RFC 3339 time", errBadRequest, name)
+			}
+		}
+	}
+
+	if query.Filter, err = logFilter(r); err != nil {
+		return xecute.LogQuery{}, err
+	}
+
+	return query, nil
+}
+
+// logFilter returns the log filter of a request. Severities are bounded with the "level" and "max_level" query
+// parameters, fields are matched with "field=<field>=<value>" parameters, and lines are searched with the "search"
+// text and the "regex" expression.
+func logFilter(r *http.Request) (xecute.LogFilter, error) {
+	values := r.URL.Query()
+	filter := xecute.LogFilter{Target: values.Get("target"), Search: values.Get("search")}
+
+	var err error
+	for name, severity := range map[string]*xecute.Severity{"level": &filter.MinSeverity, "max_level": &filter.MaxSeverity} {
+		if raw := values.Get(name); raw != "" {
+			if *severity, err = xecute.ParseSeverity(raw); err != nil {
+				return xecute.LogFilter{}, err
+			}
+		}
+	}
+
+	for _, raw := range values["field"] {
+		field, value, err := xecute.ParseFieldFilter(raw)
+		if err != nil {
+			return xecute.LogFilter{}, err
+		}
+		if filter.Fields == nil {
+			filter.Fields = make(map[string]string)
+		}
+		filter.Fields[field] = value
+	}
+
+	if raw := values.Get("regex"); raw != "" {
+		if filter.Pattern, err = regexp.Compile(raw); err != nil {
+			return xecute.LogFilter{}, fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+	}
+
+	return filter, nil
+}
+
+// getNodeLogs returns a page of the log of a node, read from the log files when the lines are no longer buffered.
+// Without a cursor, the last lines are returned. Lines are filtered before being counted.
+func (a *API) getNodeLogs(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	query, err := logQuery(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.agent.GetNodeLogs(mux.Vars(r)["id"], query)
+}
+
+// getNodeCrashReport returns the last stderr lines a node wrote before its last abnormal exit.
+func (a *API) getNodeCrashReport(ctx context.Context, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	report, err := a.agent.GetNodeCrashReport(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		return nil, errNotFound
+	}
+	return report, nil
+}
+
+func lineEvent(line xecute.LogLine) payload.LogEvent {
+	return payload.LogEvent{Event: payload.LogEventLine, Cursor: line.Cursor.String(), Line: line.Entry()}
+}
+
+// followNodeLogs streams the logs of a node as they are written, over a websocket if the client asks for an upgrade
+// and as server-sent events otherwise. Clients resume from the cursor of the last line they received, passed as the
+// "cursor" query parameter or, for server-sent events, the Last-Event-ID header. Without a cursor, the stream starts
+// with the last "lines" lines.
+func (a *API) followNodeLogs(w http.ResponseWriter, r *http.Request) {
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		cursor = r.Header.Get("Last-Event-ID")
+	}
+
+	var subscription *xecute.LogSubscription
+	lines, err := logLines(r)
+	if err == nil {
+		subscription, err = a.agent.FollowNodeLogs(mux.Vars(r)["id"], cursor, lines)
+	}
+	if err == nil && subscription == nil {
+		err = errNotFound
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		handleError(w, err, r, a.log)
+		return
+	}
+	defer subscription.Close()
+
+	// Lines are only missing if the client resumed from a cursor.
+	truncated := cursor != "" && subscription.Truncated
+
+	if websocket.IsWebSocketUpgrade(r) {
+		a.streamLogsWebsocket(w, r, subscription, truncated)
+	} else {
+		a.streamLogsEvents(w, r, subscription, truncated)
+	}
+}
+
+func (a *API) streamLogsEvents(w http.ResponseWriter, r *http.Request, subscription *xecute.LogSubscription, truncated bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		handleError(w, fmt.Errorf("%w: streaming is not supported", errInternalServerError), r, a.log)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	logStatus(a.log, r, http.StatusOK)
+
+	send := func(event payload.LogEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		// Lines are sent as unnamed events, so browsers receive them as messages.
+		if event.Event != payload.LogEventLine {
+			fmt.Fprintf(w, "event: %s\n", event.Event)
+		}
+		if event.Cursor != "" {
+			fmt.Fprintf(w, "id: %s\n", event.Cursor)
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if truncated {
+		if err := send(payload.LogEvent{Event: payload.LogEventTruncated}); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(LOG_STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case line, ok := <-subscription.Lines():
+			if !ok {
+				if errors.Is(subscription.Err(), xecute.ErrSubscriberLagging) {
+					send(payload.LogEvent{Event: payload.LogEventLagging})
+				} else if errors.Is(subscription.Err(), xecute.ErrLogClosed) {
+					send(payload.LogEvent{Event: payload.LogEventClosed})
+				}
+				return
+			}
+			if err := send(lineEvent(line)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (a *API) streamLogsWebsocket(w http.ResponseWriter, r *http.Request, subscription *xecute.LogSubscription, truncated bool) {
+	conn, err := logUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client.
+		a.log.Debugf("failed to upgrade log stream: %v", err)
+		return
+	}
+	defer conn.Close()
+	logStatus(a.log, r, http.StatusSwitchingProtocols)
+
+	// Clients only send control frames, they are read until the connection closes.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event payload.LogEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(LOG_STREAM_WRITE_TIMEOUT))
+		return conn.WriteJSON(event)
+	}
+
+	if truncated {
+		if err := send(payload.LogEvent{Event: payload.LogEventTruncated}); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(LOG_STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case line, ok := <-subscription.Lines():
+			if !ok {
+				message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				if errors.Is(subscription.Err(), xecute.ErrSubscriberLagging) {
+					send(payload.LogEvent{Event: payload.LogEventLagging})
+					message = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, subscription.Err().Error())
+				} else if errors.Is(subscription.Err(), xecute.ErrLogClosed) {
+					send(payload.LogEvent{Event: payload.LogEventClosed})
+					message = websocket.FormatCloseMessage(websocket.CloseServiceRestart, subscription.Err().Error())
+				}
+				conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(LOG_STREAM_WRITE_TIMEOUT))
+				return
+			}
+			if err := send(lineEvent(line)); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(LOG_STREAM_WRITE_TIMEOUT)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
 
+	"github.com/menmos/menmos-agent/agent"
+	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/menmos/menmos-agent/agent/xecute"
 	"go.uber.org/zap"
 )
 
@@ -13,6 +18,12 @@ type errorResponse struct {
 	Error string `json:"error,omitempty"`
 }
 
+// A statusResponse is returned by routes answering with a status other than 200.
+type statusResponse struct {
+	status int
+	body   interface{}
+}
+
 func logStatus(log *zap.SugaredLogger, r *http.Request, status int) {
 	if log == nil {
 		return
@@ -31,15 +42,25 @@ func handleError(w http.ResponseWriter, err error, r *http.Request, log *zap.Sug
 	statusCode := http.StatusInternalServerError
 	if errors.Is(err, errInternalServerError) {
 		log.Errorf("error processing request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else if errors.Is(err, errBadRequest) {
-		w.WriteHeader(http.StatusBadRequest)
-	} else if errors.Is(err, errNotFound) {
-		w.WriteHeader(http.StatusNotFound)
+	} else if errors.Is(err, errBadRequest) || errors.Is(err, artifact.ErrInvalidConstraint) || errors.Is(err, artifact.ErrInvalidBundle) ||
+		errors.Is(err, xecute.ErrInvalidCursor) || errors.Is(err, xecute.ErrInvalidFilter) || errors.Is(err, xecute.ErrInvalidRestartPolicy) {
+		statusCode = http.StatusBadRequest
+	} else if errors.Is(err, errNotFound) || errors.Is(err, artifact.ErrNotInstalled) || errors.Is(err, artifact.ErrNoMatchingVersion) {
+		statusCode = http.StatusNotFound
+	} else if errors.Is(err, agent.ErrConflict) {
+		statusCode = http.StatusConflict
+	} else if errors.Is(err, artifact.ErrVerification) {
+		statusCode = http.StatusBadGateway
+	} else if errors.Is(err, artifact.ErrRateLimited) {
+		statusCode = http.StatusTooManyRequests
+		var rateErr *artifact.RateLimitError
+		if errors.As(err, &rateErr) && rateErr.RetryAfter() > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateErr.RetryAfter().Seconds()))))
+		}
 	} else {
 		log.Errorf("unhandled error: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
 	}
+	w.WriteHeader(statusCode)
 	w.Write(body)
 	logStatus(log, r, statusCode)
 }
@@ -54,12 +75,20 @@ func wrapRoute(log *zap.SugaredLogger, f func(ctx context.Context, w http.Respon
 		if err != nil {
 			handleError(w, err, r, log)
 		} else {
+			statusCode := http.StatusOK
+			if resp, ok := rval.(statusResponse); ok {
+				statusCode = resp.status
+				rval = resp.body
+			}
+
 			raw, err := json.Marshal(rval)
 			if err != nil {
 				handleError(w, err, r, log)
+				return
 			}
+			w.WriteHeader(statusCode)
 			w.Write(raw)
-			logStatus(log, r, http.StatusOK)
+			logStatus(log, r, statusCode)
 		}
 	}
 }
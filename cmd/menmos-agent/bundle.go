@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/menmos/menmos-agent/agent"
+	"github.com/menmos/menmos-agent/agent/artifact"
+	"github.com/urfave/cli/v2"
+)
+
+var bundleCommand = &cli.Command{
+	Name:  "bundle",
+	Usage: "export and import artifact bundles, for agents without network access",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "export",
+			Usage:     "export an installed version to a bundle",
+			ArgsUsage: "VERSION",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "the bundle file, '-' for stdout (default: VERSION" + artifact.BUNDLE_EXTENSION + ")",
+				},
+			},
+			Action: exportBundle,
+		},
+		{
+			Name:      "import",
+			Usage:     "install the version held by a bundle",
+			ArgsUsage: "BUNDLE",
+			Action:    importBundle,
+		},
+	},
+}
+
+// openRepository opens the artifact repository of the configured agent.
+func openRepository() (*artifact.Repository, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	logger, err := newLogger(config.Debug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init logger: %w", err)
+	}
+
+	return agent.NewArtifactRepository(config.Agent, logger)
+}
+
+func exportBundle(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("expected a version")
+	}
+	version := ctx.Args().First()
+
+	repository, err := openRepository()
+	if err != nil {
+		return err
+	}
+
+	output := ctx.String("output")
+	if output == "-" {
+		return repository.Export(version, os.Stdout)
+	}
+	if output == "" {
+		output = version + artifact.BUNDLE_EXTENSION
+	}
+
+	// The bundle is written next to its destination and renamed, so a failed export leaves no partial bundle.
+	file, err := os.CreateTemp(filepath.Dir(output), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := repository.Export(version, file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), output)
+}
+
+func importBundle(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("expected a bundle file")
+	}
+
+	repository, err := openRepository()
+	if err != nil {
+		return err
+	}
+
+	var src io.Reader = os.Stdin
+	if path := ctx.Args().First(); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		src = file
+	}
+
+	version, err := repository.Import(src)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported version '%s'\n", version)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/menmos/menmos-agent/agent"
+	"github.com/menmos/menmos-agent/agent/xecute"
 	"github.com/menmos/menmos-agent/api"
 	"github.com/spf13/viper"
 )
@@ -20,8 +21,17 @@ func defaultConfig() agentConfiguration {
 	return agentConfiguration{
 		Debug: false,
 		Agent: agent.Config{
-			AgentType: agent.Native,
-			Path:      "./menmos_agent_data",
+			AgentType:             agent.Native,
+			Path:                  "./menmos_agent_data",
+			ContainerImage:        "menmos/{binary}:{version}",
+			DockerHost:            "unix:///var/run/docker.sock",
+			KubernetesNamespace:   "default",
+			KubernetesStorageSize: "10Gi",
+			LogRotation: xecute.LogRotation{
+				MaxSize:  100 << 20,
+				MaxFiles: 5,
+				Compress: true,
+			},
 		},
 		API: api.Config{
 			Host: "0.0.0.0",
@@ -7,41 +7,57 @@ import (
 
 	"github.com/menmos/menmos-agent/agent"
 	"github.com/menmos/menmos-agent/api"
+	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 )
 
-func main() {
+func newLogger(debug bool) (*zap.Logger, error) {
+	if debug {
+		return zap.NewDevelopment()
+	}
+	return zap.NewProduction()
+}
+
+func runAgent(ctx *cli.Context) error {
 	config, err := loadConfig()
 	if err != nil {
-		panic(fmt.Sprintf("failed to load config: %v", err))
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 	// Setup logging.
-	var logger *zap.Logger
-	if config.Debug {
-		logger, err = zap.NewDevelopment()
-	} else {
-		logger, err = zap.NewProduction()
-	}
+	logger, err := newLogger(config.Debug)
 	if err != nil {
-		panic(fmt.Sprintf("failed to init logger: %v", err))
+		return fmt.Errorf("failed to init logger: %w", err)
 	}
 
 	defer logger.Sync()
 
 	agt, err := agent.New(config.Agent, logger)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	srv := api.New(agt, config.API, logger)
 	if err := srv.Start(); err != nil {
-		panic(err)
+		return err
 	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
 	agt.Shutdown()
-	os.Exit(0)
+	return nil
+}
 
+func main() {
+	app := &cli.App{
+		Name:     "menmos-agent",
+		Usage:    "manage menmos nodes",
+		Action:   runAgent,
+		Commands: []*cli.Command{bundleCommand},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,65 @@
+package payload
+
+import "time"
+
+// ArtifactVersion is a version in the artifact cache of the agent.
+type ArtifactVersion struct {
+	Version  string   `json:"version"`
+	Binaries []string `json:"binaries"`
+	Size     int64    `json:"size"`
+
+	// Incomplete versions are repaired the next time they are used.
+	Complete    bool      `json:"complete"`
+	Verified    bool      `json:"verified"`
+	InstalledAt time.Time `json:"installed_at"`
+	LastUsed    time.Time `json:"last_used"`
+	Pinned      bool      `json:"pinned"`
+
+	// The nodes running the version. Versions in use are never garbage-collected.
+	Nodes []string `json:"nodes"`
+
+	// The last download of the version since the agent started, if any.
+	Download *ArtifactDownload `json:"download,omitempty"`
+}
+
+// ArtifactDownload is the progress of the download of a version.
+type ArtifactDownload struct {
+	// The state of the download (downloading, installed or failed).
+	State string `json:"state"`
+
+	// The platform and architecture the assets were selected for.
+	Platform     string `json:"platform"`
+	Architecture string `json:"architecture"`
+
+	Assets     []*ArtifactAssetProgress `json:"assets"`
+	Bytes      int64                    `json:"bytes"`
+	TotalBytes int64                    `json:"total_bytes"`
+
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ArtifactAssetProgress is the progress of the download of a release asset.
+type ArtifactAssetProgress struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+
+	// The size of the asset, zero until the server announces it.
+	TotalBytes int64  `json:"total_bytes"`
+	Done       bool   `json:"done"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ListArtifactsResponse struct {
+	Versions  []*ArtifactVersion `json:"versions"`
+	TotalSize int64              `json:"total_size"`
+}
+
+type CollectArtifactsResponse struct {
+	Removed    []string `json:"removed"`
+	FreedBytes int64    `json:"freed_bytes"`
+
+	// Whether versions were only reported, and not actually removed.
+	DryRun bool `json:"dry_run"`
+}
@@ -1,5 +1,7 @@
 package payload
 
+import "time"
+
 // The type of a node (menmosd or amphora).
 type NodeType string
 
@@ -9,11 +11,66 @@ const (
 )
 
 type CreateNodeRequest struct {
+	// An exact release tag, an alias ("latest" or "latest-stable") or a semver constraint (e.g. "~0.2", ">=0.3,<0.4").
 	Version string `json:"version"`
 	Type    NodeType
 
 	// Config can be either MenmosdConfig if Type == "menmosd", or AmphoraConfig if type == "amphora"
 	Config map[string]interface{}
+
+	// RestartPolicy controls whether the agent restarts the node when it exits. Defaults to "never", and to "always"
+	// on kubernetes, which only supports that mode.
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+}
+
+// The restart mode of a node (never, on-failure or always).
+type RestartMode string
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy describes how the agent restarts a node that exited on its own.
+type RestartPolicy struct {
+	Mode RestartMode `json:"mode"`
+
+	// Maximum number of consecutive restarts. Zero means no limit.
+	MaxRetries uint `json:"max_retries,omitempty"`
+
+	// The delay before the first restart, doubled after every consecutive failure.
+	InitialBackoffMs uint64 `json:"initial_backoff_ms,omitempty"`
+	MaxBackoffMs     uint64 `json:"max_backoff_ms,omitempty"`
+
+	// A node crashing CrashLoopThreshold times within CrashLoopWindowMs is parked in the "crashloop" status.
+	CrashLoopThreshold uint   `json:"crash_loop_threshold,omitempty"`
+	CrashLoopWindowMs  uint64 `json:"crash_loop_window_ms,omitempty"`
+}
+
+// CrashLoop explains why a node was parked in the "crashloop" status.
+type CrashLoop struct {
+	Since        time.Time     `json:"since"`
+	Crashes      uint          `json:"crashes"`
+	WindowMs     uint64        `json:"window_ms"`
+	LastExitCode int           `json:"last_exit_code"`
+	LogTail      []interface{} `json:"log_tail,omitempty"`
+}
+
+// CrashReport holds the last lines a node wrote to stderr before its last abnormal exit.
+type CrashReport struct {
+	StartedAt time.Time         `json:"started_at"`
+	ExitedAt  time.Time         `json:"exited_at"`
+	ExitCode  int               `json:"exit_code"`
+	Lines     []CrashReportLine `json:"lines"`
+}
+
+// A CrashReportLine is a line captured before a crash. Its stream is "stderr", or "combined" for runtimes that don't
+// separate stdout from stderr.
+type CrashReportLine struct {
+	CapturedAt time.Time `json:"captured_at"`
+	Stream     string    `json:"stream"`
+	Line       string    `json:"line"`
 }
 
 // Menmosd is the confifg sent to an agent to create a menmosd instance.
@@ -55,6 +112,19 @@ type NodeResponse struct {
 	Version string `json:"version,omitempty"`
 	Port    uint16 `json:"port,omitempty"`
 	Status  string `json:"status,omitempty"`
+
+	// The alias or constraint the version was resolved from, if any.
+	RequestedVersion string `json:"requested_version,omitempty"`
+
+	// The state the agent converges the node to (running or stopped), and how the node differs from it.
+	DesiredState string `json:"desired_state,omitempty"`
+	Drift        string `json:"drift,omitempty"`
+
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+	Restarts      uint           `json:"restarts"`
+	NextRetry     *time.Time     `json:"next_retry,omitempty"`
+	LastExitCode  *int           `json:"last_exit_code,omitempty"`
+	CrashLoop     *CrashLoop     `json:"crash_loop,omitempty"`
 }
 
 type ListNodesResponse struct {
@@ -63,4 +133,39 @@ type ListNodesResponse struct {
 
 type GetLogsResponse struct {
 	Log []interface{} `json:"log,omitempty"`
+
+	// The cursor of the last line, following the logs from it returns the lines written next.
+	Cursor string `json:"cursor,omitempty"`
+
+	// The cursor before the first line, querying the lines before it returns the previous page.
+	StartCursor string `json:"start_cursor,omitempty"`
+
+	// Whether more lines match the query past the page: after it when querying the lines after a cursor, before it
+	// otherwise.
+	HasMore bool `json:"has_more,omitempty"`
+}
+
+// The kind of an event streamed while following the logs of a node.
+type LogEventType string
+
+const (
+	// A log line.
+	LogEventLine LogEventType = "line"
+
+	// Lines between the cursor the client resumed from and the next line are no longer available.
+	LogEventTruncated LogEventType = "truncated"
+
+	// The client fell behind the log and is disconnected. It can resume from the cursor of the last line it received.
+	LogEventLagging LogEventType = "lagging"
+
+	// The process of the node was replaced or deleted, and the client is disconnected. It can resume from the cursor of
+	// the last line it received, once the node is started again.
+	LogEventClosed LogEventType = "closed"
+)
+
+// A LogEvent is streamed while following the logs of a node.
+type LogEvent struct {
+	Event  LogEventType `json:"event"`
+	Cursor string       `json:"cursor,omitempty"`
+	Line   interface{}  `json:"line,omitempty"`
 }
@@ -0,0 +1,35 @@
+package payload
+
+import "time"
+
+// The kind of an operation.
+type OperationKind string
+
+const (
+	OperationCreateNode = "create_node"
+	OperationStartNode  = "start_node"
+	OperationStopNode   = "stop_node"
+	OperationDeleteNode = "delete_node"
+)
+
+// Operation describes a long-running action of the agent (pending, running, succeeded or failed).
+type Operation struct {
+	ID     string        `json:"id"`
+	Kind   OperationKind `json:"kind"`
+	NodeID string        `json:"node_id,omitempty"`
+	State  string        `json:"state"`
+
+	// Progress is a fraction between 0 and 1.
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+type ListOperationsResponse struct {
+	Operations []*Operation `json:"operations,omitempty"`
+}
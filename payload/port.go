@@ -0,0 +1,17 @@
+package payload
+
+import "time"
+
+// PortReservation is a port held by a node.
+type PortReservation struct {
+	Port       uint16    `json:"port"`
+	NodeID     string    `json:"node_id"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+type ListPortsResponse struct {
+	// The configured port ranges. Empty when the agent uses ephemeral ports.
+	Ranges  []string          `json:"ranges,omitempty"`
+	Exclude []uint16          `json:"exclude,omitempty"`
+	Ports   []PortReservation `json:"ports,omitempty"`
+}